@@ -0,0 +1,158 @@
+package hlsproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+var (
+	allowedClientCIDRs []netip.Prefix
+	blockedClientCIDRs []netip.Prefix
+	trustedProxyCIDRs  []netip.Prefix
+
+	// blockedReferers are hostname patterns of pages that may not embed
+	// proxied URLs, blockedUserAgents patterns of refused clients (* wildcards)
+	blockedReferers   []string
+	blockedUserAgents []string
+)
+
+// parseCIDRs parses CIDRs or bare addresses; a bare address matches only itself
+func parseCIDRs(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, v := range values {
+		if strings.Contains(v, "/") {
+			prefix, err := netip.ParsePrefix(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q", v)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address %q", v)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// inPrefixes reports whether addr falls in any of prefixes
+func inPrefixes(addr netip.Addr, prefixes []netip.Prefix) bool {
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client. X-Forwarded-For is only
+// honored when the direct peer is a trusted proxy, and then read from the
+// right, skipping further trusted proxies, so clients can't spoof it.
+func clientIP(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil && !isUnixSocketPeer(r.RemoteAddr) {
+		return netip.Addr{}, false
+	}
+	peer = peer.Unmap()
+	// A Unix socket peer is a local reverse proxy and always trusted
+	if err == nil && !inPrefixes(peer, trustedProxyCIDRs) {
+		return peer, true
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = addr.Unmap()
+		if !inPrefixes(addr, trustedProxyCIDRs) {
+			return addr, true
+		}
+		peer = addr
+	}
+	return peer, peer.IsValid()
+}
+
+// trustedPeer reports whether the direct peer is a trusted proxy, whose
+// forwarding headers are believed
+func trustedPeer(r *http.Request) bool {
+	if isUnixSocketPeer(r.RemoteAddr) {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	return err == nil && inPrefixes(peer.Unmap(), trustedProxyCIDRs)
+}
+
+// clientAllowed applies BLOCKED_CLIENT_CIDRS, then ALLOWED_CLIENT_CIDRS
+func clientAllowed(r *http.Request) bool {
+	if len(allowedClientCIDRs) == 0 && len(blockedClientCIDRs) == 0 {
+		return true
+	}
+	addr, ok := clientIP(r)
+	if !ok {
+		return false
+	}
+	if inPrefixes(addr, blockedClientCIDRs) {
+		return false
+	}
+	return len(allowedClientCIDRs) == 0 || inPrefixes(addr, allowedClientCIDRs)
+}
+
+// blockedSource returns "referer" or "user agent" when the request comes
+// from a blocked page or client, and "" otherwise. Without a Referer the
+// Origin header names the embedding page.
+func blockedSource(r *http.Request) string {
+	if len(blockedReferers) > 0 {
+		page := r.Header.Get("Referer")
+		if page == "" {
+			page = r.Header.Get("Origin")
+		}
+		if u, err := url.Parse(page); err == nil && u.Hostname() != "" {
+			host := strings.ToLower(u.Hostname())
+			for _, pattern := range blockedReferers {
+				if wildcardMatch(strings.ToLower(pattern), host) {
+					return "referer"
+				}
+			}
+		}
+	}
+	if ua := strings.ToLower(r.Header.Get("User-Agent")); ua != "" {
+		for _, pattern := range blockedUserAgents {
+			if wildcardMatch(strings.ToLower(pattern), ua) {
+				return "user agent"
+			}
+		}
+	}
+	return ""
+}
+
+// sendForbidden rejects a client outside the allowed networks
+func sendForbidden(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]string{"error": "Access denied for this client address"})
+}
+
+// sendBlockedSource rejects a request from a blocked referer or user agent
+func sendBlockedSource(w http.ResponseWriter, source string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]string{"error": "Access denied for this " + source})
+}
@@ -0,0 +1,133 @@
+package hlsproxy
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// parseAcceptLanguage returns the language ranges of an Accept-Language
+// header, most preferred first, without "*" and refused (q=0) entries
+func parseAcceptLanguage(header string) []string {
+	type weighted struct {
+		lang string
+		q    float64
+	}
+	var ranges []weighted
+	for _, part := range strings.Split(header, ",") {
+		lang, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		lang = strings.TrimSpace(lang)
+		if lang == "" || lang == "*" {
+			continue
+		}
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			ranges = append(ranges, weighted{lang, q})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+	langs := make([]string, len(ranges))
+	for i, r := range ranges {
+		langs[i] = r.lang
+	}
+	return langs
+}
+
+// languageRank returns how well lang satisfies prefs: lower is better, -1
+// means no match. An exact tag beats a match on the primary subtag only.
+func languageRank(lang string, prefs []string) int {
+	lang = strings.ToLower(lang)
+	primary, _, _ := strings.Cut(lang, "-")
+	for i, pref := range prefs {
+		pref = strings.ToLower(pref)
+		if pref == lang {
+			return 2 * i
+		}
+		if p, _, _ := strings.Cut(pref, "-"); p == primary && primary != "" {
+			return 2*i + 1
+		}
+	}
+	return -1
+}
+
+// selectAudioDefault makes the audio rendition matching prefs the default of
+// each EXT-X-MEDIA group and lists it first, so players that auto-select
+// pick the viewer's language. Groups without a match are left as they are.
+func selectAudioDefault(m3u8Content string, prefs []string) string {
+	if len(prefs) == 0 || !strings.Contains(m3u8Content, "#EXT-X-MEDIA") {
+		return m3u8Content
+	}
+	lines := strings.Split(normalizeLineEndings(m3u8Content), "\n")
+
+	groups := make(map[string][]int)
+	var order []string
+	for i, line := range lines {
+		if playlistTagName(line) != "EXT-X-MEDIA" {
+			continue
+		}
+		_, attrList, _ := strings.Cut(strings.TrimSpace(line), ":")
+		attrs := parseAttributeList(attrList)
+		if attrs["TYPE"] != "AUDIO" {
+			continue
+		}
+		if _, seen := groups[attrs["GROUP-ID"]]; !seen {
+			order = append(order, attrs["GROUP-ID"])
+		}
+		groups[attrs["GROUP-ID"]] = append(groups[attrs["GROUP-ID"]], i)
+	}
+
+	for _, group := range order {
+		slots := groups[group]
+		best, bestRank := -1, -1
+		for _, i := range slots {
+			_, attrList, _ := strings.Cut(strings.TrimSpace(lines[i]), ":")
+			rank := languageRank(parseAttributeList(attrList)["LANGUAGE"], prefs)
+			if rank >= 0 && (bestRank < 0 || rank < bestRank) {
+				best, bestRank = i, rank
+			}
+		}
+		if best == -1 {
+			continue
+		}
+
+		reordered := []string{setEnumAttr(setEnumAttr(lines[best], "DEFAULT", "YES"), "AUTOSELECT", "YES")}
+		for _, i := range slots {
+			if i != best {
+				reordered = append(reordered, setEnumAttr(lines[i], "DEFAULT", "NO"))
+			}
+		}
+		for n, i := range slots {
+			lines[i] = reordered[n]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// setEnumAttr sets an unquoted attribute such as DEFAULT=YES on a tag line,
+// appending it when the tag doesn't have it yet
+func setEnumAttr(line, name, value string) string {
+	needle := name + "="
+	for offset := 0; ; {
+		i := strings.Index(line[offset:], needle)
+		if i == -1 {
+			break
+		}
+		i += offset
+		if i > 0 && strings.ContainsRune(":, \t", rune(line[i-1])) {
+			start := i + len(needle)
+			end := strings.IndexByte(line[start:], ',')
+			if end == -1 {
+				end = len(line) - start
+			}
+			return line[:start] + value + line[start+end:]
+		}
+		offset = i + len(needle)
+	}
+	return strings.TrimRight(line, " \t") + "," + needle + value
+}
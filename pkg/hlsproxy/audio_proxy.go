@@ -0,0 +1,193 @@
+package hlsproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// audioClient is used for radio streams. Shoutcast v1 servers answer with an
+// "ICY 200 OK" status line that net/http refuses to parse, so plain HTTP
+// connections are wrapped to present it as HTTP/1.0.
+var audioClient = &http.Client{
+	Transport: upstreamTransport(&http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialUpstream(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &icyConn{Conn: conn}, nil
+		},
+		MaxIdleConnsPerHost: 50,
+		IdleConnTimeout:     90 * time.Second,
+	}),
+	CheckRedirect: checkRedirect,
+}
+
+// icyConn rewrites a leading "ICY " status line to "HTTP/1.0 "
+type icyConn struct {
+	net.Conn
+	checked bool
+	pending []byte
+}
+
+func (c *icyConn) Read(p []byte) (int, error) {
+	if !c.checked {
+		c.checked = true
+		head := make([]byte, 4)
+		n, err := io.ReadFull(c.Conn, head)
+		head = head[:n]
+		if bytes.Equal(head, []byte("ICY ")) {
+			head = []byte("HTTP/1.0 ")
+		}
+		c.pending = head
+		if err != nil && n == 0 {
+			return 0, err
+		}
+	}
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// icyStripReader removes the interleaved ICY metadata blocks from a stream
+// whose audio chunks are metaint bytes long
+type icyStripReader struct {
+	r         *bufio.Reader
+	metaint   int
+	remaining int
+}
+
+func (s *icyStripReader) Read(p []byte) (int, error) {
+	if s.remaining == 0 {
+		// Metadata block: one length byte (in 16-byte units) followed by the text
+		length, err := s.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if _, err := s.r.Discard(int(length) * 16); err != nil {
+			return 0, err
+		}
+		s.remaining = s.metaint
+	}
+	if len(p) > s.remaining {
+		p = p[:s.remaining]
+	}
+	n, err := s.r.Read(p)
+	s.remaining -= n
+	return n, err
+}
+
+// audioContentType guesses an audio content type from the stream URL
+func audioContentType(targetURL string) string {
+	path := strings.ToLower(targetURL)
+	if i := strings.IndexAny(path, "?#"); i != -1 {
+		path = path[:i]
+	}
+	switch {
+	case strings.HasSuffix(path, ".aac"):
+		return "audio/aac"
+	case strings.HasSuffix(path, ".m4a"):
+		return "audio/mp4"
+	case strings.HasSuffix(path, ".ogg"), strings.HasSuffix(path, ".opus"):
+		return "audio/ogg"
+	case strings.HasSuffix(path, ".flac"):
+		return "audio/flac"
+	default:
+		return "audio/mpeg"
+	}
+}
+
+// audioProxyHandler handles internet radio (Shoutcast/Icecast) streams
+// URL format: /audio-proxy?url={stream_url}&headers={optional_headers}&strip_icy={optional_1}
+func audioProxyHandler(w http.ResponseWriter, r *http.Request) {
+	targetURL, parsedHeaders, err := validateRequest(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	stripICY := r.URL.Query().Get("strip_icy") == "1"
+
+	// Forward the client's metadata request so the server interleaves titles
+	if icy := r.Header.Get("Icy-MetaData"); icy != "" {
+		parsedHeaders["Icy-MetaData"] = icy
+	}
+
+	requestHeaders := requestHeadersFor(r, targetURL, parsedHeaders)
+
+	resp, err := fetch(r.Context(), fetchOptions{url: targetURL, headers: requestHeaders, overrides: parsedHeaders, client: audioClient})
+	if err != nil {
+		sendUpstreamError(w, "Failed to proxy audio stream", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" || contentType == "application/octet-stream" {
+		contentType = audioContentType(targetURL)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+
+	body := io.Reader(resp.Body)
+	metaint, _ := strconv.Atoi(resp.Header.Get("Icy-Metaint"))
+	if stripICY && metaint > 0 {
+		body = &icyStripReader{r: bufio.NewReader(resp.Body), metaint: metaint, remaining: metaint}
+	} else {
+		// Pass the station headers through so the player can parse the metadata itself
+		var exposed []string
+		for k, v := range resp.Header {
+			if strings.HasPrefix(strings.ToLower(k), "icy-") {
+				w.Header()[k] = v
+				exposed = append(exposed, k)
+			}
+		}
+		if len(exposed) > 0 {
+			w.Header().Add("Access-Control-Expose-Headers", strings.Join(exposed, ", "))
+		}
+	}
+
+	// Radio streams never end, so lift the server write timeout for this response
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.WriteHeader(resp.StatusCode)
+	copyWithFlush(w, body)
+}
+
+// copyWithFlush copies src to w, flushing after every chunk so live data is
+// delivered as soon as it arrives
+func copyWithFlush(w http.ResponseWriter, src io.Reader) (int64, error) {
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 32*1024)
+	var written int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			m, werr := w.Write(buf[:n])
+			written += int64(m)
+			if werr != nil {
+				return written, werr
+			}
+			rc.Flush()
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package hlsproxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upstreamAuth is how requests to one group of upstream hosts authenticate
+type upstreamAuth struct {
+	Type string `yaml:"type" json:"type"` // basic, bearer, sigv4 or hmac
+
+	// basic
+	Username string `yaml:"username,omitempty" json:"username,omitempty"`
+	Password string `yaml:"password,omitempty" json:"password,omitempty"`
+
+	// bearer; with RefreshURL the token is fetched from there instead
+	Token           string        `yaml:"token,omitempty" json:"token,omitempty"`
+	RefreshURL      string        `yaml:"refresh_url,omitempty" json:"refresh_url,omitempty"`
+	RefreshInterval time.Duration `yaml:"refresh_interval,omitempty" json:"-"`
+
+	// sigv4
+	AccessKey    string `yaml:"access_key,omitempty" json:"access_key,omitempty"`
+	SecretKey    string `yaml:"secret_key,omitempty" json:"secret_key,omitempty"`
+	SessionToken string `yaml:"session_token,omitempty" json:"session_token,omitempty"`
+	Region       string `yaml:"region,omitempty" json:"region,omitempty"`
+	Service      string `yaml:"service,omitempty" json:"service,omitempty"`
+
+	// hmac signs with secret_key; Header names the signature header
+	Header string `yaml:"header,omitempty" json:"header,omitempty"`
+}
+
+// UnmarshalJSON accepts refresh_interval as a duration string
+func (a *upstreamAuth) UnmarshalJSON(data []byte) error {
+	type plain upstreamAuth
+	var raw struct {
+		plain
+		RefreshInterval string `json:"refresh_interval"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*a = upstreamAuth(raw.plain)
+	if raw.RefreshInterval != "" {
+		return parseDuration(&a.RefreshInterval, raw.RefreshInterval)
+	}
+	return nil
+}
+
+// redacted returns a copy with secrets masked, for -print-config
+func (a upstreamAuth) redacted() upstreamAuth {
+	for _, secret := range []*string{&a.Password, &a.Token, &a.SecretKey, &a.SessionToken} {
+		if *secret != "" {
+			*secret = "********"
+		}
+	}
+	return a
+}
+
+// upstreamAuths maps hostname patterns (* wildcards) to their credentials
+var upstreamAuths map[string]upstreamAuth
+
+// validateUpstreamAuths rejects incomplete auth entries
+func validateUpstreamAuths(auths map[string]upstreamAuth) error {
+	for pattern, auth := range auths {
+		switch auth.Type {
+		case "basic":
+			if auth.Username == "" {
+				return fmt.Errorf("basic auth for %q needs a username", pattern)
+			}
+		case "bearer":
+			if auth.Token == "" && auth.RefreshURL == "" {
+				return fmt.Errorf("bearer auth for %q needs a token or refresh_url", pattern)
+			}
+		case "sigv4":
+			if auth.AccessKey == "" || auth.SecretKey == "" || auth.Region == "" || auth.Service == "" {
+				return fmt.Errorf("sigv4 auth for %q needs access_key, secret_key, region and service", pattern)
+			}
+		case "hmac":
+			if auth.SecretKey == "" {
+				return fmt.Errorf("hmac auth for %q needs a secret_key", pattern)
+			}
+		default:
+			return fmt.Errorf("unknown upstream auth type %q for %q (want basic, bearer, sigv4 or hmac)", auth.Type, pattern)
+		}
+	}
+	return nil
+}
+
+// authTransport adds configured credentials to upstream requests. Headers
+// the caller set explicitly, e.g. through the headers param, win; hmac
+// signatures don't use Authorization and are added regardless.
+type authTransport struct {
+	next http.RoundTripper
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(upstreamAuths) == 0 || isWebhookCall(req) {
+		return t.next.RoundTrip(req)
+	}
+	auth := matchHostPattern(upstreamAuths, req.URL.Hostname())
+	if auth.Type == "" || (auth.Type != "hmac" && req.Header.Get("Authorization") != "") {
+		return t.next.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	switch auth.Type {
+	case "basic":
+		req.SetBasicAuth(auth.Username, auth.Password)
+	case "bearer":
+		token, err := bearerTokens.get(req.Context(), auth, false)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := t.next.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusUnauthorized || auth.RefreshURL == "" || (req.Body != nil && req.GetBody == nil) {
+			return resp, err
+		}
+		// The token was revoked early; fetch a new one and retry once
+		resp.Body.Close()
+		if token, err = bearerTokens.get(req.Context(), auth, true); err != nil {
+			return nil, err
+		}
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	case "sigv4":
+		if err := signSigV4(req, auth, time.Now().UTC()); err != nil {
+			return nil, err
+		}
+	case "hmac":
+		signHMAC(req, auth, time.Now())
+	}
+	return t.next.RoundTrip(req)
+}
+
+// cachedToken is a bearer token fetched from a refresh webhook
+type cachedToken struct {
+	token   string
+	expires time.Time
+}
+
+// tokenFlight is one webhook call that concurrent requests for the same
+// credential wait for
+type tokenFlight struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+// bearerTokenCache holds refreshed bearer tokens by refresh URL and static
+// token. The lock only guards the maps; webhook calls run outside it.
+type bearerTokenCache struct {
+	mu      sync.Mutex
+	tokens  map[string]cachedToken
+	flights map[string]*tokenFlight
+}
+
+var bearerTokens = &bearerTokenCache{tokens: make(map[string]cachedToken), flights: make(map[string]*tokenFlight)}
+
+// defaultTokenLifetime is used when neither the webhook nor the config says
+const defaultTokenLifetime = 5 * time.Minute
+
+// get returns the token for auth, calling its refresh webhook when the
+// cached one expired or force is set. Concurrent callers for the same
+// credential share one webhook call.
+func (c *bearerTokenCache) get(ctx context.Context, auth upstreamAuth, force bool) (string, error) {
+	if auth.RefreshURL == "" {
+		return auth.Token, nil
+	}
+	key := auth.RefreshURL + "\x00" + auth.Token
+	for {
+		c.mu.Lock()
+		if cached, ok := c.tokens[key]; ok && !force && time.Now().Before(cached.expires) {
+			c.mu.Unlock()
+			return cached.token, nil
+		}
+		flight, ok := c.flights[key]
+		if !ok {
+			break
+		}
+		c.mu.Unlock()
+		select {
+		case <-flight.done:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		// When the request that called the webhook went away, try again ourselves
+		if !errors.Is(flight.err, context.Canceled) {
+			return flight.token, flight.err
+		}
+	}
+	flight := &tokenFlight{done: make(chan struct{})}
+	c.flights[key] = flight
+	c.mu.Unlock()
+
+	var lifetime time.Duration
+	flight.token, lifetime, flight.err = refreshBearerToken(ctx, auth)
+	c.mu.Lock()
+	if flight.err == nil {
+		c.tokens[key] = cachedToken{token: flight.token, expires: time.Now().Add(lifetime)}
+	}
+	delete(c.flights, key)
+	c.mu.Unlock()
+	close(flight.done)
+	return flight.token, flight.err
+}
+
+// refreshBearerToken calls the refresh webhook of auth and returns the new
+// token with its lifetime
+func refreshBearerToken(ctx context.Context, auth upstreamAuth) (string, time.Duration, error) {
+	ctx, cancel := webhookContext(ctx)
+	defer cancel()
+	headers := make(map[string]string)
+	if auth.Token != "" {
+		// The static token authenticates the proxy to the webhook
+		headers["Authorization"] = "Bearer " + auth.Token
+	}
+	resp, err := fetch(ctx, fetchOptions{url: auth.RefreshURL, headers: headers})
+	if err != nil {
+		return "", 0, fmt.Errorf("refreshing bearer token: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", 0, fmt.Errorf("refreshing bearer token: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("refreshing bearer token: webhook returned %s", resp.Status)
+	}
+
+	// Either {"token": "...", "expires_in": seconds} or the bare token
+	var payload struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	token := strings.TrimSpace(string(body))
+	lifetime := auth.RefreshInterval
+	if json.Unmarshal(body, &payload) == nil {
+		if token = payload.Token; token == "" {
+			token = payload.AccessToken
+		}
+		if payload.ExpiresIn > 0 {
+			lifetime = time.Duration(payload.ExpiresIn) * time.Second
+		}
+	}
+	if token == "" {
+		return "", 0, fmt.Errorf("refreshing bearer token: webhook returned no token")
+	}
+	if lifetime <= 0 {
+		lifetime = defaultTokenLifetime
+	}
+	return token, lifetime, nil
+}
+
+// emptyPayloadHash is the SHA-256 of an empty body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// signSigV4 signs req with AWS Signature Version 4
+func signSigV4(req *http.Request, auth upstreamAuth, now time.Time) error {
+	payloadHash := emptyPayloadHash
+	if req.Body != nil && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		io.Copy(h, body)
+		body.Close()
+		payloadHash = hex.EncodeToString(h.Sum(nil))
+	} else if req.Body != nil {
+		payloadHash = "UNSIGNED-PAYLOAD"
+	}
+
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if auth.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", auth.SessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	signed := map[string]string{
+		"host":                 host,
+		"x-amz-date":           amzDate,
+		"x-amz-content-sha256": payloadHash,
+	}
+	if auth.SessionToken != "" {
+		signed["x-amz-security-token"] = auth.SessionToken
+	}
+	if r := req.Header.Get("Range"); r != "" {
+		signed["range"] = r
+	}
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(signed[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	segments := strings.Split(req.URL.Path, "/")
+	for i, segment := range segments {
+		segments[i] = awsEscape(segment)
+		if auth.Service != "s3" {
+			// Every service but S3 expects the path encoded twice
+			segments[i] = awsEscape(segments[i])
+		}
+	}
+	canonicalPath := strings.Join(segments, "/")
+	if canonicalPath == "" {
+		canonicalPath = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalPath,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + auth.Region + "/" + auth.Service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+auth.SecretKey), day)
+	key = hmacSHA256(key, auth.Region)
+	key = hmacSHA256(key, auth.Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		auth.AccessKey, scope, signedHeaders, signature))
+	return nil
+}
+
+// defaultSignatureHeader carries hmac signatures unless auth.Header is set
+const defaultSignatureHeader = "X-Proxy-Signature"
+
+// signHMAC proves req came through the proxy: X-Proxy-Timestamp holds the
+// Unix time and the signature header the hex HMAC-SHA256, keyed with the
+// shared secret, of "{timestamp}\n{method}\n{path and query}". Origins
+// recompute it and reject stale timestamps to stop replays.
+func signHMAC(req *http.Request, auth upstreamAuth, now time.Time) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	header := auth.Header
+	if header == "" {
+		header = defaultSignatureHeader
+	}
+	signature := hmacSHA256([]byte(auth.SecretKey), timestamp+"\n"+req.Method+"\n"+req.URL.RequestURI())
+	req.Header.Set("X-Proxy-Timestamp", timestamp)
+	req.Header.Set(header, hex.EncodeToString(signature))
+}
+
+// canonicalQuery encodes query parameters sorted by name, then value
+func canonicalQuery(values url.Values) string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		vs := append([]string(nil), values[name]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			pairs = append(pairs, awsEscape(name)+"="+awsEscape(v))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// awsEscape percent-encodes everything but RFC 3986 unreserved characters
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,137 @@
+package hlsproxy
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var (
+	// shortURLBinding is what short URLs are bound to on first use: "" (not
+	// bound), "ip" or "session"
+	shortURLBinding string
+	// shortURLBindingSecret signs the bind param that URLs rewritten from a
+	// bound short URL carry, so they only work for the bound client too
+	shortURLBindingSecret []byte
+)
+
+// bindingSessionCookie is the cookie a player can send its session ID in
+// instead of the X-Session-ID header
+const bindingSessionCookie = "session_id"
+
+// validateShortURLBinding rejects unknown binding modes, and binding without
+// a secret to sign the rewritten URLs with
+func validateShortURLBinding(mode, secret string) error {
+	switch mode {
+	case "":
+		return nil
+	case "ip", "session":
+		if secret == "" {
+			return fmt.Errorf("short URL binding requires SHORT_URL_BINDING_SECRET")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown short URL binding %q (want ip or session)", mode)
+}
+
+// bindingIdentity returns who is requesting a bound short URL: the client
+// IP, or the session ID the player sends as X-Session-ID or the session_id
+// cookie. It's never taken from the query, which is copied along with the link.
+func bindingIdentity(r *http.Request) (string, bool) {
+	switch shortURLBinding {
+	case "ip":
+		addr, ok := clientIP(r)
+		if !ok {
+			return "", false
+		}
+		return "ip:" + addr.String(), true
+	case "session":
+		session := strings.TrimSpace(r.Header.Get("X-Session-ID"))
+		if session == "" {
+			if cookie, err := r.Cookie(bindingSessionCookie); err == nil {
+				session = strings.TrimSpace(cookie.Value)
+			}
+		}
+		return "session:" + session, session != ""
+	}
+	return "", true
+}
+
+// checkBinding binds short URL id to the requester on first use and reports
+// whether this request comes from the bound client. It writes the error
+// response itself.
+func checkBinding(w http.ResponseWriter, r *http.Request, id string) bool {
+	if shortURLBinding == "" {
+		return true
+	}
+	identity, ok := bindingIdentity(r)
+	if !ok {
+		sendBindingError(w, "This link requires a session ID (X-Session-ID header or session_id cookie)")
+		return false
+	}
+
+	// Set-if-absent, so two first clients racing can't both bind the link
+	key := "bind:" + id
+	if set, err := shortURLs.SetIfAbsent(key, []byte(identity), shortURLTTL); err != nil {
+		sendError(w, "Failed to store short URL binding", err.Error())
+		return false
+	} else if set {
+		return true
+	}
+	bound, found, err := shortURLs.Get(key)
+	if err != nil {
+		sendError(w, "Failed to look up short URL binding", err.Error())
+		return false
+	}
+	if !found || string(bound) != identity {
+		sendBindingError(w, "This link is bound to another client")
+		return false
+	}
+	return true
+}
+
+// bindingSignature signs that short URL id is bound to identity
+func bindingSignature(id, identity string) string {
+	return hex.EncodeToString(hmacSHA256(shortURLBindingSecret, "bind:"+id+"\x00"+identity))[:32]
+}
+
+// bindingValue is the bind param of a request for bound short URL id
+func bindingValue(r *http.Request, id string) string {
+	identity, _ := bindingIdentity(r)
+	return id + "." + bindingSignature(id, identity)
+}
+
+// bindingParam returns the &bind= suffix carried by rewritten URLs
+func bindingParam(r *http.Request) string {
+	if bind := r.URL.Query().Get("bind"); bind != "" && shortURLBinding != "" {
+		return "&bind=" + url.QueryEscape(bind)
+	}
+	return ""
+}
+
+// checkBindingParam reports whether the bind param of a rewritten URL, when
+// it has one, was signed for this client. It writes the error response itself.
+func checkBindingParam(w http.ResponseWriter, r *http.Request) bool {
+	bind := r.URL.Query().Get("bind")
+	if bind == "" || shortURLBinding == "" {
+		return true
+	}
+	id, signature, _ := strings.Cut(bind, ".")
+	identity, ok := bindingIdentity(r)
+	if !ok || !hmac.Equal([]byte(signature), []byte(bindingSignature(id, identity))) {
+		sendBindingError(w, "This link is bound to another client")
+		return false
+	}
+	return true
+}
+
+// sendBindingError rejects a request for a short URL bound to someone else
+func sendBindingError(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
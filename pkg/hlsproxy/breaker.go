@@ -0,0 +1,203 @@
+package hlsproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// circuitOpenError is returned for requests short-circuited by an open breaker
+type circuitOpenError struct {
+	host       string
+	retryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("circuit open for %s, retry in %s", e.host, e.retryAfter.Round(time.Second))
+}
+
+func (e *circuitOpenError) RetryAfter() time.Duration { return e.retryAfter }
+
+// unavailableError is an upstream error the client should retry later
+type unavailableError interface {
+	error
+	RetryAfter() time.Duration
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// hostBreaker tracks recent failures of one upstream host
+type hostBreaker struct {
+	state    breakerState
+	failures []time.Time
+	openedAt time.Time
+	probing  bool
+}
+
+// circuitBreaker opens per upstream host after too many failures inside a
+// window, rejects requests while open, and lets a single probe through once
+// the cooldown has passed
+type circuitBreaker struct {
+	mu    sync.Mutex
+	hosts map[string]*hostBreaker
+}
+
+var breakers = &circuitBreaker{hosts: make(map[string]*hostBreaker)}
+
+// allow reports whether a request to host may proceed
+func (cb *circuitBreaker) allow(host string, now time.Time) error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	b, ok := cb.hosts[host]
+	if !ok {
+		return nil
+	}
+
+	switch b.state {
+	case breakerOpen:
+		if wait := circuitBreakerCooldown - now.Sub(b.openedAt); wait > 0 {
+			return &circuitOpenError{host: host, retryAfter: wait}
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return nil
+	case breakerHalfOpen:
+		if b.probing {
+			return &circuitOpenError{host: host, retryAfter: time.Second}
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// release frees a half-open probe slot without recording an outcome
+func (cb *circuitBreaker) release(host string) {
+	cb.mu.Lock()
+	if b, ok := cb.hosts[host]; ok && b.state == breakerHalfOpen {
+		b.probing = false
+	}
+	cb.mu.Unlock()
+}
+
+// record feeds the outcome of a request to host back into its breaker
+func (cb *circuitBreaker) record(host string, failed bool, now time.Time) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	b, ok := cb.hosts[host]
+	if !ok {
+		if !failed {
+			return
+		}
+		cb.sweep(now)
+		b = &hostBreaker{}
+		cb.hosts[host] = b
+	}
+
+	if b.state == breakerHalfOpen {
+		b.probing = false
+		if failed {
+			b.state = breakerOpen
+			b.openedAt = now
+		} else {
+			delete(cb.hosts, host)
+		}
+		return
+	}
+
+	// Keep only the failures inside the window
+	b.expire(now)
+	if !failed {
+		if b.state == breakerClosed && len(b.failures) == 0 {
+			delete(cb.hosts, host)
+		}
+		return
+	}
+	b.failures = append(b.failures, now)
+
+	if b.state == breakerClosed && len(b.failures) >= circuitBreakerFailures {
+		b.state = breakerOpen
+		b.openedAt = now
+		b.failures = nil
+	}
+}
+
+// expire drops the failures that left the window
+func (b *hostBreaker) expire(now time.Time) {
+	recent := b.failures[:0]
+	for _, t := range b.failures {
+		if now.Sub(t) <= circuitBreakerWindow {
+			recent = append(recent, t)
+		}
+	}
+	b.failures = recent
+}
+
+// sweep drops the closed breakers whose failures all left the window, so
+// hosts that failed once and were never asked again aren't kept forever;
+// callers must hold cb.mu
+func (cb *circuitBreaker) sweep(now time.Time) {
+	for host, b := range cb.hosts {
+		if b.state == breakerClosed {
+			if b.expire(now); len(b.failures) == 0 {
+				delete(cb.hosts, host)
+			}
+		}
+	}
+}
+
+// breakerTransport applies the circuit breaker to every upstream request
+type breakerTransport struct {
+	next http.RoundTripper
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if circuitBreakerFailures <= 0 {
+		return t.next.RoundTrip(req)
+	}
+
+	host := strings.ToLower(req.URL.Host)
+	if err := breakers.allow(host, time.Now()); err != nil {
+		return nil, err
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	var queueFull *queueFullError
+	if req.Context().Err() != nil || errors.As(err, &queueFull) {
+		// Client cancellations and our own queueing say nothing about the origin's health
+		breakers.release(host)
+	} else {
+		breakers.record(host, err != nil || resp.StatusCode >= 500, time.Now())
+	}
+	return resp, err
+}
+
+// writeUnavailable answers 503 with Retry-After when err comes from an open
+// breaker or a full host queue. It reports whether it wrote the response.
+func writeUnavailable(w http.ResponseWriter, err error) bool {
+	var unavailable unavailableError
+	if !errors.As(err, &unavailable) {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(unavailable.RetryAfter().Seconds())))))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":   "Upstream temporarily unavailable",
+		"details": err.Error(),
+	})
+	return true
+}
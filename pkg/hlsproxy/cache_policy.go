@@ -0,0 +1,262 @@
+package hlsproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheDirectives returns what an upstream Cache-Control allows: whether
+// the response may be stored, and its max-age when given
+func cacheDirectives(cacheControl string) (storable bool, maxAge time.Duration, hasMaxAge bool) {
+	storable = true
+	for _, directive := range strings.Split(strings.ToLower(cacheControl), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch name {
+		case "no-store", "no-cache", "private":
+			storable = false
+		case "max-age", "s-maxage":
+			if seconds, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil && seconds >= 0 {
+				if !hasMaxAge || time.Duration(seconds)*time.Second < maxAge {
+					maxAge = time.Duration(seconds) * time.Second
+				}
+				hasMaxAge = true
+			}
+		}
+	}
+	return storable, maxAge, hasMaxAge
+}
+
+// cacheTTL returns how long the proxy may keep a response with the given
+// upstream Cache-Control. Respecting it, no-store, no-cache and private
+// responses aren't kept and max-age shortens the TTL; ignoring it, every
+// response is kept for the full cache_ttl.
+func (p domainPolicy) cacheTTL(cacheControl string) time.Duration {
+	if p.CacheTTL <= 0 || p.CacheControl == "ignore" {
+		return p.CacheTTL
+	}
+	storable, maxAge, hasMaxAge := cacheDirectives(cacheControl)
+	if !storable {
+		return 0
+	}
+	if hasMaxAge {
+		return min(p.CacheTTL, maxAge)
+	}
+	return p.CacheTTL
+}
+
+// setSegmentCacheControl sets the Cache-Control clients get for a proxied
+// segment or file: the upstream one when the domain policy respects it, or
+// the policy's own cache_ttl when it ignores it. Without cache settings no
+// Cache-Control is sent, as before.
+func setSegmentCacheControl(w http.ResponseWriter, targetURL string, resp *http.Response) {
+	if len(domainPolicies) == 0 {
+		return
+	}
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return
+	}
+	policy := matchHostPattern(domainPolicies, u.Hostname())
+	switch {
+	case policy.CacheControl == "ignore" && policy.CacheTTL > 0:
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(policy.CacheTTL.Seconds())))
+	case policy.CacheControl == "respect" || policy.CacheTTL > 0:
+		if cacheControl := resp.Header.Get("Cache-Control"); cacheControl != "" {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+	}
+}
+
+// cacheStore also keeps domain-cached responses when CACHE_BACKEND is set,
+// so they outlive restarts or are shared between instances
+var cacheStore Store
+
+const (
+	// cacheStoreQueue bounds the responses waiting to be written to
+	// cacheStore; more are only kept in memory
+	cacheStoreQueue = 256
+	// cacheStoreReadTimeout bounds a cacheStore lookup, so a slow backend
+	// makes a hit no slower than a miss would have been
+	cacheStoreReadTimeout = 250 * time.Millisecond
+	// cacheStoreReads bounds the lookups in flight; more count as misses
+	cacheStoreReads = 64
+)
+
+var (
+	cacheStoreWrites     = make(chan *prewarmEntry, cacheStoreQueue)
+	cacheStoreWriterOnce sync.Once
+	cacheStoreReading    = make(chan struct{}, cacheStoreReads)
+)
+
+// storedCacheEntry is a domain-cached response as kept in cacheStore
+type storedCacheEntry struct {
+	Body         []byte    `json:"body"`
+	ContentType  string    `json:"contentType,omitempty"`
+	CacheControl string    `json:"cacheControl,omitempty"`
+	Expires      time.Time `json:"expires"`
+}
+
+// requestCredentialKey is the suffix of cache keys of upstream requests:
+// "" without credentials or header overrides, else credentialKey after a NUL
+func requestCredentialKey(req *http.Request) string {
+	headers := make(map[string]string)
+	for _, name := range credentialHeaders {
+		if v := req.Header.Get(name); v != "" {
+			headers[name] = v
+		}
+	}
+	return credentialSuffix(headers, headerOverrides(req))
+}
+
+// credentialSuffix is requestCredentialKey of a request to be sent with
+// headers, overrides among them
+func credentialSuffix(headers, overrides map[string]string) string {
+	if key := credentialKey(headers, overrides); key != "" {
+		return "\x00" + key
+	}
+	return ""
+}
+
+// storeCacheEntry queues a domain-cached response for cacheStore. Writing
+// happens in the background, so the client reading the response never
+// waits for the backend; when the queue is full the entry stays in memory only.
+func storeCacheEntry(entry *prewarmEntry) {
+	if cacheStore == nil || time.Until(entry.expires) <= 0 {
+		return
+	}
+	cacheStoreWriterOnce.Do(func() { go writeCacheEntries() })
+	select {
+	case cacheStoreWrites <- entry:
+	default:
+	}
+}
+
+// writeCacheEntries writes the queued responses to cacheStore
+func writeCacheEntries() {
+	for entry := range cacheStoreWrites {
+		ttl := time.Until(entry.expires)
+		store := cacheStore
+		if store == nil || ttl <= 0 {
+			continue
+		}
+		data, _ := json.Marshal(storedCacheEntry{Body: entry.body, ContentType: entry.contentType, CacheControl: entry.cacheControl, Expires: entry.expires})
+		if err := store.Set(entry.url, data, ttl); err != nil {
+			log.Printf("Cache store: saving %s: %v", entry.url, err)
+		}
+	}
+}
+
+// loadCacheEntry reads a response of a host with a cache_ttl from
+// cacheStore into the memory cache. Lookups slower than
+// cacheStoreReadTimeout count as misses; they finish in the background.
+func loadCacheEntry(host, url string) (*prewarmEntry, bool) {
+	if cacheStore == nil || len(domainPolicies) == 0 || matchHostPattern(domainPolicies, host).CacheTTL <= 0 {
+		return nil, false
+	}
+	select {
+	case cacheStoreReading <- struct{}{}:
+	default:
+		return nil, false
+	}
+	type lookup struct {
+		data []byte
+		ok   bool
+	}
+	done := make(chan lookup, 1)
+	go func(store Store) {
+		defer func() { <-cacheStoreReading }()
+		data, ok, err := store.Get(url)
+		if err != nil {
+			log.Printf("Cache store: loading %s: %v", url, err)
+		}
+		done <- lookup{data, ok}
+	}(cacheStore)
+
+	var result lookup
+	select {
+	case result = <-done:
+	case <-time.After(cacheStoreReadTimeout):
+		return nil, false
+	}
+	data, ok := result.data, result.ok
+	var stored storedCacheEntry
+	if !ok || json.Unmarshal(data, &stored) != nil || time.Now().After(stored.Expires) {
+		return nil, false
+	}
+	entry := &prewarmEntry{url: url, body: stored.Body, contentType: stored.ContentType, cacheControl: stored.CacheControl, expires: stored.Expires}
+	prewarmed.put(entry)
+	return entry, true
+}
+
+// cacheTransport keeps whole GET responses of hosts whose domain policy
+// sets cache_ttl in the prewarm store, which answers later requests for
+// them, and in cacheStore when configured. Playlists aren't kept, so live
+// streams keep moving. Responses to requests with cookies or authorization
+// are kept apart per credentials.
+type cacheTransport struct {
+	next http.RoundTripper
+}
+
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || len(domainPolicies) == 0 || req.Method != http.MethodGet || req.Header.Get("Range") != "" {
+		return resp, err
+	}
+	policy := matchHostPattern(domainPolicies, req.URL.Hostname())
+	if policy.CacheTTL <= 0 || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "" ||
+		resp.ContentLength > prewarmMaxEntryBytes {
+		return resp, nil
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if strings.Contains(strings.ToLower(contentType), "mpegurl") || isM3U8URL(req.URL.String()) {
+		return resp, nil
+	}
+	ttl := policy.cacheTTL(resp.Header.Get("Cache-Control"))
+	if ttl <= 0 {
+		return resp, nil
+	}
+	resp.Body = &cachingBody{ReadCloser: resp.Body, entry: &prewarmEntry{
+		url:          req.URL.String() + requestCredentialKey(req),
+		contentType:  contentType,
+		cacheControl: resp.Header.Get("Cache-Control"),
+		expires:      time.Now().Add(ttl),
+	}}
+	return resp, nil
+}
+
+// cachingBody stores a response body in the prewarm store once it was read
+// to the end, unless it grew past prewarmMaxEntryBytes
+type cachingBody struct {
+	io.ReadCloser
+	entry *prewarmEntry
+	buf   bytes.Buffer
+	over  bool
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.over {
+		if b.buf.Len()+n > prewarmMaxEntryBytes {
+			b.over = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !b.over {
+		b.entry.body = b.buf.Bytes()
+		prewarmed.put(b.entry)
+		storeCacheEntry(b.entry)
+		b.over = true
+	}
+	return n, err
+}
@@ -0,0 +1,105 @@
+package hlsproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// clipHandler serves the part of a VOD playlist between two playback times:
+// every segment overlapping [start, end) by EXTINF accumulation, started at
+// the requested moment. Nothing is downloaded beyond the playlist. A master
+// playlist contributes its highest-bandwidth variant.
+// URL format: /clip?url={m3u8_url}&start={seconds}&end={seconds}&headers={optional_headers}
+func clipHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	source := query.Get("url")
+	if source == "" {
+		sendClipError(w, http.StatusBadRequest, "URL parameter is required")
+		return
+	}
+	start, err := strconv.ParseFloat(query.Get("start"), 64)
+	if err != nil || start < 0 {
+		sendClipError(w, http.StatusBadRequest, "start must be a non-negative number of seconds")
+		return
+	}
+	end, err := strconv.ParseFloat(query.Get("end"), 64)
+	if err != nil || end <= start {
+		sendClipError(w, http.StatusBadRequest, "end must be a number of seconds after start")
+		return
+	}
+
+	rules := parseHeadersParam(query.Get("headers"))
+	sessionRules, err := requestHeaderRules(r)
+	if err != nil {
+		sendClipError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	playlistURL, content, err := fetchMediaPlaylist(r.Context(), source, sessionRules)
+	if err != nil {
+		sendUpstreamError(w, "Failed to fetch "+source, err)
+		return
+	}
+	content = preparePlaylist(content, playlistURL)
+	playlist := parseMediaPlaylist(content, playlistURL)
+	if !playlist.endList && playlist.playlistType != "VOD" {
+		sendClipError(w, http.StatusUnprocessableEntity, "Only VOD playlists can be clipped")
+		return
+	}
+
+	first, count, clipStart := clipSegments(playlist.segments, start, end)
+	if count == 0 {
+		sendClipError(w, http.StatusRequestedRangeNotSatisfiable, "No segments between start and end")
+		return
+	}
+	clipped, _ := windowPlaylist(content, playlist.mediaSequence+int64(first), count)
+	// The source's own start point means nothing inside the clip
+	clipped = setStartOffset(clipped, start-clipStart)
+
+	keyParam := streamParam(r, source) + headerParams(r)
+	if apiKey := query.Get("api_key"); apiKey != "" {
+		keyParam += "&api_key=" + url.QueryEscape(apiKey)
+	}
+	encodedHeaders := url.QueryEscape(rules.encode(generateRequestHeaders(playlistURL, rules["*"])))
+	rewrite := func(resolvedURL string, kind uriKind) string {
+		return fmt.Sprintf("%s/%s?url=%s&headers=%s",
+			rewriteBaseURL(r, segmentBaseURL(r, resolvedURL)),
+			segmentEndpoint(kind),
+			url.QueryEscape(resolvedURL),
+			encodedHeaders) + keyParam
+	}
+	lines := strings.Split(clipped, "\n")
+	for i, line := range lines {
+		lines[i] = rewritePlaylistLine(line, playlistURL, false, rewrite)
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Write([]byte(strings.Join(lines, "\n")))
+}
+
+// clipSegments returns the index and number of the segments overlapping
+// [start, end) and the playback time the first of them starts at
+func clipSegments(segments []mediaSegment, start, end float64) (first, count int, clipStart float64) {
+	first = -1
+	elapsed := 0.0
+	for i, segment := range segments {
+		segmentEnd := elapsed + segment.duration
+		if segmentEnd > start && elapsed < end {
+			if first == -1 {
+				first, clipStart = i, elapsed
+			}
+			count++
+		}
+		elapsed = segmentEnd
+	}
+	return max(first, 0), count, clipStart
+}
+
+func sendClipError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
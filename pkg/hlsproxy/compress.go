@@ -0,0 +1,147 @@
+package hlsproxy
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// compressMinBytes skips responses too small to be worth compressing
+const compressMinBytes = 1024
+
+var gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(io.Discard) }}
+
+// compressibleType reports whether responses of this content type are text
+// worth compressing: playlists, manifests and JSON
+func compressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "application/vnd.apple.mpegurl", "application/x-mpegurl", "audio/mpegurl", "audio/x-mpegurl",
+		"application/dash+xml", "application/json", "application/xml":
+		return true
+	}
+	return strings.HasPrefix(mediaType, "text/")
+}
+
+// negotiateEncoding picks gzip or deflate from Accept-Encoding, or ""
+func negotiateEncoding(acceptEncoding string) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		accepted[name] = true
+	}
+	switch {
+	case accepted["gzip"]:
+		return "gzip"
+	case accepted["deflate"]:
+		return "deflate"
+	}
+	return ""
+}
+
+// addVary appends a field to the Vary header unless it's already listed
+func addVary(h http.Header, field string) {
+	for _, v := range h.Values("Vary") {
+		for _, existing := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(existing), field) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", field)
+}
+
+// compressWriter compresses playlist and JSON responses for clients that
+// accept it. The decision is made when the handler writes the header, so
+// media and ranged responses pass through untouched.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string // negotiated with the client, "" if none
+	encoder     io.WriteCloser
+	wroteHeader bool
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.Header()
+	if compressibleType(h.Get("Content-Type")) {
+		addVary(h, "Accept-Encoding")
+		length, err := strconv.Atoi(h.Get("Content-Length"))
+		small := err == nil && length < compressMinBytes
+		bodiless := status == http.StatusNoContent || status == http.StatusNotModified || status < 200
+		if w.encoding != "" && !small && !bodiless && status != http.StatusPartialContent &&
+			h.Get("Content-Encoding") == "" && h.Get("Content-Range") == "" {
+			h.Set("Content-Encoding", w.encoding)
+			h.Del("Content-Length")
+			if w.encoding == "gzip" {
+				gz := gzipWriters.Get().(*gzip.Writer)
+				gz.Reset(w.ResponseWriter)
+				w.encoder = gz
+			} else {
+				w.encoder = zlib.NewWriter(w.ResponseWriter)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.encoder != nil {
+		return w.encoder.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush pushes compressed data out so streaming responses keep flowing
+func (w *compressWriter) Flush() {
+	if gz, ok := w.encoder.(*gzip.Writer); ok {
+		gz.Flush()
+	} else if zw, ok := w.encoder.(*zlib.Writer); ok {
+		zw.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Close finishes the compressed stream
+func (w *compressWriter) Close() {
+	if w.encoder == nil {
+		return
+	}
+	w.encoder.Close()
+	if gz, ok := w.encoder.(*gzip.Writer); ok {
+		gz.Reset(io.Discard)
+		gzipWriters.Put(gz)
+	}
+	w.encoder = nil
+}
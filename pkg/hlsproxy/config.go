@@ -0,0 +1,886 @@
+package hlsproxy
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the server configuration. Values are layered with
+// precedence flags > environment > YAML config file > defaults.
+type Config struct {
+	Host                   string                `yaml:"host"`
+	Port                   string                `yaml:"port"`
+	ListenSocket           string                `yaml:"listen_socket"`
+	ListenSocketMode       string                `yaml:"listen_socket_mode"`
+	ShutdownTimeout        time.Duration         `yaml:"shutdown_timeout"`
+	PIDFile                string                `yaml:"pid_file"`
+	PublicURL              string                `yaml:"public_url"`
+	PublicURLMode          string                `yaml:"public_url_mode"`
+	AllowedOrigins         []string              `yaml:"allowed_origins"`
+	CORSPolicies           map[string]corsPolicy `yaml:"cors_policies"`
+	ResponseHeaders        map[string]string     `yaml:"response_headers"`
+	ParamAliases           map[string]string     `yaml:"param_aliases"`
+	AllowedClientCIDRs     []string              `yaml:"allowed_client_cidrs"`
+	BlockedClientCIDRs     []string              `yaml:"blocked_client_cidrs"`
+	TrustedProxyCIDRs      []string              `yaml:"trusted_proxy_cidrs"`
+	BlockedReferers        []string              `yaml:"blocked_referers"`
+	BlockedUserAgents      []string              `yaml:"blocked_user_agents"`
+	GhostProxyURL          string                `yaml:"ghost_proxy_url"`
+	MaxRedirects           int                   `yaml:"max_redirects"`
+	MaxPlaylistDepth       int                   `yaml:"max_playlist_depth"`
+	PlaylistDepthSecret    string                `yaml:"playlist_depth_secret"`
+	RedirectMatchDomain    bool                  `yaml:"redirect_match_domain"`
+	SchemeMemoryTTL        time.Duration         `yaml:"scheme_memory_ttl"`
+	SegmentVariantFailover bool                  `yaml:"segment_variant_failover"`
+	VerifySegments         bool                  `yaml:"verify_segments"`
+	SegmentTiming          bool                  `yaml:"segment_timing"`
+	AdminToken             string                `yaml:"admin_token"`
+	JWTAlgorithm           string                `yaml:"jwt_algorithm"`
+	JWTSecret              string                `yaml:"jwt_secret"`
+	JWTPublicKeyFile       string                `yaml:"jwt_public_key_file"`
+	WatermarkSecret        string                `yaml:"watermark_secret"`
+	MP4ParallelConnections int                   `yaml:"mp4_parallel_connections"`
+	MP4ParallelChunkSize   int64                 `yaml:"mp4_parallel_chunk_size"`
+	MP4MaxTransfers        int                   `yaml:"mp4_max_transfers"`
+	MP4QueueWait           time.Duration         `yaml:"mp4_queue_wait"`
+	MP4CacheDir            string                `yaml:"mp4_cache_dir"`
+	MP4CacheMaxBytes       int64                 `yaml:"mp4_cache_max_bytes"`
+	MP4CacheChunkSize      int64                 `yaml:"mp4_cache_chunk_size"`
+	StreamFlushBytes       int                   `yaml:"stream_flush_bytes"`
+	KeyCacheTTL            time.Duration         `yaml:"key_cache_ttl"`
+	PrewarmTTL             time.Duration         `yaml:"prewarm_ttl"`
+
+	ShortenerBackend      string        `yaml:"shortener_backend"`
+	RedisURL              string        `yaml:"redis_url"`
+	StoreDB               string        `yaml:"store_db"`
+	ShortURLTTL           time.Duration `yaml:"short_url_ttl"`
+	HeaderSessionTTL      time.Duration `yaml:"header_session_ttl"`
+	ShortURLBinding       string        `yaml:"short_url_binding"`
+	ShortURLBindingSecret string        `yaml:"short_url_binding_secret"`
+
+	BoltDB       string `yaml:"bolt_db"`
+	S3Bucket     string `yaml:"s3_bucket"`
+	S3Region     string `yaml:"s3_region"`
+	S3Endpoint   string `yaml:"s3_endpoint"`
+	S3AccessKey  string `yaml:"s3_access_key"`
+	S3SecretKey  string `yaml:"s3_secret_key"`
+	S3Prefix     string `yaml:"s3_prefix"`
+	CacheBackend string `yaml:"cache_backend"`
+
+	SessionRefreshWebhook  string        `yaml:"session_refresh_webhook"`
+	SessionRefreshInterval time.Duration `yaml:"session_refresh_interval"`
+
+	UpstreamFirstByteTimeout time.Duration `yaml:"upstream_first_byte_timeout"`
+	UpstreamIdleTimeout      time.Duration `yaml:"upstream_idle_timeout"`
+
+	UsageDB string `yaml:"usage_db"`
+
+	FFprobePath   string        `yaml:"ffprobe_path"`
+	FFmpegPath    string        `yaml:"ffmpeg_path"`
+	ProbeTimeout  time.Duration `yaml:"probe_timeout"`
+	ProbeCacheTTL time.Duration `yaml:"probe_cache_ttl"`
+
+	EPGCacheTTL time.Duration `yaml:"epg_cache_ttl"`
+
+	LocalMediaDir string `yaml:"local_media_dir"`
+
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	MaxHeaderBytes    int           `yaml:"max_header_bytes"`
+	MaxBodyBytes      int64         `yaml:"max_body_bytes"`
+
+	FetchEnabled      bool     `yaml:"fetch_enabled"`
+	FetchMaxBytes     int64    `yaml:"fetch_max_bytes"`
+	FetchContentTypes []string `yaml:"fetch_content_types"`
+	MaxEgressMbps     float64  `yaml:"max_egress_mbps"`
+
+	PushEnabled bool `yaml:"push_enabled"`
+
+	TestStreamEnabled bool `yaml:"test_stream_enabled"`
+
+	UnwrapProxies bool `yaml:"unwrap_proxies"`
+
+	CircuitBreakerFailures int           `yaml:"circuit_breaker_failures"`
+	CircuitBreakerWindow   time.Duration `yaml:"circuit_breaker_window"`
+	CircuitBreakerCooldown time.Duration `yaml:"circuit_breaker_cooldown"`
+
+	QuarantineErrorRate   float64       `yaml:"quarantine_error_rate"`
+	QuarantineMinRequests int           `yaml:"quarantine_min_requests"`
+	QuarantineWindow      time.Duration `yaml:"quarantine_window"`
+	QuarantineCooldown    time.Duration `yaml:"quarantine_cooldown"`
+
+	UpstreamMaxConcurrency int           `yaml:"upstream_max_concurrency"`
+	UpstreamQueueSize      int           `yaml:"upstream_queue_size"`
+	UpstreamQueueWait      time.Duration `yaml:"upstream_queue_wait"`
+	RateLimitMaxWait       time.Duration `yaml:"rate_limit_max_wait"`
+
+	ScriptFile string `yaml:"script_file"`
+
+	LicenseHeaders headerRules `yaml:"license_headers"`
+
+	PathProxyHeaders headerRules `yaml:"path_proxy_headers"`
+
+	TLSFingerprints   map[string]string `yaml:"tls_fingerprints"`
+	UpstreamProtocols map[string]string `yaml:"upstream_protocols"`
+
+	UpstreamAuth map[string]upstreamAuth `yaml:"upstream_auth"`
+
+	DomainPolicies map[string]domainPolicy `yaml:"domain_policies"`
+
+	PreserveHeaderCase   []string `yaml:"preserve_header_case"`
+	MinimalHeaderDomains []string `yaml:"minimal_header_domains"`
+
+	OutboundAddrs    []string `yaml:"outbound_addrs"`
+	OutboundAddrMode string   `yaml:"outbound_addr_mode"`
+
+	SampleAESMode string `yaml:"sample_aes_mode"`
+
+	InjectVariants map[string][]injectedVariant `yaml:"inject_variants"`
+}
+
+// DefaultConfig returns the built-in defaults
+func DefaultConfig() Config {
+	return Config{
+		Host:             "localhost",
+		Port:             "3000",
+		ListenSocketMode: "0660",
+		ShutdownTimeout:  30 * time.Second,
+		PublicURLMode:    "shard",
+		OutboundAddrMode: "rotate",
+		SampleAESMode:    "pass",
+		GhostProxyURL:    "http://5.231.61.126:8080",
+		MaxRedirects:     5,
+		MaxPlaylistDepth: 8,
+		SchemeMemoryTTL:  time.Hour,
+
+		UpstreamFirstByteTimeout: 10 * time.Second,
+		UpstreamIdleTimeout:      30 * time.Second,
+
+		MP4ParallelChunkSize: 2 << 20,
+		MP4QueueWait:         5 * time.Second,
+		MP4CacheMaxBytes:     10 << 30,
+		MP4CacheChunkSize:    1 << 20,
+		StreamFlushBytes:     64 << 10,
+		PrewarmTTL:           10 * time.Minute,
+
+		ShortenerBackend: "memory",
+		ShortURLTTL:      24 * time.Hour,
+		HeaderSessionTTL: 24 * time.Hour,
+		FFprobePath:      "ffprobe",
+		FFmpegPath:       "ffmpeg",
+		ProbeTimeout:     30 * time.Second,
+		ProbeCacheTTL:    10 * time.Minute,
+		EPGCacheTTL:      time.Hour,
+
+		SessionRefreshInterval: 30 * time.Second,
+
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       15 * time.Second,
+		WriteTimeout:      60 * time.Second,
+		IdleTimeout:       120 * time.Second,
+		MaxHeaderBytes:    64 << 10,
+		MaxBodyBytes:      1 << 20,
+		FetchEnabled:      true,
+
+		CircuitBreakerWindow:   30 * time.Second,
+		CircuitBreakerCooldown: 30 * time.Second,
+
+		QuarantineMinRequests: 20,
+		QuarantineWindow:      time.Minute,
+		QuarantineCooldown:    2 * time.Minute,
+
+		UpstreamQueueSize: 100,
+		UpstreamQueueWait: 10 * time.Second,
+	}
+}
+
+// redacted returns the config with its secrets masked, for -print-config
+func (c Config) redacted() Config {
+	for _, secret := range []*string{&c.AdminToken, &c.JWTSecret, &c.WatermarkSecret, &c.PlaylistDepthSecret,
+		&c.ShortURLBindingSecret, &c.S3AccessKey, &c.S3SecretKey, &c.SessionRefreshWebhook} {
+		if *secret != "" {
+			*secret = "********"
+		}
+	}
+	if u, err := url.Parse(c.RedisURL); err == nil {
+		c.RedisURL = u.Redacted()
+	}
+	if c.UpstreamAuth != nil {
+		auths := make(map[string]upstreamAuth, len(c.UpstreamAuth))
+		for pattern, auth := range c.UpstreamAuth {
+			auths[pattern] = auth.redacted()
+		}
+		c.UpstreamAuth = auths
+	}
+	c.LicenseHeaders = c.LicenseHeaders.redacted()
+	c.PathProxyHeaders = c.PathProxyHeaders.redacted()
+	return c
+}
+
+// configField binds one setting to its flag and environment variable
+type configField struct {
+	flag  string
+	env   string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+var configFields = []configField{
+	{"host", "HOST", "address to listen on", func(c *Config, v string) error {
+		c.Host = v
+		return nil
+	}},
+	{"port", "PORT", "port to listen on", func(c *Config, v string) error {
+		c.Port = v
+		return nil
+	}},
+	{"listen-socket", "LISTEN_SOCKET", "Unix socket path to listen on instead of host:port", func(c *Config, v string) error {
+		c.ListenSocket = v
+		return nil
+	}},
+	{"listen-socket-mode", "LISTEN_SOCKET_MODE", "octal permissions of the Unix socket", func(c *Config, v string) error {
+		if _, err := parseFileMode(v); err != nil {
+			return err
+		}
+		c.ListenSocketMode = v
+		return nil
+	}},
+	{"shutdown-timeout", "SHUTDOWN_TIMEOUT", "how long active requests may finish after SIGINT/SIGTERM or an upgrade (SIGHUP) before they are cut", func(c *Config, v string) error {
+		return parseDuration(&c.ShutdownTimeout, v)
+	}},
+	{"pid-file", "PID_FILE", "file the serving process writes its PID to, rewritten by the new process after an upgrade", func(c *Config, v string) error {
+		c.PIDFile = v
+		return nil
+	}},
+	{"public-url", "PUBLIC_URL", "base URL used in rewritten playlists; a comma-separated list spreads them over several hostnames; empty uses the scheme and host of each request", func(c *Config, v string) error {
+		c.PublicURL = v
+		return nil
+	}},
+	{"public-url-mode", "PUBLIC_URL_MODE", "how several PUBLIC_URLs are used: shard (per segment) or session (one per viewer)", func(c *Config, v string) error {
+		c.PublicURLMode = v
+		return nil
+	}},
+	{"allowed-origins", "ALLOWED_ORIGINS", "comma-separated CORS origins (empty allows all)", func(c *Config, v string) error {
+		c.AllowedOrigins = splitList(v)
+		return nil
+	}},
+	{"cors-policies", "CORS_POLICIES", `JSON object of endpoint path pattern -> {"allowed_origins", "allow_methods", "allow_headers", "expose_headers", "max_age", "allow_credentials"} CORS overrides`, func(c *Config, v string) error {
+		c.CORSPolicies = nil
+		if v == "" {
+			return nil
+		}
+		if err := json.Unmarshal([]byte(v), &c.CORSPolicies); err != nil {
+			return fmt.Errorf("invalid JSON object %q", v)
+		}
+		return nil
+	}},
+	{"response-headers", "RESPONSE_HEADERS", `JSON object of header name -> value added to every response, e.g. {"X-Content-Type-Options": "nosniff"}`, func(c *Config, v string) error {
+		c.ResponseHeaders = nil
+		if v == "" {
+			return nil
+		}
+		if err := json.Unmarshal([]byte(v), &c.ResponseHeaders); err != nil {
+			return fmt.Errorf("invalid JSON object %q", v)
+		}
+		return nil
+	}},
+	{"param-aliases", "PARAM_ALIASES", `JSON object of query param alias -> param name for existing clients, e.g. {"link": "url", "h": "headers"}`, func(c *Config, v string) error {
+		c.ParamAliases = nil
+		if v == "" {
+			return nil
+		}
+		if err := json.Unmarshal([]byte(v), &c.ParamAliases); err != nil {
+			return fmt.Errorf("invalid JSON object %q", v)
+		}
+		return nil
+	}},
+	{"allowed-client-cidrs", "ALLOWED_CLIENT_CIDRS", "comma-separated client networks allowed to use the proxy (empty allows all)", func(c *Config, v string) error {
+		c.AllowedClientCIDRs = splitList(v)
+		return nil
+	}},
+	{"blocked-client-cidrs", "BLOCKED_CLIENT_CIDRS", "comma-separated client networks that are always refused", func(c *Config, v string) error {
+		c.BlockedClientCIDRs = splitList(v)
+		return nil
+	}},
+	{"blocked-referers", "BLOCKED_REFERERS", "comma-separated hostname patterns of pages whose requests (by Referer, or Origin) are refused, against hotlinking", func(c *Config, v string) error {
+		c.BlockedReferers = splitList(v)
+		return nil
+	}},
+	{"blocked-user-agents", "BLOCKED_USER_AGENTS", "comma-separated User-Agent patterns (* wildcards, case-insensitive) whose requests are refused", func(c *Config, v string) error {
+		c.BlockedUserAgents = splitList(v)
+		return nil
+	}},
+	{"trusted-proxy-cidrs", "TRUSTED_PROXY_CIDRS", "comma-separated reverse proxies whose X-Forwarded-For is honored", func(c *Config, v string) error {
+		c.TrustedProxyCIDRs = splitList(v)
+		return nil
+	}},
+	{"ghost-proxy-url", "GHOST_PROXY_URL", "default upstream proxy for /ghost-proxy", func(c *Config, v string) error {
+		c.GhostProxyURL = v
+		return nil
+	}},
+	{"max-redirects", "MAX_REDIRECTS", "maximum upstream redirects to follow", func(c *Config, v string) error {
+		return parseInt(&c.MaxRedirects, v)
+	}},
+	{"max-playlist-depth", "MAX_PLAYLIST_DEPTH", "how many playlists deep rewritten playlist URLs may nest before they are refused (0 disables)", func(c *Config, v string) error {
+		return parseInt(&c.MaxPlaylistDepth, v)
+	}},
+	{"playlist-depth-secret", "PLAYLIST_DEPTH_SECRET", "key signing the depth param of rewritten URLs; the depth limit is off without one, and instances behind a load balancer share it", func(c *Config, v string) error {
+		c.PlaylistDepthSecret = v
+		return nil
+	}},
+	{"redirect-match-domain", "REDIRECT_MATCH_DOMAIN", "apply the new host's header profile on cross-host redirects", func(c *Config, v string) error {
+		return parseBool(&c.RedirectMatchDomain, v)
+	}},
+	{"scheme-memory-ttl", "SCHEME_MEMORY_TTL", "how long a host's http->https redirect is remembered so later requests go to https directly (0 disables)", func(c *Config, v string) error {
+		return parseDuration(&c.SchemeMemoryTTL, v)
+	}},
+	{"segment-variant-failover", "SEGMENT_VARIANT_FAILOVER", "retry live segment 404s on sibling variants", func(c *Config, v string) error {
+		return parseBool(&c.SegmentVariantFailover, v)
+	}},
+	{"verify-segments", "VERIFY_SEGMENTS", "check proxied segments against Content-Length, MD5 ETags and TS sync bytes, counting failures per stream", func(c *Config, v string) error {
+		return parseBool(&c.VerifySegments, v)
+	}},
+	{"segment-timing", "SEGMENT_TIMING", "track time to first byte, transfer time and size of proxied segments per stream, logging a stall risk when they consistently take longer than their duration", func(c *Config, v string) error {
+		return parseBool(&c.SegmentTiming, v)
+	}},
+	{"mp4-parallel-connections", "MP4_PARALLEL_CONNECTIONS", "upstream connections per /mp4-proxy transfer (below 2 disables)", func(c *Config, v string) error {
+		return parseInt(&c.MP4ParallelConnections, v)
+	}},
+	{"mp4-parallel-chunk-size", "MP4_PARALLEL_CHUNK_SIZE", "bytes fetched per parallel /mp4-proxy request", func(c *Config, v string) error {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid size %q", v)
+		}
+		c.MP4ParallelChunkSize = n
+		return nil
+	}},
+	{"mp4-max-transfers", "MP4_MAX_TRANSFERS", "simultaneous /mp4-proxy transfers allowed (0 is unlimited)", func(c *Config, v string) error {
+		return parseInt(&c.MP4MaxTransfers, v)
+	}},
+	{"mp4-queue-wait", "MP4_QUEUE_WAIT", "how long an /mp4-proxy request waits for a transfer slot before answering 503 (0 rejects at once)", func(c *Config, v string) error {
+		return parseDuration(&c.MP4QueueWait, v)
+	}},
+	{"mp4-cache-dir", "MP4_CACHE_DIR", "directory caching /mp4-proxy files in chunks, so repeated range requests are served from disk (empty disables)", func(c *Config, v string) error {
+		c.MP4CacheDir = v
+		return nil
+	}},
+	{"mp4-cache-max-bytes", "MP4_CACHE_MAX_BYTES", "size of the MP4 disk cache before the least recently used files are removed", func(c *Config, v string) error {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid size %q", v)
+		}
+		c.MP4CacheMaxBytes = n
+		return nil
+	}},
+	{"mp4-cache-chunk-size", "MP4_CACHE_CHUNK_SIZE", "bytes per chunk file of the MP4 disk cache", func(c *Config, v string) error {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid size %q", v)
+		}
+		c.MP4CacheChunkSize = n
+		return nil
+	}},
+	{"stream-flush-bytes", "STREAM_FLUSH_BYTES", "flush streamed segments and files to the client every this many bytes (0 leaves it to the server's buffering)", func(c *Config, v string) error {
+		return parseInt(&c.StreamFlushBytes, v)
+	}},
+	{"shortener-backend", "SHORTENER_BACKEND", "short URL, header session and watermark storage: memory, redis, sqlite, bolt or s3 (all but memory survive restarts)", func(c *Config, v string) error {
+		c.ShortenerBackend = v
+		return nil
+	}},
+	{"redis-url", "REDIS_URL", "redis://[:password@]host:port[/db] for the redis backend", func(c *Config, v string) error {
+		c.RedisURL = v
+		return nil
+	}},
+	{"store-db", "STORE_DB", "SQLite database file for the sqlite backend", func(c *Config, v string) error {
+		c.StoreDB = v
+		return nil
+	}},
+	{"bolt-db", "BOLT_DB", "BoltDB file for the bolt backend", func(c *Config, v string) error {
+		c.BoltDB = v
+		return nil
+	}},
+	{"s3-bucket", "S3_BUCKET", "bucket for the s3 backend", func(c *Config, v string) error {
+		c.S3Bucket = v
+		return nil
+	}},
+	{"s3-region", "S3_REGION", "region of S3_BUCKET", func(c *Config, v string) error {
+		c.S3Region = v
+		return nil
+	}},
+	{"s3-endpoint", "S3_ENDPOINT", "S3-compatible endpoint, e.g. for MinIO or R2 (default AWS for S3_REGION); buckets are addressed path-style", func(c *Config, v string) error {
+		c.S3Endpoint = v
+		return nil
+	}},
+	{"s3-access-key", "S3_ACCESS_KEY", "access key of the s3 backend", func(c *Config, v string) error {
+		c.S3AccessKey = v
+		return nil
+	}},
+	{"s3-secret-key", "S3_SECRET_KEY", "secret key of the s3 backend", func(c *Config, v string) error {
+		c.S3SecretKey = v
+		return nil
+	}},
+	{"s3-prefix", "S3_PREFIX", "object name prefix of the s3 backend, e.g. m3u8-proxy/", func(c *Config, v string) error {
+		c.S3Prefix = v
+		return nil
+	}},
+	{"cache-backend", "CACHE_BACKEND", "also keep domain-cached segments (cache_ttl) in memory, redis, sqlite, bolt or s3, so they outlive restarts or are shared (empty keeps them in process memory only)", func(c *Config, v string) error {
+		c.CacheBackend = v
+		return nil
+	}},
+	{"short-url-ttl", "SHORT_URL_TTL", "lifetime of short URLs, e.g. 24h (0 keeps them forever)", func(c *Config, v string) error {
+		return parseDuration(&c.ShortURLTTL, v)
+	}},
+	{"header-session-ttl", "HEADER_SESSION_TTL", "lifetime of a header session after its last update (0 keeps them forever)", func(c *Config, v string) error {
+		return parseDuration(&c.HeaderSessionTTL, v)
+	}},
+	{"session-refresh-webhook", "SESSION_REFRESH_WEBHOOK", "URL POSTed {session, url, status} when a header session's upstream requests get 401/403; it answers {headers, url} and the request is retried", func(c *Config, v string) error {
+		c.SessionRefreshWebhook = v
+		return nil
+	}},
+	{"session-refresh-interval", "SESSION_REFRESH_INTERVAL", "least time between refresh webhook calls for one header session", func(c *Config, v string) error {
+		return parseDuration(&c.SessionRefreshInterval, v)
+	}},
+	{"short-url-binding", "SHORT_URL_BINDING", "bind each short URL to its first client: ip, or session (X-Session-ID header or session_id cookie); empty disables", func(c *Config, v string) error {
+		c.ShortURLBinding = v
+		return nil
+	}},
+	{"short-url-binding-secret", "SHORT_URL_BINDING_SECRET", "key signing the bind param that keeps the URLs of a bound short URL's playlist bound; instances behind a load balancer share it", func(c *Config, v string) error {
+		c.ShortURLBindingSecret = v
+		return nil
+	}},
+	{"read-header-timeout", "READ_HEADER_TIMEOUT", "time allowed to read request headers (0 disables)", func(c *Config, v string) error {
+		return parseDuration(&c.ReadHeaderTimeout, v)
+	}},
+	{"read-timeout", "READ_TIMEOUT", "time allowed to read a whole request (0 disables)", func(c *Config, v string) error {
+		return parseDuration(&c.ReadTimeout, v)
+	}},
+	{"write-timeout", "WRITE_TIMEOUT", "time allowed to write a response (0 disables)", func(c *Config, v string) error {
+		return parseDuration(&c.WriteTimeout, v)
+	}},
+	{"idle-timeout", "IDLE_TIMEOUT", "keep-alive idle time before closing a connection", func(c *Config, v string) error {
+		return parseDuration(&c.IdleTimeout, v)
+	}},
+	{"max-header-bytes", "MAX_HEADER_BYTES", "maximum size of request headers", func(c *Config, v string) error {
+		return parseInt(&c.MaxHeaderBytes, v)
+	}},
+	{"max-body-bytes", "MAX_BODY_BYTES", "maximum size of a request body", func(c *Config, v string) error {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid size %q", v)
+		}
+		c.MaxBodyBytes = n
+		return nil
+	}},
+	{"push-enabled", "PUSH_ENABLED", "serve the experimental /push endpoint, polling each live playlist once for all its clients and streaming updates as server-sent events", func(c *Config, v string) error {
+		return parseBool(&c.PushEnabled, v)
+	}},
+	{"test-stream-enabled", "TEST_STREAM_ENABLED", "serve a synthetic live stream at /test-stream.m3u8 for testing players against the proxy", func(c *Config, v string) error {
+		return parseBool(&c.TestStreamEnabled, v)
+	}},
+	{"unwrap-proxies", "UNWRAP_PROXIES", "rewrite playlist URLs pointing at other public proxies (/proxy?url=..., cors-anywhere style) to the origin behind them", func(c *Config, v string) error {
+		return parseBool(&c.UnwrapProxies, v)
+	}},
+	{"fetch-enabled", "FETCH_ENABLED", "serve the /fetch endpoint; disable it where arbitrary proxying isn't wanted", func(c *Config, v string) error {
+		return parseBool(&c.FetchEnabled, v)
+	}},
+	{"fetch-max-bytes", "FETCH_MAX_BYTES", "maximum size of a /fetch response body after decompression (0 is unlimited)", func(c *Config, v string) error {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid size %q", v)
+		}
+		c.FetchMaxBytes = n
+		return nil
+	}},
+	{"fetch-content-types", "FETCH_CONTENT_TYPES", "comma-separated media type patterns /fetch passes on, e.g. video/*,image/* (empty allows any)", func(c *Config, v string) error {
+		c.FetchContentTypes = splitList(v)
+		return nil
+	}},
+	{"max-egress-mbps", "MAX_EGRESS_MBPS", "cap on the total bandwidth of all responses, in megabits per second (0 is unlimited)", func(c *Config, v string) error {
+		return parseFloat(&c.MaxEgressMbps, v)
+	}},
+	{"circuit-breaker-failures", "CIRCUIT_BREAKER_FAILURES", "upstream failures within the window that open a host's circuit (0 disables)", func(c *Config, v string) error {
+		return parseInt(&c.CircuitBreakerFailures, v)
+	}},
+	{"circuit-breaker-window", "CIRCUIT_BREAKER_WINDOW", "window in which circuit breaker failures are counted", func(c *Config, v string) error {
+		return parseDuration(&c.CircuitBreakerWindow, v)
+	}},
+	{"circuit-breaker-cooldown", "CIRCUIT_BREAKER_COOLDOWN", "how long an open circuit rejects requests before probing", func(c *Config, v string) error {
+		return parseDuration(&c.CircuitBreakerCooldown, v)
+	}},
+	{"quarantine-error-rate", "QUARANTINE_ERROR_RATE", "failure ratio (0-1) within the window that quarantines an upstream domain (0 disables)", func(c *Config, v string) error {
+		if err := parseFloat(&c.QuarantineErrorRate, v); err != nil {
+			return err
+		}
+		if c.QuarantineErrorRate > 1 {
+			return fmt.Errorf("error rate %q is above 1", v)
+		}
+		return nil
+	}},
+	{"quarantine-min-requests", "QUARANTINE_MIN_REQUESTS", "requests within the window before a domain's error rate is judged", func(c *Config, v string) error {
+		return parseInt(&c.QuarantineMinRequests, v)
+	}},
+	{"quarantine-window", "QUARANTINE_WINDOW", "rolling window of upstream domain health scores", func(c *Config, v string) error {
+		return parseDuration(&c.QuarantineWindow, v)
+	}},
+	{"quarantine-cooldown", "QUARANTINE_COOLDOWN", "how long a domain stays quarantined", func(c *Config, v string) error {
+		return parseDuration(&c.QuarantineCooldown, v)
+	}},
+	{"upstream-max-concurrency", "UPSTREAM_MAX_CONCURRENCY", "in-flight requests allowed per upstream host before queueing (0 disables)", func(c *Config, v string) error {
+		return parseInt(&c.UpstreamMaxConcurrency, v)
+	}},
+	{"upstream-queue-size", "UPSTREAM_QUEUE_SIZE", "requests that may wait per upstream host before answering 503", func(c *Config, v string) error {
+		return parseInt(&c.UpstreamQueueSize, v)
+	}},
+	{"upstream-queue-wait", "UPSTREAM_QUEUE_WAIT", "longest a queued request waits for an upstream slot", func(c *Config, v string) error {
+		return parseDuration(&c.UpstreamQueueWait, v)
+	}},
+	{"rate-limit-max-wait", "RATE_LIMIT_MAX_WAIT", "total time a segment request waits out upstream 429 Retry-After before passing the 429 on (0 disables)", func(c *Config, v string) error {
+		return parseDuration(&c.RateLimitMaxWait, v)
+	}},
+	{"usage-db", "USAGE_DB", "SQLite file for per-day, per-API-key usage accounting (empty disables)", func(c *Config, v string) error {
+		c.UsageDB = v
+		return nil
+	}},
+	{"ffprobe-path", "FFPROBE_PATH", "ffprobe binary used by /probe", func(c *Config, v string) error {
+		c.FFprobePath = v
+		return nil
+	}},
+	{"ffmpeg-path", "FFMPEG_PATH", "ffmpeg binary that renders /test-stream segments", func(c *Config, v string) error {
+		c.FFmpegPath = v
+		return nil
+	}},
+	{"probe-timeout", "PROBE_TIMEOUT", "longest a /probe run may take", func(c *Config, v string) error {
+		return parseDuration(&c.ProbeTimeout, v)
+	}},
+	{"probe-cache-ttl", "PROBE_CACHE_TTL", "how long /probe results are cached (0 disables)", func(c *Config, v string) error {
+		return parseDuration(&c.ProbeCacheTTL, v)
+	}},
+	{"epg-cache-ttl", "EPG_CACHE_TTL", "how long /epg guides are cached (0 disables)", func(c *Config, v string) error {
+		return parseDuration(&c.EPGCacheTTL, v)
+	}},
+	{"local-media-dir", "LOCAL_MEDIA_DIR", "directory of playlists and segments served under /local/ (empty disables)", func(c *Config, v string) error {
+		c.LocalMediaDir = v
+		return nil
+	}},
+	{"script-file", "SCRIPT_FILE", "Lua script with on_request/on_playlist hooks", func(c *Config, v string) error {
+		c.ScriptFile = v
+		return nil
+	}},
+	{"license-headers", "LICENSE_HEADERS", "JSON object of URL pattern -> headers sent to DRM license servers", func(c *Config, v string) error {
+		c.LicenseHeaders = parseHeadersParam(v)
+		if v != "" && len(c.LicenseHeaders) == 0 {
+			return fmt.Errorf("invalid JSON object %q", v)
+		}
+		return nil
+	}},
+	{"path-proxy-headers", "PATH_PROXY_HEADERS", "JSON object of URL pattern -> headers sent on path-style /{domain}/{path} requests", func(c *Config, v string) error {
+		c.PathProxyHeaders = parseHeadersParam(v)
+		if v != "" && len(c.PathProxyHeaders) == 0 {
+			return fmt.Errorf("invalid JSON object %q", v)
+		}
+		return nil
+	}},
+	{"tls-fingerprints", "TLS_FINGERPRINTS", `JSON object of hostname pattern -> browser TLS fingerprint (chrome, firefox, safari, edge, ios)`, func(c *Config, v string) error {
+		c.TLSFingerprints = nil
+		if v == "" {
+			return nil
+		}
+		if err := json.Unmarshal([]byte(v), &c.TLSFingerprints); err != nil {
+			return fmt.Errorf("invalid JSON object %q", v)
+		}
+		return nil
+	}},
+	{"upstream-auth", "UPSTREAM_AUTH", `JSON object of hostname pattern -> {"type": "basic"|"bearer"|"sigv4"|"hmac", ...} credentials or signatures added to upstream requests`, func(c *Config, v string) error {
+		c.UpstreamAuth = nil
+		if v == "" {
+			return nil
+		}
+		if err := json.Unmarshal([]byte(v), &c.UpstreamAuth); err != nil {
+			return fmt.Errorf("invalid JSON object %q", v)
+		}
+		return nil
+	}},
+	{"upstream-protocols", "UPSTREAM_PROTOCOLS", "JSON object of hostname pattern -> upstream HTTP version (h1, h2, or experimental h3)", func(c *Config, v string) error {
+		c.UpstreamProtocols = nil
+		if v == "" {
+			return nil
+		}
+		if err := json.Unmarshal([]byte(v), &c.UpstreamProtocols); err != nil {
+			return fmt.Errorf("invalid JSON object %q", v)
+		}
+		return nil
+	}},
+	{"upstream-first-byte-timeout", "UPSTREAM_FIRST_BYTE_TIMEOUT", "longest wait for upstream response headers, per attempt (0 disables)", func(c *Config, v string) error {
+		return parseDuration(&c.UpstreamFirstByteTimeout, v)
+	}},
+	{"upstream-idle-timeout", "UPSTREAM_IDLE_TIMEOUT", "longest wait for more of an upstream body; transfers may take any time while data keeps coming (0 disables)", func(c *Config, v string) error {
+		return parseDuration(&c.UpstreamIdleTimeout, v)
+	}},
+	{"domain-policies", "DOMAIN_POLICIES", `JSON object of hostname pattern -> {"timeout": "3s", "idle_timeout": "10s", "retries": 2, "backoff": "500ms", "mode": "proxy"|"redirect", "cache_ttl": "1h", "cache_control": "respect"|"ignore"} overriding how upstream requests are timed, retried and cached, or redirecting segment requests to the origin`, func(c *Config, v string) error {
+		c.DomainPolicies = nil
+		if v == "" {
+			return nil
+		}
+		if err := json.Unmarshal([]byte(v), &c.DomainPolicies); err != nil {
+			return fmt.Errorf("invalid JSON object %q", v)
+		}
+		return nil
+	}},
+	{"preserve-header-case", "PRESERVE_HEADER_CASE", "comma-separated hostname patterns sent the headers param with its exact name casing (HTTP/1.1 only)", func(c *Config, v string) error {
+		c.PreserveHeaderCase = splitList(v)
+		return nil
+	}},
+	{"minimal-header-domains", "MINIMAL_HEADER_DOMAINS", "comma-separated hostname patterns sent only User-Agent, Accept and Accept-Language by default (like hdr_mode=minimal)", func(c *Config, v string) error {
+		c.MinimalHeaderDomains = splitList(v)
+		return nil
+	}},
+	{"outbound-addrs", "OUTBOUND_ADDRS", "comma-separated local IPs upstream connections are bound to (IPv4 and IPv6 destinations use their own family)", func(c *Config, v string) error {
+		c.OutboundAddrs = splitList(v)
+		return nil
+	}},
+	{"outbound-addr-mode", "OUTBOUND_ADDR_MODE", "how several OUTBOUND_ADDRS are used: rotate (next one per new connection to a host) or sticky (one per host)", func(c *Config, v string) error {
+		c.OutboundAddrMode = v
+		return nil
+	}},
+	{"sample-aes-mode", "SAMPLE_AES_MODE", "what /proxy does with SAMPLE-AES playlists hls.js can't play: pass (native players handle them) or reject (friendly 422 error for hls.js frontends; per request: sample_aes=)", func(c *Config, v string) error {
+		c.SampleAESMode = v
+		return nil
+	}},
+	{"inject-variants", "INJECT_VARIANTS", `JSON object of hostname pattern -> [{"uri": ..., "bandwidth": 64000, "resolution": "640x360", "codecs": "mp4a.40.2"}] variants added to master playlists from those hosts`, func(c *Config, v string) error {
+		c.InjectVariants = nil
+		if v == "" {
+			return nil
+		}
+		if err := json.Unmarshal([]byte(v), &c.InjectVariants); err != nil {
+			return fmt.Errorf("invalid JSON object %q", v)
+		}
+		return nil
+	}},
+	{"key-cache-ttl", "KEY_CACHE_TTL", "how long AES keys of live streams are cached; rotation invalidates early (0 disables)", func(c *Config, v string) error {
+		return parseDuration(&c.KeyCacheTTL, v)
+	}},
+	{"prewarm-ttl", "PREWARM_TTL", "how long /prewarm keeps fetched playlists and segments; live playlists expire after one target duration (0 disables)", func(c *Config, v string) error {
+		return parseDuration(&c.PrewarmTTL, v)
+	}},
+	{"admin-token", "ADMIN_TOKEN", "token required by admin and debug endpoints (empty disables them)", func(c *Config, v string) error {
+		c.AdminToken = v
+		return nil
+	}},
+	{"jwt-algorithm", "JWT_ALGORITHM", "require a playback JWT in ?token= signed with HS256 or RS256 on proxying endpoints (empty disables)", func(c *Config, v string) error {
+		c.JWTAlgorithm = v
+		return nil
+	}},
+	{"jwt-secret", "JWT_SECRET", "shared secret verifying HS256 playback tokens", func(c *Config, v string) error {
+		c.JWTSecret = v
+		return nil
+	}},
+	{"watermark-secret", "WATERMARK_SECRET", "key of the per-user watermarks (api_key or token sub) added to rewritten playlists; empty disables", func(c *Config, v string) error {
+		c.WatermarkSecret = v
+		return nil
+	}},
+	{"jwt-public-key-file", "JWT_PUBLIC_KEY_FILE", "PEM RSA public key or certificate verifying RS256 playback tokens", func(c *Config, v string) error {
+		c.JWTPublicKeyFile = v
+		return nil
+	}},
+}
+
+// runMode is what Main does once the configuration is loaded
+type runMode int
+
+const (
+	runServer runMode = iota
+	runPrintConfig
+	runSelfTest
+)
+
+// loadConfig builds the configuration from args, the environment and an
+// optional YAML file. mode reports whether -print-config or -selftest was given.
+func loadConfig(args []string) (cfg Config, mode runMode, err error) {
+	fs := flag.NewFlagSet("proxy-server", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML config file")
+	printConfig := fs.Bool("print-config", false, "print the effective configuration and exit")
+	selfTest := fs.Bool("selftest", false, "proxy a built-in sample stream through a local server and exit 0 on success, 1 on failure")
+	flagValues := make(map[string]*string)
+	for _, f := range configFields {
+		flagValues[f.flag] = fs.String(f.flag, "", f.usage+" (env "+f.env+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, runServer, err
+	}
+
+	cfg = DefaultConfig()
+
+	if *configFile != "" {
+		data, err := os.ReadFile(*configFile)
+		if err != nil {
+			return cfg, runServer, fmt.Errorf("reading config file: %w", err)
+		}
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return cfg, runServer, fmt.Errorf("parsing config file: %w", err)
+		}
+	}
+
+	for _, f := range configFields {
+		if value := os.Getenv(f.env); value != "" {
+			if err := f.set(&cfg, value); err != nil {
+				return cfg, runServer, fmt.Errorf("%s: %w", f.env, err)
+			}
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(fl *flag.Flag) {
+		for _, f := range configFields {
+			if f.flag == fl.Name && flagErr == nil {
+				if err := f.set(&cfg, *flagValues[f.flag]); err != nil {
+					flagErr = fmt.Errorf("-%s: %w", f.flag, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return cfg, runServer, flagErr
+	}
+
+	if err := cfg.validate(); err != nil {
+		return cfg, runServer, err
+	}
+
+	switch {
+	case *printConfig:
+		mode = runPrintConfig
+	case *selfTest:
+		mode = runSelfTest
+	}
+	return cfg, mode, nil
+}
+
+// validate checks the settings that are parsed again when applied
+func (cfg *Config) validate() error {
+	for _, cidrs := range [][]string{cfg.AllowedClientCIDRs, cfg.BlockedClientCIDRs, cfg.TrustedProxyCIDRs} {
+		if _, err := parseCIDRs(cidrs); err != nil {
+			return err
+		}
+	}
+	if err := validateResponseHeaders(cfg.ResponseHeaders); err != nil {
+		return err
+	}
+	if err := validateParamAliases(cfg.ParamAliases); err != nil {
+		return err
+	}
+	if err := validateJWTConfig(cfg.JWTAlgorithm, cfg.JWTSecret, cfg.JWTPublicKeyFile); err != nil {
+		return err
+	}
+	if err := validateTLSFingerprints(cfg.TLSFingerprints); err != nil {
+		return err
+	}
+	if err := validateUpstreamProtocols(cfg.UpstreamProtocols); err != nil {
+		return err
+	}
+	if err := validateUpstreamAuths(cfg.UpstreamAuth); err != nil {
+		return err
+	}
+	if err := validateDomainPolicies(cfg.DomainPolicies); err != nil {
+		return err
+	}
+	if err := validateShortURLBinding(cfg.ShortURLBinding, cfg.ShortURLBindingSecret); err != nil {
+		return err
+	}
+	if _, err := parseFileMode(cfg.ListenSocketMode); err != nil {
+		return err
+	}
+	if err := validatePublicURLMode(cfg.PublicURLMode); err != nil {
+		return err
+	}
+	if _, err := parseOutboundAddrs(cfg.OutboundAddrs); err != nil {
+		return err
+	}
+	if err := validateOutboundAddrMode(cfg.OutboundAddrMode); err != nil {
+		return err
+	}
+	if err := validateSampleAESMode(cfg.SampleAESMode); err != nil {
+		return err
+	}
+	for pattern, variants := range cfg.InjectVariants {
+		if err := validateInjectedVariants(variants); err != nil {
+			return fmt.Errorf("inject_variants for %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Set applies one setting by its environment variable name, e.g.
+// cfg.Set("UPSTREAM_AUTH", `{"origin.example": {...}}`), parsing the value as
+// the environment would
+func (cfg *Config) Set(env, value string) error {
+	for _, f := range configFields {
+		if f.env == env {
+			if err := f.set(cfg, value); err != nil {
+				return fmt.Errorf("%s: %w", env, err)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown setting %s", env)
+}
+
+// splitList splits a comma-separated list, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func parseBool(dst *bool, value string) error {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("invalid boolean %q", value)
+	}
+	*dst = b
+	return nil
+}
+
+// parseInt parses a non-negative integer setting
+func parseInt(dst *int, value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid number %q", value)
+	}
+	*dst = n
+	return nil
+}
+
+// parseFloat parses a non-negative number setting
+func parseFloat(dst *float64, value string) error {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 || math.IsInf(f, 0) {
+		return fmt.Errorf("invalid number %q", value)
+	}
+	*dst = f
+	return nil
+}
+
+// parseDuration parses a duration setting such as "30s" or "24h"
+func parseDuration(dst *time.Duration, value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return fmt.Errorf("invalid duration %q", value)
+	}
+	*dst = d
+	return nil
+}
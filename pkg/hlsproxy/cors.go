@@ -0,0 +1,149 @@
+package hlsproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsPolicy is the CORS behaviour of one group of endpoints. Unset fields
+// inherit from less specific policies and finally from the defaults.
+type corsPolicy struct {
+	AllowedOrigins   []string      `yaml:"allowed_origins,omitempty" json:"allowed_origins,omitempty"` // "*" allows any
+	AllowMethods     []string      `yaml:"allow_methods,omitempty" json:"allow_methods,omitempty"`
+	AllowHeaders     []string      `yaml:"allow_headers,omitempty" json:"allow_headers,omitempty"`
+	ExposeHeaders    []string      `yaml:"expose_headers,omitempty" json:"expose_headers,omitempty"`
+	MaxAge           time.Duration `yaml:"max_age,omitempty" json:"-"` // preflight cache lifetime
+	AllowCredentials *bool         `yaml:"allow_credentials,omitempty" json:"allow_credentials,omitempty"`
+}
+
+// UnmarshalJSON accepts max_age as a duration string
+func (p *corsPolicy) UnmarshalJSON(data []byte) error {
+	type plain corsPolicy
+	var raw struct {
+		plain
+		MaxAge string `json:"max_age"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*p = corsPolicy(raw.plain)
+	if raw.MaxAge != "" {
+		return parseDuration(&p.MaxAge, raw.MaxAge)
+	}
+	return nil
+}
+
+// corsPolicies maps endpoint path patterns (* wildcards, e.g. "/admin/*")
+// to policy overrides; "*" applies to every endpoint
+var corsPolicies map[string]corsPolicy
+
+// defaultCORSPolicy is what endpoints get without overrides
+func defaultCORSPolicy() corsPolicy {
+	allowCredentials := true
+	return corsPolicy{
+		AllowedOrigins:   allowedOrigins,
+		AllowMethods:     []string{"GET", "POST", "OPTIONS"},
+		AllowHeaders:     []string{"Content-Type", "Authorization", "Range", "Icy-MetaData", "X-API-Key", "X-Session-ID"},
+		AllowCredentials: &allowCredentials,
+	}
+}
+
+// corsPolicyFor merges the policies matching path, least specific first
+func corsPolicyFor(path string) corsPolicy {
+	policy := defaultCORSPolicy()
+	if len(corsPolicies) == 0 {
+		return policy
+	}
+
+	var patterns []string
+	for pattern := range corsPolicies {
+		if wildcardMatch(pattern, path) {
+			patterns = append(patterns, pattern)
+		}
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) < len(patterns[j])
+		}
+		return patterns[i] < patterns[j]
+	})
+	for _, pattern := range patterns {
+		override := corsPolicies[pattern]
+		if override.AllowedOrigins != nil {
+			policy.AllowedOrigins = override.AllowedOrigins
+		}
+		if override.AllowMethods != nil {
+			policy.AllowMethods = override.AllowMethods
+		}
+		if override.AllowHeaders != nil {
+			policy.AllowHeaders = override.AllowHeaders
+		}
+		if override.ExposeHeaders != nil {
+			policy.ExposeHeaders = override.ExposeHeaders
+		}
+		if override.MaxAge > 0 {
+			policy.MaxAge = override.MaxAge
+		}
+		if override.AllowCredentials != nil {
+			policy.AllowCredentials = override.AllowCredentials
+		}
+	}
+	return policy
+}
+
+func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		policy := corsPolicyFor(r.URL.Path)
+		origin := r.Header.Get("Origin")
+
+		// If no allowed origins are specified, allow all (*)
+		if len(policy.AllowedOrigins) == 0 || contains(policy.AllowedOrigins, "*") {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else if origin != "" && contains(policy.AllowedOrigins, origin) {
+			// If allowed origins are specified, check if the request origin is in the list
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+		}
+
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(policy.AllowMethods, ", "))
+		// Headers the request asks to forward upstream must pass preflight too
+		allowHeaders := policy.AllowHeaders
+		for _, name := range splitList(r.URL.Query().Get("fwd_headers")) {
+			if !slices.ContainsFunc(allowHeaders, func(h string) bool { return strings.EqualFold(h, name) }) {
+				allowHeaders = append(slices.Clip(allowHeaders), name)
+			}
+		}
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(allowHeaders, ", "))
+		if len(policy.ExposeHeaders) > 0 {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(policy.ExposeHeaders, ", "))
+		}
+		if policy.AllowCredentials != nil && *policy.AllowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		// Handle preflight requests
+		if r.Method == "OPTIONS" {
+			if policy.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(policy.MaxAge/time.Second)))
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func contains(slice []string, item string) bool {
+	for _, s := range slice {
+		if s == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,353 @@
+package hlsproxy
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dashTimescale is the SegmentTimeline timescale (milliseconds)
+const dashTimescale = 1000
+
+type mpdDocument struct {
+	XMLName                   xml.Name    `xml:"MPD"`
+	Xmlns                     string      `xml:"xmlns,attr"`
+	Profiles                  string      `xml:"profiles,attr"`
+	Type                      string      `xml:"type,attr"`
+	MediaPresentationDuration string      `xml:"mediaPresentationDuration,attr,omitempty"`
+	AvailabilityStartTime     string      `xml:"availabilityStartTime,attr,omitempty"`
+	PublishTime               string      `xml:"publishTime,attr,omitempty"`
+	MinimumUpdatePeriod       string      `xml:"minimumUpdatePeriod,attr,omitempty"`
+	TimeShiftBufferDepth      string      `xml:"timeShiftBufferDepth,attr,omitempty"`
+	MinBufferTime             string      `xml:"minBufferTime,attr"`
+	Periods                   []mpdPeriod `xml:"Period"`
+}
+
+type mpdPeriod struct {
+	ID             string             `xml:"id,attr"`
+	Start          string             `xml:"start,attr"`
+	AdaptationSets []mpdAdaptationSet `xml:"AdaptationSet"`
+}
+
+type mpdAdaptationSet struct {
+	ContentType      string              `xml:"contentType,attr"`
+	MimeType         string              `xml:"mimeType,attr"`
+	Lang             string              `xml:"lang,attr,omitempty"`
+	SegmentAlignment bool                `xml:"segmentAlignment,attr"`
+	Representations  []mpdRepresentation `xml:"Representation"`
+}
+
+type mpdRepresentation struct {
+	ID          string         `xml:"id,attr"`
+	Bandwidth   int            `xml:"bandwidth,attr"`
+	Codecs      string         `xml:"codecs,attr,omitempty"`
+	Width       int            `xml:"width,attr,omitempty"`
+	Height      int            `xml:"height,attr,omitempty"`
+	FrameRate   string         `xml:"frameRate,attr,omitempty"`
+	SegmentList mpdSegmentList `xml:"SegmentList"`
+}
+
+type mpdSegmentList struct {
+	Timescale              int             `xml:"timescale,attr"`
+	PresentationTimeOffset int64           `xml:"presentationTimeOffset,attr,omitempty"`
+	StartNumber            int64           `xml:"startNumber,attr"`
+	Initialization         *mpdURLType     `xml:"Initialization,omitempty"`
+	Timeline               mpdTimeline     `xml:"SegmentTimeline"`
+	SegmentURLs            []mpdSegmentURL `xml:"SegmentURL"`
+}
+
+type mpdURLType struct {
+	SourceURL string `xml:"sourceURL,attr"`
+	Range     string `xml:"range,attr,omitempty"`
+}
+
+type mpdTimeline struct {
+	S []mpdS `xml:"S"`
+}
+
+type mpdS struct {
+	T *int64 `xml:"t,attr,omitempty"`
+	D int64  `xml:"d,attr"`
+}
+
+type mpdSegmentURL struct {
+	Media      string `xml:"media,attr"`
+	MediaRange string `xml:"mediaRange,attr,omitempty"`
+}
+
+// isVideoCodec reports whether an RFC 6381 codec string is a video codec
+func isVideoCodec(codec string) bool {
+	for _, prefix := range []string{"avc", "hvc", "hev", "av01", "vp08", "vp09", "dvh", "dva"} {
+		if strings.HasPrefix(codec, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitCodecs separates a CODECS attribute into its video and audio parts
+func splitCodecs(codecs string) (video, audio string) {
+	var v, a []string
+	for _, c := range strings.Split(codecs, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if isVideoCodec(c) {
+			v = append(v, c)
+		} else {
+			a = append(a, c)
+		}
+	}
+	return strings.Join(v, ","), strings.Join(a, ",")
+}
+
+// xsDuration formats seconds as an xs:duration
+func xsDuration(seconds float64) string {
+	return "PT" + strconv.FormatFloat(seconds, 'f', 3, 64) + "S"
+}
+
+// byteRangeSpec formats an inclusive DASH byte range, or "" for a whole resource
+func byteRangeSpec(start, length int64) string {
+	if length <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d-%d", start, start+length-1)
+}
+
+// dashSegmentList builds the SegmentList of one media playlist. Timelines
+// start at the first segment's program date time (relative to the epoch)
+// when present, otherwise at mediaSequence * targetDuration. Live timelines
+// keep those times, which stay put across refreshes, and the MPD's
+// availabilityStartTime maps them to now; VOD ones get a
+// presentationTimeOffset of the first time, so playback starts at the
+// period start.
+func dashSegmentList(playlist mediaPlaylist, proxied func(string) string) (mpdSegmentList, float64) {
+	list := mpdSegmentList{Timescale: dashTimescale, StartNumber: playlist.mediaSequence}
+
+	if playlist.mapURI != "" {
+		list.Initialization = &mpdURLType{
+			SourceURL: proxied(playlist.mapURI),
+			Range:     byteRangeSpec(playlist.mapRangeStart, playlist.mapRangeLength),
+		}
+	}
+
+	var start int64
+	if len(playlist.segments) > 0 && !playlist.segments[0].programDateTime.IsZero() {
+		start = playlist.segments[0].programDateTime.UnixMilli()
+	} else {
+		start = playlist.mediaSequence * int64(playlist.targetDuration) * dashTimescale
+	}
+	if playlist.endList {
+		list.PresentationTimeOffset = start
+	}
+	list.Timeline.S = []mpdS{}
+
+	total := 0.0
+	for i, segment := range playlist.segments {
+		s := mpdS{D: int64(math.Round(segment.duration * dashTimescale))}
+		if i == 0 {
+			t := start
+			s.T = &t
+		}
+		list.Timeline.S = append(list.Timeline.S, s)
+		list.SegmentURLs = append(list.SegmentURLs, mpdSegmentURL{
+			Media:      proxied(segment.uri),
+			MediaRange: byteRangeSpec(segment.rangeStart, segment.rangeLength),
+		})
+		total += segment.duration
+	}
+
+	return list, total
+}
+
+// dashConvertHandler translates an HLS master (or media) playlist with fMP4
+// segments into a DASH MPD whose segment URLs go through the proxy. Live
+// playlists produce a dynamic MPD that players refresh from this endpoint.
+// URL format: /convert/dash?url={m3u8_url}&headers={optional_headers}
+func dashConvertHandler(w http.ResponseWriter, r *http.Request) {
+	targetURL, parsedHeaders, err := validateRequest(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	requestHeaders := requestHeadersFor(r, targetURL, parsedHeaders)
+	rules := parseHeadersParam(r.URL.Query().Get("headers"))
+	encodedHeaders := url.QueryEscape(rules.encode(requestHeadersFor(r, targetURL, rules["*"])))
+	encodedHeaders += headerParams(r)
+	proxied := func(resolvedURL string) string {
+		return fmt.Sprintf("%s/ts-proxy?url=%s&headers=%s", rewriteBaseURL(r, segmentBaseURL(r, resolvedURL)), url.QueryEscape(resolvedURL), encodedHeaders)
+	}
+
+	content, err := fetchPlaylistText(r.Context(), targetURL, requestHeaders)
+	if err != nil {
+		sendUpstreamError(w, "Failed to fetch playlist", err)
+		return
+	}
+
+	master := parseMasterPlaylist(content, targetURL)
+	if len(master.variants) == 0 {
+		// A bare media playlist becomes a single representation
+		master.variants = []variantStream{{uri: targetURL, attrs: map[string]string{}}}
+	}
+
+	video := mpdAdaptationSet{ContentType: "video", MimeType: "video/mp4", SegmentAlignment: true}
+	var audioSets []mpdAdaptationSet
+	live, skippedTS := false, 0
+	duration, targetDuration := 0.0, 0
+
+	addPlaylist := func(playlistURL string) (mpdSegmentList, bool) {
+		text := content
+		if playlistURL != targetURL {
+			if text, err = fetchPlaylistText(r.Context(), playlistURL, requestHeaders); err != nil {
+				return mpdSegmentList{}, false
+			}
+		}
+		playlist := parseMediaPlaylist(text, playlistURL)
+		if playlist.mapURI == "" {
+			// MPEG-TS segments can't be referenced from a DASH manifest without repackaging
+			skippedTS++
+			return mpdSegmentList{}, false
+		}
+		list, total := dashSegmentList(playlist, proxied)
+		live = live || !playlist.endList
+		duration = math.Max(duration, total)
+		targetDuration = max(targetDuration, playlist.targetDuration)
+		return list, true
+	}
+
+	audioCodecs := make(map[string]string) // audio group -> codec
+	for i, variant := range master.variants {
+		videoCodecs, audio := splitCodecs(variant.attrs["CODECS"])
+		if group := variant.attrs["AUDIO"]; group != "" && audio != "" {
+			audioCodecs[group] = audio
+		}
+
+		list, ok := addPlaylist(variant.uri)
+		if !ok {
+			continue
+		}
+
+		bandwidth, _ := strconv.Atoi(variant.attrs["BANDWIDTH"])
+		rep := mpdRepresentation{
+			ID:          fmt.Sprintf("v%d", i),
+			Bandwidth:   bandwidth,
+			FrameRate:   variant.attrs["FRAME-RATE"],
+			SegmentList: list,
+		}
+		if width, height, found := strings.Cut(variant.attrs["RESOLUTION"], "x"); found {
+			rep.Width, _ = strconv.Atoi(width)
+			rep.Height, _ = strconv.Atoi(height)
+		}
+
+		if videoCodecs == "" && audio != "" {
+			// Audio-only variant
+			rep.Codecs = audio
+			audioSets = append(audioSets, mpdAdaptationSet{
+				ContentType: "audio", MimeType: "audio/mp4", SegmentAlignment: true,
+				Representations: []mpdRepresentation{rep},
+			})
+			continue
+		}
+
+		// Muxed audio stays in the video representation when there is no separate group
+		rep.Codecs = videoCodecs
+		if variant.attrs["AUDIO"] == "" && audio != "" {
+			rep.Codecs = strings.Trim(videoCodecs+","+audio, ",")
+		}
+		video.Representations = append(video.Representations, rep)
+	}
+
+	for i, rend := range master.renditions {
+		if rend.attrs["TYPE"] != "AUDIO" || rend.uri == "" {
+			continue
+		}
+		list, ok := addPlaylist(rend.uri)
+		if !ok {
+			continue
+		}
+		audioSets = append(audioSets, mpdAdaptationSet{
+			ContentType:      "audio",
+			MimeType:         "audio/mp4",
+			Lang:             rend.attrs["LANGUAGE"],
+			SegmentAlignment: true,
+			Representations: []mpdRepresentation{{
+				ID:          fmt.Sprintf("a%d", i),
+				Bandwidth:   128000,
+				Codecs:      audioCodecs[rend.attrs["GROUP-ID"]],
+				SegmentList: list,
+			}},
+		})
+	}
+
+	if len(video.Representations) == 0 && len(audioSets) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":   "No fMP4 renditions to convert",
+			"details": fmt.Sprintf("%d MPEG-TS playlists skipped; only fMP4 (EXT-X-MAP) sources can be referenced from DASH", skippedTS),
+		})
+		return
+	}
+
+	period := mpdPeriod{ID: "0", Start: "PT0S"}
+	if len(video.Representations) > 0 {
+		period.AdaptationSets = append(period.AdaptationSets, video)
+	}
+	period.AdaptationSets = append(period.AdaptationSets, audioSets...)
+
+	mpd := mpdDocument{
+		Xmlns:         "urn:mpeg:dash:schema:mpd:2011",
+		Profiles:      "urn:mpeg:dash:profile:isoff-live:2011",
+		Type:          "static",
+		MinBufferTime: xsDuration(float64(max(targetDuration, 2))),
+		Periods:       []mpdPeriod{period},
+	}
+	if live {
+		// Timelines are anchored so that the newest segment ends roughly now
+		now := time.Now().UTC()
+		mpd.Type = "dynamic"
+		mpd.PublishTime = now.Format(time.RFC3339)
+		mpd.MinimumUpdatePeriod = xsDuration(float64(max(targetDuration, 1)))
+		mpd.TimeShiftBufferDepth = xsDuration(duration)
+		mpd.AvailabilityStartTime = dashAvailabilityStart(period, now).Format(time.RFC3339)
+	} else {
+		mpd.MediaPresentationDuration = xsDuration(duration)
+	}
+
+	out, _ := xml.MarshalIndent(mpd, "", "  ")
+	w.Header().Set("Content-Type", "application/dash+xml")
+	if live {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Write([]byte(xml.Header))
+	w.Write(out)
+}
+
+// dashAvailabilityStart picks the availabilityStartTime that puts the end
+// of the first representation's timeline at now
+func dashAvailabilityStart(period mpdPeriod, now time.Time) time.Time {
+	for _, set := range period.AdaptationSets {
+		for _, rep := range set.Representations {
+			timeline := rep.SegmentList.Timeline.S
+			if len(timeline) == 0 || timeline[0].T == nil {
+				continue
+			}
+			end := *timeline[0].T - rep.SegmentList.PresentationTimeOffset
+			for _, s := range timeline {
+				end += s.D
+			}
+			return now.Add(-time.Duration(end) * time.Millisecond)
+		}
+	}
+	return now
+}
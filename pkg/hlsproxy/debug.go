@@ -0,0 +1,149 @@
+package hlsproxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	debugDefaultBodyBytes = 1024
+	debugMaxBodyBytes     = 64 * 1024
+)
+
+// debugHop is one response in the redirect chain
+type debugHop struct {
+	URL    string `json:"url"`
+	Status int    `json:"status"`
+}
+
+// debugTLS describes the negotiated upstream TLS connection
+type debugTLS struct {
+	Version     string   `json:"version"`
+	CipherSuite string   `json:"cipherSuite"`
+	ServerName  string   `json:"serverName"`
+	ALPN        string   `json:"alpn,omitempty"`
+	PeerSubject string   `json:"peerSubject,omitempty"`
+	PeerIssuer  string   `json:"peerIssuer,omitempty"`
+	PeerExpires string   `json:"peerExpires,omitempty"`
+	PeerDNS     []string `json:"peerDNSNames,omitempty"`
+}
+
+// debugReport is the JSON document returned by /debug/fetch
+type debugReport struct {
+	URL             string              `json:"url"`
+	FinalURL        string              `json:"finalUrl,omitempty"`
+	RequestHeaders  map[string][]string `json:"requestHeaders"`
+	FinalHeaders    map[string][]string `json:"finalRequestHeaders,omitempty"`
+	Status          int                 `json:"status,omitempty"`
+	ResponseHeaders map[string][]string `json:"responseHeaders,omitempty"`
+	Redirects       []debugHop          `json:"redirects"`
+	TLS             *debugTLS           `json:"tls,omitempty"`
+	DurationMs      int64               `json:"durationMs"`
+	Body            string              `json:"body,omitempty"`
+	BodyTruncated   bool                `json:"bodyTruncated,omitempty"`
+	Error           string              `json:"error,omitempty"`
+}
+
+// debugFetchHandler performs the same upstream request as /proxy and reports
+// everything about the exchange
+// URL format: /debug/fetch?url={target_url}&headers={optional_headers}&bytes={optional_body_bytes}
+func debugFetchHandler(w http.ResponseWriter, r *http.Request) {
+	targetURL, parsedHeaders, err := validateRequest(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	bodyBytes := debugDefaultBodyBytes
+	if n, err := strconv.Atoi(r.URL.Query().Get("bytes")); err == nil && n >= 0 {
+		bodyBytes = min(n, debugMaxBodyBytes)
+	}
+
+	requestHeaders := requestHeadersFor(r, targetURL, parsedHeaders)
+	report := debugReport{URL: targetURL, Redirects: []debugHop{}}
+
+	req, err := http.NewRequestWithContext(r.Context(), "GET", targetURL, nil)
+	if err != nil {
+		sendError(w, "Failed to create request", err.Error())
+		return
+	}
+	req = withHeaderOverrides(req, parsedHeaders)
+
+	for k, v := range requestHeaders {
+		req.Header.Set(k, v)
+	}
+	report.RequestHeaders = req.Header.Clone()
+
+	// Same transport and redirect policy as the proxy, but record every hop
+	client := &http.Client{
+		Transport: sharedClient.Transport,
+		CheckRedirect: func(next *http.Request, via []*http.Request) error {
+			if next.Response != nil {
+				report.Redirects = append(report.Redirects, debugHop{
+					URL:    via[len(via)-1].URL.String(),
+					Status: next.Response.StatusCode,
+				})
+			}
+			return checkRedirect(next, via)
+		},
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		report.DurationMs = time.Since(start).Milliseconds()
+		report.Error = err.Error()
+		writeDebugReport(w, report)
+		return
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, int64(bodyBytes)+1))
+	report.DurationMs = time.Since(start).Milliseconds()
+
+	if len(body) > bodyBytes {
+		body = body[:bodyBytes]
+		report.BodyTruncated = true
+	}
+	report.Body = string(body)
+	report.Status = resp.StatusCode
+	report.ResponseHeaders = resp.Header
+	report.FinalURL = resp.Request.URL.String()
+	report.FinalHeaders = resp.Request.Header
+	if resp.TLS != nil {
+		report.TLS = describeTLS(resp.TLS)
+	}
+
+	writeDebugReport(w, report)
+}
+
+// describeTLS summarizes a TLS connection state
+func describeTLS(state *tls.ConnectionState) *debugTLS {
+	info := &debugTLS{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ServerName:  state.ServerName,
+		ALPN:        state.NegotiatedProtocol,
+	}
+	if len(state.PeerCertificates) > 0 {
+		leaf := state.PeerCertificates[0]
+		info.PeerSubject = leaf.Subject.String()
+		info.PeerIssuer = leaf.Issuer.String()
+		info.PeerExpires = leaf.NotAfter.UTC().Format(time.RFC3339)
+		info.PeerDNS = leaf.DNSNames
+	}
+	return info
+}
+
+func writeDebugReport(w http.ResponseWriter, report debugReport) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+}
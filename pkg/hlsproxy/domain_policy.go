@@ -0,0 +1,215 @@
+package hlsproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// domainPolicy overrides how requests to one group of upstream hosts are
+// timed, retried and cached, and whether their segments are proxied at all
+type domainPolicy struct {
+	Timeout     time.Duration `yaml:"timeout,omitempty" json:"-"`      // until response headers, per attempt
+	IdleTimeout time.Duration `yaml:"idle_timeout,omitempty" json:"-"` // between body bytes
+	Retries     int           `yaml:"retries,omitempty" json:"retries,omitempty"`
+	Backoff     time.Duration `yaml:"backoff,omitempty" json:"-"` // before the first retry, doubling after
+
+	// Mode "redirect" answers segment requests with a 302 to the origin, for
+	// origins that need no headers and send CORS headers themselves.
+	// Playlists are still rewritten.
+	Mode string `yaml:"mode,omitempty" json:"mode,omitempty"`
+
+	// CacheTTL keeps segments in memory for up to that long; CacheControl
+	// "respect" (the default) lets upstream no-store and max-age limit it,
+	// "ignore" doesn't, and tells clients max-age=cache_ttl instead
+	CacheTTL     time.Duration `yaml:"cache_ttl,omitempty" json:"-"`
+	CacheControl string        `yaml:"cache_control,omitempty" json:"cache_control,omitempty"`
+}
+
+// UnmarshalJSON accepts timeout, idle_timeout, backoff and cache_ttl as
+// duration strings
+func (p *domainPolicy) UnmarshalJSON(data []byte) error {
+	type plain domainPolicy
+	var raw struct {
+		plain
+		Timeout     string `json:"timeout"`
+		IdleTimeout string `json:"idle_timeout"`
+		Backoff     string `json:"backoff"`
+		CacheTTL    string `json:"cache_ttl"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*p = domainPolicy(raw.plain)
+	if raw.Timeout != "" {
+		if err := parseDuration(&p.Timeout, raw.Timeout); err != nil {
+			return err
+		}
+	}
+	if raw.IdleTimeout != "" {
+		if err := parseDuration(&p.IdleTimeout, raw.IdleTimeout); err != nil {
+			return err
+		}
+	}
+	if raw.Backoff != "" {
+		if err := parseDuration(&p.Backoff, raw.Backoff); err != nil {
+			return err
+		}
+	}
+	if raw.CacheTTL != "" {
+		return parseDuration(&p.CacheTTL, raw.CacheTTL)
+	}
+	return nil
+}
+
+// domainPolicies maps hostname patterns (* wildcards) to their policy
+var domainPolicies map[string]domainPolicy
+
+// validateDomainPolicies rejects negative values and unknown modes
+func validateDomainPolicies(policies map[string]domainPolicy) error {
+	for pattern, policy := range policies {
+		if policy.Timeout < 0 || policy.IdleTimeout < 0 || policy.Retries < 0 || policy.Backoff < 0 || policy.CacheTTL < 0 {
+			return fmt.Errorf("domain policy for %q has a negative timeout, idle_timeout, retries, backoff or cache_ttl", pattern)
+		}
+		switch policy.CacheControl {
+		case "", "respect", "ignore":
+		default:
+			return fmt.Errorf("unknown cache_control %q for %q (want respect or ignore)", policy.CacheControl, pattern)
+		}
+		switch policy.Mode {
+		case "", "proxy", "redirect":
+		default:
+			return fmt.Errorf("unknown mode %q for %q (want proxy or redirect)", policy.Mode, pattern)
+		}
+	}
+	return nil
+}
+
+// redirectToOrigin answers a segment request with a redirect when the
+// target's domain policy says so, and reports whether it did
+func redirectToOrigin(w http.ResponseWriter, r *http.Request, targetURL string) bool {
+	if len(domainPolicies) == 0 {
+		return false
+	}
+	u, err := url.Parse(targetURL)
+	if err != nil || matchHostPattern(domainPolicies, u.Hostname()).Mode != "redirect" {
+		return false
+	}
+	http.Redirect(w, r, targetURL, http.StatusFound)
+	return true
+}
+
+// domainPolicyTransport applies the timeout and retry policy of the
+// request's host. Retries follow network errors, timeouts and 502/503/504
+// answers; 429s are left to the rate limit handling.
+type domainPolicyTransport struct {
+	next http.RoundTripper
+}
+
+func (t *domainPolicyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var policy domainPolicy
+	if len(domainPolicies) > 0 {
+		policy = matchHostPattern(domainPolicies, req.URL.Hostname())
+	}
+	if policy.Timeout == 0 {
+		policy.Timeout = upstreamFirstByteTimeout
+	}
+	if policy.IdleTimeout == 0 {
+		policy.IdleTimeout = upstreamIdleTimeout
+	}
+	if policy.Timeout == 0 && policy.IdleTimeout == 0 && policy.Retries == 0 {
+		return t.next.RoundTrip(req)
+	}
+
+	backoff := policy.Backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := t.attempt(req, policy.Timeout, policy.IdleTimeout)
+		if attempt >= policy.Retries || !retryableAttempt(resp, err) || req.Context().Err() != nil {
+			return resp, err
+		}
+		// Only retry when the request body can be replayed
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return resp, err
+			}
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return resp, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		metrics.addRetry(strings.ToLower(req.URL.Host))
+
+		select {
+		case <-time.After(backoff):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		backoff *= 2
+	}
+}
+
+// attempt sends the request once, giving up when no response headers
+// arrived within timeout or the body stalls for idle. The body may take as
+// long as it needs while data keeps coming.
+func (t *domainPolicyTransport) attempt(req *http.Request, timeout, idle time.Duration) (*http.Response, error) {
+	if timeout == 0 && idle == 0 {
+		return t.next.RoundTrip(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	var timer *time.Timer
+	if timeout > 0 {
+		timer = time.AfterFunc(timeout, cancel)
+	}
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if timer != nil && !timer.Stop() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel()
+		return nil, &upstreamTimeoutError{msg: fmt.Sprintf("%s: no response within %s", req.URL.Host, timeout)}
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if idle > 0 {
+		resp.Body = newIdleTimeoutBody(resp.Body, req.URL.Host, idle, cancel)
+	} else {
+		resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	}
+	return resp, nil
+}
+
+// retryableAttempt reports whether an attempt failed in a way another try may fix
+func retryableAttempt(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// cancelOnClose releases an attempt's context once its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,102 @@
+package hlsproxy
+
+import (
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// maxFilenameBytes keeps generated filenames within common filesystem limits
+const maxFilenameBytes = 200
+
+// mediaExtensions covers types mime.ExtensionsByType doesn't know everywhere
+var mediaExtensions = map[string]string{
+	"video/mp4":                     ".mp4",
+	"video/mp2t":                    ".ts",
+	"video/webm":                    ".webm",
+	"audio/mpeg":                    ".mp3",
+	"audio/aac":                     ".aac",
+	"audio/mp4":                     ".m4a",
+	"application/vnd.apple.mpegurl": ".m3u8",
+	"application/x-mpegurl":         ".m3u8",
+	"audio/x-mpegurl":               ".m3u",
+	"application/dash+xml":          ".mpd",
+}
+
+// wantsDownload reports whether the client asked for a named download
+func wantsDownload(r *http.Request) bool {
+	q := r.URL.Query()
+	return q.Get("dl") == "1" || q.Get("filename") != ""
+}
+
+// contentDisposition builds the Content-Disposition header for a proxied
+// file: attachment when &dl=1 is passed, inline otherwise, named after
+// &filename= or the last segment of the target URL path
+func contentDisposition(r *http.Request, targetURL, contentType string) string {
+	disposition := "inline"
+	if r.URL.Query().Get("dl") == "1" {
+		disposition = "attachment"
+	}
+
+	name := downloadFilename(r.URL.Query().Get("filename"), targetURL, contentType)
+	if v := mime.FormatMediaType(disposition, map[string]string{"filename": name}); v != "" {
+		return v
+	}
+	return disposition
+}
+
+// downloadFilename picks and sanitizes the filename for a download, adding
+// an extension from the content type when the name has none
+func downloadFilename(requested, targetURL, contentType string) string {
+	name := requested
+	if name == "" {
+		if u, err := url.Parse(targetURL); err == nil {
+			name = path.Base(u.Path)
+		}
+	}
+	name = sanitizeFilename(name)
+	if name == "" {
+		name = "download"
+	}
+
+	if path.Ext(name) == "" {
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		if ext, ok := mediaExtensions[mediaType]; ok {
+			name += ext
+		} else if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+			name += exts[0]
+		}
+	}
+	return name
+}
+
+// sanitizeFilename strips directories and characters that are unsafe in
+// filenames or headers
+func sanitizeFilename(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i != -1 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r < 0x20 || r == 0x7f:
+			return -1
+		case strings.ContainsRune(`<>:"|?*`, r):
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.Trim(name, ". ")
+
+	for len(name) > maxFilenameBytes {
+		// Trim whole runes from the end of the stem, keeping the extension
+		ext := path.Ext(name)
+		if len(ext) >= maxFilenameBytes {
+			ext = ""
+		}
+		stem := []rune(strings.TrimSuffix(name, ext))
+		name = string(stem[:len(stem)-1]) + ext
+	}
+	return name
+}
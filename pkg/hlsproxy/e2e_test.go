@@ -0,0 +1,1214 @@
+package hlsproxy
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// e2eAdminToken is the admin token of the proxy under test
+const e2eAdminToken = "e2e-admin-token"
+
+// e2eProxyURL and e2eOriginURL are the proxy under test and the fake
+// origin behind it, started by TestMain
+var (
+	e2eProxyURL  string
+	e2eOriginURL string
+)
+
+// e2eClient talks to the proxy under test
+var e2eClient = &http.Client{Timeout: 15 * time.Second}
+
+// e2eKey, e2eIV and e2eSegment are what the origin encrypts its segments
+// with and what they decrypt to
+var (
+	e2eKey     = []byte("0123456789abcdef")
+	e2eIV      = []byte{15: 1}
+	e2eSegment = bytes.Repeat([]byte{0x47, 0x00, 0x11, 0x10}, 47)
+)
+
+// e2eStream is the file byte ranges and MP4 ranges are cut from: 64 KiB
+// that differ at every offset worth checking
+var e2eStream = func() []byte {
+	b := make([]byte, 64<<10)
+	for i := range b {
+		b[i] = byte(i*7 + i>>8)
+	}
+	return b
+}()
+
+// e2eVariant is the AES-128 media playlist, relative to /video/
+const e2eVariant = "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:0\n" +
+	"#EXT-X-KEY:METHOD=AES-128,URI=\"../keys/key.bin\",IV=0x00000000000000000000000000000001\n" +
+	"#EXTINF:4.0,\nseg0.ts\n#EXTINF:4.0,\nseg1.ts\n#EXT-X-ENDLIST\n"
+
+// e2eOriginAuth is the header /private/ resources require
+const e2eOriginAuth = "origin-secret"
+
+// originLog records the requests the fake origin received
+var originLog = &requestLog{}
+
+// requestLog keeps the Range header of every request by path, and which
+// paths were requested through a forward proxy
+type requestLog struct {
+	mu      sync.Mutex
+	ranges  map[string][]string
+	proxied map[string]bool
+}
+
+func (l *requestLog) record(r *http.Request) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ranges == nil {
+		l.ranges, l.proxied = make(map[string][]string), make(map[string]bool)
+	}
+	l.ranges[r.URL.Path] = append(l.ranges[r.URL.Path], r.Header.Get("Range"))
+	if strings.HasPrefix(r.RequestURI, "http://") {
+		l.proxied[r.URL.Path] = true
+	}
+}
+
+// take returns and forgets the Range headers path was requested with
+func (l *requestLog) take(path string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ranges := l.ranges[path]
+	delete(l.ranges, path)
+	return ranges
+}
+
+// viaProxy reports whether path was requested through a forward proxy
+func (l *requestLog) viaProxy(path string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.proxied[path]
+}
+
+// e2eOrigin is the fake origin: an AES-128 stream (master, variant, key and
+// two segments), the master behind a redirect, a gzip-encoded variant,
+// EXT-X-BYTERANGE playlists over TS and fMP4, an MP4, a DRM playlist and its
+// license server, an ICY radio stream, an XMLTV guide with its channel list
+// and a segment that needs a header. Files honor Range.
+func e2eOrigin() http.Handler {
+	encrypted := e2eEncrypt(e2eSegment)
+	playlist := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+			io.WriteString(w, body)
+		}
+	}
+	file := func(contentType string, data []byte) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/master.m3u8", playlist("#EXTM3U\n"+
+		"#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360,CODECS=\"avc1.64001f,mp4a.40.2\"\nvideo/index.m3u8\n"))
+	mux.HandleFunc("/video/index.m3u8", playlist(e2eVariant))
+	mux.HandleFunc("/keys/key.bin", file("application/octet-stream", e2eKey))
+	mux.HandleFunc("/video/seg0.ts", file("video/mp2t", encrypted))
+	mux.HandleFunc("/video/seg1.ts", file("video/mp2t", encrypted))
+
+	// Moved elsewhere, so relative URIs only resolve against the final URL
+	mux.HandleFunc("/moved/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/master.m3u8", http.StatusFound)
+	})
+	// Compressed whether or not the client asked for it, as some CDNs do
+	mux.HandleFunc("/video/gzip.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		io.WriteString(gz, e2eVariant)
+		gz.Close()
+	})
+
+	mux.HandleFunc("/video/byterange.m3u8", playlist("#EXTM3U\n#EXT-X-VERSION:4\n#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:0\n"+
+		"#EXTINF:4.0,\n#EXT-X-BYTERANGE:1000@0\nstream.ts\n#EXTINF:4.0,\n#EXT-X-BYTERANGE:2000@5000\nstream.ts\n#EXT-X-ENDLIST\n"))
+	mux.HandleFunc("/video/stream.ts", file("video/mp2t", e2eStream))
+	mux.HandleFunc("/fmp4/index.m3u8", playlist("#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:0\n"+
+		"#EXT-X-MAP:URI=\"stream.mp4\",BYTERANGE=\"800@0\"\n"+
+		"#EXTINF:4.0,\n#EXT-X-BYTERANGE:3000@800\nstream.mp4\n#EXTINF:4.0,\n#EXT-X-BYTERANGE:4000\nstream.mp4\n#EXT-X-ENDLIST\n"))
+	mux.HandleFunc("/fmp4/stream.mp4", file("video/mp4", e2eStream))
+	mux.HandleFunc("/movie.mp4", file("video/mp4", e2eStream))
+
+	mux.HandleFunc("/drm/index.m3u8", playlist("#EXTM3U\n#EXT-X-VERSION:5\n#EXT-X-TARGETDURATION:4\n"+
+		"#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"../license\",KEYFORMAT=\"com.widevine\",KEYFORMATVERSIONS=\"1\"\n"+
+		"#EXTINF:4.0,\n../video/seg0.ts\n#EXT-X-ENDLIST\n"))
+	mux.HandleFunc("/license", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST a challenge", http.StatusMethodNotAllowed)
+			return
+		}
+		challenge, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		fmt.Fprintf(w, "license for %s (%s)", challenge, r.Header.Get("Content-Type"))
+	})
+
+	// Two 16-byte audio blocks with a title between them
+	mux.HandleFunc("/radio", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/mpeg")
+		w.Header().Set("Icy-Metaint", "16")
+		w.Header().Set("Icy-Name", "E2E Radio")
+		w.Write(bytes.Repeat([]byte{0xAA}, 16))
+		w.Write(append([]byte{1}, []byte("StreamTitle='x';")...))
+		w.Write(bytes.Repeat([]byte{0xBB}, 16))
+	})
+
+	mux.HandleFunc("/guide.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><tv>`+
+			`<channel id="news"><display-name>News</display-name></channel>`+
+			`<channel id="sport"><display-name>Sport</display-name></channel>`+
+			`<programme channel="news" start="20260101000000 +0000"><title>Headlines</title></programme>`+
+			`<programme channel="sport" start="20260101000000 +0000"><title>Match</title></programme></tv>`)
+	})
+	mux.HandleFunc("/channels.m3u", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/x-mpegurl")
+		io.WriteString(w, "#EXTM3U\n#EXTINF:-1 tvg-id=\"news\" group-title=\"News\",News\nhttp://example.com/news.m3u8\n")
+	})
+
+	mux.HandleFunc("/private/index.m3u8", playlist("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:4\n"+
+		"#EXTINF:4.0,\nseg.ts\n#EXT-X-ENDLIST\n"))
+	mux.HandleFunc("/private/movie.mp4", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Origin-Auth") != e2eOriginAuth {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		file("video/mp4", e2eStream)(w, r)
+	})
+	mux.HandleFunc("/private/seg.ts", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Origin-Auth") != e2eOriginAuth {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp2t")
+		w.Write(e2eSegment)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originLog.record(r)
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// e2eEncrypt encrypts a segment the way the origin's variant declares:
+// AES-128-CBC with PKCS#7 padding under e2eKey and e2eIV
+func e2eEncrypt(plain []byte) []byte {
+	block, _ := aes.NewCipher(e2eKey)
+	pad := aes.BlockSize - len(plain)%aes.BlockSize
+	out := append(append([]byte(nil), plain...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, e2eIV).CryptBlocks(out, out)
+	return out
+}
+
+// e2eDecrypt reverses e2eEncrypt with the key the proxy served
+func e2eDecrypt(t *testing.T, key, data []byte) []byte {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("key: %v", err)
+	}
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		t.Fatalf("%d bytes isn't a whole number of AES blocks", len(data))
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, e2eIV).CryptBlocks(out, data)
+	pad := int(out[len(out)-1])
+	if pad == 0 || pad > aes.BlockSize {
+		t.Fatalf("bad padding")
+	}
+	return out[:len(out)-pad]
+}
+
+// e2eFakeTools are stand-ins for ffprobe and ffmpeg, which the probe and
+// test stream shell out to
+var e2eFakeTools = map[string]string{
+	"ffprobe": `printf '%s' '{"format":{"format_name":"mpegts","duration":"8.000","bit_rate":"1000000"},` +
+		`"streams":[{"index":0,"codec_type":"video","codec_name":"h264","width":640,"height":360,"avg_frame_rate":"30/1"}]}'`,
+	"ffmpeg": `printf 'rendered test segment'`,
+}
+
+// TestMain starts the fake origin and the proxy, configured with every
+// optional endpoint enabled, and runs the tests against them
+func TestMain(m *testing.M) {
+	os.Exit(runE2E(m))
+}
+
+func runE2E(m *testing.M) int {
+	dir, err := os.MkdirTemp("", "hlsproxy-e2e-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	origin := httptest.NewServer(e2eOrigin())
+	defer origin.Close()
+	e2eOriginURL = origin.URL
+
+	// Rewritten playlists point at PUBLIC_URL, so the address is needed first
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(routeHandler))
+	e2eProxyURL = "http://" + proxy.Listener.Addr().String()
+
+	localDir := filepath.Join(dir, "local")
+	if err := os.MkdirAll(filepath.Join(localDir, "vod"), 0o755); err != nil {
+		log.Fatal(err)
+	}
+	localPlaylist := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:4\n" +
+		"#EXTINF:4.0,\nseg0.ts\n#EXTINF:4.0,\n" + e2eOriginURL + "/video/stream.ts\n#EXT-X-ENDLIST\n"
+	if err := os.WriteFile(filepath.Join(localDir, "vod", "index.m3u8"), []byte(localPlaylist), 0o644); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(localDir, "vod", "seg0.ts"), e2eStream[:4096], 0o644); err != nil {
+		log.Fatal(err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.PublicURL = e2eProxyURL
+	cfg.AdminToken = e2eAdminToken
+	cfg.WatermarkSecret = "e2e-watermark-secret"
+	cfg.LocalMediaDir = localDir
+	cfg.UsageDB = filepath.Join(dir, "usage.db")
+	cfg.PushEnabled = true
+	cfg.TestStreamEnabled = true
+	if runtime.GOOS != "windows" {
+		for name, script := range e2eFakeTools {
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+				log.Fatal(err)
+			}
+		}
+		cfg.FFprobePath = filepath.Join(dir, "ffprobe")
+		cfg.FFmpegPath = filepath.Join(dir, "ffmpeg")
+	}
+	if _, err := New(cfg); err != nil {
+		log.Fatal(err)
+	}
+	proxy.Start()
+	defer proxy.Close()
+
+	return m.Run()
+}
+
+// e2eRoutes test each route of the routing table end to end, by pattern
+var e2eRoutes = map[string]func(t *testing.T){
+	"/":                      testE2EHome,
+	"/openapi.json":          testE2EOpenAPI,
+	"/proxy":                 testE2EProxy,
+	"/ts-proxy":              testE2ETSProxy,
+	"/mp4-proxy":             testE2EMP4Proxy,
+	"/fetch":                 testE2EFetch,
+	"/ghost-proxy":           testE2EGhostProxy,
+	"/audio-proxy":           testE2EAudioProxy,
+	"/push":                  testE2EPush,
+	"/inspect":               testE2EInspect,
+	"/validate":              testE2EValidate,
+	"/probe":                 testE2EProbe,
+	"/epg":                   testE2EEPG,
+	"/stitch":                testE2EStitch,
+	"/clip":                  testE2EClip,
+	"/export":                testE2EExport,
+	"/convert/dash":          testE2EDASH,
+	"/license-proxy":         testE2ELicenseProxy,
+	"/shorten":               testE2EShorten,
+	"/test-stream.m3u8":      testE2ETestStream,
+	"/test-stream/{segment}": testE2ETestSegment,
+	"/local/{path...}":       testE2ELocal,
+	"/u/{id}":                testE2EShortURL,
+	"/metrics":               testE2EMetrics,
+	"/admin/streams":         testE2EAdminStreams,
+	"/admin/header-sessions": testE2EHeaderSessions,
+	"/admin/quarantine":      testE2EQuarantine,
+	"/admin/watermark":       testE2EWatermark,
+	"/admin/metrics":         testE2EAdminMetrics,
+	"/prewarm":               testE2EPrewarm,
+	"/usage":                 testE2EUsage,
+	"/debug/fetch":           testE2EDebugFetch,
+	"/{domain}/{path...}":    testE2EPathProxy,
+}
+
+// TestEndToEnd runs the test of every route, and fails for routes without one
+func TestEndToEnd(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, rt := range routes {
+		seen[rt.pattern] = true
+		run, ok := e2eRoutes[rt.pattern]
+		if !ok {
+			t.Errorf("route %s has no end-to-end test", rt.pattern)
+			continue
+		}
+		t.Run(rt.pattern, run)
+	}
+	for pattern := range e2eRoutes {
+		if !seen[pattern] {
+			t.Errorf("end-to-end test for %s, which is not a route", pattern)
+		}
+	}
+}
+
+func testE2EHome(t *testing.T) {
+	var info struct {
+		Message   string            `json:"message"`
+		Endpoints map[string]string `json:"endpoints"`
+	}
+	e2eJSON(t, e2eGet(t, e2eProxyURL+"/", nil, http.StatusOK), &info)
+	if info.Endpoints["m3u8"] == "" {
+		t.Errorf("endpoint list without /proxy: %v", info.Endpoints)
+	}
+}
+
+func testE2EOpenAPI(t *testing.T) {
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	e2eJSON(t, e2eGet(t, e2eProxyURL+"/openapi.json", nil, http.StatusOK), &spec)
+	for _, rt := range routes {
+		if _, ok := spec.Paths[strings.ReplaceAll(rt.pattern, "...}", "}")]; !ok {
+			t.Errorf("%s is not described", rt.pattern)
+		}
+	}
+	var export struct {
+		Get struct {
+			Responses map[string]struct {
+				Content map[string]json.RawMessage `json:"content"`
+			} `json:"responses"`
+		} `json:"get"`
+	}
+	if err := json.Unmarshal(mustMarshal(t, spec.Paths["/export"]), &export); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := export.Get.Responses["200"].Content["application/zip"]; !ok {
+		t.Errorf("/export is not described as a zip: %v", export.Get.Responses["200"].Content)
+	}
+}
+
+func testE2EProxy(t *testing.T) {
+	t.Run("encrypted master", func(t *testing.T) {
+		e2eMaster(t, e2eEndpoint("/proxy", "/master.m3u8"))
+	})
+	t.Run("redirected master", func(t *testing.T) {
+		e2eMaster(t, e2eEndpoint("/proxy", "/moved/master.m3u8"))
+	})
+	t.Run("gzip variant", func(t *testing.T) {
+		e2eVariantPlaylist(t, e2eEndpoint("/proxy", "/video/gzip.m3u8"))
+	})
+	t.Run("DRM license", func(t *testing.T) {
+		variant := string(e2eGet(t, e2eEndpoint("/proxy", "/drm/index.m3u8"), nil, http.StatusOK))
+		keyURL := e2eKeyURI(variant)
+		e2eRequireProxied(t, keyURL, "/license-proxy", "/license")
+	})
+	t.Run("missing url", func(t *testing.T) {
+		e2eGet(t, e2eProxyURL+"/proxy", nil, http.StatusBadRequest)
+	})
+}
+
+// e2eMaster walks master → variant → key → segments
+func e2eMaster(t *testing.T, masterURL string) {
+	t.Helper()
+	master := string(e2eGet(t, masterURL, nil, http.StatusOK))
+	variantURLs := e2eURILines(master)
+	if len(variantURLs) != 1 {
+		t.Fatalf("master playlist: %d variants, want 1:\n%s", len(variantURLs), master)
+	}
+	e2eRequireProxied(t, variantURLs[0], "/proxy", "/video/index.m3u8")
+	e2eVariantPlaylist(t, variantURLs[0])
+}
+
+// e2eVariantPlaylist fetches the encrypted variant, its key and both
+// segments, and checks the segments decrypt to the origin's plaintext
+func e2eVariantPlaylist(t *testing.T, variantURL string) {
+	t.Helper()
+	variant := string(e2eGet(t, variantURL, nil, http.StatusOK))
+	keyURL := e2eKeyURI(variant)
+	e2eRequireProxied(t, keyURL, "/ts-proxy", "/keys/key.bin")
+	key := e2eGet(t, keyURL, nil, http.StatusOK)
+	if !bytes.Equal(key, e2eKey) {
+		t.Fatalf("key: got %d bytes that don't match the origin", len(key))
+	}
+
+	segmentURLs := e2eURILines(variant)
+	if len(segmentURLs) != 2 {
+		t.Fatalf("variant playlist: %d segments, want 2:\n%s", len(segmentURLs), variant)
+	}
+	for i, segmentURL := range segmentURLs {
+		e2eRequireProxied(t, segmentURL, "/ts-proxy", fmt.Sprintf("/video/seg%d.ts", i))
+		if plain := e2eDecrypt(t, key, e2eGet(t, segmentURL, nil, http.StatusOK)); !bytes.Equal(plain, e2eSegment) {
+			t.Errorf("segment %d: decrypts to %d bytes that don't match the origin", i, len(plain))
+		}
+	}
+}
+
+func testE2ETSProxy(t *testing.T) {
+	// The player reads the sub-ranges from the rewritten playlist, so the
+	// proxy has to keep them and forward the matching Range upstream
+	proxied := string(e2eGet(t, e2eEndpoint("/proxy", "/video/byterange.m3u8"), nil, http.StatusOK))
+	playlist := parseMediaPlaylist(proxied, "")
+	if len(playlist.segments) != 2 {
+		t.Fatalf("byterange playlist: %d segments, want 2:\n%s", len(playlist.segments), proxied)
+	}
+	want := []struct{ start, length int64 }{{0, 1000}, {5000, 2000}}
+	originLog.take("/video/stream.ts")
+	for i, segment := range playlist.segments {
+		if segment.rangeStart != want[i].start || segment.rangeLength != want[i].length {
+			t.Fatalf("segment %d: byte range %d@%d, want %d@%d", i, segment.rangeLength, segment.rangeStart, want[i].length, want[i].start)
+		}
+		e2eRequireProxied(t, segment.uri, "/ts-proxy", "/video/stream.ts")
+
+		rangeHeader := byteRangeHeader(segment.rangeStart, segment.rangeLength)
+		resp, body := e2eDo(t, "GET", segment.uri, map[string]string{"Range": rangeHeader}, nil)
+		if resp.StatusCode != http.StatusPartialContent {
+			t.Fatalf("segment %d: status %d, want 206", i, resp.StatusCode)
+		}
+		wantRange := fmt.Sprintf("bytes %d-%d/%d", segment.rangeStart, segment.rangeStart+segment.rangeLength-1, len(e2eStream))
+		if got := resp.Header.Get("Content-Range"); got != wantRange {
+			t.Errorf("segment %d: Content-Range %q, want %q", i, got, wantRange)
+		}
+		if !bytes.Equal(body, e2eStream[segment.rangeStart:segment.rangeStart+segment.rangeLength]) {
+			t.Errorf("segment %d: got %d bytes that don't match the origin's range", i, len(body))
+		}
+	}
+	if got := originLog.take("/video/stream.ts"); strings.Join(got, ",") != "bytes=0-999,bytes=5000-6999" {
+		t.Errorf("origin was asked for %q", got)
+	}
+
+	t.Run("header session", func(t *testing.T) {
+		target := e2eEndpoint("/ts-proxy", "/private/seg.ts")
+		e2eGet(t, target, nil, http.StatusForbidden)
+		id := e2eHeaderSession(t, "127.0.0.1", map[string]string{"X-Origin-Auth": e2eOriginAuth})
+		if body := e2eGet(t, target+"&header_session="+id, nil, http.StatusOK); !bytes.Equal(body, e2eSegment) {
+			t.Errorf("got %d bytes that don't match the origin", len(body))
+		}
+
+		// A domain cache never hands what the session fetched to other viewers
+		defer func(saved map[string]domainPolicy) { domainPolicies = saved }(domainPolicies)
+		domainPolicies = map[string]domainPolicy{"127.0.0.1": {CacheTTL: time.Minute}}
+		e2eGet(t, target+"&header_session="+id, nil, http.StatusOK)
+		e2eGet(t, target, nil, http.StatusForbidden)
+	})
+}
+
+func testE2EMP4Proxy(t *testing.T) {
+	target := e2eEndpoint("/mp4-proxy", "/movie.mp4")
+	e2eRange(t, target, "", e2eStream)
+	e2eRange(t, target, "bytes=1000-4999", e2eStream[1000:5000])
+	e2eRange(t, target, "bytes=60000-", e2eStream[60000:])
+
+	// The accelerator splits the transfer into ranges of its own
+	t.Run("parallel", func(t *testing.T) {
+		defer func(connections int, chunkSize int64) {
+			mp4ParallelConnections, mp4ParallelChunkSize = connections, chunkSize
+		}(mp4ParallelConnections, mp4ParallelChunkSize)
+		mp4ParallelConnections, mp4ParallelChunkSize = 3, 8<<10
+
+		originLog.take("/movie.mp4")
+		e2eRange(t, target, "", e2eStream)
+		want := []string{"bytes=0-0"}
+		for start := 0; start < len(e2eStream); start += 8 << 10 {
+			want = append(want, fmt.Sprintf("bytes=%d-%d", start, start+8<<10-1))
+		}
+		got := originLog.take("/movie.mp4")
+		slices.Sort(got)
+		if slices.Sort(want); !slices.Equal(got, want) {
+			t.Errorf("origin was asked for %q, want a probe and 8 KiB chunks", got)
+		}
+		e2eRange(t, target, "bytes=1000-50000", e2eStream[1000:50001])
+	})
+
+	// The disk cache answers ranges from chunks it fetched itself
+	t.Run("disk cache", func(t *testing.T) {
+		cache, err := newMP4DiskCache(t.TempDir(), 1<<20, 4<<10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { mp4Cache = nil }()
+		mp4Cache = cache
+
+		e2eRange(t, target, "bytes=5000-13000", e2eStream[5000:13001])
+		e2eRange(t, target, "bytes=6000-6999", e2eStream[6000:7000])
+		e2eRange(t, target, "", e2eStream)
+
+		// What a header session fetched stays its own
+		private := e2eEndpoint("/mp4-proxy", "/private/movie.mp4")
+		id := e2eHeaderSession(t, "127.0.0.1", map[string]string{"X-Origin-Auth": e2eOriginAuth})
+		e2eRange(t, private+"&header_session="+id, "bytes=0-4095", e2eStream[:4096])
+		e2eGet(t, private, map[string]string{"Range": "bytes=0-4095"}, http.StatusForbidden)
+	})
+}
+
+func testE2EFetch(t *testing.T) {
+	target := e2eEndpoint("/fetch", "/movie.mp4")
+	e2eRange(t, target, "", e2eStream)
+	e2eRange(t, target, "bytes=100-199", e2eStream[100:200])
+}
+
+func testE2EGhostProxy(t *testing.T) {
+	// The origin doubles as the forward proxy the playlist is fetched through
+	target := e2eEndpoint("/ghost-proxy", "/video/index.m3u8") + "&proxy=" + url.QueryEscape(e2eOriginURL)
+	variant := string(e2eGet(t, target, nil, http.StatusOK))
+	if !originLog.viaProxy("/video/index.m3u8") {
+		t.Errorf("playlist was not fetched through the forward proxy")
+	}
+	segmentURLs := e2eURILines(variant)
+	for i, segmentURL := range segmentURLs {
+		e2eRequireProxied(t, segmentURL, "/ghost-proxy", fmt.Sprintf("/video/seg%d.ts", i))
+	}
+	key := e2eGet(t, e2eKeyURI(variant), nil, http.StatusOK)
+	if plain := e2eDecrypt(t, key, e2eGet(t, segmentURLs[0], nil, http.StatusOK)); !bytes.Equal(plain, e2eSegment) {
+		t.Errorf("segment doesn't decrypt to the origin's")
+	}
+	if !originLog.viaProxy("/video/seg0.ts") {
+		t.Errorf("segment was not fetched through the forward proxy")
+	}
+
+	// Relative URIs of a redirected playlist resolve against where it moved
+	moved := e2eEndpoint("/ghost-proxy", "/moved/master.m3u8") + "&proxy=" + url.QueryEscape(e2eOriginURL)
+	master := string(e2eGet(t, moved, nil, http.StatusOK))
+	e2eRequireProxied(t, e2eURILines(master)[0], "/ghost-proxy", "/video/index.m3u8")
+}
+
+func testE2EAudioProxy(t *testing.T) {
+	target := e2eEndpoint("/audio-proxy", "/radio")
+	resp, body := e2eDo(t, "GET", target, nil, nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Icy-Metaint") != "16" || len(body) != 16+17+16 {
+		t.Errorf("passthrough: status %d, Icy-Metaint %q, %d bytes", resp.StatusCode, resp.Header.Get("Icy-Metaint"), len(body))
+	}
+	want := append(bytes.Repeat([]byte{0xAA}, 16), bytes.Repeat([]byte{0xBB}, 16)...)
+	if body := e2eGet(t, target+"&strip_icy=1", nil, http.StatusOK); !bytes.Equal(body, want) {
+		t.Errorf("strip_icy: got %x", body)
+	}
+}
+
+func testE2EPush(t *testing.T) {
+	// A VOD playlist is sent once, then the stream ends
+	resp, body := e2eDo(t, "GET", e2eEndpoint("/push", "/video/index.m3u8"), nil, nil)
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		t.Fatalf("status %d, Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var event string
+	var data []string
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		if name, ok := strings.CutPrefix(scanner.Text(), "event: "); ok {
+			event = name
+		} else if line, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			data = append(data, line)
+		}
+	}
+	if event != "playlist" {
+		t.Fatalf("last event %q, want playlist:\n%s", event, body)
+	}
+	if keyURL := e2eKeyURI(strings.Join(data, "\n")); !strings.HasPrefix(keyURL, e2eProxyURL+"/ts-proxy?") {
+		t.Errorf("pushed playlist not rewritten: key %q", keyURL)
+	}
+}
+
+func testE2EInspect(t *testing.T) {
+	var report struct {
+		Type     string `json:"type"`
+		Variants []struct {
+			Bandwidth  int    `json:"bandwidth"`
+			Resolution string `json:"resolution"`
+		} `json:"variants"`
+		Media *struct {
+			SegmentCount int `json:"segmentCount"`
+			Encryption   struct {
+				Method string `json:"method"`
+			} `json:"encryption"`
+		} `json:"media"`
+	}
+	e2eJSON(t, e2eGet(t, e2eEndpoint("/inspect", "/master.m3u8"), nil, http.StatusOK), &report)
+	if report.Type != "master" || len(report.Variants) != 1 || report.Variants[0].Resolution != "640x360" {
+		t.Errorf("report: %+v", report)
+	}
+	if report.Media == nil || report.Media.SegmentCount != 2 || report.Media.Encryption.Method != "AES-128" {
+		t.Errorf("first variant: %+v", report.Media)
+	}
+}
+
+func testE2EValidate(t *testing.T) {
+	var report struct {
+		Healthy           bool `json:"healthy"`
+		ReachableVariants int  `json:"reachableVariants"`
+		TotalVariants     int  `json:"totalVariants"`
+	}
+	e2eJSON(t, e2eGet(t, e2eEndpoint("/validate", "/master.m3u8")+"&deep=1", nil, http.StatusOK), &report)
+	if !report.Healthy || report.ReachableVariants != 1 || report.TotalVariants != 1 {
+		t.Errorf("report: %+v", report)
+	}
+}
+
+func testE2EProbe(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake ffprobe is a shell script")
+	}
+	var report struct {
+		Format   string  `json:"format"`
+		Duration float64 `json:"duration"`
+		Streams  []struct {
+			Codec string `json:"codec"`
+			Width int    `json:"width"`
+		} `json:"streams"`
+	}
+	e2eJSON(t, e2eGet(t, e2eEndpoint("/probe", "/video/seg0.ts"), nil, http.StatusOK), &report)
+	if report.Format != "mpegts" || report.Duration != 8 || len(report.Streams) != 1 || report.Streams[0].Width != 640 {
+		t.Errorf("report: %+v", report)
+	}
+}
+
+func testE2EEPG(t *testing.T) {
+	guide := string(e2eGet(t, e2eEndpoint("/epg", "/guide.xml"), nil, http.StatusOK))
+	if !strings.Contains(guide, "Headlines") || !strings.Contains(guide, "Match") {
+		t.Errorf("unfiltered guide lost programmes:\n%s", guide)
+	}
+	filtered := string(e2eGet(t, e2eEndpoint("/epg", "/guide.xml")+"&playlist="+url.QueryEscape(e2eOriginURL+"/channels.m3u"), nil, http.StatusOK))
+	if !strings.Contains(filtered, "Headlines") || strings.Contains(filtered, "Match") {
+		t.Errorf("guide not filtered to the channel list:\n%s", filtered)
+	}
+}
+
+func testE2EStitch(t *testing.T) {
+	urls := e2eOriginURL + "/video/index.m3u8," + e2eOriginURL + "/video/byterange.m3u8"
+	stitched := string(e2eGet(t, e2eProxyURL+"/stitch?urls="+url.QueryEscape(urls), nil, http.StatusOK))
+	if !strings.Contains(stitched, "#EXT-X-DISCONTINUITY") || !strings.Contains(stitched, "#EXT-X-BYTERANGE:2000@5000") {
+		t.Errorf("stitched playlist:\n%s", stitched)
+	}
+	want := []string{"/video/seg0.ts", "/video/seg1.ts", "/video/stream.ts", "/video/stream.ts"}
+	segmentURLs := e2eURILines(stitched)
+	if len(segmentURLs) != len(want) {
+		t.Fatalf("%d segments, want %d:\n%s", len(segmentURLs), len(want), stitched)
+	}
+	for i, segmentURL := range segmentURLs {
+		e2eRequireProxied(t, segmentURL, "/ts-proxy", want[i])
+	}
+}
+
+func testE2EClip(t *testing.T) {
+	clipped := string(e2eGet(t, e2eEndpoint("/clip", "/video/index.m3u8")+"&start=4&end=8", nil, http.StatusOK))
+	segmentURLs := e2eURILines(clipped)
+	if len(segmentURLs) != 1 || !strings.Contains(clipped, "#EXT-X-ENDLIST") {
+		t.Fatalf("clip of the second segment:\n%s", clipped)
+	}
+	e2eRequireProxied(t, segmentURLs[0], "/ts-proxy", "/video/seg1.ts")
+	key := e2eGet(t, e2eKeyURI(clipped), nil, http.StatusOK)
+	if plain := e2eDecrypt(t, key, e2eGet(t, segmentURLs[0], nil, http.StatusOK)); !bytes.Equal(plain, e2eSegment) {
+		t.Errorf("clipped segment doesn't decrypt to the origin's")
+	}
+	e2eGet(t, e2eEndpoint("/clip", "/video/index.m3u8")+"&start=8&end=4", nil, http.StatusBadRequest)
+}
+
+func testE2EExport(t *testing.T) {
+	resp, body := e2eDo(t, "GET", e2eEndpoint("/export", "/video/byterange.m3u8"), nil, nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/zip" {
+		t.Fatalf("status %d, Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	files := e2eUnzip(t, body)
+	index := string(files["index.m3u8"])
+	// Both sub-ranges come from one archived file
+	if strings.Count(index, "media/00000.ts") != 2 || !strings.Contains(index, "#EXT-X-BYTERANGE:2000@5000") || len(files) != 2 {
+		t.Errorf("archive index:\n%s", index)
+	}
+	if !bytes.Equal(files["media/00000.ts"], e2eStream) {
+		t.Errorf("archived file: %d bytes that don't match the origin", len(files["media/00000.ts"]))
+	}
+
+	_, body = e2eDo(t, "GET", e2eEndpoint("/export", "/video/index.m3u8"), nil, nil)
+	files = e2eUnzip(t, body)
+	index = string(files["index.m3u8"])
+	key := files[e2eKeyURI(index)]
+	segments := e2eURILines(index)
+	if len(segments) != 2 {
+		t.Fatalf("archive index:\n%s", index)
+	}
+	for _, name := range segments {
+		if plain := e2eDecrypt(t, key, files[name]); !bytes.Equal(plain, e2eSegment) {
+			t.Errorf("%s doesn't decrypt to the origin's segment", name)
+		}
+	}
+}
+
+func testE2EDASH(t *testing.T) {
+	var mpd mpdDocument
+	body := e2eGet(t, e2eEndpoint("/convert/dash", "/fmp4/index.m3u8"), nil, http.StatusOK)
+	if err := xml.Unmarshal(body, &mpd); err != nil {
+		t.Fatalf("%v:\n%s", err, body)
+	}
+	if mpd.Type != "static" || len(mpd.Periods) != 1 || len(mpd.Periods[0].AdaptationSets) != 1 ||
+		len(mpd.Periods[0].AdaptationSets[0].Representations) != 1 {
+		t.Fatalf("MPD:\n%s", body)
+	}
+	list := mpd.Periods[0].AdaptationSets[0].Representations[0].SegmentList
+	if list.Initialization == nil || list.Initialization.Range != "0-799" || len(list.SegmentURLs) != 2 {
+		t.Fatalf("segment list:\n%s", body)
+	}
+
+	// The player requests the ranges the MPD names
+	parts := []struct{ url, byteRange string }{{list.Initialization.SourceURL, list.Initialization.Range}}
+	for _, segment := range list.SegmentURLs {
+		parts = append(parts, struct{ url, byteRange string }{segment.Media, segment.MediaRange})
+	}
+	want := []string{"0-799", "800-3799", "3800-7799"}
+	for i, part := range parts {
+		if part.byteRange != want[i] {
+			t.Errorf("part %d: range %q, want %q", i, part.byteRange, want[i])
+		}
+		e2eRequireProxied(t, part.url, "/ts-proxy", "/fmp4/stream.mp4")
+		var start, end int
+		fmt.Sscanf(part.byteRange, "%d-%d", &start, &end)
+		e2eRange(t, part.url, "bytes="+part.byteRange, e2eStream[start:end+1])
+	}
+
+	// MPEG-TS sources can't be referenced from an MPD
+	e2eGet(t, e2eEndpoint("/convert/dash", "/video/index.m3u8"), nil, http.StatusUnprocessableEntity)
+}
+
+func testE2ELicenseProxy(t *testing.T) {
+	target := e2eEndpoint("/license-proxy", "/license")
+	resp, body := e2eDo(t, "POST", target, map[string]string{"Content-Type": "application/octet-stream"}, []byte("challenge"))
+	if resp.StatusCode != http.StatusOK || string(body) != "license for challenge (application/octet-stream)" {
+		t.Errorf("status %d: %q", resp.StatusCode, body)
+	}
+	resp, _ = e2eDo(t, "PUT", target, nil, nil)
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("PUT: status %d, want 405", resp.StatusCode)
+	}
+}
+
+func testE2EShorten(t *testing.T) {
+	e2eGet(t, e2eProxyURL+"/shorten?url="+url.QueryEscape("https://example.com/index.m3u8"), nil, http.StatusBadRequest)
+	if shortURL := e2eShorten(t, e2eEndpoint("/proxy", "/master.m3u8")); !strings.HasPrefix(shortURL, e2eProxyURL+"/u/") {
+		t.Errorf("short URL %q", shortURL)
+	}
+}
+
+func testE2ETestStream(t *testing.T) {
+	playlist := string(e2eGet(t, e2eProxyURL+"/test-stream.m3u8", nil, http.StatusOK))
+	if uris := e2eURILines(playlist); !strings.HasPrefix(uris[0], "test-stream/") || !strings.Contains(playlist, "#EXT-X-PROGRAM-DATE-TIME") {
+		t.Errorf("test stream:\n%s", playlist)
+	}
+	// Proxying it works like any origin
+	proxied := string(e2eGet(t, e2eProxyURL+"/proxy?url="+url.QueryEscape(e2eProxyURL+"/test-stream.m3u8"), nil, http.StatusOK))
+	if uris := e2eURILines(proxied); !strings.HasPrefix(uris[0], e2eProxyURL+"/ts-proxy?") {
+		t.Errorf("proxied test stream:\n%s", proxied)
+	}
+}
+
+func testE2ETestSegment(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake ffmpeg is a shell script")
+	}
+	uris := e2eURILines(string(e2eGet(t, e2eProxyURL+"/test-stream.m3u8", nil, http.StatusOK)))
+	if body := e2eGet(t, e2eProxyURL+"/"+uris[len(uris)-1], nil, http.StatusOK); string(body) != "rendered test segment" {
+		t.Errorf("segment: %q", body)
+	}
+	e2eGet(t, e2eProxyURL+"/test-stream/1.ts", nil, http.StatusNotFound)
+}
+
+func testE2ELocal(t *testing.T) {
+	playlist := string(e2eGet(t, e2eProxyURL+"/local/vod/index.m3u8", nil, http.StatusOK))
+	uris := e2eURILines(playlist)
+	if len(uris) != 2 || uris[0] != "seg0.ts" {
+		t.Fatalf("local playlist:\n%s", playlist)
+	}
+	e2eRequireProxied(t, uris[1], "/ts-proxy", "/video/stream.ts")
+
+	segmentURL := e2eProxyURL + "/local/vod/" + uris[0]
+	e2eRange(t, segmentURL, "", e2eStream[:4096])
+	e2eRange(t, segmentURL, "bytes=100-1099", e2eStream[100:1100])
+	e2eGet(t, e2eProxyURL+"/local/vod/missing.ts", nil, http.StatusNotFound)
+	e2eGet(t, e2eProxyURL+"/local/../usage.db", nil, http.StatusNotFound)
+}
+
+func testE2EShortURL(t *testing.T) {
+	shortURL := e2eShorten(t, e2eEndpoint("/proxy", "/master.m3u8"))
+	master := string(e2eGet(t, shortURL, nil, http.StatusOK))
+	variantURLs := e2eURILines(master)
+	e2eRequireProxied(t, variantURLs[0], "/proxy", "/video/index.m3u8")
+	e2eGet(t, e2eProxyURL+"/u/doesnotexist", nil, http.StatusNotFound)
+
+	// What it resolves to is accounted once, to the stored URL's API key
+	apiKey := fmt.Sprintf("short-%d", time.Now().UnixNano())
+	segment := e2eGet(t, e2eShorten(t, e2eEndpoint("/ts-proxy", "/video/seg0.ts")+"&api_key="+apiKey), nil, http.StatusOK)
+	var report struct {
+		Usage []struct {
+			Requests int64 `json:"requests"`
+			Bytes    int64 `json:"bytes"`
+		} `json:"usage"`
+	}
+	e2eJSON(t, e2eGet(t, e2eProxyURL+"/usage?api_key="+apiKey, e2eAdmin, http.StatusOK), &report)
+	if len(report.Usage) != 1 || report.Usage[0].Requests != 1 || report.Usage[0].Bytes != int64(len(segment)) {
+		t.Errorf("usage: %+v", report.Usage)
+	}
+}
+
+func testE2EMetrics(t *testing.T) {
+	e2eGet(t, e2eEndpoint("/proxy", "/video/index.m3u8"), nil, http.StatusOK)
+	e2eGet(t, e2eProxyURL+"/metrics", nil, http.StatusUnauthorized)
+	body := string(e2eGet(t, e2eProxyURL+"/metrics", e2eAdmin, http.StatusOK))
+	if !strings.Contains(body, "m3u8_proxy_upstream_requests_total{host=") {
+		t.Errorf("metrics:\n%s", body)
+	}
+}
+
+func testE2EAdminStreams(t *testing.T) {
+	e2eGet(t, e2eProxyURL+"/admin/streams", nil, http.StatusUnauthorized)
+	var list struct {
+		Streams json.RawMessage `json:"streams"`
+	}
+	e2eJSON(t, e2eGet(t, e2eProxyURL+"/admin/streams", e2eAdmin, http.StatusOK), &list)
+	if list.Streams == nil {
+		t.Errorf("no stream list")
+	}
+	resp, _ := e2eDo(t, "DELETE", e2eProxyURL+"/admin/streams?id=unknown", e2eAdmin, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("terminating an unknown stream: status %d, want 404", resp.StatusCode)
+	}
+}
+
+func testE2EHeaderSessions(t *testing.T) {
+	id := e2eHeaderSession(t, "127.0.0.1", map[string]string{"X-Origin-Auth": e2eOriginAuth})
+	sessionURL := e2eProxyURL + "/admin/header-sessions?id=" + id
+	var session struct {
+		Hosts []string `json:"hosts"`
+	}
+	e2eJSON(t, e2eGet(t, sessionURL, e2eAdmin, http.StatusOK), &session)
+	if len(session.Hosts) != 1 || session.Hosts[0] != "127.0.0.1" {
+		t.Errorf("session: %+v", session)
+	}
+
+	// Its headers only go to its hosts
+	segment := e2eOriginURL + "/private/seg.ts"
+	e2eGet(t, e2eProxyURL+"/ts-proxy?url="+url.QueryEscape(segment)+"&header_session="+id, nil, http.StatusOK)
+	other := e2eHeaderSession(t, "cdn.example.com", map[string]string{"X-Origin-Auth": e2eOriginAuth})
+	e2eGet(t, e2eProxyURL+"/ts-proxy?url="+url.QueryEscape(segment)+"&header_session="+other, nil, http.StatusForbidden)
+
+	resp, _ := e2eDo(t, "DELETE", sessionURL, e2eAdmin, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("DELETE: status %d", resp.StatusCode)
+	}
+	e2eGet(t, sessionURL, e2eAdmin, http.StatusNotFound)
+}
+
+func testE2EQuarantine(t *testing.T) {
+	var list struct {
+		Domains json.RawMessage `json:"domains"`
+	}
+	e2eJSON(t, e2eGet(t, e2eProxyURL+"/admin/quarantine", e2eAdmin, http.StatusOK), &list)
+	if list.Domains == nil {
+		t.Errorf("no domain list")
+	}
+	resp, _ := e2eDo(t, "DELETE", e2eProxyURL+"/admin/quarantine?domain=example.com", e2eAdmin, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("lifting a domain that isn't quarantined: status %d, want 404", resp.StatusCode)
+	}
+}
+
+func testE2EWatermark(t *testing.T) {
+	leaked := e2eGet(t, e2eEndpoint("/proxy", "/master.m3u8")+"&api_key=leaker", nil, http.StatusOK)
+	if !bytes.Contains(leaked, []byte("# wm:")) {
+		t.Fatalf("playlist not watermarked:\n%s", leaked)
+	}
+	var trace struct {
+		ID string `json:"id"`
+	}
+	resp, body := e2eDo(t, "POST", e2eProxyURL+"/admin/watermark", e2eAdmin, leaked)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	e2eJSON(t, body, &trace)
+	if trace.ID != "api_key:leaker" {
+		t.Errorf("traced to %q", trace.ID)
+	}
+}
+
+func testE2EAdminMetrics(t *testing.T) {
+	e2eGet(t, e2eEndpoint("/ts-proxy", "/keys/key.bin"), nil, http.StatusOK)
+	var snapshot struct {
+		Upstreams []struct {
+			Host     string `json:"host"`
+			Requests int64  `json:"requests"`
+		} `json:"upstreams"`
+	}
+	e2eJSON(t, e2eGet(t, e2eProxyURL+"/admin/metrics", e2eAdmin, http.StatusOK), &snapshot)
+	originHost := strings.TrimPrefix(e2eOriginURL, "http://")
+	for _, upstream := range snapshot.Upstreams {
+		if strings.HasPrefix(originHost, upstream.Host) && upstream.Requests > 0 {
+			return
+		}
+	}
+	t.Errorf("no requests to %s: %+v", originHost, snapshot.Upstreams)
+}
+
+func testE2EPrewarm(t *testing.T) {
+	resp, _ := e2eDo(t, "GET", e2eProxyURL+"/prewarm", e2eAdmin, nil)
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status %d, want 405", resp.StatusCode)
+	}
+	request, _ := json.Marshal(map[string]any{"urls": []string{e2eOriginURL + "/master.m3u8"}, "segments": 1})
+	resp, body := e2eDo(t, "POST", e2eProxyURL+"/prewarm", e2eAdmin, request)
+	var result struct {
+		Results []struct {
+			Playlists int    `json:"playlists"`
+			Segments  int    `json:"segments"`
+			Error     string `json:"error"`
+		} `json:"results"`
+	}
+	e2eJSON(t, body, &result)
+	if resp.StatusCode != http.StatusOK || len(result.Results) != 1 || result.Results[0].Playlists != 2 || result.Results[0].Segments < 1 {
+		t.Errorf("status %d: %s", resp.StatusCode, body)
+	}
+
+	// Segments warmed with headers only serve requests with the same ones
+	request, _ = json.Marshal(map[string]any{"urls": []string{e2eOriginURL + "/private/index.m3u8"},
+		"headers": map[string]string{"X-Origin-Auth": e2eOriginAuth}})
+	if resp, body := e2eDo(t, "POST", e2eProxyURL+"/prewarm", e2eAdmin, request); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	originLog.take("/private/seg.ts")
+	target := e2eEndpoint("/ts-proxy", "/private/seg.ts")
+	e2eGet(t, target, nil, http.StatusForbidden)
+	id := e2eHeaderSession(t, "127.0.0.1", map[string]string{"X-Origin-Auth": e2eOriginAuth})
+	e2eGet(t, target+"&header_session="+id, nil, http.StatusOK)
+	if got := originLog.take("/private/seg.ts"); len(got) != 1 {
+		t.Errorf("origin got %d requests, want only the anonymous one", len(got))
+	}
+}
+
+func testE2EUsage(t *testing.T) {
+	// A key of its own, so reruns in one process start from zero
+	apiKey := fmt.Sprintf("usage-%d", time.Now().UnixNano())
+	e2eGet(t, e2eEndpoint("/ts-proxy", "/video/seg0.ts")+"&api_key="+apiKey, nil, http.StatusOK)
+	var report struct {
+		Usage []struct {
+			APIKey   string `json:"apiKey"`
+			Requests int64  `json:"requests"`
+			Bytes    int64  `json:"bytes"`
+		} `json:"usage"`
+	}
+	e2eJSON(t, e2eGet(t, e2eProxyURL+"/usage?api_key="+apiKey, e2eAdmin, http.StatusOK), &report)
+	if len(report.Usage) != 1 || report.Usage[0].Requests != 1 || report.Usage[0].Bytes != int64(len(e2eEncrypt(e2eSegment))) {
+		t.Errorf("usage: %+v", report.Usage)
+	}
+}
+
+func testE2EDebugFetch(t *testing.T) {
+	var report struct {
+		FinalURL  string `json:"finalUrl"`
+		Status    int    `json:"status"`
+		Redirects []struct {
+			Status int `json:"status"`
+		} `json:"redirects"`
+		Body string `json:"body"`
+	}
+	e2eJSON(t, e2eGet(t, e2eEndpoint("/debug/fetch", "/moved/master.m3u8"), e2eAdmin, http.StatusOK), &report)
+	if report.Status != http.StatusOK || report.FinalURL != e2eOriginURL+"/master.m3u8" ||
+		len(report.Redirects) != 1 || report.Redirects[0].Status != http.StatusFound || !strings.HasPrefix(report.Body, "#EXTM3U") {
+		t.Errorf("report: %+v", report)
+	}
+}
+
+func testE2EPathProxy(t *testing.T) {
+	// Path-style URLs target https; url= points one at the plain-http origin
+	host := strings.TrimPrefix(e2eOriginURL, "http://")
+	target := e2eProxyURL + "/" + host + "/video/index.m3u8?url=" + url.QueryEscape(e2eOriginURL+"/video/index.m3u8")
+	variant := string(e2eGet(t, target, nil, http.StatusOK))
+	segmentURLs := e2eURILines(variant)
+	if len(segmentURLs) != 2 {
+		t.Fatalf("variant playlist:\n%s", variant)
+	}
+	key := e2eGet(t, e2eKeyURI(variant), nil, http.StatusOK)
+	for i, segmentURL := range segmentURLs {
+		if !strings.HasPrefix(segmentURL, e2eProxyURL+"/") {
+			t.Errorf("segment %d not rewritten through the proxy: %q", i, segmentURL)
+		}
+		if plain := e2eDecrypt(t, key, e2eGet(t, segmentURL, nil, http.StatusOK)); !bytes.Equal(plain, e2eSegment) {
+			t.Errorf("segment %d doesn't decrypt to the origin's", i)
+		}
+	}
+	e2eGet(t, e2eProxyURL+"/not-a-domain/index.m3u8", nil, http.StatusNotFound)
+}
+
+// e2eAdmin are the headers of an admin request
+var e2eAdmin = map[string]string{"X-Admin-Token": e2eAdminToken}
+
+// e2eEndpoint returns the proxy URL of endpoint for an origin path
+func e2eEndpoint(endpoint, originPath string) string {
+	return e2eProxyURL + endpoint + "?url=" + url.QueryEscape(e2eOriginURL+originPath)
+}
+
+// e2eRequireProxied fails unless proxiedURL goes through endpoint of the
+// proxy to originPath
+func e2eRequireProxied(t *testing.T, proxiedURL, endpoint, originPath string) {
+	t.Helper()
+	if !strings.HasPrefix(proxiedURL, e2eProxyURL+endpoint+"?") {
+		t.Fatalf("%q is not rewritten through %s", proxiedURL, endpoint)
+	}
+	u, err := url.Parse(proxiedURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target := u.Query().Get("url"); target != e2eOriginURL+originPath {
+		t.Fatalf("%q resolves to %q, want %q", proxiedURL, target, e2eOriginURL+originPath)
+	}
+}
+
+// e2eDo sends a request and reads the whole answer
+func e2eDo(t *testing.T, method, target string, headers map[string]string, body []byte) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e2eClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, target, err)
+	}
+	return resp, data
+}
+
+// e2eGet fetches target and requires the given status
+func e2eGet(t *testing.T, target string, headers map[string]string, status int) []byte {
+	t.Helper()
+	resp, body := e2eDo(t, "GET", target, headers, nil)
+	if resp.StatusCode != status {
+		t.Fatalf("GET %s: status %d, want %d: %s", target, resp.StatusCode, status, bytes.TrimSpace(body))
+	}
+	return body
+}
+
+// e2eRange fetches target, with a Range header unless rangeHeader is
+// empty, and requires the matching status and exactly want back
+func e2eRange(t *testing.T, target, rangeHeader string, want []byte) {
+	t.Helper()
+	var headers map[string]string
+	status := http.StatusOK
+	if rangeHeader != "" {
+		headers = map[string]string{"Range": rangeHeader}
+		status = http.StatusPartialContent
+	}
+	resp, body := e2eDo(t, "GET", target, headers, nil)
+	if resp.StatusCode != status {
+		t.Fatalf("%q: status %d, want %d: %s", rangeHeader, resp.StatusCode, status, bytes.TrimSpace(body))
+	}
+	if !bytes.Equal(body, want) {
+		t.Fatalf("%q: got %d bytes that don't match the origin's %d", rangeHeader, len(body), len(want))
+	}
+}
+
+// e2eJSON decodes a JSON answer into v
+func e2eJSON(t *testing.T, body []byte, v any) {
+	t.Helper()
+	if err := json.Unmarshal(body, v); err != nil {
+		t.Fatalf("%v: %s", err, body)
+	}
+}
+
+// mustMarshal encodes v as JSON
+func mustMarshal(t *testing.T, v any) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// e2eShorten returns a short URL for proxiedURL
+func e2eShorten(t *testing.T, proxiedURL string) string {
+	t.Helper()
+	var short struct {
+		ShortURL string `json:"shortUrl"`
+	}
+	e2eJSON(t, e2eGet(t, e2eProxyURL+"/shorten?url="+url.QueryEscape(proxiedURL), nil, http.StatusOK), &short)
+	return short.ShortURL
+}
+
+// e2eHeaderSession creates a header session for host and returns its id
+func e2eHeaderSession(t *testing.T, host string, headers map[string]string) string {
+	t.Helper()
+	request, _ := json.Marshal(map[string]any{"hosts": []string{host}, "headers": headers})
+	resp, body := e2eDo(t, "POST", e2eProxyURL+"/admin/header-sessions", e2eAdmin, request)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("creating a header session: status %d: %s", resp.StatusCode, body)
+	}
+	var session struct {
+		ID string `json:"id"`
+	}
+	e2eJSON(t, body, &session)
+	return session.ID
+}
+
+// e2eUnzip returns the files of a zip archive by name
+func e2eUnzip(t *testing.T, data []byte) map[string][]byte {
+	t.Helper()
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	for _, f := range archive.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name], err = io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return files
+}
+
+// e2eURILines returns the URI lines of a playlist
+func e2eURILines(m3u8Content string) []string {
+	var lines []string
+	for _, line := range strings.Split(m3u8Content, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	if lines == nil {
+		return []string{""}
+	}
+	return lines
+}
+
+// e2eKeyURI returns the URI of the first EXT-X-KEY tag
+func e2eKeyURI(m3u8Content string) string {
+	for _, line := range strings.Split(m3u8Content, "\n") {
+		if playlistTagName(line) == "EXT-X-KEY" {
+			_, attrList, _ := strings.Cut(strings.TrimSpace(line), ":")
+			return parseAttributeList(attrList)["URI"]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,95 @@
+package hlsproxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// egressChunk bounds one paced write, so concurrent responses interleave
+// instead of one large write holding the bucket
+const egressChunk = 32 << 10
+
+// egressBucket is a token bucket shared by every response, in bytes
+type egressBucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// egress caps the proxy's total outgoing bandwidth; nil means unlimited
+var egress *egressBucket
+
+// newEgressBucket allows mbps megabits per second with a burst of a quarter second
+func newEgressBucket(mbps float64) *egressBucket {
+	rate := mbps * 1e6 / 8
+	burst := max(rate/4, egressChunk)
+	return &egressBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait reserves n bytes and sleeps until the bucket can pay for them. A
+// reservation may drive the bucket into debt, which later callers wait off,
+// so writers are served roughly in arrival order.
+func (b *egressBucket) wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	deficit := -b.tokens
+	b.mu.Unlock()
+	if deficit <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Duration(deficit / b.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// Hand back what this write never sent
+		b.mu.Lock()
+		b.tokens += float64(n)
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// egressWriter paces a response through the shared egress bucket
+type egressWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+}
+
+func (w *egressWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), egressChunk)]
+		if err := egress.wait(w.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Flush keeps streaming handlers working through the wrapper
+func (w *egressWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *egressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,109 @@
+package hlsproxy
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// hopByHopHeaders apply to a single connection and must not be forwarded
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHop deletes hop-by-hop headers, including any named in Connection
+func removeHopByHop(h http.Header) {
+	for _, field := range h.Values("Connection") {
+		for _, name := range strings.Split(field, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// decodedBody closes both the decoder and the underlying body
+type decodedBody struct {
+	io.Reader
+	decoder io.Closer
+	body    io.Closer
+}
+
+func (d *decodedBody) Close() error {
+	d.decoder.Close()
+	return d.body.Close()
+}
+
+// sendUndecodableBody answers a request whose upstream playlist came with an
+// encoding the proxy can't decode, so it can't be rewritten
+func sendUndecodableBody(w http.ResponseWriter, encoding string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadGateway)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error": "Upstream sent the playlist with Content-Encoding " + encoding + ", which can't be decoded",
+		"code":  "undecodable_encoding",
+	})
+}
+
+// prepareUpstreamBody decompresses gzip and deflate response bodies in place.
+// net/http only does this itself when the proxy picked Accept-Encoding, not
+// when a caller-supplied header did. Partial content and encodings the proxy
+// can't decode are left untouched; their Content-Encoding is returned so the
+// caller can forward it to the client.
+func prepareUpstreamBody(resp *http.Response) string {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" {
+		return ""
+	}
+	if resp.StatusCode == http.StatusPartialContent {
+		return encoding
+	}
+
+	var decoder io.ReadCloser
+	switch encoding {
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return encoding
+		}
+		decoder = gz
+	case "deflate":
+		// Most servers send zlib-wrapped data despite the name; some send raw deflate
+		buffered := bufio.NewReader(resp.Body)
+		if header, err := buffered.Peek(2); err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			zr, err := zlib.NewReader(buffered)
+			if err != nil {
+				return encoding
+			}
+			decoder = zr
+		} else {
+			decoder = flate.NewReader(buffered)
+		}
+	default:
+		return encoding
+	}
+
+	resp.Body = &decodedBody{Reader: decoder, decoder: decoder, body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return ""
+}
@@ -0,0 +1,271 @@
+package hlsproxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// epgMaxBytes caps a decompressed XMLTV guide
+	epgMaxBytes = 512 << 20
+	// epgMaxCached bounds how many guides and filtered guides are cached
+	epgMaxCached = 32
+)
+
+// epgCacheTTL is how long fetched guides are served from memory
+var epgCacheTTL time.Duration
+
+// cachedGuide is one cached XMLTV document
+type cachedGuide struct {
+	data    []byte
+	expires time.Time
+}
+
+// guideCache keeps guides by URL, and filtered guides by URL and playlist
+type guideCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedGuide
+}
+
+var guides = &guideCache{entries: make(map[string]cachedGuide)}
+
+func (c *guideCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.data, true
+}
+
+func (c *guideCache) put(key string, data []byte) {
+	if epgCacheTTL <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= epgMaxCached {
+		now := time.Now()
+		for k, entry := range c.entries {
+			if now.After(entry.expires) || len(c.entries) >= epgMaxCached {
+				delete(c.entries, k)
+			}
+		}
+	}
+	c.entries[key] = cachedGuide{data: data, expires: time.Now().Add(epgCacheTTL)}
+}
+
+// fetchGuide fetches an XMLTV guide, gunzipping .xml.gz files
+func fetchGuide(ctx context.Context, guideURL string, rules requestRules) ([]byte, error) {
+	if data, ok := guides.get(guideURL); ok {
+		return data, nil
+	}
+	resp, err := fetchWithHeaders(ctx, guideURL, generateRequestHeaders(guideURL, rules.forURL(guideURL)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream returned %d for %s", resp.StatusCode, guideURL)
+	}
+	prepareUpstreamBody(resp)
+
+	// Guides are often served as gzip files rather than gzip-encoded
+	buffered := bufio.NewReader(resp.Body)
+	body := io.Reader(buffered)
+	if magic, _ := buffered.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		body = gz
+	}
+	data, err := io.ReadAll(io.LimitReader(body, epgMaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > epgMaxBytes {
+		return nil, fmt.Errorf("guide exceeds %d MB", epgMaxBytes>>20)
+	}
+	guides.put(guideURL, data)
+	return data, nil
+}
+
+// playlistChannelIDs returns the tvg-id of every channel in a channel list
+func playlistChannelIDs(content string) map[string]bool {
+	ids := make(map[string]bool)
+	_, channels := parseIPTVPlaylist(content)
+	for _, channel := range channels {
+		for _, tag := range channel.tags {
+			if playlistTagName(tag) == "EXTINF" {
+				if id := iptvAttr(tag, "tvg-id"); id != "" {
+					ids[id] = true
+				}
+			}
+		}
+	}
+	return ids
+}
+
+// filterGuide keeps only the channels and programmes of the given channel ids
+func filterGuide(data []byte, ids map[string]bool) ([]byte, error) {
+	var out bytes.Buffer
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+	encoder := xml.NewEncoder(&out)
+	depth := 0
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if depth == 1 && !guideElementWanted(t, ids) {
+				if err := skipElement(decoder); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+		if err := encoder.EncodeToken(xml.CopyToken(token)); err != nil {
+			return nil, err
+		}
+	}
+	if err := encoder.Flush(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// guideElementWanted reports whether a child of <tv> belongs to one of ids
+func guideElementWanted(element xml.StartElement, ids map[string]bool) bool {
+	attr := ""
+	switch element.Name.Local {
+	case "channel":
+		attr = "id"
+	case "programme":
+		attr = "channel"
+	default:
+		return true
+	}
+	for _, a := range element.Attr {
+		if a.Name.Local == attr {
+			return ids[a.Value]
+		}
+	}
+	return false
+}
+
+// skipElement reads up to the end of the element just started
+func skipElement(decoder *xml.Decoder) error {
+	for depth := 1; depth > 0; {
+		token, err := decoder.RawToken()
+		if err != nil {
+			return err
+		}
+		switch token.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+	}
+	return nil
+}
+
+// epgHandler serves an XMLTV guide from cache, fetching and gunzipping it
+// as needed. With &playlist= only the channels of that channel list, by
+// tvg-id, and their programmes are kept.
+// URL format: /epg?url={xmltv_url}&playlist={optional_m3u_url}&headers={optional_headers}
+func epgHandler(w http.ResponseWriter, r *http.Request) {
+	guideURL, _, err := validateRequest(r)
+	if err != nil {
+		sendEPGError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	rules, err := requestHeaderRules(r)
+	if err != nil {
+		sendEPGError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	playlistURL := r.URL.Query().Get("playlist")
+	key := guideURL + "\x00" + playlistURL
+	data, ok := guides.get(key)
+	if !ok {
+		if data, err = fetchGuide(r.Context(), guideURL, rules); err != nil {
+			sendUpstreamError(w, "Failed to fetch guide", err)
+			return
+		}
+		if playlistURL != "" {
+			content, err := fetchPlaylistText(r.Context(), playlistURL, generateRequestHeaders(playlistURL, rules.forURL(playlistURL)))
+			if err != nil {
+				sendUpstreamError(w, "Failed to fetch playlist", err)
+				return
+			}
+			if data, err = filterGuide(data, playlistChannelIDs(content)); err != nil {
+				sendEPGError(w, http.StatusBadGateway, "Invalid XMLTV guide: "+err.Error())
+				return
+			}
+			guides.put(key, data)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	if epgCacheTTL > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(epgCacheTTL.Seconds())))
+	}
+	w.Write(data)
+}
+
+// guideURLAttrs are the #EXTM3U attributes that point at a channel list's guide
+var guideURLAttrs = []string{"url-tvg", "x-tvg-url"}
+
+// rewriteGuideURLs points the guide attributes of an #EXTM3U line at /epg,
+// filtered to the channels of the list
+func rewriteGuideURLs(line, playlistURL, base, suffix string) string {
+	for _, attr := range guideURLAttrs {
+		start := strings.Index(strings.ToLower(line), attr+`="`)
+		if start == -1 {
+			continue
+		}
+		start += len(attr) + 2
+		end := strings.IndexByte(line[start:], '"')
+		if end == -1 {
+			continue
+		}
+		urls := strings.Split(line[start:start+end], ",")
+		for i, u := range urls {
+			resolved := resolveURL(strings.TrimSpace(u), playlistURL)
+			urls[i] = base + "/epg?url=" + url.QueryEscape(resolved) + "&playlist=" + url.QueryEscape(playlistURL) + suffix
+		}
+		line = line[:start] + strings.Join(urls, ",") + line[start+end:]
+	}
+	return line
+}
+
+func sendEPGError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
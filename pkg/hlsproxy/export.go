@@ -0,0 +1,138 @@
+package hlsproxy
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// maxExportResources bounds the files one /export archive downloads
+const maxExportResources = 20000
+
+// exportEntry is one upstream resource stored in an export archive
+type exportEntry struct {
+	url  string
+	name string
+}
+
+// exportHandler streams a zip holding a VOD playlist rewritten to relative
+// paths together with every segment, key and init section it references, so
+// the stream can be played offline. A master playlist contributes its
+// highest-bandwidth variant.
+// URL format: /export?url={m3u8_url}&headers={optional_headers}&filename={optional_name}
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	targetURL, _, err := validateRequest(r)
+	if err != nil {
+		sendStitchError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	rules, err := requestHeaderRules(r)
+	if err != nil {
+		sendStitchError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	playlistURL, content, err := fetchMediaPlaylist(r.Context(), targetURL, rules)
+	if err != nil {
+		sendUpstreamError(w, "Failed to fetch playlist", err)
+		return
+	}
+	playlist := parseMediaPlaylist(content, playlistURL)
+	if !playlist.endList && playlist.playlistType != "VOD" {
+		sendStitchError(w, http.StatusUnprocessableEntity, "Only VOD playlists can be exported")
+		return
+	}
+
+	// Name every resource once, in order of appearance; byte ranges of one
+	// file share its entry and keep their EXT-X-BYTERANGE offsets
+	var entries []exportEntry
+	names := make(map[string]string)
+	localize := func(resolvedURL string, kind uriKind) string {
+		if kind == licenseURI {
+			// Players of the archive still fetch licenses through this proxy
+			return licenseProxyURL(resolvedURL) + tokenParam(r)
+		}
+		if name, ok := names[resolvedURL]; ok {
+			return name
+		}
+		name := exportName(resolvedURL, len(entries))
+		names[resolvedURL] = name
+		entries = append(entries, exportEntry{url: resolvedURL, name: name})
+		return name
+	}
+	var lines []string
+	for _, line := range strings.Split(preparePlaylist(content, playlistURL), "\n") {
+		lines = append(lines, rewritePlaylistLine(line, playlistURL, false, localize))
+	}
+	if len(entries) > maxExportResources {
+		sendStitchError(w, http.StatusUnprocessableEntity, fmt.Sprintf("Playlist references more than %d files", maxExportResources))
+		return
+	}
+
+	name := downloadFilename(r.URL.Query().Get("filename"), targetURL, "")
+	name = strings.TrimSuffix(name, path.Ext(name)) + ".zip"
+	w.Header().Set("Content-Type", "application/zip")
+	if v := mime.FormatMediaType("attachment", map[string]string{"filename": name}); v != "" {
+		w.Header().Set("Content-Disposition", v)
+	}
+
+	archive := zip.NewWriter(w)
+	if err := writeExportFile(archive, "index.m3u8", strings.NewReader(strings.Join(lines, "\n"))); err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if err := exportResource(r.Context(), archive, entry, rules); err != nil {
+			// The archive is already partly sent; abort so it isn't mistaken for complete
+			log.Printf("Export of %s failed at %s: %v", targetURL, entry.url, err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+	archive.Close()
+}
+
+// exportName is the archive path of the n-th resource, keeping its extension
+func exportName(resolvedURL string, n int) string {
+	ext := ""
+	if u, err := url.Parse(resolvedURL); err == nil {
+		ext = strings.ToLower(path.Ext(u.Path))
+	}
+	if len(ext) > 8 || strings.ContainsAny(ext, `<>:"|?*\`) {
+		ext = ""
+	}
+	if ext == "" {
+		ext = ".bin"
+	}
+	return fmt.Sprintf("media/%05d%s", n, ext)
+}
+
+// exportResource downloads one resource into the archive
+func exportResource(ctx context.Context, archive *zip.Writer, entry exportEntry, rules requestRules) error {
+	resp, err := fetchWithHeaders(ctx, entry.url, generateRequestHeaders(entry.url, rules.forURL(entry.url)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upstream returned %s", resp.Status)
+	}
+	prepareUpstreamBody(resp)
+	return writeExportFile(archive, entry.name, resp.Body)
+}
+
+// writeExportFile stores a file uncompressed; media is compressed already
+func writeExportFile(archive *zip.Writer, name string, body io.Reader) error {
+	f, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, body)
+	return err
+}
@@ -0,0 +1,54 @@
+package hlsproxy
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"strings"
+)
+
+var (
+	// fetchEnabled turns the /fetch endpoint off when false
+	fetchEnabled = true
+	// fetchMaxBytes caps a /fetch response body after decoding; 0 is unlimited
+	fetchMaxBytes int64
+	// fetchContentTypes lists the media type patterns (e.g. "video/*") /fetch
+	// passes on from successful responses; empty allows any
+	fetchContentTypes []string
+)
+
+var errFetchTooLarge = errors.New("response exceeds FETCH_MAX_BYTES")
+
+// fetchContentTypeAllowed reports whether a Content-Type is in FETCH_CONTENT_TYPES
+func fetchContentTypeAllowed(contentType string) bool {
+	if len(fetchContentTypes) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range fetchContentTypes {
+		if wildcardMatch(strings.ToLower(pattern), mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchLimitReader fails with errFetchTooLarge once more than max bytes were
+// read, so a decompressed body can't grow without bound
+type fetchLimitReader struct {
+	r   io.Reader
+	max int64
+	n   int64
+}
+
+func (l *fetchLimitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.max {
+		return n - int(l.n-l.max), errFetchTooLarge
+	}
+	return n, err
+}
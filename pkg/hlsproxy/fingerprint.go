@@ -0,0 +1,146 @@
+package hlsproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
+)
+
+// tlsProfiles are the browser ClientHellos upstream connections can mimic
+var tlsProfiles = map[string]utls.ClientHelloID{
+	"chrome":  utls.HelloChrome_Auto,
+	"firefox": utls.HelloFirefox_Auto,
+	"safari":  utls.HelloSafari_Auto,
+	"edge":    utls.HelloEdge_Auto,
+	"ios":     utls.HelloIOS_Auto,
+}
+
+// tlsFingerprints maps hostname patterns (* wildcards) to a tlsProfiles name
+var tlsFingerprints map[string]string
+
+// validateTLSFingerprints rejects unknown profile names
+func validateTLSFingerprints(fingerprints map[string]string) error {
+	for pattern, name := range fingerprints {
+		if _, ok := tlsProfiles[name]; !ok {
+			names := make([]string, 0, len(tlsProfiles))
+			for n := range tlsProfiles {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("unknown TLS fingerprint %q for %q (want one of %s)", name, pattern, strings.Join(names, ", "))
+		}
+	}
+	return nil
+}
+
+// fingerprintTransport sends HTTPS requests for configured hosts over a
+// transport whose ClientHello mimics a browser, and everything else over the
+// standard one. h2 is set for hosts configured for HTTP/2, whose hellos offer
+// only h2.
+type fingerprintTransport struct {
+	std *http.Transport
+	h2  bool
+
+	mu       sync.Mutex
+	profiled map[string]http.RoundTripper
+}
+
+func (t *fingerprintTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Requests through a forward proxy are TLS-wrapped by net/http itself
+	if req.URL.Scheme != "https" || t.std.Proxy != nil {
+		return t.std.RoundTrip(req)
+	}
+	profile := matchHostPattern(tlsFingerprints, req.URL.Hostname())
+	if profile == "" {
+		return t.std.RoundTrip(req)
+	}
+	return t.transport(profile).RoundTrip(req)
+}
+
+// transport returns the shared transport for profile, creating it on first use
+func (t *fingerprintTransport) transport(profile string) http.RoundTripper {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if tr, ok := t.profiled[profile]; ok {
+		return tr
+	}
+	if t.profiled == nil {
+		t.profiled = make(map[string]http.RoundTripper)
+	}
+
+	dial := t.std.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	}
+	id := tlsProfiles[profile]
+	var tr http.RoundTripper
+	if t.h2 {
+		// net/http only speaks HTTP/2 over crypto/tls connections; the
+		// x/net transport runs it over the uTLS one
+		tr = &http2.Transport{
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dialUTLS(ctx, dial, network, addr, id, "h2")
+			},
+			IdleConnTimeout: t.std.IdleConnTimeout,
+		}
+	} else {
+		h1 := t.std.Clone()
+		h1.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialUTLS(ctx, dial, network, addr, id, "http/1.1")
+		}
+		tr = h1
+	}
+	t.profiled[profile] = tr
+	return tr
+}
+
+// dialUTLS opens a TLS connection presenting the ClientHello of id. The
+// browser's ALPN list is cut down to proto, the one protocol the transport
+// on top runs, and a server that picks no protocol or another is refused;
+// the rest of the hello, which is what JA3 fingerprints, is left as the
+// browser sends it.
+func dialUTLS(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error), network, addr string, id utls.ClientHelloID, proto string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	spec, err := utls.UTLSIdToSpec(id)
+	if err != nil {
+		return nil, err
+	}
+	for _, ext := range spec.Extensions {
+		if alpn, ok := ext.(*utls.ALPNExtension); ok {
+			alpn.AlpnProtocols = []string{proto}
+		}
+	}
+
+	conn, err := dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := utls.UClient(conn, &utls.Config{ServerName: host}, utls.HelloCustom)
+	if err := tlsConn.ApplyPreset(&spec); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if negotiated := tlsConn.ConnectionState().NegotiatedProtocol; proto == "h2" && negotiated != "h2" {
+		conn.Close()
+		return nil, fmt.Errorf("%s did not negotiate h2 (got %q)", host, negotiated)
+	}
+	return tlsConn, nil
+}
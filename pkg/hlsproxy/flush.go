@@ -0,0 +1,14 @@
+package hlsproxy
+
+import "net/http"
+
+// streamFlushBytes is how many body bytes a streamed response may buffer
+// before it is flushed to the client; 0 leaves flushing to net/http
+var streamFlushBytes int
+
+// writePlaylist writes a rewritten playlist and flushes it at once, so
+// players behind buffering proxies get it without waiting for more
+func writePlaylist(w http.ResponseWriter, playlist string) {
+	w.Write([]byte(playlist))
+	http.NewResponseController(w).Flush()
+}
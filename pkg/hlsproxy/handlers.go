@@ -0,0 +1,867 @@
+package hlsproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var sharedClient = &http.Client{
+	Transport: upstreamTransport(&http.Transport{
+		DialContext:         dialUpstream,
+		DisableKeepAlives:   false,
+		MaxIdleConns:        2000,
+		MaxIdleConnsPerHost: 500,
+		IdleConnTimeout:     90 * time.Second,
+	}),
+	CheckRedirect: checkRedirect,
+}
+
+// upstreamTransport wraps a transport with the script hooks, remembered
+// scheme switches, prewarm and per-domain caches, domain quarantine, circuit
+// breaker, host queue, per-domain timeouts and retries, credentials,
+// metrics, header casing, protocol selection and TLS fingerprinting every
+// upstream client shares
+func upstreamTransport(t *http.Transport) http.RoundTripper {
+	return &scriptTransport{next: &schemeTransport{next: &sessionRefreshTransport{next: &prewarmTransport{next: &cacheTransport{next: &quarantineTransport{next: &breakerTransport{next: &queueTransport{next: &domainPolicyTransport{next: &authTransport{next: &metricsTransport{next: &headerCaseTransport{next: newProtocolTransport(t)}}}}}}}}}}}}
+}
+
+// finalURL is the URL resp was served from after any redirects, which
+// relative playlist URIs resolve against; fallback when unknown
+func finalURL(resp *http.Response, fallback string) string {
+	if resp.Request != nil && resp.Request.URL != nil {
+		return resp.Request.URL.String()
+	}
+	return fallback
+}
+
+// checkRedirect enforces the redirect limit and the playback token's
+// domains, and re-applies the upstream headers on every hop, since net/http
+// rewrites Referer. Like net/http, it drops credentials when the host changes.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	observeSchemeRedirect(req, via)
+
+	// A playback token's domains hold for every hop, not just the URL asked for
+	if claims, _ := req.Context().Value(playbackClaimsKey{}).(*playbackClaims); claims != nil &&
+		len(claims.Domains) > 0 && !matchesAnyHost(claims.Domains, req.URL.Hostname()) {
+		return fmt.Errorf("%w: %s", errRedirectNotAllowed, req.URL.Hostname())
+	}
+
+	original := via[0]
+	for k, v := range original.Header {
+		req.Header[k] = v
+	}
+
+	crossHost := !strings.EqualFold(req.URL.Host, original.URL.Host)
+	// Optionally switch to the domain profile of the new host, keeping caller overrides
+	if redirectMatchDomain && crossHost {
+		for k, v := range generateRequestHeaders(req.URL.String(), headerOverrides(original)) {
+			req.Header.Set(k, v)
+		}
+	}
+	// Credentials are for the origin, not whatever host it redirects to
+	if crossHost {
+		for _, name := range credentialHeaders {
+			req.Header.Del(name)
+		}
+	}
+
+	return nil
+}
+
+// isM3U8URL checks if a URL points to an .m3u8 (or .m3u) file, ignoring query string and fragment
+func isM3U8URL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		// Fallback: strip query manually
+		if i := strings.Index(rawURL, "?"); i != -1 {
+			rawURL = rawURL[:i]
+		}
+		if i := strings.Index(rawURL, "#"); i != -1 {
+			rawURL = rawURL[:i]
+		}
+		lower := strings.ToLower(rawURL)
+		return strings.HasSuffix(lower, ".m3u8") || strings.HasSuffix(lower, ".m3u")
+	}
+	// Use path only (safe from query/fragment)
+	path := strings.ToLower(u.Path)
+	if strings.HasSuffix(path, ".m3u8") || strings.HasSuffix(path, ".m3u") {
+		return true
+	}
+	// Another proxy's URL is whatever it forwards to
+	if u.RawQuery != "" || strings.Contains(path, "/http") {
+		if target, ok := proxiedTarget(rawURL); ok {
+			return isM3U8URL(target)
+		}
+	}
+	return false
+}
+
+// resolveURL resolves a relative URL against a base URL
+func resolveURL(href, base string) string {
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return href
+	}
+
+	relURL, err := url.Parse(href)
+	if err != nil {
+		return href
+	}
+
+	return baseURL.ResolveReference(relURL).String()
+}
+
+// fetchWithHeaders performs a GET through the shared client with the given
+// headers, bound to ctx
+func fetchWithHeaders(ctx context.Context, targetURL string, requestHeaders map[string]string) (*http.Response, error) {
+	return fetch(ctx, fetchOptions{url: targetURL, headers: requestHeaders})
+}
+
+// fetchPlaylistText fetches a playlist and returns its body, failing on non-200 answers
+func fetchPlaylistText(ctx context.Context, targetURL string, requestHeaders map[string]string) (string, error) {
+	resp, err := fetchWithHeaders(ctx, targetURL, requestHeaders)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("upstream returned %d for %s", resp.StatusCode, targetURL)
+	}
+	prepareUpstreamBody(resp)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// validateRequest validates and extracts URL and headers from request
+func validateRequest(r *http.Request) (string, map[string]string, error) {
+	targetURL := r.URL.Query().Get("url")
+	if targetURL == "" {
+		return "", nil, fmt.Errorf("URL parameter is required")
+	}
+
+	rules, err := requestHeaderRules(r)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return targetURL, rules.forURL(targetURL), nil
+}
+
+// sendUpstreamError sends an error response for a failed upstream request,
+// 502 or 504 with an error code telling DNS, TLS, timeout and refused
+// connections apart
+func sendUpstreamError(w http.ResponseWriter, message string, err error) {
+	if writeUnavailable(w, err) {
+		return
+	}
+	status, code := classifyUpstreamError(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":   message,
+		"details": err.Error(),
+		"code":    code,
+	})
+}
+
+// sendError sends an error response
+func sendError(w http.ResponseWriter, message string, details interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":   message,
+		"details": details,
+	})
+}
+
+// m3u8ProxyHandler handles M3U8 playlist proxying
+func m3u8ProxyHandler(w http.ResponseWriter, r *http.Request) {
+	targetURL, parsedHeaders, err := validateRequest(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	// Optional EXT-X-START offset in seconds, negative meaning behind the live edge
+	startParam := r.URL.Query().Get("start")
+	var startOffset float64
+	if startParam != "" {
+		if startOffset, err = strconv.ParseFloat(startParam, 64); err != nil || math.IsNaN(startOffset) || math.IsInf(startOffset, 0) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "start must be a number of seconds"})
+			return
+		}
+	}
+
+	// Optional window of segments: from_seq={media_sequence}&count={segments}
+	fromSeqParam, countParam := r.URL.Query().Get("from_seq"), r.URL.Query().Get("count")
+	fromSeq, count := int64(-1), 0
+	if fromSeqParam != "" {
+		if fromSeq, err = strconv.ParseInt(fromSeqParam, 10, 64); err != nil || fromSeq < 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "from_seq must be a media sequence number"})
+			return
+		}
+	}
+	if countParam != "" {
+		if count, err = strconv.Atoi(countParam); err != nil || count < 1 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "count must be a positive number of segments"})
+			return
+		}
+	}
+
+	if !checkPlaylistDepth(w, r) {
+		return
+	}
+
+	if _, err := injectParam(r); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	requestHeaders := requestHeadersFor(r, targetURL, parsedHeaders)
+
+	resp, err := fetch(withPlaylistHealth(r.Context()), fetchOptions{url: targetURL, headers: requestHeaders, overrides: parsedHeaders})
+	if err != nil {
+		sendUpstreamError(w, "Failed to proxy m3u8 content", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// Error pages aren't playlists; pass the status on without reading them
+		sendUpstreamStatus(w, resp)
+		return
+	}
+	if encoding := prepareUpstreamBody(resp); encoding != "" {
+		sendUndecodableBody(w, encoding)
+		return
+	}
+	baseURL := finalURL(resp, targetURL)
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		sendError(w, "Failed to read m3u8 content", err.Error())
+		return
+	}
+
+	if variantFailover {
+		variants.record(string(body), targetURL)
+	}
+	if keyCacheTTL > 0 {
+		keyCache.observe(string(body), targetURL)
+	}
+	if segmentTiming {
+		segmentDurations.observe(string(body), targetURL)
+	}
+
+	// IPTV channel lists aren't HLS; their entries are channels
+	if isIPTVPlaylist(string(body)) {
+		serveIPTVPlaylist(w, r, string(body), baseURL)
+		return
+	}
+
+	// SAMPLE-AES breaks hls.js, so say so instead of serving a dead stream
+	sampleAES := r.URL.Query().Get("sample_aes")
+	if sampleAESModeFor(r) == "reject" {
+		if method := sampleAESMethod(string(body)); method != "" {
+			sendSampleAESError(w, method)
+			return
+		}
+	}
+
+	// Encode headers for URL parameters, keeping any per-URL-pattern rules
+	rules := parseHeadersParam(r.URL.Query().Get("headers"))
+	encodedHeaders := url.QueryEscape(rules.encode(requestHeadersFor(r, targetURL, rules["*"])))
+	encodedHeaders += headerParams(r)
+
+	// Registered playlist transformers, such as ?repair=1, run before rewriting
+	if body, err = transformBody(r, targetURL, playlistContentType, body); err != nil {
+		sendError(w, "Failed to transform m3u8 content", err.Error())
+		return
+	}
+	m3u8Content := string(body)
+	repair := r.URL.Query().Get("repair") == "1"
+
+	if fromSeqParam != "" || countParam != "" {
+		var ok bool
+		if m3u8Content, ok = windowPlaylist(m3u8Content, fromSeq, count); !ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			json.NewEncoder(w).Encode(map[string]string{"error": "No segments in the requested from_seq/count window"})
+			return
+		}
+	}
+
+	if startParam != "" {
+		m3u8Content = setStartOffset(m3u8Content, startOffset)
+	}
+
+	// Optional default audio language: a list, or "auto" for Accept-Language
+	switch audioLang := r.URL.Query().Get("audio_lang"); audioLang {
+	case "":
+	case "auto":
+		w.Header().Add("Vary", "Accept-Language")
+		m3u8Content = selectAudioDefault(m3u8Content, parseAcceptLanguage(r.Header.Get("Accept-Language")))
+	default:
+		m3u8Content = selectAudioDefault(m3u8Content, splitList(audioLang))
+	}
+
+	// Usage accounting keys and the stream id travel with the rewritten URLs
+	keyParam := streamParam(r, targetURL)
+	if apiKey := r.URL.Query().Get("api_key"); apiKey != "" {
+		keyParam += "&api_key=" + url.QueryEscape(apiKey)
+	}
+
+	// Optional relative URLs, carried over to variants
+	relative := r.URL.Query().Get("rewrite") == "relative"
+
+	// Live refreshes reuse the previous rewrite of unchanged lines
+	playlistBase := rewriteBaseURL(r, playlistBaseURL(r))
+	rewritten := rewriteLivePlaylist(playlistBase+"\x00"+r.URL.RawQuery, m3u8Content, baseURL, func(resolvedURL string, kind uriKind) string {
+		if kind == playlistURI {
+			newURL := fmt.Sprintf("%s/proxy?url=%s&headers=%s",
+				playlistBase,
+				url.QueryEscape(resolvedURL),
+				encodedHeaders)
+			if repair {
+				newURL += "&repair=1"
+			}
+			if startParam != "" {
+				newURL += "&start=" + url.QueryEscape(startParam)
+			}
+			if fromSeqParam != "" {
+				newURL += "&from_seq=" + url.QueryEscape(fromSeqParam)
+			}
+			if countParam != "" {
+				newURL += "&count=" + url.QueryEscape(countParam)
+			}
+			if relative {
+				newURL += "&rewrite=relative"
+			}
+			if sampleAES != "" {
+				newURL += "&sample_aes=" + url.QueryEscape(sampleAES)
+			}
+			return newURL + keyParam
+		}
+		return fmt.Sprintf("%s/%s?url=%s&headers=%s",
+			rewriteBaseURL(r, segmentBaseURL(r, resolvedURL)),
+			segmentEndpoint(kind),
+			url.QueryEscape(resolvedURL),
+			encodedHeaders) + keyParam
+	})
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	if wantsDownload(r) {
+		w.Header().Set("Content-Disposition", contentDisposition(r, targetURL, "application/vnd.apple.mpegurl"))
+	}
+	writePlaylist(w, rewritten)
+}
+
+// tsProxyHandler handles TS segment and general content proxying
+func tsProxyHandler(w http.ResponseWriter, r *http.Request) {
+	targetURL, parsedHeaders, err := validateRequest(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if redirectToOrigin(w, r, targetURL) {
+		return
+	}
+
+	// Forward Range so byte-range addressed segments (e.g. from DASH manifests) work
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		if _, exists := parsedHeaders["Range"]; !exists {
+			parsedHeaders["Range"] = rangeHeader
+		}
+	}
+
+	requestHeaders := requestHeadersFor(r, targetURL, parsedHeaders)
+
+	// Keys of live AES-128 streams are cached until they rotate
+	if serveCachedKey(w, r, targetURL, requestHeaders, parsedHeaders) {
+		return
+	}
+
+	timer := startSegmentTimer(r, targetURL, parsedHeaders["Range"])
+	resp, err := fetch(r.Context(), fetchOptions{url: targetURL, headers: requestHeaders, overrides: parsedHeaders, retry429: true})
+	if err != nil {
+		sendUpstreamError(w, "Failed to proxy segment", err)
+		return
+	}
+
+	// Live edge glitch: try the same media sequence on a sibling variant.
+	// The 404 is closed first, giving its host queue slot back, since the
+	// sibling is usually on the same host.
+	if resp.StatusCode == http.StatusNotFound && variantFailover {
+		resp.Body.Close()
+		resp.Body = http.NoBody
+		if alternate := variants.retry(r.Context(), targetURL, requestHeaders); alternate != nil {
+			resp = alternate
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		sendUpstreamStatus(w, resp)
+		return
+	}
+	timer.watch(resp)
+	defer timer.finish()
+
+	// Headers upstream marked hop-by-hop, e.g. in Connection, aren't copied on
+	removeHopByHop(resp.Header)
+
+	// Decode compressed bodies, or forward the encoding when they can't be decoded
+	if encoding := prepareUpstreamBody(resp); encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+
+	// Determine content type
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		if strings.HasSuffix(targetURL, ".ts") {
+			contentType = "video/mp2t"
+		} else if strings.HasSuffix(targetURL, ".m3u8") {
+			contentType = "application/vnd.apple.mpegurl"
+		} else if strings.Contains(targetURL, ".jpg") || strings.Contains(targetURL, ".jpeg") ||
+			strings.Contains(targetURL, ".png") || strings.Contains(targetURL, ".gif") ||
+			strings.Contains(targetURL, ".webp") || strings.Contains(targetURL, ".bmp") ||
+			strings.Contains(targetURL, ".svg") {
+			contentType = "image/jpeg"
+		} else {
+			contentType = "application/octet-stream"
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	setSegmentCacheControl(w, targetURL, resp)
+	if contentRange := resp.Header.Get("Content-Range"); contentRange != "" {
+		w.Header().Set("Content-Range", contentRange)
+	}
+	if acceptRanges := resp.Header.Get("Accept-Ranges"); acceptRanges != "" {
+		w.Header().Set("Accept-Ranges", acceptRanges)
+	}
+	if wantsDownload(r) {
+		w.Header().Set("Content-Disposition", contentDisposition(r, targetURL, contentType))
+	}
+	if resp.ContentLength >= 0 {
+		// Lets players detect a truncated segment even if the abort below is missed
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+
+	// Registered transformers, such as subtitle rewriting, get whole bodies
+	if serveTransformed(w, r, targetURL, contentType, resp) {
+		return
+	}
+
+	// Optional integrity checks of what reaches the player
+	out := w
+	if verifySegments {
+		verifier := newSegmentVerifier(w, r, targetURL, resp, contentType)
+		defer verifier.finish()
+		out = verifier
+	}
+	out.WriteHeader(resp.StatusCode)
+
+	copyUpstreamBody(out, resp)
+}
+
+// mp4ProxyHandler handles MP4 video proxying with range support
+func mp4ProxyHandler(w http.ResponseWriter, r *http.Request) {
+	targetURL, parsedHeaders, err := validateRequest(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	if redirectToOrigin(w, r, targetURL) {
+		return
+	}
+
+	// Bound concurrent MP4 transfers, which dominate bandwidth
+	release, err := acquireMP4Transfer(r)
+	if err != nil {
+		sendTransferLimit(w, err)
+		return
+	}
+	defer release()
+
+	// Forward Range header if provided by the client
+	rangeHeader := r.Header.Get("Range")
+	if rangeHeader != "" {
+		parsedHeaders["Range"] = rangeHeader
+	}
+
+	requestHeaders := requestHeadersFor(r, targetURL, parsedHeaders)
+
+	// Opt-in relocation of a trailing moov atom so playback starts immediately
+	if r.URL.Query().Get("faststart") == "1" && serveFaststartMP4(w, r, targetURL, requestHeaders, parsedHeaders) {
+		return
+	}
+
+	// Range-aware disk cache for files many viewers seek around in
+	if serveCachedMP4(w, r, targetURL, requestHeaders, parsedHeaders) {
+		return
+	}
+
+	// Opt-in multi-connection accelerator for slow origins
+	if serveParallelMP4(w, r, targetURL, requestHeaders) {
+		return
+	}
+
+	resp, err := fetch(r.Context(), fetchOptions{url: targetURL, headers: requestHeaders, overrides: parsedHeaders})
+	if err != nil {
+		sendUpstreamError(w, "Failed to proxy mp4 content", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	// Decode compressed bodies, or forward the encoding when they can't be decoded
+	if encoding := prepareUpstreamBody(resp); encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+
+	// Use upstream headers when available
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "video/mp4"
+	}
+	w.Header().Set("Content-Type", contentType)
+	setSegmentCacheControl(w, targetURL, resp)
+
+	if contentLength := resp.Header.Get("Content-Length"); contentLength != "" {
+		w.Header().Set("Content-Length", contentLength)
+	}
+
+	if contentRange := resp.Header.Get("Content-Range"); contentRange != "" {
+		w.Header().Set("Content-Range", contentRange)
+	}
+
+	acceptRanges := resp.Header.Get("Accept-Ranges")
+	if acceptRanges == "" {
+		acceptRanges = "bytes"
+	}
+	w.Header().Set("Accept-Ranges", acceptRanges)
+	w.Header().Set("Content-Disposition", contentDisposition(r, targetURL, contentType))
+
+	w.WriteHeader(resp.StatusCode)
+
+	io.Copy(&clientWriter{w: w}, resp.Body)
+}
+
+// fetchHandler handles generic fetch requests with optional referer and custom headers
+func fetchHandler(w http.ResponseWriter, r *http.Request) {
+	if !fetchEnabled {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "The /fetch endpoint is disabled"})
+		return
+	}
+
+	targetURL := r.URL.Query().Get("url")
+	if targetURL == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "URL parameter is required"})
+		return
+	}
+
+	// Optional referer convenience param
+	referer := r.URL.Query().Get("ref")
+
+	// Optional header overrides via `headers` query param (URL-escaped JSON)
+	rules, err := requestHeaderRules(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	parsedHeaders := rules.forURL(targetURL)
+	if referer != "" {
+		parsedHeaders["Referer"] = referer
+	}
+	// Forward Range from client if present and not overridden
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		if _, exists := parsedHeaders["Range"]; !exists {
+			parsedHeaders["Range"] = rangeHeader
+		}
+	}
+
+	// Generate headers tailored to the target domain, allowing overrides
+	requestHeaders := requestHeadersFor(r, targetURL, parsedHeaders)
+
+	resp, err := fetch(r.Context(), fetchOptions{url: targetURL, headers: requestHeaders, overrides: parsedHeaders})
+	if writeUnavailable(w, err) {
+		return
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Request failed",
+			"error":   err.Error(),
+		})
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 300 && !fetchContentTypeAllowed(resp.Header.Get("Content-Type")) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Request failed",
+			"error":   fmt.Sprintf("upstream content type %q is not allowed", resp.Header.Get("Content-Type")),
+		})
+		return
+	}
+	if fetchMaxBytes > 0 && resp.ContentLength > fetchMaxBytes {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Request failed",
+			"error":   errFetchTooLarge.Error(),
+		})
+		return
+	}
+
+	// Decode compressed bodies, or forward the encoding when they can't be decoded
+	if encoding := prepareUpstreamBody(resp); encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+
+	// Propagate upstream content headers when useful
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	if contentLength := resp.Header.Get("Content-Length"); contentLength != "" {
+		w.Header().Set("Content-Length", contentLength)
+	}
+	if contentRange := resp.Header.Get("Content-Range"); contentRange != "" {
+		w.Header().Set("Content-Range", contentRange)
+	}
+	if acceptRanges := resp.Header.Get("Accept-Ranges"); acceptRanges != "" {
+		w.Header().Set("Accept-Ranges", acceptRanges)
+	}
+	if wantsDownload(r) {
+		w.Header().Set("Content-Disposition", contentDisposition(r, targetURL, resp.Header.Get("Content-Type")))
+	}
+
+	w.WriteHeader(resp.StatusCode)
+	if fetchMaxBytes <= 0 {
+		io.Copy(w, resp.Body)
+		return
+	}
+	// Compressed bodies can expand far beyond their Content-Length
+	if _, err := io.Copy(w, &fetchLimitReader{r: resp.Body, max: fetchMaxBytes}); errors.Is(err, errFetchTooLarge) {
+		log.Printf("Aborting /fetch of %s: %v", targetURL, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// ghostClientLimit caps how many forward proxies keep a client, since the
+// proxy param can name any of them
+const ghostClientLimit = 64
+
+// ghostClientCache keeps one client, with its pooled connections and
+// per-protocol transports, per forward proxy
+type ghostClientCache struct {
+	mu      sync.Mutex
+	clients map[string]*http.Client
+	order   []string // proxy URLs, oldest first
+}
+
+var ghostClients = &ghostClientCache{clients: make(map[string]*http.Client)}
+
+// get returns the client for proxyURL, creating it on first use and
+// dropping the oldest one past ghostClientLimit
+func (c *ghostClientCache) get(proxyURL *url.URL) *http.Client {
+	key := proxyURL.String()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if client, ok := c.clients[key]; ok {
+		return client
+	}
+	if len(c.order) >= ghostClientLimit {
+		delete(c.clients, c.order[0])
+		c.order = c.order[1:]
+	}
+	client := &http.Client{
+		Transport: upstreamTransport(&http.Transport{
+			Proxy:           http.ProxyURL(proxyURL),
+			DialContext:     dialUpstream,
+			IdleConnTimeout: 90 * time.Second,
+		}),
+		CheckRedirect: checkRedirect,
+	}
+	c.clients[key] = client
+	c.order = append(c.order, key)
+	return client
+}
+
+// ghostProxyHandler handles requests through a Ghost IP proxy
+// URL format: /ghost-proxy?url={target_url}&proxy={proxy_url}&headers={optional_headers}
+func ghostProxyHandler(w http.ResponseWriter, r *http.Request) {
+	targetURL := r.URL.Query().Get("url")
+	if targetURL == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "URL parameter is required"})
+		return
+	}
+
+	// Get proxy URL (default to the configured Ghost IP)
+	proxyURL := r.URL.Query().Get("proxy")
+	if proxyURL == "" {
+		proxyURL = ghostProxyURL
+	}
+
+	// Parse proxy URL
+	parsedProxyURL, err := url.Parse(proxyURL)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error":   "Invalid proxy URL",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	// Optional header overrides via `headers` query param (URL-escaped JSON);
+	// header session headers are looked up again on every request
+	rules := parseHeadersParam(r.URL.Query().Get("headers"))
+	sessionRules, err := requestHeaderRules(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	parsedHeaders := sessionRules.forURL(targetURL)
+
+	// Generate headers tailored to the target domain, allowing overrides
+	requestHeaders := requestHeadersFor(r, targetURL, parsedHeaders)
+
+	proxyClient := ghostClients.get(parsedProxyURL)
+
+	// Forward Range from client if present and not overridden
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		if _, exists := requestHeaders["Range"]; !exists {
+			requestHeaders["Range"] = rangeHeader
+		}
+	}
+
+	resp, err := fetch(r.Context(), fetchOptions{url: targetURL, headers: requestHeaders, overrides: parsedHeaders, client: proxyClient})
+	if writeUnavailable(w, err) {
+		return
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Request through proxy failed",
+			"error":   err.Error(),
+		})
+		return
+	}
+	defer resp.Body.Close()
+	encoding := prepareUpstreamBody(resp)
+
+	// Check if it's an M3U8 file
+	contentType := resp.Header.Get("Content-Type")
+	isM3U8 := strings.Contains(contentType, "mpegurl") ||
+		isM3U8URL(targetURL) // ✅ Use fixed detector
+
+	if isM3U8 {
+		if encoding != "" {
+			sendUndecodableBody(w, encoding)
+			return
+		}
+		// Read and process M3U8 content
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// Encode headers and proxy for URL parameters, keeping any per-URL-pattern rules
+		encodedHeaders := url.QueryEscape(rules.encode(requestHeadersFor(r, targetURL, rules["*"])))
+		encodedHeaders += headerParams(r)
+		encodedProxy := url.QueryEscape(proxyURL)
+
+		// Everything, playlists and segments alike, goes back through the ghost
+		// proxy. Relative URIs resolve against where a redirect ended up.
+		rewritten := rewritePlaylist(string(body), finalURL(resp, targetURL), func(resolvedURL string, kind uriKind) string {
+			isPlaylist := kind == playlistURI
+			base := playlistBaseURL(r)
+			if !isPlaylist {
+				base = segmentBaseURL(r, resolvedURL)
+			}
+			if kind == licenseURI {
+				// License servers are reached directly, not through the ghost proxy
+				return fmt.Sprintf("%s/license-proxy?url=%s&headers=%s", rewriteBaseURL(r, base), url.QueryEscape(resolvedURL), encodedHeaders)
+			}
+			newURL := fmt.Sprintf("%s/ghost-proxy?url=%s&proxy=%s&headers=%s",
+				rewriteBaseURL(r, base),
+				url.QueryEscape(resolvedURL),
+				encodedProxy,
+				encodedHeaders)
+			if isPlaylist && r.URL.Query().Get("rewrite") == "relative" {
+				newURL += "&rewrite=relative"
+			}
+			return newURL
+		})
+
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		writePlaylist(w, rewritten)
+	} else {
+		// Stream non-M3U8 content directly
+		if encoding != "" {
+			w.Header().Set("Content-Encoding", encoding)
+		}
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		if contentLength := resp.Header.Get("Content-Length"); contentLength != "" {
+			w.Header().Set("Content-Length", contentLength)
+		}
+		if contentRange := resp.Header.Get("Content-Range"); contentRange != "" {
+			w.Header().Set("Content-Range", contentRange)
+		}
+		if acceptRanges := resp.Header.Get("Accept-Ranges"); acceptRanges != "" {
+			w.Header().Set("Accept-Ranges", acceptRanges)
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}
+}
@@ -0,0 +1,59 @@
+package hlsproxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// preserveHeaderCase lists hostname patterns (* wildcards) whose requests
+// carry the caller's headers with exactly the casing given in `headers`
+var preserveHeaderCase []string
+
+// headerCaseTransport re-keys the caller's header overrides to their literal
+// names. net/http canonicalizes names on Set but writes map keys verbatim over
+// HTTP/1.1, so a WAF expecting e.g. "referer" sees it. HTTP/2 and HTTP/3
+// always send lowercase names, which is what such origins usually want anyway.
+type headerCaseTransport struct {
+	next http.RoundTripper
+}
+
+func (t *headerCaseTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	overrides := headerOverrides(req)
+	if len(overrides) == 0 || !preservesHeaderCase(req.URL.Hostname()) {
+		return t.next.RoundTrip(req)
+	}
+
+	var header http.Header
+	for name, value := range overrides {
+		canonical := http.CanonicalHeaderKey(name)
+		if name == canonical || value == "" || strings.EqualFold(name, "Host") {
+			continue
+		}
+		if header == nil {
+			header = req.Header.Clone()
+		}
+		delete(header, canonical)
+		header[name] = []string{value}
+		if canonical == "User-Agent" {
+			// An empty canonical entry stops net/http adding its own User-Agent
+			header[canonical] = []string{""}
+		}
+	}
+	if header == nil {
+		return t.next.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header = header
+	return t.next.RoundTrip(req)
+}
+
+// preservesHeaderCase reports whether host is listed in PRESERVE_HEADER_CASE
+func preservesHeaderCase(host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range preserveHeaderCase {
+		if wildcardMatch(strings.ToLower(pattern), host) {
+			return true
+		}
+	}
+	return false
+}
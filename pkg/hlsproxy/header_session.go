@@ -0,0 +1,183 @@
+package hlsproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// headerSessions backs /admin/header-sessions; set up in main from the config
+var headerSessions Store = newMemoryStore()
+
+// headerSessionTTL is how long a header session lives after its last update
+var headerSessionTTL time.Duration
+
+// headerSessionIDLength is the length of header session ids, long enough
+// that they can't be guessed
+const headerSessionIDLength = 24
+
+// headerSession is a stored header session, also the JSON accepted by
+// /admin/header-sessions. Headers take the same forms as the headers param,
+// flat or per URL pattern. They are only sent to the hosts matching one of
+// Hosts, e.g. "cdn.example.com" or "*.example.com", since the session id
+// travels in every rewritten URL and anyone holding it could otherwise point
+// /fetch at their own server and read the credentials.
+type headerSession struct {
+	Hosts   []string        `json:"hosts"`
+	Headers json.RawMessage `json:"headers"`
+}
+
+// loadHeaderSession returns the stored header session id
+func loadHeaderSession(id string) (headerSession, bool, error) {
+	stored, ok, err := headerSessions.Get(id)
+	if err != nil || !ok {
+		return headerSession{}, ok, err
+	}
+	var session headerSession
+	if err := json.Unmarshal(stored, &session); err != nil {
+		return headerSession{}, false, fmt.Errorf("invalid header session: %w", err)
+	}
+	return session, true, nil
+}
+
+// save stores the session as id
+func (s headerSession) save(id string) error {
+	record, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return headerSessions.Set(id, record, headerSessionTTL)
+}
+
+// rules returns the session's header rules
+func (s headerSession) rules() headerRules {
+	return parseHeadersParam(string(s.Headers))
+}
+
+// appliesTo reports whether targetURL is on one of the session's hosts
+func (s headerSession) appliesTo(targetURL string) bool {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, pattern := range s.Hosts {
+		if wildcardMatch(strings.ToLower(pattern), host) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestRules are the header rules of a request: the headers param, then
+// the headers of its header_session for the session's hosts, then the
+// client headers named in fwd_headers
+type requestRules struct {
+	params    headerRules
+	session   headerSession
+	forwarded map[string]string
+}
+
+// forURL merges the rules that apply to targetURL
+func (rules requestRules) forURL(targetURL string) map[string]string {
+	headers := rules.params.forURL(targetURL)
+	if rules.session.appliesTo(targetURL) {
+		for k, v := range rules.session.rules().forURL(targetURL) {
+			headers[k] = v
+		}
+	}
+	for k, v := range rules.forwarded {
+		headers[k] = v
+	}
+	return headers
+}
+
+// requestHeaderRules returns the header rules of a request, looking up the
+// current headers of its header_session, if any
+func requestHeaderRules(r *http.Request) (requestRules, error) {
+	rules := requestRules{
+		params:    parseHeadersParam(r.URL.Query().Get("headers")),
+		forwarded: forwardedHeaders(r),
+	}
+	if id := r.URL.Query().Get("header_session"); id != "" {
+		session, ok, err := loadHeaderSession(id)
+		if err != nil {
+			return requestRules{}, fmt.Errorf("failed to look up header session: %w", err)
+		}
+		if !ok {
+			return requestRules{}, fmt.Errorf("header session not found or expired")
+		}
+		rules.session = session
+	}
+	return rules, nil
+}
+
+// adminHeaderSessionsHandler manages header sessions: POST creates one for
+// the given hosts and returns its id, PUT ?id= replaces its headers (and
+// hosts, when given), GET ?id= shows them and DELETE ?id= removes it. Playlists proxied with &header_session={id} carry
+// the id instead of the headers, so every segment request uses the session's
+// current headers, e.g. after an extractor refreshed a token.
+func adminHeaderSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id := r.URL.Query().Get("id")
+	if r.Method != http.MethodPost && (id == "" || strings.Trim(id, shortIDAlphabet) != "") {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "id parameter is required"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		session, ok, err := loadHeaderSession(id)
+		if err != nil {
+			sendError(w, "Failed to look up header session", err.Error())
+			return
+		}
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Header session not found or expired"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "hosts": session.Hosts, "headers": session.Headers})
+	case http.MethodPost, http.MethodPut:
+		var body headerSession
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.rules()) == 0 ||
+			(r.Method == http.MethodPost && len(body.Hosts) == 0) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Body must be {\"hosts\": [...], \"headers\": {...}} with at least one host and header"})
+			return
+		}
+		if r.Method == http.MethodPost {
+			id = randomID(headerSessionIDLength)
+		} else if current, ok, err := loadHeaderSession(id); err != nil || !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Header session not found or expired"})
+			return
+		} else if len(body.Hosts) == 0 {
+			body.Hosts = current.Hosts
+		}
+		if err := body.save(id); err != nil {
+			sendError(w, "Failed to store header session", err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":        id,
+			"hosts":     body.Hosts,
+			"param":     "header_session=" + id,
+			"expiresIn": int(headerSessionTTL.Seconds()),
+		})
+	case http.MethodDelete:
+		if err := headerSessions.Delete(id); err != nil {
+			sendError(w, "Failed to delete header session", err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"deleted": id})
+	default:
+		w.Header().Set("Allow", "GET, POST, PUT, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Use POST to create, PUT to update, GET to show or DELETE to remove a header session"})
+	}
+}
@@ -0,0 +1,304 @@
+package hlsproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+)
+
+type headerOverridesKey struct{}
+
+// minimalHeaderDomains lists hostname patterns that get only the basic
+// headers, for origins rejecting requests that carry Origin or Referer
+var minimalHeaderDomains []string
+
+// generateBasicHeaders returns the headers every upstream request carries
+func generateBasicHeaders() map[string]string {
+	return map[string]string{
+		"User-Agent":      "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36",
+		"Accept":          "*/*",
+		"Accept-Language": "en-US,en;q=0.9",
+	}
+}
+
+// generateHeadersForDomain generates domain-specific headers
+func generateHeadersForDomain(targetURL *url.URL) map[string]string {
+	headers := generateBasicHeaders()
+
+	hostname := strings.ToLower(targetURL.Hostname())
+
+	// Add domain-specific headers
+	if strings.Contains(hostname, "example.com") {
+		headers["Referer"] = targetURL.Scheme + "://" + targetURL.Host + "/"
+	}
+
+	// Add Origin header for certain domains
+	if strings.Contains(hostname, "cdn") || strings.Contains(hostname, "stream") {
+		headers["Origin"] = targetURL.Scheme + "://" + targetURL.Host
+	}
+
+	return headers
+}
+
+// generateRequestHeaders generates request headers with optional overrides
+func generateRequestHeaders(targetURL string, additionalHeaders map[string]string) map[string]string {
+	parsedURL, err := url.Parse(targetURL)
+	if err != nil || usesMinimalHeaders(parsedURL.Hostname()) {
+		// Use default headers if URL parsing fails
+		return mergeHeaders(generateBasicHeaders(), additionalHeaders)
+	}
+
+	// Generate base headers for the domain
+	return mergeHeaders(generateHeadersForDomain(parsedURL), additionalHeaders)
+}
+
+// requestHeadersFor is generateRequestHeaders honouring the hdr_mode param;
+// hdr_mode=minimal leaves out every default beyond the basic headers
+func requestHeadersFor(r *http.Request, targetURL string, additionalHeaders map[string]string) map[string]string {
+	if r.URL.Query().Get("hdr_mode") == "minimal" {
+		return mergeHeaders(generateBasicHeaders(), additionalHeaders)
+	}
+	return generateRequestHeaders(targetURL, additionalHeaders)
+}
+
+// headerParams returns the &hdr_mode=, &header_session=, &fwd_headers= and
+// &token= suffix carried by rewritten URLs, so segments don't get back the
+// defaults their playlist went without, keep following their header session,
+// forward the same client headers and pass the playback token check
+func headerParams(r *http.Request) string {
+	var suffix string
+	if mode := r.URL.Query().Get("hdr_mode"); mode != "" {
+		suffix += "&hdr_mode=" + url.QueryEscape(mode)
+	}
+	if id := r.URL.Query().Get("header_session"); id != "" {
+		suffix += "&header_session=" + url.QueryEscape(id)
+	}
+	if names := r.URL.Query().Get("fwd_headers"); names != "" {
+		suffix += "&fwd_headers=" + url.QueryEscape(names)
+	}
+	return suffix + tokenParam(r) + depthParam(r)
+}
+
+// forwardedHeaders returns the client request headers named by the
+// fwd_headers param (e.g. fwd_headers=authorization,x-custom), so a player
+// can send per-user tokens upstream without putting them in the URL.
+// Hop-by-hop headers and Host are never forwarded.
+func forwardedHeaders(r *http.Request) map[string]string {
+	names := splitList(r.URL.Query().Get("fwd_headers"))
+	if len(names) == 0 {
+		return nil
+	}
+	headers := make(map[string]string)
+	for _, name := range names {
+		name = http.CanonicalHeaderKey(name)
+		if name == "Host" || slices.Contains(hopByHopHeaders, name) {
+			continue
+		}
+		if value := r.Header.Get(name); value != "" {
+			headers[name] = value
+		}
+	}
+	return headers
+}
+
+// credentialHeaders make an upstream response private to whoever sent them
+var credentialHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+
+// credentialKey identifies the credentials among upstream request headers
+// and every header the caller supplied through overrides, "" when there are
+// none, so caches shared between viewers never serve one viewer's private
+// response to another
+func credentialKey(headers, overrides map[string]string) string {
+	private := make(map[string]string)
+	for _, name := range credentialHeaders {
+		for k, v := range headers {
+			if v != "" && strings.EqualFold(k, name) {
+				private[name] = v
+			}
+		}
+	}
+	for k, v := range overrides {
+		// Range selects part of the same response, not a different one
+		if name := http.CanonicalHeaderKey(k); v != "" && name != "Range" {
+			private[name] = v
+		}
+	}
+	if len(private) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(private))
+	for name := range private {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var key string
+	for _, name := range names {
+		key += name + ":" + private[name] + "\x00"
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
+
+// mergeHeaders applies additional headers over base ones, skipping empty values
+func mergeHeaders(headers, additionalHeaders map[string]string) map[string]string {
+	for k, v := range additionalHeaders {
+		if v != "" {
+			headers[k] = v
+		}
+	}
+	return headers
+}
+
+// usesMinimalHeaders reports whether host is listed in MINIMAL_HEADER_DOMAINS
+func usesMinimalHeaders(host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range minimalHeaderDomains {
+		if wildcardMatch(strings.ToLower(pattern), host) {
+			return true
+		}
+	}
+	return false
+}
+
+// withHeaderOverrides records the caller-supplied header overrides on an
+// upstream request so they can be reapplied when a redirect changes host
+func withHeaderOverrides(req *http.Request, overrides map[string]string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), headerOverridesKey{}, overrides))
+}
+
+// headerOverrides returns the overrides recorded by withHeaderOverrides
+func headerOverrides(req *http.Request) map[string]string {
+	overrides, _ := req.Context().Value(headerOverridesKey{}).(map[string]string)
+	return overrides
+}
+
+// headerRules are header overrides keyed by URL pattern. "*" applies to every
+// URL; other patterns use * as a wildcard over the full URL, e.g. "*/key*".
+type headerRules map[string]map[string]string
+
+// redacted returns the rules with every header value masked
+func (rules headerRules) redacted() headerRules {
+	if rules == nil {
+		return nil
+	}
+	masked := make(headerRules, len(rules))
+	for pattern, headers := range rules {
+		masked[pattern] = make(map[string]string, len(headers))
+		for name := range headers {
+			masked[pattern][name] = "********"
+		}
+	}
+	return masked
+}
+
+// parseHeadersParam decodes the `headers` query param, which is either a flat
+// {"Name": "value"} object or per-pattern rules such as
+// {"*": {"Referer": "..."}, "*/key*": {"Authorization": "Bearer ..."}}
+func parseHeadersParam(raw string) headerRules {
+	rules := headerRules{}
+	if raw == "" {
+		return rules
+	}
+	if decoded, err := url.QueryUnescape(raw); err == nil {
+		raw = decoded
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(raw), &fields); err != nil {
+		return rules
+	}
+
+	flat := make(map[string]string)
+	for key, value := range fields {
+		var text string
+		if err := json.Unmarshal(value, &text); err == nil {
+			flat[key] = text
+			continue
+		}
+		var nested map[string]string
+		if err := json.Unmarshal(value, &nested); err == nil {
+			rules[key] = nested
+		}
+	}
+
+	if len(flat) > 0 {
+		if rules["*"] == nil {
+			rules["*"] = make(map[string]string)
+		}
+		for k, v := range flat {
+			rules["*"][k] = v
+		}
+	}
+	return rules
+}
+
+// forURL merges the overrides that apply to targetURL: "*" first, then
+// matching patterns from least to most specific
+func (rules headerRules) forURL(targetURL string) map[string]string {
+	headers := make(map[string]string)
+	for k, v := range rules["*"] {
+		headers[k] = v
+	}
+
+	var patterns []string
+	for pattern := range rules {
+		if pattern != "*" && wildcardMatch(pattern, targetURL) {
+			patterns = append(patterns, pattern)
+		}
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) < len(patterns[j])
+		}
+		return patterns[i] < patterns[j]
+	})
+	for _, pattern := range patterns {
+		for k, v := range rules[pattern] {
+			headers[k] = v
+		}
+	}
+	return headers
+}
+
+// encode serializes the rules for a rewritten URL, with base replacing the
+// catch-all entry. Without pattern rules this is the flat header object.
+func (rules headerRules) encode(base map[string]string) string {
+	if len(rules) == 0 || (len(rules) == 1 && rules["*"] != nil) {
+		out, _ := json.Marshal(base)
+		return string(out)
+	}
+	withBase := headerRules{"*": base}
+	for pattern, headers := range rules {
+		if pattern != "*" {
+			withBase[pattern] = headers
+		}
+	}
+	out, _ := json.Marshal(withBase)
+	return string(out)
+}
+
+// wildcardMatch reports whether s matches pattern, where * matches any run of characters
+func wildcardMatch(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i == -1 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
@@ -0,0 +1,322 @@
+package hlsproxy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// inspectVariant is one EXT-X-STREAM-INF entry
+type inspectVariant struct {
+	Bandwidth        int     `json:"bandwidth"`
+	AverageBandwidth int     `json:"averageBandwidth,omitempty"`
+	Resolution       string  `json:"resolution,omitempty"`
+	Width            int     `json:"width,omitempty"`
+	Height           int     `json:"height,omitempty"`
+	FrameRate        float64 `json:"frameRate,omitempty"`
+	Codecs           string  `json:"codecs,omitempty"`
+	Audio            string  `json:"audio,omitempty"`
+	Subtitles        string  `json:"subtitles,omitempty"`
+	URL              string  `json:"url"`
+	ProxiedURL       string  `json:"proxiedUrl"`
+	LatencyMs        int64   `json:"latencyMs"` // time to fetch the variant playlist
+	Error            string  `json:"error,omitempty"`
+}
+
+// inspectRendition is one EXT-X-MEDIA entry
+type inspectRendition struct {
+	GroupID    string `json:"groupId"`
+	Name       string `json:"name,omitempty"`
+	Language   string `json:"language,omitempty"`
+	Default    bool   `json:"default"`
+	Autoselect bool   `json:"autoselect"`
+	Channels   string `json:"channels,omitempty"`
+	URL        string `json:"url,omitempty"`
+	ProxiedURL string `json:"proxiedUrl,omitempty"`
+}
+
+// inspectEncryption summarizes the EXT-X-KEY tags of a media playlist
+type inspectEncryption struct {
+	Method     string       `json:"method"`
+	KeyFormats []string     `json:"keyFormats,omitempty"`
+	Keys       []inspectKey `json:"keys,omitempty"`
+}
+
+// inspectKey is one EXT-X-KEY and the IV of the first segment it encrypts.
+// IVSource is "attribute" for an explicit IV, or "mediaSequence" when the
+// IV is the segment's sequence number.
+type inspectKey struct {
+	Method        string `json:"method"`
+	URI           string `json:"uri,omitempty"`
+	KeyFormat     string `json:"keyFormat,omitempty"`
+	FirstSequence int64  `json:"firstSequence"`
+	Segments      int    `json:"segments"`
+	IV            string `json:"iv,omitempty"`
+	IVSource      string `json:"ivSource"`
+	IVError       string `json:"ivError,omitempty"`
+}
+
+// inspectMedia describes a media playlist
+type inspectMedia struct {
+	URL            string            `json:"url"`
+	Live           bool              `json:"live"`
+	PlaylistType   string            `json:"playlistType,omitempty"`
+	TargetDuration int               `json:"targetDuration"`
+	MediaSequence  int64             `json:"mediaSequence"`
+	SegmentCount   int               `json:"segmentCount"`
+	TotalDuration  float64           `json:"totalDuration"`
+	Encryption     inspectEncryption `json:"encryption"`
+}
+
+// inspectReport is the JSON document returned by /inspect
+type inspectReport struct {
+	URL        string             `json:"url"`
+	Type       string             `json:"type"` // master or media
+	ProxiedURL string             `json:"proxiedUrl"`
+	Variants   []inspectVariant   `json:"variants,omitempty"`
+	Audio      []inspectRendition `json:"audio,omitempty"`
+	Subtitles  []inspectRendition `json:"subtitles,omitempty"`
+	Captions   []inspectRendition `json:"closedCaptions,omitempty"`
+	Media      *inspectMedia      `json:"media,omitempty"` // for a master, its first variant
+	MediaError string             `json:"mediaError,omitempty"`
+
+	// EncryptionMethod is the media's, or a master's EXT-X-SESSION-KEY method;
+	// HLSJSCompatible is false for SAMPLE-AES outside a DRM key system
+	EncryptionMethod string `json:"encryptionMethod"`
+	HLSJSCompatible  bool   `json:"hlsjsCompatible"`
+}
+
+// inspectConcurrency is how many variant playlists /inspect fetches at once
+const inspectConcurrency = 4
+
+// inspectHandler fetches a playlist and describes it as JSON, with proxied
+// URLs ready for a player's quality and language menus
+// URL format: /inspect?url={m3u8_url}&headers={optional_headers}
+func inspectHandler(w http.ResponseWriter, r *http.Request) {
+	targetURL, parsedHeaders, err := validateRequest(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	requestHeaders := requestHeadersFor(r, targetURL, parsedHeaders)
+	content, err := fetchPlaylistText(r.Context(), targetURL, requestHeaders)
+	if err != nil {
+		sendUpstreamError(w, "Failed to fetch playlist", err)
+		return
+	}
+	if !strings.Contains(content, "#EXTM3U") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Upstream response is not an M3U8 playlist"})
+		return
+	}
+
+	// Proxied URLs carry the same headers a /proxy request would
+	rules := parseHeadersParam(r.URL.Query().Get("headers"))
+	encodedHeaders := url.QueryEscape(rules.encode(requestHeadersFor(r, targetURL, rules["*"])))
+	encodedHeaders += headerParams(r)
+	proxied := func(playlistURL string) string {
+		return fmt.Sprintf("%s/proxy?url=%s&headers=%s", playlistBaseURL(r), url.QueryEscape(playlistURL), encodedHeaders)
+	}
+
+	report := inspectReport{URL: targetURL, Type: "media", ProxiedURL: proxied(targetURL), EncryptionMethod: "NONE"}
+	sampleAES := sampleAESMethod(content)
+	master := parseMasterPlaylist(content, targetURL)
+	if len(master.variants) == 0 {
+		report.Media = inspectMediaPlaylist(content, targetURL)
+	} else {
+		report.Type = "master"
+		for _, v := range master.variants {
+			report.Variants = append(report.Variants, newInspectVariant(v, proxied(v.uri)))
+		}
+		for _, m := range master.renditions {
+			rendition := inspectRendition{
+				GroupID:    m.attrs["GROUP-ID"],
+				Name:       m.attrs["NAME"],
+				Language:   m.attrs["LANGUAGE"],
+				Default:    m.attrs["DEFAULT"] == "YES",
+				Autoselect: m.attrs["AUTOSELECT"] == "YES",
+				Channels:   m.attrs["CHANNELS"],
+			}
+			if m.uri != "" {
+				rendition.URL, rendition.ProxiedURL = m.uri, proxied(m.uri)
+			}
+			switch m.attrs["TYPE"] {
+			case "AUDIO":
+				report.Audio = append(report.Audio, rendition)
+			case "SUBTITLES":
+				report.Subtitles = append(report.Subtitles, rendition)
+			case "CLOSED-CAPTIONS":
+				report.Captions = append(report.Captions, rendition)
+			}
+		}
+
+		// Encryption and duration live in the media playlists; every variant
+		// is fetched to time it, and the first one is described
+		medias := fetchInspectVariants(r, report.Variants, parsedHeaders)
+		first := master.variants[0].uri
+		if report.Variants[0].Error != "" {
+			report.MediaError = report.Variants[0].Error
+		} else {
+			report.Media = inspectMediaPlaylist(medias[0], first)
+			if sampleAES == "" {
+				sampleAES = sampleAESMethod(medias[0])
+			}
+		}
+		if method := sessionKeyMethod(content); method != "" {
+			report.EncryptionMethod = method
+		}
+	}
+	if report.Media != nil && report.Media.Encryption.Method != "NONE" {
+		report.EncryptionMethod = report.Media.Encryption.Method
+	}
+	report.HLSJSCompatible = sampleAES == ""
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(report)
+}
+
+// fetchInspectVariants fetches the variant playlists concurrently, at most
+// inspectConcurrency at once, recording each one's latency or error, and
+// returns their contents
+func fetchInspectVariants(r *http.Request, variants []inspectVariant, parsedHeaders map[string]string) []string {
+	medias := make([]string, len(variants))
+	slots := make(chan struct{}, inspectConcurrency)
+	var wg sync.WaitGroup
+	for i := range variants {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			v := &variants[i]
+			start := time.Now()
+			media, err := fetchPlaylistText(r.Context(), v.URL, requestHeadersFor(r, v.URL, parsedHeaders))
+			v.LatencyMs = time.Since(start).Milliseconds()
+			if err != nil {
+				v.Error = err.Error()
+				return
+			}
+			medias[i] = media
+		}(i)
+	}
+	wg.Wait()
+	return medias
+}
+
+// newInspectVariant converts a parsed variant stream
+func newInspectVariant(v variantStream, proxiedURL string) inspectVariant {
+	variant := inspectVariant{
+		Resolution: v.attrs["RESOLUTION"],
+		Codecs:     v.attrs["CODECS"],
+		Audio:      v.attrs["AUDIO"],
+		Subtitles:  v.attrs["SUBTITLES"],
+		URL:        v.uri,
+		ProxiedURL: proxiedURL,
+	}
+	variant.Bandwidth, _ = strconv.Atoi(v.attrs["BANDWIDTH"])
+	variant.AverageBandwidth, _ = strconv.Atoi(v.attrs["AVERAGE-BANDWIDTH"])
+	variant.FrameRate, _ = strconv.ParseFloat(v.attrs["FRAME-RATE"], 64)
+	if width, height, ok := strings.Cut(variant.Resolution, "x"); ok {
+		variant.Width, _ = strconv.Atoi(width)
+		variant.Height, _ = strconv.Atoi(height)
+	}
+	return variant
+}
+
+// sessionKeyMethod returns the METHOD of a master playlist's first
+// EXT-X-SESSION-KEY, or "" when it has none
+func sessionKeyMethod(content string) string {
+	for _, line := range strings.Split(normalizeLineEndings(content), "\n") {
+		line = strings.TrimSpace(line)
+		if playlistTagName(line) != "EXT-X-SESSION-KEY" {
+			continue
+		}
+		_, attrList, _ := strings.Cut(line, ":")
+		if method := parseAttributeList(attrList)["METHOD"]; method != "" && method != "NONE" {
+			return method
+		}
+	}
+	return ""
+}
+
+// inspectMediaPlaylist describes a media playlist
+func inspectMediaPlaylist(content, playlistURL string) *inspectMedia {
+	playlist := parseMediaPlaylist(content, playlistURL)
+	media := &inspectMedia{
+		URL:            playlistURL,
+		Live:           !playlist.endList && playlist.playlistType != "VOD",
+		PlaylistType:   playlist.playlistType,
+		TargetDuration: playlist.targetDuration,
+		MediaSequence:  playlist.mediaSequence,
+		SegmentCount:   len(playlist.segments),
+		Encryption:     inspectEncryption{Method: "NONE"},
+	}
+	for _, segment := range playlist.segments {
+		media.TotalDuration += segment.duration
+	}
+	media.TotalDuration = math.Round(media.TotalDuration*1000) / 1000
+
+	formats := make(map[string]bool)
+	for _, line := range strings.Split(normalizeLineEndings(content), "\n") {
+		if playlistTagName(line) != "EXT-X-KEY" {
+			continue
+		}
+		_, attrList, _ := strings.Cut(strings.TrimSpace(line), ":")
+		attrs := parseAttributeList(attrList)
+		if attrs["METHOD"] == "" || attrs["METHOD"] == "NONE" {
+			continue
+		}
+		media.Encryption.Method = attrs["METHOD"]
+		format := attrs["KEYFORMAT"]
+		if format == "" {
+			format = "identity"
+		}
+		if !formats[format] {
+			formats[format] = true
+			media.Encryption.KeyFormats = append(media.Encryption.KeyFormats, format)
+		}
+	}
+
+	for i, segment := range playlist.segments {
+		n := len(media.Encryption.Keys)
+		if segment.key == nil {
+			continue
+		}
+		if i > 0 && playlist.segments[i-1].key == segment.key {
+			media.Encryption.Keys[n-1].Segments++
+			continue
+		}
+		sequence := playlist.mediaSequence + int64(i)
+		key := inspectKey{
+			Method:        segment.key.method,
+			URI:           segment.key.uri,
+			KeyFormat:     segment.key.keyFormat,
+			FirstSequence: sequence,
+			Segments:      1,
+			IVSource:      "mediaSequence",
+		}
+		if segment.key.iv != "" {
+			key.IVSource = "attribute"
+		}
+		if iv, err := segment.key.ivFor(sequence); err != nil {
+			key.IVError = err.Error()
+		} else {
+			key.IV = "0x" + hex.EncodeToString(iv)
+		}
+		media.Encryption.Keys = append(media.Encryption.Keys, key)
+	}
+	return media
+}
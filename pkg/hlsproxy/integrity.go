@@ -0,0 +1,147 @@
+package hlsproxy
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	// tsPacketSize is the length of an MPEG-TS packet, each starting with tsSyncByte
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+	// tsDetectPackets is how many leading packets must carry the sync byte
+	// before a segment is treated as plain TS; encrypted ones don't
+	tsDetectPackets = 3
+)
+
+// verifySegments enables integrity checks of proxied segments
+var verifySegments bool
+
+// md5ETag matches single-part ETags that are the MD5 of the body, as S3,
+// GCS and many object stores send
+var md5ETag = regexp.MustCompile(`^"[0-9a-fA-F]{32}"$`)
+
+// segmentVerifier checks the bytes of a segment as they are sent to the
+// client: the length against Content-Length, the MD5 against an MD5-style
+// ETag, and the MPEG-TS sync byte at the start of every packet
+type segmentVerifier struct {
+	http.ResponseWriter
+	r        *http.Request
+	url      string
+	expected int64
+
+	md5     hash.Hash
+	wantMD5 string
+
+	ts       bool // a TS segment, before detection completes
+	detected bool
+	head     []byte
+	written  int64
+	syncErr  int64 // offset of the first packet without a sync byte, or -1
+
+	writeErr bool
+}
+
+// newSegmentVerifier wraps w to verify the body of resp
+func newSegmentVerifier(w http.ResponseWriter, r *http.Request, targetURL string, resp *http.Response, contentType string) *segmentVerifier {
+	v := &segmentVerifier{ResponseWriter: w, r: r, url: targetURL, expected: resp.ContentLength, syncErr: -1}
+	if etag := resp.Header.Get("ETag"); resp.StatusCode == http.StatusOK && !resp.Uncompressed && md5ETag.MatchString(etag) {
+		v.md5, v.wantMD5 = md5.New(), strings.ToLower(strings.Trim(etag, `"`))
+	}
+	// Ranged responses needn't start at a packet boundary
+	v.ts = resp.StatusCode == http.StatusOK &&
+		(strings.Contains(contentType, "mp2t") || strings.HasSuffix(strings.ToLower(pathWithoutQuery(targetURL)), ".ts"))
+	return v
+}
+
+func (v *segmentVerifier) Write(p []byte) (int, error) {
+	n, err := v.ResponseWriter.Write(p)
+	if err != nil {
+		v.writeErr = true
+	}
+	v.check(p[:n])
+	return n, err
+}
+
+// Flush passes through to the client connection
+func (v *segmentVerifier) Flush() {
+	if f, ok := v.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (v *segmentVerifier) Unwrap() http.ResponseWriter {
+	return v.ResponseWriter
+}
+
+// check feeds the bytes at offset v.written to the checks
+func (v *segmentVerifier) check(p []byte) {
+	if v.md5 != nil {
+		v.md5.Write(p)
+	}
+	if v.ts && v.syncErr < 0 {
+		if !v.detected {
+			v.head = append(v.head, p[:min(len(p), tsDetectPackets*tsPacketSize-len(v.head))]...)
+			v.detectTS()
+		}
+		if v.detected {
+			// Offsets of packet starts falling inside p
+			first := (v.written + tsPacketSize - 1) / tsPacketSize * tsPacketSize
+			for off := first; off < v.written+int64(len(p)); off += tsPacketSize {
+				if p[off-v.written] != tsSyncByte {
+					v.syncErr = off
+					break
+				}
+			}
+		}
+	}
+	v.written += int64(len(p))
+}
+
+// detectTS decides from the leading packets whether sync bytes can be checked
+func (v *segmentVerifier) detectTS() {
+	for i := 0; i < tsDetectPackets; i++ {
+		off := i * tsPacketSize
+		if off >= len(v.head) {
+			return
+		}
+		if v.head[off] != tsSyncByte {
+			v.ts = false // encrypted, or not TS after all
+			return
+		}
+	}
+	if len(v.head) > (tsDetectPackets-1)*tsPacketSize {
+		v.detected, v.head = true, nil
+	}
+}
+
+// finish reports a failed check. Deferred, it also sees transfers that
+// copyUpstreamBody aborted.
+func (v *segmentVerifier) finish() {
+	if v.writeErr {
+		return // the client went away; nothing to judge
+	}
+	var problem string
+	switch {
+	case v.expected >= 0 && v.written != v.expected:
+		problem = fmt.Sprintf("length mismatch: sent %d of %d bytes", v.written, v.expected)
+	case v.syncErr >= 0:
+		problem = fmt.Sprintf("missing TS sync byte at offset %d", v.syncErr)
+	case v.md5 != nil && hex.EncodeToString(v.md5.Sum(nil)) != v.wantMD5:
+		problem = "MD5 does not match ETag"
+	}
+	if problem == "" {
+		return
+	}
+	log.Printf("Corrupted segment %s: %s", v.url, problem)
+	if id, _ := requestStream(v.r); id != "" {
+		streams.recordCorruption(v.r, id, problem)
+	}
+}
@@ -0,0 +1,183 @@
+package hlsproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// vlcHeaderOptions maps the #EXTVLCOPT options IPTV lists use to set
+// request headers per channel
+var vlcHeaderOptions = map[string]string{
+	"http-referrer":   "Referer",
+	"http-user-agent": "User-Agent",
+	"http-origin":     "Origin",
+}
+
+// isIPTVPlaylist reports whether a playlist is a channel list, a plain or
+// extended .m3u without any HLS tags, rather than an HLS playlist
+func isIPTVPlaylist(content string) bool {
+	if strings.Contains(content, "#EXT-X-") {
+		return false
+	}
+	for _, line := range strings.Split(normalizeLineEndings(content), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			return true
+		}
+	}
+	return false
+}
+
+// iptvChannel is one entry of a channel list: its metadata lines and URL
+type iptvChannel struct {
+	tags []string
+	uri  string
+}
+
+// group returns the channel's group-title, or its #EXTGRP
+func (c iptvChannel) group() string {
+	for _, tag := range c.tags {
+		if playlistTagName(tag) == "EXTINF" {
+			if group := iptvAttr(tag, "group-title"); group != "" {
+				return group
+			}
+		}
+	}
+	for _, tag := range c.tags {
+		if playlistTagName(tag) == "EXTGRP" {
+			return strings.TrimSpace(strings.TrimPrefix(tag, "#EXTGRP:"))
+		}
+	}
+	return ""
+}
+
+// headers returns the request headers the list sets for the channel with
+// #EXTVLCOPT lines or a Kodi-style "url|Name=value&..." suffix, and the URL
+// without that suffix
+func (c iptvChannel) headers() (string, map[string]string) {
+	headers := make(map[string]string)
+	for _, tag := range c.tags {
+		if playlistTagName(tag) != "EXTVLCOPT" {
+			continue
+		}
+		option, value, _ := strings.Cut(strings.TrimPrefix(tag, "#EXTVLCOPT:"), "=")
+		if name, ok := vlcHeaderOptions[strings.ToLower(strings.TrimSpace(option))]; ok {
+			headers[name] = strings.TrimSpace(value)
+		}
+	}
+	uri, suffix, ok := strings.Cut(c.uri, "|")
+	if ok {
+		for _, pair := range strings.Split(suffix, "&") {
+			name, value, _ := strings.Cut(pair, "=")
+			if decoded, err := url.QueryUnescape(value); err == nil {
+				value = decoded
+			}
+			if name = strings.TrimSpace(name); name != "" {
+				headers[http.CanonicalHeaderKey(name)] = value
+			}
+		}
+	}
+	return uri, headers
+}
+
+// iptvAttr returns a quoted attribute of an #EXTINF line, such as tvg-id
+func iptvAttr(line, name string) string {
+	i := strings.Index(strings.ToLower(line), name+`="`)
+	if i == -1 {
+		return ""
+	}
+	value := line[i+len(name)+2:]
+	if end := strings.IndexByte(value, '"'); end != -1 {
+		return value[:end]
+	}
+	return ""
+}
+
+// parseIPTVPlaylist splits a channel list into its header lines and channels
+func parseIPTVPlaylist(content string) ([]string, []iptvChannel) {
+	var header []string
+	var channels []iptvChannel
+	var pending []string
+	for _, line := range strings.Split(normalizeLineEndings(content), "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+		case strings.HasPrefix(trimmed, "#EXTM3U"):
+			header = append(header, trimmed)
+		case strings.HasPrefix(trimmed, "#"):
+			pending = append(pending, trimmed)
+		default:
+			channels = append(channels, iptvChannel{tags: pending, uri: trimmed})
+			pending = nil
+		}
+	}
+	return header, channels
+}
+
+// serveIPTVPlaylist rewrites every channel of a channel list through the
+// proxy, leaving #EXTINF metadata such as tvg-id and group-title as it is.
+// HLS channels go through /proxy and anything else, usually a raw MPEG-TS
+// stream, through /ts-proxy. &group= keeps only the listed groups.
+func serveIPTVPlaylist(w http.ResponseWriter, r *http.Request, content, playlistURL string) {
+	groups := splitList(r.URL.Query().Get("group"))
+	rules := parseHeadersParam(r.URL.Query().Get("headers"))
+
+	suffix := headerParams(r)
+	if apiKey := r.URL.Query().Get("api_key"); apiKey != "" {
+		suffix += "&api_key=" + url.QueryEscape(apiKey)
+	}
+	playlistBase := rewriteBaseURL(r, playlistBaseURL(r))
+
+	header, channels := parseIPTVPlaylist(preparePlaylist(content, playlistURL))
+	if len(header) == 0 {
+		header = []string{"#EXTM3U"}
+	}
+	// Guides are fetched with the same headers, filtered to this list
+	guideSuffix := headerParams(r)
+	if raw := r.URL.Query().Get("headers"); raw != "" {
+		guideSuffix = "&headers=" + url.QueryEscape(raw) + guideSuffix
+	}
+	for i, line := range header {
+		header[i] = rewriteGuideURLs(line, playlistURL, playlistBase, guideSuffix)
+	}
+	out := header
+	for _, channel := range channels {
+		if len(groups) > 0 && !containsFold(groups, channel.group()) {
+			continue
+		}
+		uri, extra := channel.headers()
+		resolvedURL := resolveURL(uri, playlistURL)
+
+		headers := mergeHeaders(mergeHeaders(make(map[string]string), rules["*"]), extra)
+		encodedHeaders := url.QueryEscape(rules.encode(requestHeadersFor(r, resolvedURL, headers)))
+		var newURL string
+		if isM3U8URL(resolvedURL) {
+			newURL = fmt.Sprintf("%s/proxy?url=%s&headers=%s", playlistBase, url.QueryEscape(resolvedURL), encodedHeaders)
+			if r.URL.Query().Get("rewrite") == "relative" {
+				newURL += "&rewrite=relative"
+			}
+		} else {
+			newURL = fmt.Sprintf("%s/ts-proxy?url=%s&headers=%s",
+				rewriteBaseURL(r, segmentBaseURL(r, resolvedURL)), url.QueryEscape(resolvedURL), encodedHeaders)
+		}
+		out = append(out, channel.tags...)
+		out = append(out, newURL+suffix)
+	}
+
+	w.Header().Set("Content-Type", "audio/x-mpegurl")
+	if wantsDownload(r) {
+		w.Header().Set("Content-Disposition", contentDisposition(r, playlistURL, "audio/x-mpegurl"))
+	}
+	writePlaylist(w, strings.Join(out, "\n")+"\n")
+}
+
+// containsFold reports whether list holds s, ignoring case
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,276 @@
+package hlsproxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// jwtAlgorithm is HS256 or RS256; empty accepts requests without tokens
+	jwtAlgorithm string
+	// jwtSecret verifies HS256 playback tokens
+	jwtSecret string
+	// jwtPublicKey verifies RS256 playback tokens
+	jwtPublicKey *rsa.PublicKey
+)
+
+// playbackClaims are the claims of a playback token. Exp is required; the
+// others restrict the token when set. Domains are hostname patterns (*
+// wildcards) of the upstream URLs the token may fetch, IP is a client
+// address or CIDR, and MaxResolution is the tallest variant height a
+// master playlist keeps.
+type playbackClaims struct {
+	Subject       string   `json:"sub,omitempty"`
+	Exp           int64    `json:"exp"`
+	NotBefore     int64    `json:"nbf,omitempty"`
+	Domains       []string `json:"domains,omitempty"`
+	IP            string   `json:"ip,omitempty"`
+	MaxResolution int      `json:"max_resolution,omitempty"`
+}
+
+// playbackClaimsKey is the context key of a request's verified claims
+type playbackClaimsKey struct{}
+
+// errRedirectNotAllowed is returned when upstream redirects to a host the
+// playback token's domains don't cover
+var errRedirectNotAllowed = errors.New("playback token does not allow the redirect")
+
+// validateJWTConfig checks that the configured algorithm has its key
+func validateJWTConfig(algorithm, secret, publicKeyFile string) error {
+	switch algorithm {
+	case "":
+		return nil
+	case "HS256":
+		if secret == "" {
+			return fmt.Errorf("JWT_ALGORITHM HS256 needs JWT_SECRET")
+		}
+		return nil
+	case "RS256":
+		_, err := loadJWTPublicKey(publicKeyFile)
+		return err
+	}
+	return fmt.Errorf("unknown JWT algorithm %q (want HS256 or RS256)", algorithm)
+}
+
+// loadJWTPublicKey reads a PEM RSA public key or certificate
+func loadJWTPublicKey(path string) (*rsa.PublicKey, error) {
+	if path == "" {
+		return nil, fmt.Errorf("JWT_ALGORITHM RS256 needs JWT_PUBLIC_KEY_FILE")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", path)
+	}
+	var key any
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, certErr := x509.ParseCertificate(block.Bytes)
+		if certErr != nil {
+			return nil, certErr
+		}
+		key = cert.PublicKey
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s does not hold an RSA public key", path)
+	}
+	return rsaKey, nil
+}
+
+// verifyPlaybackToken checks a token's signature and returns its claims
+func verifyPlaybackToken(token string, now time.Time) (*playbackClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != jwtAlgorithm {
+		return nil, fmt.Errorf("token algorithm %q is not accepted", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	switch jwtAlgorithm {
+	case "HS256":
+		mac := hmac.New(sha256.New, []byte(jwtSecret))
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return nil, fmt.Errorf("invalid token signature")
+		}
+	case "RS256":
+		digest := sha256.Sum256(signed)
+		if rsa.VerifyPKCS1v15(jwtPublicKey, crypto.SHA256, digest[:], signature) != nil {
+			return nil, fmt.Errorf("invalid token signature")
+		}
+	}
+
+	var claims playbackClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if claims.Exp == 0 {
+		return nil, fmt.Errorf("token has no expiry")
+	}
+	if now.Unix() >= claims.Exp {
+		return nil, fmt.Errorf("token expired")
+	}
+	if claims.NotBefore != 0 && now.Unix() < claims.NotBefore {
+		return nil, fmt.Errorf("token is not valid yet")
+	}
+	return &claims, nil
+}
+
+// decodeJWTPart decodes a base64url JSON token part into v
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil || json.Unmarshal(data, v) != nil {
+		return fmt.Errorf("malformed token")
+	}
+	return nil
+}
+
+// allows checks the client and upstream hosts of a request against the claims
+func (c *playbackClaims) allows(r *http.Request, hosts []string) error {
+	if c.IP != "" {
+		addr, ok := clientIP(r)
+		if !ok {
+			return fmt.Errorf("token is bound to another client")
+		}
+		prefix, err := netip.ParsePrefix(c.IP)
+		if err != nil {
+			ip, ipErr := netip.ParseAddr(c.IP)
+			if ipErr != nil {
+				return fmt.Errorf("token has an invalid ip claim")
+			}
+			prefix = netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen())
+		}
+		if !prefix.Contains(addr) {
+			return fmt.Errorf("token is bound to another client")
+		}
+	}
+	if len(c.Domains) > 0 {
+		for _, host := range hosts {
+			if !matchesAnyHost(c.Domains, host) {
+				return fmt.Errorf("token does not allow %s", host)
+			}
+		}
+	}
+	return nil
+}
+
+// matchesAnyHost reports whether host matches one of the patterns
+func matchesAnyHost(patterns []string, host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range patterns {
+		if wildcardMatch(strings.ToLower(pattern), host) {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenTargetHosts returns the upstream hosts a request would fetch
+func tokenTargetHosts(r *http.Request) []string {
+	query := r.URL.Query()
+	var targets []string
+	if target := query.Get("url"); target != "" {
+		targets = append(targets, target)
+	}
+	targets = append(targets, splitList(query.Get("urls"))...)
+	if playlist := query.Get("playlist"); playlist != "" {
+		targets = append(targets, playlist)
+	}
+	if domain := r.PathValue("domain"); domain != "" && len(targets) == 0 {
+		targets = append(targets, "https://"+domain)
+	}
+	hosts := make([]string, 0, len(targets))
+	for _, target := range targets {
+		u, err := url.Parse(target)
+		if err != nil || u.Hostname() == "" {
+			hosts = append(hosts, target)
+			continue
+		}
+		hosts = append(hosts, u.Hostname())
+	}
+	return hosts
+}
+
+// tokenMiddleware requires a valid playback token in ?token= on proxying
+// endpoints once JWT_ALGORITHM is set. Rewritten URLs carry the token on,
+// so its claims hold for every variant and segment of the stream.
+func tokenMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next(w, r)
+			return
+		}
+		if !checkBindingParam(w, r) {
+			return
+		}
+		if jwtAlgorithm == "" {
+			next(w, r)
+			return
+		}
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			sendTokenError(w, "A playback token is required")
+			return
+		}
+		claims, err := verifyPlaybackToken(token, time.Now())
+		if err == nil {
+			err = claims.allows(r, tokenTargetHosts(r))
+		}
+		if err != nil {
+			sendTokenError(w, "Invalid playback token: "+err.Error())
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), playbackClaimsKey{}, claims)))
+	}
+}
+
+// tokenParam returns the &token= and &bind= suffix carried by rewritten URLs
+func tokenParam(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" && jwtAlgorithm != "" {
+		return "&token=" + url.QueryEscape(token) + bindingParam(r)
+	}
+	return bindingParam(r)
+}
+
+func sendTokenError(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -0,0 +1,47 @@
+package hlsproxy
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// segmentEncryption is the EXT-X-KEY in effect for a segment
+type segmentEncryption struct {
+	method    string
+	uri       string // resolved key URI
+	iv        string // IV attribute, empty when derived from the sequence number
+	keyFormat string
+}
+
+// segmentIV returns the 16-byte AES-128 IV of a segment per RFC 8216
+// section 5.2: the key's IV attribute when present, otherwise the segment's
+// media sequence number as a big-endian 128-bit integer. Short hex IVs are
+// zero-padded on the left, as players do.
+func segmentIV(ivAttr string, mediaSequence int64) ([]byte, error) {
+	iv := make([]byte, 16)
+	if ivAttr == "" {
+		binary.BigEndian.PutUint64(iv[8:], uint64(mediaSequence))
+		return iv, nil
+	}
+	digits, ok := strings.CutPrefix(ivAttr, "0x")
+	if !ok {
+		if digits, ok = strings.CutPrefix(ivAttr, "0X"); !ok {
+			return nil, fmt.Errorf("IV %q is not a 0x hexadecimal sequence", ivAttr)
+		}
+	}
+	if len(digits) == 0 || len(digits) > 32 {
+		return nil, fmt.Errorf("IV %q is not 128 bits", ivAttr)
+	}
+	decoded, err := hex.DecodeString(strings.Repeat("0", 32-len(digits)) + digits)
+	if err != nil {
+		return nil, fmt.Errorf("IV %q is not hexadecimal", ivAttr)
+	}
+	return decoded, nil
+}
+
+// ivFor returns the IV of the segment with the given media sequence number
+func (k *segmentEncryption) ivFor(mediaSequence int64) ([]byte, error) {
+	return segmentIV(k.iv, mediaSequence)
+}
@@ -0,0 +1,178 @@
+package hlsproxy
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxCachedKeyBytes skips caching anything bigger than a key plausibly is
+	maxCachedKeyBytes = 4096
+	// keyTrackingTTL is how long key URIs stay tracked after their playlist was last seen
+	keyTrackingTTL = 10 * time.Minute
+)
+
+// trackedKey is what the latest playlists say about one key URI
+type trackedKey struct {
+	fingerprint string // the URI's current EXT-X-KEY attribute lists, IVs included
+	seen        time.Time
+}
+
+// cachedKey is one cached key response
+type cachedKey struct {
+	data        []byte
+	contentType string
+	expires     time.Time
+}
+
+// keyCacheStore caches AES keys of live streams. Entries are keyed by the
+// key URI plus the IVs the playlist currently lists for it, live for
+// keyCacheTTL, and are dropped as soon as a refreshed playlist changes the
+// EXT-X-KEY lines for the URI, since servers that rotate keys often keep
+// the URI and only change the bytes behind it.
+type keyCacheStore struct {
+	mu      sync.Mutex
+	keys    map[string]*trackedKey
+	entries map[string]cachedKey
+}
+
+var keyCache = &keyCacheStore{
+	keys:    make(map[string]*trackedKey),
+	entries: make(map[string]cachedKey),
+}
+
+// observe records the key tags of a fetched playlist
+func (c *keyCacheStore) observe(m3u8Content, playlistURL string) {
+	current := make(map[string]map[string]bool)
+	for _, line := range strings.Split(normalizeLineEndings(m3u8Content), "\n") {
+		line = strings.TrimSpace(line)
+		if playlistTagName(line) != "EXT-X-KEY" {
+			continue
+		}
+		_, attrList, _ := strings.Cut(line, ":")
+		attrs := parseAttributeList(attrList)
+		if attrs["URI"] == "" || attrs["METHOD"] == "NONE" || (attrs["KEYFORMAT"] != "" && attrs["KEYFORMAT"] != "identity") {
+			continue
+		}
+		uri := resolveURL(attrs["URI"], playlistURL)
+		if current[uri] == nil {
+			current[uri] = make(map[string]bool)
+		}
+		current[uri][attrList] = true
+	}
+	if len(current) == 0 {
+		return
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for uri, lines := range current {
+		sorted := make([]string, 0, len(lines))
+		for line := range lines {
+			sorted = append(sorted, line)
+		}
+		sort.Strings(sorted)
+		fingerprint := strings.Join(sorted, "\n")
+
+		if tracked, ok := c.keys[uri]; ok && tracked.fingerprint != fingerprint {
+			// Rotation: whatever was cached for this URI may be stale
+			c.invalidate(uri)
+		}
+		c.keys[uri] = &trackedKey{fingerprint: fingerprint, seen: now}
+	}
+
+	for uri, tracked := range c.keys {
+		if now.Sub(tracked.seen) > keyTrackingTTL {
+			c.invalidate(uri)
+			delete(c.keys, uri)
+		}
+	}
+}
+
+// invalidate drops every cached entry of uri; callers must hold c.mu
+func (c *keyCacheStore) invalidate(uri string) {
+	prefix := uri + "\x00"
+	for key := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// cacheKey returns the entry key for a request to uri, or false when the
+// URI isn't a tracked key. Credentials and header overrides are part of it
+// so one viewer's key is never served to another.
+func (c *keyCacheStore) cacheKey(uri string, requestHeaders, overrides map[string]string) (string, bool) {
+	tracked, ok := c.keys[uri]
+	if !ok {
+		return "", false
+	}
+	return uri + "\x00" + tracked.fingerprint + "\x00" + credentialKey(requestHeaders, overrides), true
+}
+
+// serveCachedKey answers a request for a tracked key URI from the cache,
+// fetching and storing it on a miss. overrides are the caller-supplied
+// headers among requestHeaders. It reports whether it handled the request.
+func serveCachedKey(w http.ResponseWriter, r *http.Request, targetURL string, requestHeaders, overrides map[string]string) bool {
+	if keyCacheTTL <= 0 || requestHeaders["Range"] != "" {
+		return false
+	}
+
+	c := keyCache
+	c.mu.Lock()
+	key, ok := c.cacheKey(targetURL, requestHeaders, overrides)
+	entry, cached := c.entries[key]
+	c.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	if !cached || time.Now().After(entry.expires) {
+		resp, err := fetch(r.Context(), fetchOptions{url: targetURL, headers: requestHeaders, overrides: overrides})
+		if err != nil {
+			sendUpstreamError(w, "Failed to fetch key", err)
+			return true
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			sendUpstreamStatus(w, resp)
+			return true
+		}
+		prepareUpstreamBody(resp)
+		data, err := io.ReadAll(io.LimitReader(resp.Body, maxCachedKeyBytes+1))
+		if err != nil {
+			sendError(w, "Failed to read key", err.Error())
+			return true
+		}
+		if len(data) > maxCachedKeyBytes {
+			// Not a key after all; pass it through uncached
+			w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+			w.Write(data)
+			io.Copy(w, resp.Body)
+			return true
+		}
+
+		entry = cachedKey{data: data, contentType: resp.Header.Get("Content-Type"), expires: time.Now().Add(keyCacheTTL)}
+		c.mu.Lock()
+		// Only store if no rotation happened while fetching
+		if current, ok := c.cacheKey(targetURL, requestHeaders, overrides); ok && current == key {
+			c.entries[key] = entry
+		}
+		c.mu.Unlock()
+	}
+
+	contentType := entry.contentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(entry.data)
+	return true
+}
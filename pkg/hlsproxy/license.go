@@ -0,0 +1,108 @@
+package hlsproxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// licenseHeaders are extra headers sent to DRM license servers, keyed by
+// URL pattern like the headers param (e.g. {"https://drm.example.com/*": {"X-Token": "..."}})
+var licenseHeaders headerRules
+
+// isLicenseKey reports whether a key tag points at a DRM license server
+// rather than a plain AES-128 key, i.e. it names a KEYFORMAT other than identity
+func isLicenseKey(line string) bool {
+	switch playlistTagName(line) {
+	case "EXT-X-KEY", "EXT-X-SESSION-KEY":
+	default:
+		return false
+	}
+	_, attrList, _ := strings.Cut(line, ":")
+	keyFormat := parseAttributeList(attrList)["KEYFORMAT"]
+	return keyFormat != "" && keyFormat != "identity"
+}
+
+// segmentEndpoint is the endpoint a non-playlist URI is proxied through
+func segmentEndpoint(kind uriKind) string {
+	if kind == licenseURI {
+		return "license-proxy"
+	}
+	return "ts-proxy"
+}
+
+// licenseProxyURL routes a license server URL through /license-proxy for
+// playlists rewritten outside a proxied request, like exports; proxied
+// playlists route licenses through their rewriter with the same params as
+// their segments. With PUBLIC_URL unset the URL is root-relative, so players
+// resolve it against the host they fetched the playlist from.
+func licenseProxyURL(licenseURL string) string {
+	base := webServerURL
+	if detectPublicURL {
+		base = ""
+	}
+	return base + "/license-proxy?url=" + url.QueryEscape(licenseURL)
+}
+
+// licenseProxyHandler forwards ClearKey/Widevine license requests to the
+// license server with its configured headers and returns the answer verbatim
+func licenseProxyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST, OPTIONS")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Use GET or POST"})
+		return
+	}
+
+	targetURL := r.URL.Query().Get("url")
+	if targetURL == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "URL parameter is required"})
+		return
+	}
+
+	// Configured license headers, then any the caller or its header session supplied
+	rules, err := requestHeaderRules(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	parsedHeaders := licenseHeaders.forURL(targetURL)
+	for k, v := range rules.forURL(targetURL) {
+		parsedHeaders[k] = v
+	}
+	requestHeaders := requestHeadersFor(r, targetURL, parsedHeaders)
+
+	// Buffer the challenge so it can be replayed if the server redirects
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sendError(w, "Failed to read license request", err.Error())
+		return
+	}
+
+	if contentType := r.Header.Get("Content-Type"); contentType != "" && parsedHeaders["Content-Type"] == "" {
+		requestHeaders["Content-Type"] = contentType
+	}
+
+	resp, err := fetch(r.Context(), fetchOptions{method: r.Method, url: targetURL, body: body, headers: requestHeaders, overrides: parsedHeaders})
+	if err != nil {
+		sendUpstreamError(w, "Failed to reach license server", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if encoding := prepareUpstreamBody(resp); encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
@@ -0,0 +1,49 @@
+package hlsproxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// parseFileMode parses an octal permission mode such as "0660"
+func parseFileMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("invalid file mode %q", value)
+	}
+	return os.FileMode(mode), nil
+}
+
+// listen opens the configured Unix socket, or the TCP host:port otherwise.
+// It also returns a description of the address for the startup log.
+func listen(cfg Config) (net.Listener, string, error) {
+	if cfg.ListenSocket == "" {
+		addr := fmt.Sprintf("%s:%s", cfg.Host, cfg.Port)
+		l, err := net.Listen("tcp", addr)
+		return l, "http://" + addr, err
+	}
+
+	// A socket left behind by a previous run would make Listen fail;
+	// anything that isn't a socket is left alone
+	if info, err := os.Lstat(cfg.ListenSocket); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(cfg.ListenSocket)
+	}
+	l, err := net.Listen("unix", cfg.ListenSocket)
+	if err != nil {
+		return nil, "", err
+	}
+	mode, _ := parseFileMode(cfg.ListenSocketMode)
+	if err := os.Chmod(cfg.ListenSocket, mode); err != nil {
+		l.Close()
+		return nil, "", err
+	}
+	return l, "unix:" + cfg.ListenSocket, nil
+}
+
+// isUnixSocketPeer reports whether remoteAddr belongs to a Unix socket
+// connection, which carries no IP address
+func isUnixSocketPeer(remoteAddr string) bool {
+	return remoteAddr == "" || remoteAddr == "@"
+}
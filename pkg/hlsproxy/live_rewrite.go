@@ -0,0 +1,98 @@
+package hlsproxy
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// liveRewriteMaxPlaylists bounds how many live playlists keep a rewrite memo
+	liveRewriteMaxPlaylists = 4096
+	// liveRewriteIdle drops the memo of a playlist nobody refreshed for this long
+	liveRewriteIdle = 2 * time.Minute
+)
+
+// liveRewrite is the last rewrite of one live playlist, by original line
+type liveRewrite struct {
+	lines map[string]string
+	used  time.Time
+}
+
+// liveRewriteCache remembers the rewritten lines of live media playlists.
+// A refresh usually only appends a segment or two and drops the oldest, so
+// every other line is copied from the previous rewrite instead of being
+// resolved, escaped and formatted again.
+type liveRewriteCache struct {
+	mu        sync.Mutex
+	playlists map[string]*liveRewrite
+}
+
+var liveRewrites = &liveRewriteCache{playlists: make(map[string]*liveRewrite)}
+
+// isLiveMediaPlaylist reports whether content is a media playlist that is
+// still being appended to
+func isLiveMediaPlaylist(m3u8Content string) bool {
+	return strings.Contains(m3u8Content, "#EXTINF") &&
+		!strings.Contains(m3u8Content, "#EXT-X-ENDLIST") &&
+		!strings.Contains(m3u8Content, "#EXT-X-STREAM-INF")
+}
+
+// rewriteLivePlaylist is rewritePlaylist for live media playlists. key must
+// identify everything rewrite depends on besides the line itself, such as
+// the request's query string. Other playlists are rewritten in full.
+func rewriteLivePlaylist(key, m3u8Content, baseURL string, rewrite urlRewriter) string {
+	if !isLiveMediaPlaylist(m3u8Content) {
+		return rewritePlaylist(m3u8Content, baseURL, rewrite)
+	}
+	m3u8Content = preparePlaylist(m3u8Content, baseURL)
+	key = baseURL + "\x00" + key
+
+	c := liveRewrites
+	c.mu.Lock()
+	var previous map[string]string
+	if entry, ok := c.playlists[key]; ok {
+		previous = entry.lines
+	}
+	c.mu.Unlock()
+
+	lines := strings.Split(m3u8Content, "\n")
+	newLines := make([]string, len(lines))
+	current := make(map[string]string, len(lines))
+	for i, line := range lines {
+		rewritten, ok := previous[line]
+		if !ok {
+			rewritten = rewritePlaylistLine(line, baseURL, false, rewrite)
+		}
+		newLines[i] = rewritten
+		if line != rewritten {
+			current[line] = rewritten
+		}
+	}
+
+	c.mu.Lock()
+	c.playlists[key] = &liveRewrite{lines: current, used: time.Now()}
+	if len(c.playlists) > liveRewriteMaxPlaylists {
+		c.evict()
+	}
+	c.mu.Unlock()
+
+	return strings.Join(newLines, "\n")
+}
+
+// evict drops idle memos, then arbitrary ones until under the limit;
+// callers must hold c.mu
+func (c *liveRewriteCache) evict() {
+	cutoff := time.Now().Add(-liveRewriteIdle)
+	for key, entry := range c.playlists {
+		if entry.used.Before(cutoff) {
+			delete(c.playlists, key)
+		}
+	}
+	for key := range c.playlists {
+		if len(c.playlists) <= liveRewriteMaxPlaylists {
+			break
+		}
+		delete(c.playlists, key)
+	}
+}
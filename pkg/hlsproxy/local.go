@@ -0,0 +1,127 @@
+package hlsproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// localMedia is the directory served under /local/, or nil when disabled.
+// os.Root keeps symlinks and ".." from escaping it.
+var localMedia *os.Root
+
+// localContentTypes covers streaming extensions missing from most mime tables
+var localContentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".m3u":  "audio/x-mpegurl",
+	".mpd":  "application/dash+xml",
+	".ts":   "video/mp2t",
+	".m4s":  "video/iso.segment",
+	".mp4":  "video/mp4",
+	".m4a":  "audio/mp4",
+	".aac":  "audio/aac",
+	".vtt":  "text/vtt",
+}
+
+// localMediaHandler serves playlists and segments from LOCAL_MEDIA_DIR.
+// Playlists get the same URI rewriting as proxied ones, so remote URIs in
+// them are routed through the proxy while local ones stay relative.
+func localMediaHandler(w http.ResponseWriter, r *http.Request) {
+	if localMedia == nil {
+		sendLocalError(w, http.StatusNotFound, "Local media is disabled; set LOCAL_MEDIA_DIR")
+		return
+	}
+
+	cleaned := path.Clean(r.URL.Path)
+	if !strings.HasPrefix(cleaned, "/local/") {
+		sendLocalError(w, http.StatusNotFound, "File not found")
+		return
+	}
+	name := strings.TrimPrefix(cleaned, "/local/")
+
+	f, err := localMedia.Open(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			sendLocalError(w, http.StatusNotFound, "File not found")
+		} else {
+			sendLocalError(w, http.StatusForbidden, "File not accessible")
+		}
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		sendLocalError(w, http.StatusNotFound, "File not found")
+		return
+	}
+
+	ext := strings.ToLower(path.Ext(name))
+	contentType, ok := localContentTypes[ext]
+	if !ok {
+		contentType = mime.TypeByExtension(ext)
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+
+	if ext == ".m3u8" || ext == ".m3u" {
+		body, err := io.ReadAll(f)
+		if err != nil {
+			sendError(w, "Failed to read playlist", err.Error())
+			return
+		}
+		base := playlistBaseURL(r)
+		playlistURL := base + "/local/" + name
+		w.Write([]byte(rewritePlaylist(string(body), playlistURL, localRewriter(base, playlistURL, tokenParam(r)))))
+		return
+	}
+
+	// ServeContent handles Range, If-Modified-Since and HEAD
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
+// localRewriter keeps URIs that resolve inside /local/ relative to the
+// playlist and sends everything else through the proxy. Every URI gets
+// suffix, the &token= of the playlist request.
+func localRewriter(base, playlistURL, suffix string) urlRewriter {
+	localPrefix := base + "/local/"
+	dir := playlistURL[:strings.LastIndex(playlistURL, "/")+1]
+
+	return func(resolvedURL string, kind uriKind) string {
+		if strings.HasPrefix(resolvedURL, localPrefix) {
+			local := strings.TrimPrefix(resolvedURL, base)
+			if strings.HasPrefix(resolvedURL, dir) {
+				local = strings.TrimPrefix(resolvedURL, dir)
+			}
+			if suffix != "" {
+				separator := "?"
+				if strings.Contains(local, "?") {
+					separator = "&"
+				}
+				local += separator + suffix[1:]
+			}
+			return local
+		}
+		endpoint := segmentEndpoint(kind)
+		if kind == playlistURI {
+			endpoint = "proxy"
+		}
+		return fmt.Sprintf("%s/%s?url=%s", base, endpoint, url.QueryEscape(resolvedURL)) + suffix
+	}
+}
+
+// sendLocalError sends a JSON error with the given status
+func sendLocalError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -0,0 +1,327 @@
+package hlsproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencySamples is how many recent latencies are kept per host for percentiles
+const latencySamples = 512
+
+const (
+	// metricsMaxHosts caps how many upstream hosts are tracked
+	metricsMaxHosts = 1000
+	// metricsHostIdle is how long a host without requests is kept once the
+	// cap is reached
+	metricsHostIdle = time.Hour
+)
+
+// hostMetrics accumulates upstream health for one host
+type hostMetrics struct {
+	requests            int64
+	failures            int64
+	consecutiveFailures int64
+	bytes               atomic.Int64 // added to as bodies are read, without m.mu
+	rateLimited         int64        // 429 responses
+	rateLimitRetries    int64        // requests retried in-proxy after a 429
+	retries             int64        // attempts repeated under a domain policy
+	latencySum          time.Duration
+	latencies           []time.Duration // ring buffer of the most recent samples
+	next                int
+	lastError           string
+	lastErrorAt         time.Time
+	lastSeen            time.Time
+}
+
+// upstreamMetrics tracks every upstream host the proxy talks to
+type upstreamMetrics struct {
+	mu    sync.Mutex
+	hosts map[string]*hostMetrics
+}
+
+var metrics = &upstreamMetrics{hosts: make(map[string]*hostMetrics)}
+
+// host returns the metrics for host, creating them; callers must hold m.mu.
+// Past metricsMaxHosts, hosts idle for metricsHostIdle are dropped, or the
+// longest idle one when none is.
+func (m *upstreamMetrics) host(host string) *hostMetrics {
+	now := time.Now()
+	h, ok := m.hosts[host]
+	if !ok {
+		if len(m.hosts) >= metricsMaxHosts {
+			m.evict(now)
+		}
+		h = &hostMetrics{}
+		m.hosts[host] = h
+	}
+	h.lastSeen = now
+	return h
+}
+
+// evict makes room for another host; callers must hold m.mu
+func (m *upstreamMetrics) evict(now time.Time) {
+	var oldest string
+	for host, h := range m.hosts {
+		if now.Sub(h.lastSeen) > metricsHostIdle {
+			delete(m.hosts, host)
+		} else if oldest == "" || h.lastSeen.Before(m.hosts[oldest].lastSeen) {
+			oldest = host
+		}
+	}
+	if len(m.hosts) >= metricsMaxHosts {
+		delete(m.hosts, oldest)
+	}
+}
+
+// observe records the outcome of one upstream request
+func (m *upstreamMetrics) observe(host string, latency time.Duration, failure string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h := m.host(host)
+	h.requests++
+	h.latencySum += latency
+	if len(h.latencies) < latencySamples {
+		h.latencies = append(h.latencies, latency)
+	} else {
+		h.latencies[h.next] = latency
+		h.next = (h.next + 1) % latencySamples
+	}
+
+	if failure == "" {
+		h.consecutiveFailures = 0
+		return
+	}
+	h.failures++
+	h.consecutiveFailures++
+	h.lastError = failure
+	h.lastErrorAt = time.Now()
+}
+
+// bytesCounter returns the counter of response body bytes read from host
+func (m *upstreamMetrics) bytesCounter(host string) *atomic.Int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return &m.host(host).bytes
+}
+
+// addRateLimited records a 429 from host
+func (m *upstreamMetrics) addRateLimited(host string) {
+	m.mu.Lock()
+	m.host(host).rateLimited++
+	m.mu.Unlock()
+}
+
+// addRateLimitRetry records a retry of a request host answered with 429
+func (m *upstreamMetrics) addRateLimitRetry(host string) {
+	m.mu.Lock()
+	m.host(host).rateLimitRetries++
+	m.mu.Unlock()
+}
+
+// addRetry records another attempt at a request to host that failed
+func (m *upstreamMetrics) addRetry(host string) {
+	m.mu.Lock()
+	m.host(host).retries++
+	m.mu.Unlock()
+}
+
+// hostSnapshot is the reported view of one host's metrics
+type hostSnapshot struct {
+	Host                string     `json:"host"`
+	Requests            int64      `json:"requests"`
+	Failures            int64      `json:"failures"`
+	SuccessRate         float64    `json:"successRate"`
+	ConsecutiveFailures int64      `json:"consecutiveFailures"`
+	Bytes               int64      `json:"bytes"`
+	RateLimited         int64      `json:"rateLimited"`
+	RateLimitRetries    int64      `json:"rateLimitRetries"`
+	Retries             int64      `json:"retries"`
+	LatencyP50Ms        float64    `json:"latencyP50Ms"`
+	LatencyP95Ms        float64    `json:"latencyP95Ms"`
+	LastError           string     `json:"lastError,omitempty"`
+	LastErrorAt         *time.Time `json:"lastErrorAt,omitempty"`
+
+	latencySum time.Duration
+	p50, p95   time.Duration
+}
+
+// snapshot returns the metrics of every host, sorted by host
+func (m *upstreamMetrics) snapshot() []hostSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snapshots := make([]hostSnapshot, 0, len(m.hosts))
+	for host, h := range m.hosts {
+		s := hostSnapshot{
+			Host:                host,
+			Requests:            h.requests,
+			Failures:            h.failures,
+			ConsecutiveFailures: h.consecutiveFailures,
+			Bytes:               h.bytes.Load(),
+			RateLimited:         h.rateLimited,
+			RateLimitRetries:    h.rateLimitRetries,
+			Retries:             h.retries,
+			LastError:           h.lastError,
+			latencySum:          h.latencySum,
+		}
+		if h.requests > 0 {
+			s.SuccessRate = float64(h.requests-h.failures) / float64(h.requests)
+		}
+		if !h.lastErrorAt.IsZero() {
+			at := h.lastErrorAt
+			s.LastErrorAt = &at
+		}
+
+		sorted := append([]time.Duration(nil), h.latencies...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		s.p50, s.p95 = percentile(sorted, 0.50), percentile(sorted, 0.95)
+		s.LatencyP50Ms = float64(s.p50) / float64(time.Millisecond)
+		s.LatencyP95Ms = float64(s.p95) / float64(time.Millisecond)
+
+		snapshots = append(snapshots, s)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Host < snapshots[j].Host })
+	return snapshots
+}
+
+// percentile returns the nearest-rank percentile of sorted samples
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// metricsTransport measures every upstream attempt, retries included.
+// Latency is time to response headers; bytes are counted as the body is read.
+type metricsTransport struct {
+	next http.RoundTripper
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := strings.ToLower(req.URL.Host)
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	latency := time.Since(start)
+
+	switch {
+	case err != nil:
+		if req.Context().Err() == nil {
+			metrics.observe(host, latency, err.Error())
+		}
+		return resp, err
+	case resp.StatusCode >= 500:
+		metrics.observe(host, latency, resp.Status)
+	default:
+		metrics.observe(host, latency, "")
+		if resp.StatusCode == http.StatusTooManyRequests {
+			metrics.addRateLimited(host)
+		}
+	}
+	resp.Body = &countingBody{ReadCloser: resp.Body, bytes: metrics.bytesCounter(host)}
+	return resp, nil
+}
+
+// countingBody reports bytes read from an upstream body to its host's counter
+type countingBody struct {
+	io.ReadCloser
+	bytes *atomic.Int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.bytes.Add(int64(n))
+	}
+	return n, err
+}
+
+// adminMetricsHandler returns per-host upstream metrics as JSON
+func adminMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"upstreams": metrics.snapshot(),
+		"clients":   clientTransfers.snapshot(),
+	})
+}
+
+// prometheusHandler exposes per-host upstream metrics in the Prometheus text format
+func prometheusHandler(w http.ResponseWriter, r *http.Request) {
+	snapshots := metrics.snapshot()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	family := func(name, kind, help string, value func(s hostSnapshot) string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, s := range snapshots {
+			fmt.Fprintf(w, "%s{host=\"%s\"} %s\n", name, promLabel(s.Host), value(s))
+		}
+	}
+	family("m3u8_proxy_upstream_requests_total", "counter", "Upstream requests by host.", func(s hostSnapshot) string {
+		return fmt.Sprint(s.Requests)
+	})
+	family("m3u8_proxy_upstream_failures_total", "counter", "Upstream requests that failed or returned 5xx.", func(s hostSnapshot) string {
+		return fmt.Sprint(s.Failures)
+	})
+	family("m3u8_proxy_upstream_bytes_total", "counter", "Response body bytes read from upstream.", func(s hostSnapshot) string {
+		return fmt.Sprint(s.Bytes)
+	})
+	family("m3u8_proxy_upstream_rate_limited_total", "counter", "Upstream 429 Too Many Requests responses.", func(s hostSnapshot) string {
+		return fmt.Sprint(s.RateLimited)
+	})
+	family("m3u8_proxy_upstream_rate_limit_retries_total", "counter", "Requests retried in-proxy after a 429.", func(s hostSnapshot) string {
+		return fmt.Sprint(s.RateLimitRetries)
+	})
+	family("m3u8_proxy_upstream_retries_total", "counter", "Attempts repeated after a timeout, network error or 502/503/504.", func(s hostSnapshot) string {
+		return fmt.Sprint(s.Retries)
+	})
+	family("m3u8_proxy_upstream_consecutive_failures", "gauge", "Failures since the last successful upstream request.", func(s hostSnapshot) string {
+		return fmt.Sprint(s.ConsecutiveFailures)
+	})
+
+	clients := clientTransfers.snapshot()
+	clientFamily := func(name, help string, value func(s clientTransferSnapshot) int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, s := range clients {
+			fmt.Fprintf(w, "%s{domain=\"%s\"} %d\n", name, promLabel(s.Domain), value(s))
+		}
+	}
+	clientFamily("m3u8_proxy_client_transfers_total", "Proxied responses by upstream domain.", func(s clientTransferSnapshot) int64 {
+		return s.Transfers
+	})
+	clientFamily("m3u8_proxy_client_bytes_total", "Response body bytes clients were sent, after compression.", func(s clientTransferSnapshot) int64 {
+		return s.Bytes
+	})
+	clientFamily("m3u8_proxy_client_aborted_total", "Responses the client abandoned before the end.", func(s clientTransferSnapshot) int64 {
+		return s.Aborted
+	})
+
+	const latency = "m3u8_proxy_upstream_latency_seconds"
+	fmt.Fprintf(w, "# HELP %s Time to upstream response headers over recent requests.\n# TYPE %s summary\n", latency, latency)
+	for _, s := range snapshots {
+		host := promLabel(s.Host)
+		fmt.Fprintf(w, "%s{host=\"%s\",quantile=\"0.5\"} %g\n", latency, host, s.p50.Seconds())
+		fmt.Fprintf(w, "%s{host=\"%s\",quantile=\"0.95\"} %g\n", latency, host, s.p95.Seconds())
+		fmt.Fprintf(w, "%s_sum{host=\"%s\"} %g\n", latency, host, s.latencySum.Seconds())
+		fmt.Fprintf(w, "%s_count{host=\"%s\"} %d\n", latency, host, s.Requests)
+	}
+}
+
+// promLabel escapes a Prometheus label value
+func promLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
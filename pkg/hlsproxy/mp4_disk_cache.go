@@ -0,0 +1,414 @@
+package hlsproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// mp4CacheMetaFile holds an entry's mp4CacheMeta; its mtime is the last use
+	mp4CacheMetaFile = "meta.json"
+	// mp4CacheFills bounds the files filled in the background at once
+	mp4CacheFills = 2
+)
+
+// mp4Cache keeps MP4s proxied by range on disk; nil disables it
+var mp4Cache *mp4DiskCache
+
+// mp4CacheMeta describes one cached file
+type mp4CacheMeta struct {
+	URL          string `json:"url"`
+	Size         int64  `json:"size"`
+	ChunkSize    int64  `json:"chunkSize"`
+	ContentType  string `json:"contentType"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+
+	dir string // the entry's directory
+}
+
+// chunks returns how many chunks the file has
+func (m *mp4CacheMeta) chunks() int64 {
+	return (m.Size + m.ChunkSize - 1) / m.ChunkSize
+}
+
+// chunkRange returns the bytes chunk i covers
+func (m *mp4CacheMeta) chunkRange(i int64) (int64, int64) {
+	return i * m.ChunkSize, min((i+1)*m.ChunkSize, m.Size) - 1
+}
+
+// mp4DiskCache stores MP4s as one directory per URL and credentials holding
+// the file's chunks as separate files, present only once fetched. Viewers seeking
+// around a popular file fill in its chunks, and each entry is filled up in
+// the background after its first request. The least recently used entries
+// go when the cache grows past maxBytes.
+type mp4DiskCache struct {
+	dir       string
+	maxBytes  int64
+	chunkSize int64
+	size      atomic.Int64
+
+	mu      sync.Mutex
+	flights map[string]*chunkFlight // chunk fetches in progress, by chunk path
+	filling map[string]bool         // entries being filled in the background, by directory
+	fills   chan struct{}
+
+	evicting atomic.Bool
+}
+
+// chunkFlight is one chunk fetch that concurrent readers of the chunk wait for
+type chunkFlight struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// newMP4DiskCache opens the cache in dir, creating it when missing
+func newMP4DiskCache(dir string, maxBytes, chunkSize int64) (*mp4DiskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	c := &mp4DiskCache{
+		dir:       dir,
+		maxBytes:  maxBytes,
+		chunkSize: chunkSize,
+		flights:   make(map[string]*chunkFlight),
+		filling:   make(map[string]bool),
+		fills:     make(chan struct{}, mp4CacheFills),
+	}
+	var size int64
+	filepath.WalkDir(dir, func(_ string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, infoErr := d.Info(); infoErr == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	c.size.Store(size)
+	return c, nil
+}
+
+// entryDir returns the directory of targetURL's entry for requests with
+// requestHeaders. Files fetched with cookies, authorization or caller-supplied
+// header overrides are private, so each set of them gets its own entry.
+func (c *mp4DiskCache) entryDir(targetURL string, requestHeaders, overrides map[string]string) string {
+	sum := sha256.Sum256([]byte(targetURL + "\x00" + credentialKey(requestHeaders, overrides)))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:16]))
+}
+
+// meta returns the entry of targetURL, probing upstream for its size and
+// validators when there is none yet. ok is false when the origin doesn't
+// serve ranges, so the file can't be cached in chunks.
+func (c *mp4DiskCache) meta(ctx context.Context, targetURL string, requestHeaders, overrides map[string]string) (*mp4CacheMeta, bool) {
+	dir := c.entryDir(targetURL, requestHeaders, overrides)
+	metaPath := filepath.Join(dir, mp4CacheMetaFile)
+	if data, err := os.ReadFile(metaPath); err == nil {
+		var meta mp4CacheMeta
+		if json.Unmarshal(data, &meta) == nil && meta.URL == targetURL && meta.ChunkSize > 0 {
+			now := time.Now()
+			os.Chtimes(metaPath, now, now)
+			meta.dir = dir
+			return &meta, true
+		}
+	}
+
+	_, probe, err := fetchRange(ctx, targetURL, requestHeaders, 0, 0)
+	if err != nil || probe.Header.Get("Content-Encoding") != "" {
+		return nil, false
+	}
+	total, ok := contentRangeTotal(probe.Header.Get("Content-Range"))
+	if !ok {
+		return nil, false
+	}
+	meta := &mp4CacheMeta{
+		URL:          targetURL,
+		Size:         total,
+		ChunkSize:    c.chunkSize,
+		ContentType:  probe.Header.Get("Content-Type"),
+		ETag:         probe.Header.Get("ETag"),
+		LastModified: probe.Header.Get("Last-Modified"),
+		dir:          dir,
+	}
+	data, _ := json.Marshal(meta)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, false
+	}
+	if err := writeFileAtomic(metaPath, data); err != nil {
+		return nil, false
+	}
+	c.size.Add(int64(len(data)))
+	return meta, true
+}
+
+// chunk returns chunk i of an entry from disk, or fetches and stores it,
+// sharing the fetch with concurrent readers of the same chunk
+func (c *mp4DiskCache) chunk(ctx context.Context, meta *mp4CacheMeta, i int64, requestHeaders map[string]string) ([]byte, error) {
+	from, to := meta.chunkRange(i)
+	path := filepath.Join(meta.dir, strconv.FormatInt(i, 10)+".chunk")
+	for {
+		if data, err := os.ReadFile(path); err == nil && int64(len(data)) == to-from+1 {
+			return data, nil
+		}
+		c.mu.Lock()
+		flight, ok := c.flights[path]
+		if !ok {
+			break // with c.mu held
+		}
+		c.mu.Unlock()
+		select {
+		case <-flight.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		// When the reader that fetched went away, try again ourselves
+		if !errors.Is(flight.err, context.Canceled) {
+			return flight.data, flight.err
+		}
+	}
+	flight := &chunkFlight{done: make(chan struct{})}
+	c.flights[path] = flight
+	c.mu.Unlock()
+
+	flight.data, flight.err = c.fetchChunk(ctx, meta, from, to, path, requestHeaders)
+	c.mu.Lock()
+	delete(c.flights, path)
+	c.mu.Unlock()
+	close(flight.done)
+	return flight.data, flight.err
+}
+
+// fetchChunk fetches the bytes [from, to] of an entry and stores them in
+// path. A changed ETag or Last-Modified means the file changed upstream,
+// so the whole entry is dropped instead of mixing chunks of two versions.
+func (c *mp4DiskCache) fetchChunk(ctx context.Context, meta *mp4CacheMeta, from, to int64, path string, requestHeaders map[string]string) ([]byte, error) {
+	data, resp, err := fetchRange(ctx, meta.URL, requestHeaders, from, to)
+	if err != nil {
+		return nil, err
+	}
+	total, _ := contentRangeTotal(resp.Header.Get("Content-Range"))
+	if total != meta.Size || resp.Header.Get("ETag") != meta.ETag || resp.Header.Get("Last-Modified") != meta.LastModified {
+		c.drop(meta.dir)
+		return nil, fmt.Errorf("%s changed upstream while cached", meta.URL)
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		log.Printf("MP4 cache: storing %s: %v", path, err)
+		return data, nil
+	}
+	if c.size.Add(int64(len(data))) > c.maxBytes {
+		c.evict()
+	}
+	return data, nil
+}
+
+// fill fetches the missing chunks of an entry in the background, once per
+// entry at a time
+func (c *mp4DiskCache) fill(ctx context.Context, meta *mp4CacheMeta, requestHeaders map[string]string) {
+	c.mu.Lock()
+	if c.filling[meta.dir] {
+		c.mu.Unlock()
+		return
+	}
+	c.filling[meta.dir] = true
+	c.mu.Unlock()
+
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.filling, meta.dir)
+			c.mu.Unlock()
+		}()
+		c.fills <- struct{}{}
+		defer func() { <-c.fills }()
+		for i := int64(0); i < meta.chunks(); i++ {
+			if _, err := c.chunk(ctx, meta, i, requestHeaders); err != nil {
+				log.Printf("MP4 cache: filling %s stopped at chunk %d: %v", meta.URL, i, err)
+				return
+			}
+		}
+	}()
+}
+
+// drop removes the entry in dir
+func (c *mp4DiskCache) drop(dir string) {
+	c.size.Add(-dirSize(dir))
+	os.RemoveAll(dir)
+}
+
+// evict removes the least recently used entries until the cache is back
+// under 90% of maxBytes, one eviction at a time. Entries are picked under
+// c.mu, skipping those being filled, and deleted after releasing it, so
+// chunk reads don't wait for the disk.
+func (c *mp4DiskCache) evict() {
+	if c.size.Load() <= c.maxBytes || !c.evicting.CompareAndSwap(false, true) {
+		return
+	}
+	defer c.evicting.Store(false)
+	type entry struct {
+		dir    string
+		usedAt time.Time
+		size   int64
+	}
+	dirs, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	var entries []entry
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		dir := filepath.Join(c.dir, d.Name())
+		e := entry{dir: dir, size: dirSize(dir)}
+		if info, err := os.Stat(filepath.Join(dir, mp4CacheMetaFile)); err == nil {
+			e.usedAt = info.ModTime()
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].usedAt.Before(entries[j].usedAt) })
+
+	var victims []entry
+	excess := c.size.Load() - c.maxBytes*9/10
+	c.mu.Lock()
+	for _, e := range entries {
+		if excess <= 0 {
+			break
+		}
+		if !c.filling[e.dir] {
+			victims = append(victims, e)
+			excess -= e.size
+		}
+	}
+	c.mu.Unlock()
+
+	for _, e := range victims {
+		if os.RemoveAll(e.dir) == nil {
+			c.size.Add(-e.size)
+		}
+	}
+}
+
+// dirSize returns the bytes of the files in dir
+func dirSize(dir string) int64 {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	var size int64
+	for _, f := range files {
+		if info, err := f.Info(); err == nil && !f.IsDir() {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// writeFileAtomic writes data to path through a temporary file, so readers
+// never see a partial chunk
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// serveCachedMP4 serves the requested range of targetURL from the disk
+// cache, fetching the chunks it lacks, and starts filling in the rest of
+// the file. overrides are the caller-supplied headers among requestHeaders.
+// It returns false, without writing anything, when the cache is off or the
+// request or origin is not suitable so the caller can proxy normally.
+func serveCachedMP4(w http.ResponseWriter, r *http.Request, targetURL string, requestHeaders, overrides map[string]string) bool {
+	if mp4Cache == nil || r.Method != http.MethodGet {
+		return false
+	}
+	start, end, ranged := int64(0), int64(-1), false
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		var ok bool
+		if start, end, ok = parseByteRange(rangeHeader); !ok {
+			return false
+		}
+		ranged = true
+	}
+
+	// Chunks are fetched with the caller's headers, minus its range
+	headers := mergeHeaders(make(map[string]string), requestHeaders)
+	delete(headers, "Range")
+	meta, ok := mp4Cache.meta(r.Context(), targetURL, headers, overrides)
+	if !ok || start >= meta.Size {
+		return false
+	}
+	if end == -1 || end >= meta.Size {
+		end = meta.Size - 1
+	}
+
+	// Fetch the first chunk before answering, so a failure can still be reported
+	first, last := start/meta.ChunkSize, end/meta.ChunkSize
+	data, err := mp4Cache.chunk(r.Context(), meta, first, headers)
+	if err != nil {
+		sendUpstreamError(w, "Failed to proxy mp4 content", err)
+		return true
+	}
+
+	contentType := meta.ContentType
+	if contentType == "" {
+		contentType = "video/mp4"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Disposition", contentDisposition(r, targetURL, contentType))
+	if meta.ETag != "" {
+		w.Header().Set("ETag", meta.ETag)
+	}
+	if meta.LastModified != "" {
+		w.Header().Set("Last-Modified", meta.LastModified)
+	}
+	if ranged {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, meta.Size))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	mp4Cache.fill(context.WithoutCancel(r.Context()), meta, headers)
+	cw := &clientWriter{w: w}
+	for i := first; i <= last; i++ {
+		if i > first {
+			if data, err = mp4Cache.chunk(r.Context(), meta, i, headers); err != nil {
+				if r.Context().Err() == nil {
+					log.Printf("MP4 cache: aborting %s at chunk %d: %v", targetURL, i, err)
+				}
+				panic(http.ErrAbortHandler)
+			}
+		}
+		from, _ := meta.chunkRange(i)
+		lo, hi := max(start-from, 0), min(end-from+1, int64(len(data)))
+		if _, err := cw.Write(data[lo:hi]); err != nil {
+			return true
+		}
+	}
+	return true
+}
@@ -0,0 +1,373 @@
+package hlsproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// faststartMaxMoov bounds the moov atom held in memory per layout
+	faststartMaxMoov = 64 << 20
+	// faststartMaxAtoms bounds how many top-level atoms are probed
+	faststartMaxAtoms = 64
+	// faststartCacheTTL is how long a computed layout serves later range
+	// requests, which players send on every seek
+	faststartCacheTTL = 10 * time.Minute
+	// faststartMaxCached bounds the layout cache
+	faststartMaxCached = 64
+)
+
+// mp4Atom is a top-level box of an MP4 file
+type mp4Atom struct {
+	kind         string
+	offset, size int64
+}
+
+// faststartPiece is a run of the remuxed file: moved bytes held in memory,
+// or a range of the origin file
+type faststartPiece struct {
+	data   []byte
+	origin int64
+	length int64
+}
+
+// faststartLayout describes the remuxed file as pieces in order. It has the
+// same length as the origin file; only the moov atom moves.
+type faststartLayout struct {
+	total       int64
+	pieces      []faststartPiece
+	contentType string
+	validator   string // ETag or Last-Modified, sent as If-Range
+	expires     time.Time
+}
+
+// faststartLayouts are the layouts by faststartKey
+var faststartLayouts = struct {
+	sync.Mutex
+	entries map[string]*faststartLayout
+}{entries: make(map[string]*faststartLayout)}
+
+// faststartKey keys the layout of targetURL. A layout is learned with the
+// requester's credentials and header overrides, so others get their own.
+func faststartKey(targetURL string, requestHeaders, overrides map[string]string) string {
+	return targetURL + "\x00" + credentialKey(requestHeaders, overrides)
+}
+
+// serveFaststartMP4 serves an MP4 whose moov atom sits after its media data
+// as if it had been remuxed with the moov first, so playback can start
+// before the whole file is downloaded. Only the moov is fetched and
+// rewritten; media data streams straight from the origin. It returns false,
+// without writing anything, when the file isn't suitable so the caller can
+// proxy normally. overrides are the caller-supplied headers among
+// requestHeaders.
+func serveFaststartMP4(w http.ResponseWriter, r *http.Request, targetURL string, requestHeaders, overrides map[string]string) bool {
+	key := faststartKey(targetURL, requestHeaders, overrides)
+	layout, err := faststartLayoutFor(r.Context(), key, targetURL, requestHeaders)
+	if err != nil {
+		log.Printf("Faststart of %s skipped: %v", targetURL, err)
+		return false
+	}
+	if layout == nil {
+		return false
+	}
+
+	start, end, ranged := int64(0), layout.total-1, false
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		if s, e, ok := parseByteRange(rangeHeader); ok {
+			if s >= layout.total {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", layout.total))
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return true
+			}
+			start, ranged = s, true
+			if e != -1 && e < end {
+				end = e
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", layout.contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Disposition", contentDisposition(r, targetURL, layout.contentType))
+	if ranged {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, layout.total))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	if r.Method == http.MethodHead {
+		return true
+	}
+
+	cw := &clientWriter{w: w}
+	var pos int64
+	for _, piece := range layout.pieces {
+		from, to := max(start, pos), min(end, pos+piece.length-1)
+		pos += piece.length
+		if from > to {
+			continue
+		}
+		skip := from - (pos - piece.length)
+		if piece.data != nil {
+			if _, err := cw.Write(piece.data[skip : skip+to-from+1]); err != nil {
+				return true
+			}
+			continue
+		}
+		if err := copyOriginRange(r.Context(), cw, targetURL, requestHeaders, layout.validator, piece.origin+skip, piece.origin+skip+to-from); err != nil {
+			if cw.err != nil {
+				return true
+			}
+			// Headers are already sent; abort so the player retries the
+			// range, against a fresh layout in case the file changed
+			log.Printf("Faststart fetch of %s failed: %v", targetURL, err)
+			faststartLayouts.Lock()
+			delete(faststartLayouts.entries, key)
+			faststartLayouts.Unlock()
+			panic(http.ErrAbortHandler)
+		}
+	}
+	return true
+}
+
+// faststartLayoutFor returns the cached or newly computed layout of
+// targetURL under key, or nil when the moov already precedes the media data
+func faststartLayoutFor(ctx context.Context, key, targetURL string, requestHeaders map[string]string) (*faststartLayout, error) {
+	faststartLayouts.Lock()
+	if layout, ok := faststartLayouts.entries[key]; ok && time.Now().Before(layout.expires) {
+		faststartLayouts.Unlock()
+		return layout, nil
+	}
+	faststartLayouts.Unlock()
+
+	layout, err := buildFaststartLayout(ctx, targetURL, requestHeaders)
+	if err != nil || layout == nil {
+		return nil, err
+	}
+
+	faststartLayouts.Lock()
+	defer faststartLayouts.Unlock()
+	now := time.Now()
+	for other, cached := range faststartLayouts.entries {
+		if now.After(cached.expires) || len(faststartLayouts.entries) >= faststartMaxCached {
+			delete(faststartLayouts.entries, other)
+		}
+	}
+	faststartLayouts.entries[key] = layout
+	return layout, nil
+}
+
+// buildFaststartLayout walks the top-level atoms with small range requests,
+// fetches the moov and shifts its chunk offsets past the relocated moov
+func buildFaststartLayout(ctx context.Context, targetURL string, requestHeaders map[string]string) (*faststartLayout, error) {
+	var atoms []mp4Atom
+	var total int64 = -1
+	var probe *http.Response
+	for offset := int64(0); total < 0 || offset < total; {
+		if len(atoms) == faststartMaxAtoms {
+			return nil, fmt.Errorf("more than %d top-level atoms", faststartMaxAtoms)
+		}
+		last := offset + 15
+		if total > 0 {
+			last = min(last, total-1)
+		}
+		head, resp, err := fetchRange(ctx, targetURL, requestHeaders, offset, last)
+		if err != nil {
+			return nil, err
+		}
+		if total < 0 {
+			var ok bool
+			if total, ok = contentRangeTotal(resp.Header.Get("Content-Range")); !ok {
+				return nil, fmt.Errorf("origin did not report the file size")
+			}
+			probe = resp
+		}
+		atom, err := parseAtomHeader(head, offset, total)
+		if err != nil {
+			return nil, err
+		}
+		atoms = append(atoms, atom)
+		offset += atom.size
+	}
+
+	moov, mdat := -1, -1
+	for i, atom := range atoms {
+		switch {
+		case atom.kind == "moov" && moov == -1:
+			moov = i
+		case atom.kind == "mdat" && mdat == -1:
+			mdat = i
+		}
+	}
+	if moov == -1 || mdat == -1 {
+		return nil, fmt.Errorf("no moov or mdat atom")
+	}
+	if moov < mdat {
+		return nil, nil
+	}
+	moovAtom, mdatStart := atoms[moov], atoms[mdat].offset
+	if moovAtom.size > faststartMaxMoov {
+		return nil, fmt.Errorf("moov atom of %d bytes is too large", moovAtom.size)
+	}
+
+	data, _, err := fetchRange(ctx, targetURL, requestHeaders, moovAtom.offset, moovAtom.offset+moovAtom.size-1)
+	if err != nil {
+		return nil, err
+	}
+	moovEnd := moovAtom.offset + moovAtom.size
+	shift := func(offset int64) int64 {
+		if offset >= mdatStart && offset < moovAtom.offset {
+			return offset + moovAtom.size
+		}
+		return offset
+	}
+	if err := shiftChunkOffsets(data, shift); err != nil {
+		return nil, err
+	}
+
+	layout := &faststartLayout{
+		total:       total,
+		contentType: probe.Header.Get("Content-Type"),
+		expires:     time.Now().Add(faststartCacheTTL),
+	}
+	if layout.contentType == "" {
+		layout.contentType = "video/mp4"
+	}
+	if etag := probe.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		layout.validator = etag
+	} else {
+		layout.validator = probe.Header.Get("Last-Modified")
+	}
+	addOrigin := func(from, to int64) {
+		if to > from {
+			layout.pieces = append(layout.pieces, faststartPiece{origin: from, length: to - from})
+		}
+	}
+	addOrigin(0, mdatStart)
+	layout.pieces = append(layout.pieces, faststartPiece{data: data, length: int64(len(data))})
+	addOrigin(mdatStart, moovAtom.offset)
+	addOrigin(moovEnd, total)
+	return layout, nil
+}
+
+// parseAtomHeader reads the size and type of the atom starting at offset
+func parseAtomHeader(head []byte, offset, total int64) (mp4Atom, error) {
+	if len(head) < 8 {
+		return mp4Atom{}, fmt.Errorf("truncated atom header at %d", offset)
+	}
+	atom := mp4Atom{kind: string(head[4:8]), offset: offset, size: int64(binary.BigEndian.Uint32(head))}
+	switch atom.size {
+	case 0:
+		atom.size = total - offset
+	case 1:
+		if len(head) < 16 {
+			return mp4Atom{}, fmt.Errorf("truncated atom header at %d", offset)
+		}
+		atom.size = int64(binary.BigEndian.Uint64(head[8:16]))
+	}
+	if atom.size < 8 || offset+atom.size > total {
+		return mp4Atom{}, fmt.Errorf("invalid %q atom size %d at %d", atom.kind, atom.size, offset)
+	}
+	return atom, nil
+}
+
+// shiftChunkOffsets rewrites every stco and co64 table inside a moov atom
+func shiftChunkOffsets(moov []byte, shift func(int64) int64) error {
+	var walk func(box []byte, header int) error
+	walk = func(box []byte, header int) error {
+		for pos := header; pos+8 <= len(box); {
+			size := int(binary.BigEndian.Uint32(box[pos:]))
+			kind := string(box[pos+4 : pos+8])
+			childHeader := 8
+			if size == 1 && pos+16 <= len(box) {
+				size, childHeader = int(binary.BigEndian.Uint64(box[pos+8:])), 16
+			}
+			if size < childHeader || pos+size > len(box) {
+				return fmt.Errorf("invalid %q box in moov", kind)
+			}
+			child := box[pos : pos+size]
+			switch kind {
+			case "trak", "mdia", "minf", "stbl":
+				if err := walk(child, childHeader); err != nil {
+					return err
+				}
+			case "cmov":
+				return fmt.Errorf("compressed moov atoms are not supported")
+			case "stco", "co64":
+				if err := shiftOffsetTable(child[childHeader:], kind == "co64", shift); err != nil {
+					return err
+				}
+			}
+			pos += size
+		}
+		return nil
+	}
+
+	header := 8
+	if binary.BigEndian.Uint32(moov) == 1 {
+		header = 16
+	}
+	return walk(moov, header)
+}
+
+// shiftOffsetTable rewrites the entries of one stco or co64 full box body
+func shiftOffsetTable(body []byte, wide bool, shift func(int64) int64) error {
+	if len(body) < 8 {
+		return fmt.Errorf("truncated chunk offset table")
+	}
+	count := int(binary.BigEndian.Uint32(body[4:]))
+	width := 4
+	if wide {
+		width = 8
+	}
+	entries := body[8:]
+	if count > len(entries)/width {
+		return fmt.Errorf("truncated chunk offset table")
+	}
+	for i := 0; i < count; i++ {
+		entry := entries[i*width:]
+		if wide {
+			binary.BigEndian.PutUint64(entry, uint64(shift(int64(binary.BigEndian.Uint64(entry)))))
+			continue
+		}
+		shifted := shift(int64(binary.BigEndian.Uint32(entry)))
+		if shifted > 1<<32-1 {
+			// Would need the table widened to co64, which resizes the moov
+			return fmt.Errorf("chunk offset overflows stco")
+		}
+		binary.BigEndian.PutUint32(entry, uint32(shifted))
+	}
+	return nil
+}
+
+// copyOriginRange streams bytes from..to of targetURL to w
+func copyOriginRange(ctx context.Context, w io.Writer, targetURL string, requestHeaders map[string]string, validator string, from, to int64) error {
+	headers := mergeHeaders(make(map[string]string), requestHeaders)
+	headers["Range"] = fmt.Sprintf("bytes=%d-%d", from, to)
+	if validator != "" {
+		headers["If-Range"] = validator
+	}
+
+	resp, err := fetch(ctx, fetchOptions{url: targetURL, headers: headers})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("upstream answered %d to a range request, file changed or ranges unsupported", resp.StatusCode)
+	}
+	n, err := io.Copy(w, resp.Body)
+	if err == nil && n != to-from+1 {
+		err = fmt.Errorf("short range: got %d of %d bytes", n, to-from+1)
+	}
+	return err
+}
@@ -0,0 +1,174 @@
+package hlsproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// parseByteRange parses a single "bytes=start-end" range. end is -1 for an
+// open-ended range. Suffix and multi-part ranges are not supported.
+func parseByteRange(header string) (start, end int64, ok bool) {
+	spec, found := strings.CutPrefix(strings.TrimSpace(header), "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, found := strings.Cut(spec, "-")
+	if !found || first == "" {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	if last == "" {
+		return start, -1, true
+	}
+	end, err = strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// contentRangeTotal returns the complete length from a "bytes a-b/total" header
+func contentRangeTotal(header string) (int64, bool) {
+	_, total, found := strings.Cut(header, "/")
+	if !found || total == "*" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(total, 10, 64)
+	return n, err == nil && n > 0
+}
+
+// fetchRange performs a ranged GET and returns the bytes of [start, end]
+func fetchRange(ctx context.Context, targetURL string, requestHeaders map[string]string, start, end int64) ([]byte, *http.Response, error) {
+	headers := mergeHeaders(make(map[string]string), requestHeaders)
+	headers["Range"] = fmt.Sprintf("bytes=%d-%d", start, end)
+
+	resp, err := fetch(ctx, fetchOptions{url: targetURL, headers: headers})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, resp, fmt.Errorf("upstream answered %d to a range request", resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, resp, err
+	}
+	if int64(len(data)) != end-start+1 {
+		return nil, resp, fmt.Errorf("short range: got %d of %d bytes", len(data), end-start+1)
+	}
+	return data, resp, nil
+}
+
+// serveParallelMP4 serves the requested range of targetURL by fetching
+// chunks over several upstream connections at once and writing them to the
+// client in order. It returns false, without writing anything, when the
+// request or origin is not suitable so the caller can proxy normally.
+func serveParallelMP4(w http.ResponseWriter, r *http.Request, targetURL string, requestHeaders map[string]string) bool {
+	connections := mp4ParallelConnections
+	chunkSize := mp4ParallelChunkSize
+	if connections < 2 || chunkSize <= 0 {
+		return false
+	}
+
+	start, end, ranged := int64(0), int64(-1), false
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		var ok bool
+		if start, end, ok = parseByteRange(rangeHeader); !ok {
+			return false
+		}
+		ranged = true
+	}
+
+	// Probe a single byte to learn the total size and confirm range support
+	_, probe, err := fetchRange(r.Context(), targetURL, requestHeaders, start, start)
+	if err != nil {
+		return false
+	}
+	total, ok := contentRangeTotal(probe.Header.Get("Content-Range"))
+	if !ok || start >= total {
+		return false
+	}
+	if end == -1 || end >= total {
+		end = total - 1
+	}
+
+	// Small transfers gain nothing from splitting
+	if end-start+1 <= 2*chunkSize {
+		return false
+	}
+
+	type chunk struct {
+		data []byte
+		err  error
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// Fetch chunks in order with at most `connections` in flight; each result
+	// channel is buffered so workers never block on the writer
+	var pending []chan chunk
+	next := start
+	dispatch := func() {
+		if next > end {
+			return
+		}
+		from, to := next, min(next+chunkSize-1, end)
+		next = to + 1
+		result := make(chan chunk, 1)
+		pending = append(pending, result)
+		go func() {
+			data, _, err := fetchRange(ctx, targetURL, requestHeaders, from, to)
+			if err != nil && ctx.Err() == nil {
+				// One retry for transient failures
+				data, _, err = fetchRange(ctx, targetURL, requestHeaders, from, to)
+			}
+			result <- chunk{data, err}
+		}()
+	}
+	for i := 0; i < connections; i++ {
+		dispatch()
+	}
+
+	contentType := probe.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "video/mp4"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Disposition", contentDisposition(r, targetURL, contentType))
+	if ranged {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, total))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	cw := &clientWriter{w: w}
+	for len(pending) > 0 {
+		result := <-pending[0]
+		pending = pending[1:]
+		if result.err != nil {
+			// Headers are already sent; abort so the player retries the range
+			log.Printf("Parallel MP4 fetch of %s failed: %v", targetURL, result.err)
+			panic(http.ErrAbortHandler)
+		}
+		if _, err := cw.Write(result.data); err != nil {
+			return true
+		}
+		dispatch()
+	}
+
+	return true
+}
@@ -0,0 +1,97 @@
+package hlsproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// openAPIHandler describes the routing table as an OpenAPI 3 document, so
+// client SDKs can be generated from a running server
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(openAPISpec())
+}
+
+// openAPISpec builds the OpenAPI document from routes
+func openAPISpec() map[string]any {
+	paths := make(map[string]any)
+	for _, rt := range routes {
+		path := strings.ReplaceAll(rt.pattern, "...}", "}")
+		params := make([]map[string]any, 0, len(rt.params)+1)
+		for _, part := range rt.segments {
+			if name, ok := strings.CutPrefix(part, "{"); ok {
+				params = append(params, map[string]any{
+					"name": strings.TrimSuffix(strings.TrimSuffix(name, "}"), "..."), "in": "path", "required": true,
+					"schema": map[string]string{"type": "string"},
+				})
+			}
+		}
+		for _, p := range rt.params {
+			params = append(params, map[string]any{
+				"name": p.name, "in": "query", "required": p.required, "description": p.description,
+				"schema": map[string]string{"type": "string"},
+			})
+		}
+
+		methods := rt.methods
+		if len(methods) == 0 {
+			methods = []string{http.MethodGet, http.MethodHead}
+		}
+		content := make(map[string]any)
+		for _, contentType := range splitList(rt.produces) {
+			content[contentType] = map[string]any{}
+		}
+		operations := make(map[string]any, len(methods))
+		for _, method := range methods {
+			operation := map[string]any{
+				"summary":    rt.summary,
+				"parameters": params,
+				"responses": map[string]any{
+					"200": map[string]any{
+						"description": "OK",
+						"content":     content,
+					},
+					"default": map[string]any{
+						"description": "Error",
+						"content": map[string]any{"application/json": map[string]any{
+							"schema": map[string]string{"$ref": "#/components/schemas/Error"},
+						}},
+					},
+				},
+			}
+			if rt.requires("admin") {
+				operation["security"] = []map[string][]string{{"adminToken": {}}, {"bearer": {}}}
+			}
+			if rt.requires("token") && jwtAlgorithm != "" {
+				operation["security"] = []map[string][]string{{"playbackToken": {}}}
+			}
+			operations[strings.ToLower(method)] = operation
+		}
+		paths[path] = operations
+	}
+
+	servers := make([]map[string]string, 0, len(publicURLs))
+	for _, u := range publicURLs {
+		servers = append(servers, map[string]string{"url": u})
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info":    map[string]string{"title": "M3U8 Cross-Origin Proxy Server", "version": "1.0.0"},
+		"servers": servers,
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": map[string]any{
+				"Error": map[string]any{
+					"type":       "object",
+					"properties": map[string]any{"error": map[string]string{"type": "string"}},
+				},
+			},
+			"securitySchemes": map[string]any{
+				"adminToken":    map[string]string{"type": "apiKey", "in": "header", "name": "X-Admin-Token"},
+				"bearer":        map[string]string{"type": "http", "scheme": "bearer"},
+				"playbackToken": map[string]string{"type": "apiKey", "in": "query", "name": "token"},
+			},
+		},
+	}
+}
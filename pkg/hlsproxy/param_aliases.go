@@ -0,0 +1,48 @@
+package hlsproxy
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// paramAliases maps query param names sent by existing clients to the names
+// the proxy reads, e.g. link -> url or h -> headers
+var paramAliases map[string]string
+
+// applyParamAliases renames aliased query params before routing, so every
+// endpoint sees the names it knows. A param given under its own name wins
+// over an alias.
+func applyParamAliases(r *http.Request) {
+	if len(paramAliases) == 0 || r.URL.RawQuery == "" {
+		return
+	}
+	query := r.URL.Query()
+	changed := false
+	for alias, name := range paramAliases {
+		values, ok := query[alias]
+		if !ok {
+			continue
+		}
+		if !query.Has(name) {
+			query[name] = values
+		}
+		query.Del(alias)
+		changed = true
+	}
+	if changed {
+		r.URL.RawQuery = query.Encode()
+	}
+}
+
+// validateParamAliases rejects empty names and aliases of other aliases
+func validateParamAliases(aliases map[string]string) error {
+	for alias, name := range aliases {
+		if alias == "" || name == "" || alias == name {
+			return fmt.Errorf("invalid param alias %q -> %q", alias, name)
+		}
+		if _, chained := aliases[name]; chained {
+			return fmt.Errorf("param alias %q points at another alias %q", alias, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package hlsproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// pathProxyHeaders are extra headers sent on path-style requests, keyed by
+// URL pattern, for origins that check them on every segment
+var pathProxyHeaders headerRules
+
+// pathFileExtensions look like top-level domains but name files, such as
+// /favicon.ico, when they end a single-element path
+var pathFileExtensions = map[string]bool{
+	"ico": true, "txt": true, "html": true, "htm": true, "js": true, "css": true, "json": true,
+	"xml": true, "png": true, "jpg": true, "svg": true, "m3u8": true, "m3u": true, "ts": true, "mp4": true,
+}
+
+// pathProxyHandler handles proxying where the upstream URL is in the path:
+// /{domain}/{path} fetches https://{domain}/{path} with the header profile
+// of that domain, and playlists are rewritten to the same URL style.
+// Example: http://localhost:3000/nightbreeze17.site/file2/.../playlist.m3u8
+// An absolute &url= overrides the path for origins it can't express.
+func pathProxyHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := extractDomainFromPath(r.URL.Path); !ok && r.URL.Query().Get("url") == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not found; path-style requests start with a domain, e.g. /cdn.example.com/path/index.m3u8"})
+		return
+	}
+	targetURL, err := pathProxyTarget(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	// Configured headers, then any the caller supplied
+	parsedHeaders := pathProxyHeaders.forURL(targetURL)
+	for k, v := range parseHeadersParam(r.URL.Query().Get("headers")).forURL(targetURL) {
+		parsedHeaders[k] = v
+	}
+
+	requestHeaders := requestHeadersFor(r, targetURL, parsedHeaders)
+
+	resp, err := fetch(r.Context(), fetchOptions{url: targetURL, headers: requestHeaders, overrides: parsedHeaders})
+	if err != nil {
+		sendUpstreamError(w, "Failed to proxy content", err)
+		return
+	}
+	defer resp.Body.Close()
+	encoding := prepareUpstreamBody(resp)
+
+	// Check if this is an M3U8 playlist (needs URL rewriting)
+	contentType := resp.Header.Get("Content-Type")
+	isM3U8 := isM3U8URL(targetURL) || strings.Contains(contentType, "mpegurl") || strings.Contains(contentType, "m3u8")
+
+	if isM3U8 {
+		if !checkPlaylistDepth(w, r) {
+			return
+		}
+		if encoding != "" {
+			sendUndecodableBody(w, encoding)
+			return
+		}
+		// M3U8: Read all, process URLs, then send
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			sendError(w, "Failed to read content", err.Error())
+			return
+		}
+		content := string(body)
+		if strings.Contains(content, "#EXTM3U") {
+			content = processM3U8Content(r, content, finalURL(resp, targetURL))
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		writePlaylist(w, content)
+	} else {
+		// Segments: Stream directly for progressive playback
+		if contentType == "" {
+			if strings.HasSuffix(targetURL, ".ts") {
+				contentType = "video/mp2t"
+			} else if strings.HasSuffix(targetURL, ".mp4") {
+				contentType = "video/mp4"
+			} else {
+				contentType = "application/octet-stream"
+			}
+		}
+		w.Header().Set("Content-Type", contentType)
+		setSegmentCacheControl(w, targetURL, resp)
+		if encoding != "" {
+			w.Header().Set("Content-Encoding", encoding)
+		}
+		copyUpstreamBody(w, resp)
+	}
+}
+
+// extractDomainFromPath returns the first element of a request path when it
+// looks like a hostname or IP address, with an optional port
+func extractDomainFromPath(path string) (string, bool) {
+	first, rest, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	host := first
+	if h, port, err := net.SplitHostPort(first); err == nil {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return "", false
+		}
+		host = strings.Trim(h, "[]")
+	}
+	if net.ParseIP(host) != nil {
+		return first, true
+	}
+
+	labels := strings.Split(strings.ToLower(host), ".")
+	if len(labels) < 2 || len(host) > 253 {
+		return "", false
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return "", false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return "", false
+			}
+		}
+	}
+	tld := labels[len(labels)-1]
+	if !strings.HasPrefix(tld, "xn--") && strings.Trim(tld, "abcdefghijklmnopqrstuvwxyz") != "" {
+		return "", false
+	}
+	if rest == "" && pathFileExtensions[tld] {
+		return "", false
+	}
+	return first, true
+}
+
+// pathProxyTarget returns the upstream URL of a path-style request: the
+// &url= override when given, otherwise https:// plus the path and query
+func pathProxyTarget(r *http.Request) (string, error) {
+	if override := r.URL.Query().Get("url"); override != "" {
+		u, err := url.Parse(override)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "", fmt.Errorf("url must be an absolute http(s) URL")
+		}
+		return override, nil
+	}
+
+	// Remove leading slash and add https://
+	targetURL := "https://" + strings.TrimPrefix(r.URL.Path, "/")
+
+	// Add back query parameters if any, except the proxy's playback token, binding and depth
+	own := []string{"depth", "depth_sig"}
+	if jwtAlgorithm != "" {
+		own = append(own, "token")
+	}
+	if shortURLBinding != "" {
+		own = append(own, "bind")
+	}
+	if rawQuery := stripRawQueryParams(r.URL.RawQuery, own...); rawQuery != "" {
+		targetURL = targetURL + "?" + rawQuery
+	}
+	return targetURL, nil
+}
+
+// processM3U8Content processes M3U8 content and rewrites URLs
+func processM3U8Content(r *http.Request, m3u8Content, targetURL string) string {
+	playlistBase := playlistBaseURL(r)
+	// Rewrites carry the playback token and depth, so they are only reused for the same ones
+	return rewriteLivePlaylist(playlistBase+"\x00"+tokenParam(r)+depthParam(r), m3u8Content, targetURL, func(resolvedURL string, kind uriKind) string {
+		isPlaylist := kind == playlistURI
+		// Remove https:// or http:// from the URL for the path format
+		proxyPath := strings.TrimPrefix(resolvedURL, "https://")
+		proxyPath = strings.TrimPrefix(proxyPath, "http://")
+
+		base := playlistBase
+		if !isPlaylist {
+			base = segmentBaseURL(r, resolvedURL)
+		}
+
+		// Build proxy URL without headers in URL (headers used only in HTTP request)
+		proxyURL := fmt.Sprintf("%s/%s", base, proxyPath)
+		if kind == licenseURI {
+			proxyURL = fmt.Sprintf("%s/license-proxy?url=%s", base, url.QueryEscape(resolvedURL))
+		} else if !strings.HasPrefix(resolvedURL, "https://") || hasURLParam(resolvedURL) {
+			// The path alone would be fetched over https or lose its query; pin the exact URL
+			proxyURL = fmt.Sprintf("%s/%s?url=%s", base, pathWithoutQuery(proxyPath), url.QueryEscape(resolvedURL))
+		}
+		suffix := tokenParam(r)
+		if isPlaylist {
+			suffix += depthParam(r)
+		}
+		if suffix != "" {
+			if !strings.Contains(proxyURL, "?") {
+				suffix = "?" + suffix[1:]
+			}
+			proxyURL += suffix
+		}
+		return proxyURL
+	})
+}
+
+// stripRawQueryParams removes the named params from a raw query, leaving the
+// rest exactly as sent, since signed origin URLs break when their query is
+// reordered or re-escaped
+func stripRawQueryParams(rawQuery string, names ...string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	pairs := strings.Split(rawQuery, "&")
+	kept := pairs[:0]
+	for _, pair := range pairs {
+		key, _, _ := strings.Cut(pair, "=")
+		if unescaped, err := url.QueryUnescape(key); err == nil {
+			key = unescaped
+		}
+		if !slices.Contains(names, key) {
+			kept = append(kept, pair)
+		}
+	}
+	return strings.Join(kept, "&")
+}
+
+// pathWithoutQuery strips the query string from a proxy path
+func pathWithoutQuery(proxyPath string) string {
+	path, _, _ := strings.Cut(proxyPath, "?")
+	return path
+}
+
+// hasURLParam reports whether rawURL has its own url query parameter, which
+// the path-style handler would otherwise take as an override
+func hasURLParam(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && u.Query().Has("url")
+}
@@ -0,0 +1,386 @@
+package hlsproxy
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// uriTagKinds lists the RFC 8216 tags that carry a URI attribute and whether
+// that URI points at another playlist (true) or at a media resource (false).
+// Tags not listed here fall back to guessing from the URI itself.
+var uriTagKinds = map[string]bool{
+	"EXT-X-MEDIA":              true,
+	"EXT-X-I-FRAME-STREAM-INF": true,
+	"EXT-X-KEY":                false,
+	"EXT-X-SESSION-KEY":        false,
+	"EXT-X-SESSION-DATA":       false,
+	"EXT-X-MAP":                false,
+	"EXT-X-PART":               false,
+	"EXT-X-PRELOAD-HINT":       false,
+	"EXT-X-RENDITION-REPORT":   true,
+}
+
+// tagURIAttrs lists URI-valued attributes other than URI, e.g. the
+// interstitial assets of EXT-X-DATERANGE (HLS interstitials), and whether
+// they point at a playlist
+var tagURIAttrs = map[string]map[string]bool{
+	"EXT-X-DATERANGE": {"X-ASSET-URI": true, "X-ASSET-LIST": false},
+}
+
+// uriKind is what a playlist URI points at, which decides the endpoint it
+// is rewritten to
+type uriKind int
+
+const (
+	segmentURI  uriKind = iota // a segment, key, init section or other media resource
+	playlistURI                // another playlist
+	licenseURI                 // a DRM license server
+)
+
+// kindOf returns playlistURI or segmentURI
+func kindOf(isPlaylist bool) uriKind {
+	if isPlaylist {
+		return playlistURI
+	}
+	return segmentURI
+}
+
+// urlRewriter turns an absolute upstream URL into the URL the client should request
+type urlRewriter func(resolvedURL string, kind uriKind) string
+
+// rewritePlaylist resolves every URI in an M3U8 playlist against baseURL and
+// passes it through rewrite, covering both URI lines and URI-carrying tags
+func rewritePlaylist(m3u8Content, baseURL string, rewrite urlRewriter) string {
+	m3u8Content = preparePlaylist(m3u8Content, baseURL)
+
+	// In a master playlist every URI line is a variant playlist
+	isMasterPlaylist := strings.Contains(m3u8Content, "#EXT-X-STREAM-INF")
+
+	lines := strings.Split(m3u8Content, "\n")
+	newLines := make([]string, 0, len(lines))
+
+	for _, line := range lines {
+		newLines = append(newLines, rewritePlaylistLine(line, baseURL, isMasterPlaylist, rewrite))
+	}
+
+	return strings.Join(newLines, "\n")
+}
+
+// preparePlaylist normalizes line endings and runs the onPlaylist script hook
+func preparePlaylist(m3u8Content, baseURL string) string {
+	m3u8Content = normalizeLineEndings(m3u8Content)
+	if scripts != nil {
+		m3u8Content = scripts.onPlaylist(m3u8Content, baseURL)
+	}
+	return m3u8Content
+}
+
+// rewritePlaylistLine rewrites the URIs of a single playlist line
+func rewritePlaylistLine(line, baseURL string, isMasterPlaylist bool, rewrite urlRewriter) string {
+	trimmedLine := strings.TrimSpace(line)
+	if strings.HasPrefix(trimmedLine, "#") {
+		return rewriteTagURIs(line, baseURL, rewrite)
+	} else if trimmedLine != "" {
+		resolvedURL := unwrapProxiedURL(resolveURL(trimmedLine, baseURL))
+		return rewrite(resolvedURL, kindOf(isMasterPlaylist || isM3U8URL(resolvedURL)))
+	}
+	return line
+}
+
+// normalizeLineEndings handles different EOL formats (e.g., \r\n, \r)
+func normalizeLineEndings(m3u8Content string) string {
+	m3u8Content = strings.ReplaceAll(m3u8Content, "\r\n", "\n")
+	return strings.ReplaceAll(m3u8Content, "\r", "\n")
+}
+
+// playlistTagName returns the tag name of a playlist line, e.g. "EXT-X-KEY"
+func playlistTagName(line string) string {
+	name := strings.TrimPrefix(strings.TrimSpace(line), "#")
+	if i := strings.Index(name, ":"); i != -1 {
+		name = name[:i]
+	}
+	return name
+}
+
+// rewriteTagURIs rewrites every URI="..." attribute on a tag line, and the
+// other URI-valued attributes the tag is known to carry
+func rewriteTagURIs(line, baseURL string, rewrite urlRewriter) string {
+	tag := playlistTagName(line)
+	for attr, isPlaylist := range tagURIAttrs[tag] {
+		line = rewriteURIAttr(line, attr, baseURL, isPlaylist, true, rewrite)
+	}
+	isPlaylist, known := uriTagKinds[tag]
+	return rewriteURIAttr(line, "URI", baseURL, isPlaylist, known, rewrite)
+}
+
+// rewriteURIAttr rewrites every quoted attr on a tag line. Unless known, the
+// kind of each URI is guessed from the URI itself.
+func rewriteURIAttr(line, attr, baseURL string, isPlaylist, known bool, rewrite urlRewriter) string {
+	if !strings.Contains(line, attr+`="`) {
+		return line
+	}
+
+	var b strings.Builder
+	rest := line
+	for {
+		i := indexAttr(rest, attr)
+		if i == -1 {
+			break
+		}
+		start := i + len(attr) + len(`="`)
+		end := strings.Index(rest[start:], `"`)
+		if end == -1 {
+			break
+		}
+
+		resolvedURL := unwrapProxiedURL(resolveURL(rest[start:start+end], baseURL))
+		playlist := isPlaylist
+		if !known {
+			// Unknown tag: decide from the URI itself
+			playlist = isM3U8URL(resolvedURL)
+		}
+
+		b.WriteString(rest[:start])
+		switch {
+		case !strings.HasPrefix(resolvedURL, "http://") && !strings.HasPrefix(resolvedURL, "https://"):
+			// data:, skd: and other DRM key URIs are consumed by the player itself
+			b.WriteString(rest[start : start+end])
+		case isLicenseKey(line):
+			b.WriteString(rewrite(resolvedURL, licenseURI))
+		default:
+			b.WriteString(rewrite(resolvedURL, kindOf(playlist)))
+		}
+		rest = rest[start+end:]
+	}
+	b.WriteString(rest)
+
+	return b.String()
+}
+
+// indexAttr returns the index of a quoted attribute named exactly name (so
+// "URI" does not match "X-ASSET-URI"), or -1 if there is none
+func indexAttr(s, name string) int {
+	needle := name + `="`
+	offset := 0
+	for {
+		i := strings.Index(s[offset:], needle)
+		if i == -1 {
+			return -1
+		}
+		i += offset
+		if i > 0 {
+			switch s[i-1] {
+			case ':', ',', ' ', '\t':
+				return i
+			}
+		}
+		offset = i + len(needle)
+	}
+}
+
+// mediaSegment is one segment of a media playlist
+type mediaSegment struct {
+	uri             string // resolved segment URI
+	duration        float64
+	rangeStart      int64 // byte range inside uri; rangeLength 0 means the whole resource
+	rangeLength     int64
+	discontinuity   bool
+	programDateTime time.Time
+	key             *segmentEncryption // nil when unencrypted
+}
+
+// mediaPlaylist is the parsed form of a media playlist
+type mediaPlaylist struct {
+	targetDuration int
+	mediaSequence  int64
+	playlistType   string
+	segments       []mediaSegment
+	mapURI         string // resolved EXT-X-MAP initialization section, if any
+	mapRangeStart  int64
+	mapRangeLength int64
+	endList        bool
+}
+
+// parseMediaPlaylist extracts the segment list of a media playlist
+func parseMediaPlaylist(m3u8Content, baseURL string) mediaPlaylist {
+	var playlist mediaPlaylist
+	var next mediaSegment
+	var pendingRange string
+	var key *segmentEncryption
+	rangeEnd := make(map[string]int64) // end offset of the previous sub-range per URI
+
+	for _, line := range strings.Split(normalizeLineEndings(m3u8Content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "#") {
+			next.uri = resolveURL(line, baseURL)
+			if pendingRange != "" {
+				next.rangeStart, next.rangeLength = parseHLSByteRange(pendingRange, rangeEnd[next.uri])
+				rangeEnd[next.uri] = next.rangeStart + next.rangeLength
+				pendingRange = ""
+			}
+			next.key = key
+			playlist.segments = append(playlist.segments, next)
+			next = mediaSegment{}
+			continue
+		}
+
+		tag := playlistTagName(line)
+		value := strings.TrimPrefix(line, "#"+tag+":")
+		switch tag {
+		case "EXT-X-TARGETDURATION":
+			playlist.targetDuration, _ = strconv.Atoi(value)
+		case "EXT-X-MEDIA-SEQUENCE":
+			playlist.mediaSequence, _ = strconv.ParseInt(value, 10, 64)
+		case "EXT-X-PLAYLIST-TYPE":
+			playlist.playlistType = value
+		case "EXT-X-ENDLIST":
+			playlist.endList = true
+		case "EXTINF":
+			durationText, _, _ := strings.Cut(value, ",")
+			next.duration, _ = strconv.ParseFloat(strings.TrimSpace(durationText), 64)
+		case "EXT-X-BYTERANGE":
+			pendingRange = value
+		case "EXT-X-DISCONTINUITY":
+			next.discontinuity = true
+		case "EXT-X-KEY":
+			// A key applies to every segment up to the next EXT-X-KEY
+			attrs := parseAttributeList(value)
+			key = nil
+			if method := attrs["METHOD"]; method != "" && method != "NONE" {
+				key = &segmentEncryption{method: method, iv: attrs["IV"], keyFormat: attrs["KEYFORMAT"]}
+				if attrs["URI"] != "" {
+					key.uri = resolveURL(attrs["URI"], baseURL)
+				}
+			}
+		case "EXT-X-PROGRAM-DATE-TIME":
+			next.programDateTime, _ = time.Parse(time.RFC3339Nano, value)
+		case "EXT-X-MAP":
+			attrs := parseAttributeList(value)
+			playlist.mapURI = resolveURL(attrs["URI"], baseURL)
+			if r, ok := attrs["BYTERANGE"]; ok {
+				playlist.mapRangeStart, playlist.mapRangeLength = parseHLSByteRange(r, 0)
+			}
+		}
+	}
+	return playlist
+}
+
+// parseHLSByteRange parses "length[@offset]"; without an offset the range
+// starts where the previous sub-range of the same resource ended
+func parseHLSByteRange(value string, previousEnd int64) (start, length int64) {
+	lengthText, offsetText, hasOffset := strings.Cut(value, "@")
+	length, _ = strconv.ParseInt(lengthText, 10, 64)
+	start = previousEnd
+	if hasOffset {
+		start, _ = strconv.ParseInt(offsetText, 10, 64)
+	}
+	return start, length
+}
+
+// byteRangeHeader formats an HLS sub-range as a Range header value
+func byteRangeHeader(start, length int64) string {
+	return "bytes=" + strconv.FormatInt(start, 10) + "-" + strconv.FormatInt(start+length-1, 10)
+}
+
+// segmentKey identifies a segment by URI and sub-range, since
+// EXT-X-BYTERANGE segments share one URI
+func segmentKey(uri string, start, length int64) string {
+	if length <= 0 {
+		return uri
+	}
+	return uri + "#" + byteRangeHeader(start, length)
+}
+
+// requestSegmentKey is the segmentKey of a request for uri with the given
+// Range header; open-ended and unparsable ranges key the whole resource
+func requestSegmentKey(uri, rangeHeader string) string {
+	if start, end, ok := parseByteRange(rangeHeader); ok && end >= 0 {
+		return segmentKey(uri, start, end-start+1)
+	}
+	return uri
+}
+
+// variantStream is an EXT-X-STREAM-INF entry of a master playlist
+type variantStream struct {
+	uri   string // resolved variant playlist URI
+	attrs map[string]string
+}
+
+// rendition is an EXT-X-MEDIA entry of a master playlist
+type rendition struct {
+	uri   string // resolved rendition playlist URI, empty when muxed into the variant
+	attrs map[string]string
+}
+
+// masterPlaylist is the parsed form of a master playlist
+type masterPlaylist struct {
+	variants   []variantStream
+	renditions []rendition
+}
+
+// parseMasterPlaylist extracts the variants and renditions of a master playlist
+func parseMasterPlaylist(m3u8Content, baseURL string) masterPlaylist {
+	var master masterPlaylist
+	var pending map[string]string
+	for _, line := range strings.Split(normalizeLineEndings(m3u8Content), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			pending = parseAttributeList(strings.TrimPrefix(line, "#EXT-X-STREAM-INF:"))
+		case strings.HasPrefix(line, "#EXT-X-MEDIA:"):
+			attrs := parseAttributeList(strings.TrimPrefix(line, "#EXT-X-MEDIA:"))
+			r := rendition{attrs: attrs}
+			if attrs["URI"] != "" {
+				r.uri = resolveURL(attrs["URI"], baseURL)
+			}
+			master.renditions = append(master.renditions, r)
+		case pending != nil && line != "" && !strings.HasPrefix(line, "#"):
+			master.variants = append(master.variants, variantStream{uri: resolveURL(line, baseURL), attrs: pending})
+			pending = nil
+		}
+	}
+	return master
+}
+
+// masterVariants returns the resolved variant playlist URIs of a master playlist
+func masterVariants(m3u8Content, baseURL string) []string {
+	var variants []string
+	for _, v := range parseMasterPlaylist(m3u8Content, baseURL).variants {
+		variants = append(variants, v.uri)
+	}
+	return variants
+}
+
+// parseAttributeList parses an HLS attribute list such as
+// BANDWIDTH=1280000,CODECS="avc1.4d401f,mp4a.40.2"; quotes are removed
+func parseAttributeList(list string) map[string]string {
+	attrs := make(map[string]string)
+	for list != "" {
+		name, rest, found := strings.Cut(list, "=")
+		if !found {
+			break
+		}
+		name = strings.TrimSpace(name)
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end == -1 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+			_, rest, _ = strings.Cut(rest, ",")
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+
+		attrs[name] = strings.TrimSpace(value)
+		list = rest
+	}
+	return attrs
+}
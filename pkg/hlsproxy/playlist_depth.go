@@ -0,0 +1,81 @@
+package hlsproxy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+var (
+	// maxPlaylistDepth is how many playlists deep rewritten playlist URLs
+	// may nest below the one requested; 0 disables the limit
+	maxPlaylistDepth int
+	// playlistDepthSecret signs the depth param. The limit is off without
+	// one: a key made up per process would turn away every nested playlist
+	// URL after a restart or upgrade, or on another instance.
+	playlistDepthSecret []byte
+)
+
+// playlistDepthLimited reports whether the depth limit is on
+func playlistDepthLimited() bool {
+	return maxPlaylistDepth > 0 && len(playlistDepthSecret) > 0
+}
+
+// depthSignature signs a playlist depth
+func depthSignature(depth int) string {
+	return hex.EncodeToString(hmacSHA256(playlistDepthSecret, "depth:"+strconv.Itoa(depth)))[:16]
+}
+
+// playlistDepth returns how many playlists deep a request is, from its
+// signed depth param; requests without one are top-level
+func playlistDepth(r *http.Request) (int, error) {
+	query := r.URL.Query()
+	param := query.Get("depth")
+	if param == "" {
+		return 0, nil
+	}
+	depth, err := strconv.Atoi(param)
+	if err != nil || depth < 0 || query.Get("depth_sig") != depthSignature(depth) {
+		return 0, fmt.Errorf("invalid playlist depth")
+	}
+	return depth, nil
+}
+
+// checkPlaylistDepth refuses playlists nested deeper than maxPlaylistDepth,
+// so a playlist whose variants reference playlists without end can't keep
+// the proxy fetching. It answers the request and returns false when refused.
+func checkPlaylistDepth(w http.ResponseWriter, r *http.Request) bool {
+	if !playlistDepthLimited() {
+		return true
+	}
+	depth, err := playlistDepth(r)
+	if err == nil && depth <= maxPlaylistDepth {
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return false
+	}
+	w.WriteHeader(http.StatusLoopDetected)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":    fmt.Sprintf("Playlist nesting exceeds the maximum depth of %d", maxPlaylistDepth),
+		"maxDepth": maxPlaylistDepth,
+	})
+	return false
+}
+
+// depthParam returns the &depth= suffix of the URLs a request's playlist
+// references, one level deeper than the request
+func depthParam(r *http.Request) string {
+	if !playlistDepthLimited() {
+		return ""
+	}
+	depth, _ := playlistDepth(r)
+	depth++
+	return "&depth=" + strconv.Itoa(depth) + "&depth_sig=" + url.QueryEscape(depthSignature(depth))
+}
@@ -0,0 +1,161 @@
+package hlsproxy
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// singletonTags may appear at most once per playlist; repeats are dropped
+var singletonTags = map[string]bool{
+	"EXT-X-VERSION":                true,
+	"EXT-X-TARGETDURATION":         true,
+	"EXT-X-MEDIA-SEQUENCE":         true,
+	"EXT-X-DISCONTINUITY-SEQUENCE": true,
+	"EXT-X-PLAYLIST-TYPE":          true,
+	"EXT-X-INDEPENDENT-SEGMENTS":   true,
+	"EXT-X-START":                  true,
+	"EXT-X-I-FRAMES-ONLY":          true,
+	"EXT-X-SERVER-CONTROL":         true,
+	"EXT-X-PART-INF":               true,
+	"EXT-X-ALLOW-CACHE":            true,
+}
+
+// ?repair=1 runs as a playlist transformer, carried over to variants
+func init() {
+	RegisterTransformer(playlistContentType, func(body []byte, ctx TransformContext) ([]byte, error) {
+		if ctx.Request.URL.Query().Get("repair") != "1" {
+			return body, nil
+		}
+		return []byte(repairPlaylist(string(body))), nil
+	})
+}
+
+// repairPlaylist normalizes slightly invalid playlists so strict players
+// accept them: a single leading #EXTM3U, no duplicated header tags, an
+// EXT-X-VERSION matching the features used, a TARGETDURATION that covers
+// every segment and an EXT-X-ENDLIST on VOD playlists
+func repairPlaylist(m3u8Content string) string {
+	lines := strings.Split(normalizeLineEndings(m3u8Content), "\n")
+
+	seen := make(map[string]bool)
+	out := make([]string, 0, len(lines)+3)
+	out = append(out, "#EXTM3U")
+
+	versionIndex, targetIndex := -1, -1
+	version, targetDuration := 0, 0
+	maxDuration := 0.0
+	fractional, byteRange, hasMap, isMedia, isVOD, endList := false, false, false, false, false, false
+
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == "#EXTM3U" {
+			continue
+		}
+
+		tag := ""
+		if strings.HasPrefix(trimmed, "#EXT") {
+			tag = playlistTagName(trimmed)
+		}
+
+		switch {
+		case tag == "EXT-X-ENDLIST":
+			// Emitted once at the end
+			endList = true
+			continue
+		case singletonTags[tag]:
+			if seen[tag] {
+				continue
+			}
+			seen[tag] = true
+		}
+
+		value := strings.TrimPrefix(trimmed, "#"+tag+":")
+		switch tag {
+		case "EXT-X-VERSION":
+			version, _ = strconv.Atoi(value)
+			versionIndex = len(out)
+		case "EXT-X-TARGETDURATION":
+			targetDuration, _ = strconv.Atoi(value)
+			targetIndex = len(out)
+		case "EXT-X-PLAYLIST-TYPE":
+			isVOD = strings.EqualFold(value, "VOD")
+		case "EXTINF":
+			isMedia = true
+			durationText, _, _ := strings.Cut(value, ",")
+			if d, err := strconv.ParseFloat(strings.TrimSpace(durationText), 64); err == nil {
+				maxDuration = math.Max(maxDuration, d)
+				if d != math.Trunc(d) {
+					fractional = true
+				}
+			}
+		case "EXT-X-BYTERANGE":
+			byteRange = true
+		case "EXT-X-MAP":
+			hasMap = true
+		}
+
+		out = append(out, trimmed)
+	}
+
+	// Lowest version that supports the features in use
+	required := 1
+	switch {
+	case hasMap:
+		required = 6
+	case byteRange:
+		required = 4
+	case fractional:
+		required = 3
+	}
+	if versionIndex == -1 {
+		out = append(out[:1], append([]string{fmt.Sprintf("#EXT-X-VERSION:%d", required)}, out[1:]...)...)
+		if targetIndex != -1 {
+			targetIndex++
+		}
+	} else if version < required {
+		out[versionIndex] = fmt.Sprintf("#EXT-X-VERSION:%d", required)
+	}
+
+	if isMedia {
+		// Every EXTINF rounded to the nearest integer must fit the target duration
+		required := int(math.Round(maxDuration))
+		if targetIndex == -1 {
+			out = append(out[:2], append([]string{fmt.Sprintf("#EXT-X-TARGETDURATION:%d", required)}, out[2:]...)...)
+		} else if targetDuration < required {
+			out[targetIndex] = fmt.Sprintf("#EXT-X-TARGETDURATION:%d", required)
+		}
+	}
+
+	if isMedia && (endList || isVOD) {
+		out = append(out, "#EXT-X-ENDLIST")
+	}
+
+	return strings.Join(out, "\n") + "\n"
+}
+
+// setStartOffset replaces any EXT-X-START tag with one at offset seconds,
+// placed right after #EXTM3U. Negative offsets count back from the end of
+// the playlist, i.e. from the live edge.
+func setStartOffset(m3u8Content string, offset float64) string {
+	lines := strings.Split(normalizeLineEndings(m3u8Content), "\n")
+	start := "#EXT-X-START:TIME-OFFSET=" + strconv.FormatFloat(offset, 'f', -1, 64)
+
+	out := make([]string, 0, len(lines)+1)
+	inserted := false
+	for _, line := range lines {
+		if playlistTagName(line) == "EXT-X-START" && strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		out = append(out, line)
+		if !inserted && strings.TrimSpace(line) == "#EXTM3U" {
+			out = append(out, start)
+			inserted = true
+		}
+	}
+	if !inserted {
+		out = append([]string{start}, out...)
+	}
+	return strings.Join(out, "\n")
+}
@@ -0,0 +1,182 @@
+package hlsproxy
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mediaBlock is one segment of a media playlist with the tags before its URI
+type mediaBlock struct {
+	tags []string
+	uri  string
+}
+
+// windowPlaylist keeps only the segments of a media playlist from media
+// sequence fromSeq (-1 for the first one) on, at most count of them (0 for
+// all). The media and discontinuity sequences are renumbered, the key, map
+// and program date time in effect at the first kept segment are restated,
+// relative byte ranges get explicit offsets, and a window ending before the
+// last segment is closed with EXT-X-ENDLIST as a clip. It reports false
+// when no segment falls in the window; master playlists are returned as is.
+func windowPlaylist(m3u8Content string, fromSeq int64, count int) (string, bool) {
+	if strings.Contains(m3u8Content, "#EXT-X-STREAM-INF") {
+		return m3u8Content, true
+	}
+
+	var header []string
+	var blocks []mediaBlock
+	var pending []string
+	for _, line := range strings.Split(normalizeLineEndings(m3u8Content), "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+		case !strings.HasPrefix(trimmed, "#"):
+			blocks = append(blocks, mediaBlock{tags: pending, uri: trimmed})
+			pending = nil
+		case len(blocks) == 0 && isPlaylistHeaderTag(playlistTagName(trimmed)):
+			header = append(header, trimmed)
+		default:
+			pending = append(pending, trimmed)
+		}
+	}
+	tail := pending // parts, hints, reports and ENDLIST after the last segment
+
+	mediaSequence := int64(0)
+	discontinuitySequence := int64(0)
+	playlistType := ""
+	for _, line := range header {
+		value := strings.TrimPrefix(line, "#"+playlistTagName(line)+":")
+		switch playlistTagName(line) {
+		case "EXT-X-MEDIA-SEQUENCE":
+			mediaSequence, _ = strconv.ParseInt(value, 10, 64)
+		case "EXT-X-DISCONTINUITY-SEQUENCE":
+			discontinuitySequence, _ = strconv.ParseInt(value, 10, 64)
+		case "EXT-X-PLAYLIST-TYPE":
+			playlistType = value
+		}
+	}
+
+	first := 0
+	if fromSeq > mediaSequence {
+		first = int(min(fromSeq-mediaSequence, int64(len(blocks))))
+	}
+	last := len(blocks)
+	if count > 0 {
+		last = min(last, first+count)
+	}
+	if first >= last {
+		return "", false
+	}
+
+	// State carried over from the dropped segments
+	var key, mapTag string
+	var programDateTime time.Time
+	var elapsed float64
+	rangeEnd := make(map[string]int64)
+	for i, block := range blocks[:last] {
+		hasDateTime := false
+		for j, tag := range block.tags {
+			value := strings.TrimPrefix(tag, "#"+playlistTagName(tag)+":")
+			switch playlistTagName(tag) {
+			case "EXT-X-KEY":
+				key = tag
+			case "EXT-X-MAP":
+				mapTag = tag
+			case "EXT-X-DISCONTINUITY":
+				if i < first {
+					discontinuitySequence++
+				}
+			case "EXT-X-PROGRAM-DATE-TIME":
+				if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+					programDateTime, elapsed, hasDateTime = t, 0, true
+				}
+			case "EXT-X-BYTERANGE":
+				start, length := parseHLSByteRange(value, rangeEnd[block.uri])
+				rangeEnd[block.uri] = start + length
+				block.tags[j] = "#EXT-X-BYTERANGE:" + strconv.FormatInt(length, 10) + "@" + strconv.FormatInt(start, 10)
+			}
+		}
+		if i == first && first > 0 {
+			restated := make([]string, 0, 3)
+			if key != "" && !blockHasTag(block, "EXT-X-KEY") {
+				restated = append(restated, key)
+			}
+			if mapTag != "" && !blockHasTag(block, "EXT-X-MAP") {
+				restated = append(restated, mapTag)
+			}
+			if !programDateTime.IsZero() && !hasDateTime {
+				at := programDateTime.Add(time.Duration(elapsed * float64(time.Second)))
+				restated = append(restated, "#EXT-X-PROGRAM-DATE-TIME:"+at.Format("2006-01-02T15:04:05.000Z07:00"))
+			}
+			blocks[i].tags = append(restated, block.tags...)
+		}
+		elapsed += blockDuration(block)
+	}
+
+	closed := last < len(blocks)
+
+	out := make([]string, 0, len(header)+3*(last-first)+len(tail)+1)
+	for _, line := range header {
+		switch playlistTagName(line) {
+		case "EXT-X-MEDIA-SEQUENCE", "EXT-X-DISCONTINUITY-SEQUENCE":
+			continue
+		case "EXT-X-PLAYLIST-TYPE":
+			if closed && playlistType == "EVENT" {
+				line = "#EXT-X-PLAYLIST-TYPE:VOD"
+			} else if first > 0 && playlistType == "EVENT" {
+				continue // an EVENT playlist starts at its first segment
+			}
+		}
+		out = append(out, line)
+	}
+	out = append(out, "#EXT-X-MEDIA-SEQUENCE:"+strconv.FormatInt(mediaSequence+int64(first), 10))
+	if discontinuitySequence > 0 {
+		out = append(out, "#EXT-X-DISCONTINUITY-SEQUENCE:"+strconv.FormatInt(discontinuitySequence, 10))
+	}
+	for _, block := range blocks[first:last] {
+		out = append(out, block.tags...)
+		out = append(out, block.uri)
+	}
+	if closed {
+		out = append(out, "#EXT-X-ENDLIST")
+	} else {
+		out = append(out, tail...)
+	}
+	return strings.Join(out, "\n") + "\n", true
+}
+
+// isPlaylistHeaderTag reports whether a tag describes the whole playlist
+// rather than the segment after it
+func isPlaylistHeaderTag(tag string) bool {
+	switch tag {
+	case "EXTM3U", "EXT-X-VERSION", "EXT-X-TARGETDURATION", "EXT-X-MEDIA-SEQUENCE",
+		"EXT-X-DISCONTINUITY-SEQUENCE", "EXT-X-PLAYLIST-TYPE", "EXT-X-INDEPENDENT-SEGMENTS",
+		"EXT-X-START", "EXT-X-SERVER-CONTROL", "EXT-X-PART-INF", "EXT-X-I-FRAMES-ONLY",
+		"EXT-X-ALLOW-CACHE", "EXT-X-DEFINE":
+		return true
+	}
+	return false
+}
+
+// blockHasTag reports whether a segment's own tags include tag
+func blockHasTag(block mediaBlock, tag string) bool {
+	for _, line := range block.tags {
+		if playlistTagName(line) == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// blockDuration returns the EXTINF duration of a segment
+func blockDuration(block mediaBlock) float64 {
+	for _, line := range block.tags {
+		if playlistTagName(line) == "EXTINF" {
+			durationText, _, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			duration, _ := strconv.ParseFloat(strings.TrimSpace(durationText), 64)
+			return duration
+		}
+	}
+	return 0
+}
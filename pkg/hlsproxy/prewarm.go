@@ -0,0 +1,378 @@
+package hlsproxy
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// prewarmMaxBytes bounds the memory used by prewarmed responses
+	prewarmMaxBytes = 512 << 20
+	// prewarmMaxEntryBytes skips anything too big to be a playlist or segment
+	prewarmMaxEntryBytes = 32 << 20
+	// prewarmDefaultSegments is how many segments per variant are fetched by default
+	prewarmDefaultSegments = 3
+	// prewarmMaxURLs bounds a single /prewarm request
+	prewarmMaxURLs = 100
+	// prewarmConcurrency is how many upstream fetches a prewarm runs at once
+	prewarmConcurrency = 4
+)
+
+type prewarmBypassKey struct{}
+
+// prewarmEntry is one cached upstream response
+type prewarmEntry struct {
+	url          string // segmentKey of the resource, plus requestCredentialKey when fetched with credentials or overrides
+	body         []byte
+	contentType  string
+	contentRange string // set for EXT-X-BYTERANGE sub-ranges
+	cacheControl string // upstream Cache-Control of domain-cached responses
+	expires      time.Time
+}
+
+// prewarmStore keeps prewarmed upstream responses in memory, evicting the
+// oldest once prewarmMaxBytes is reached
+type prewarmStore struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // front is newest
+	size    int64
+}
+
+var prewarmed = &prewarmStore{entries: make(map[string]*list.Element), order: list.New()}
+
+// get returns the unexpired entry for url
+func (s *prewarmStore) get(url string) (*prewarmEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.entries[url]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*prewarmEntry)
+	if time.Now().After(entry.expires) {
+		s.remove(el)
+		return nil, false
+	}
+	return entry, true
+}
+
+// put stores an entry, replacing any previous one for its URL
+func (s *prewarmStore) put(entry *prewarmEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.entries[entry.url]; ok {
+		s.remove(el)
+	}
+	s.entries[entry.url] = s.order.PushFront(entry)
+	s.size += int64(len(entry.body))
+	for s.size > prewarmMaxBytes {
+		s.remove(s.order.Back())
+	}
+}
+
+// remove deletes an element; callers must hold s.mu
+func (s *prewarmStore) remove(el *list.Element) {
+	entry := el.Value.(*prewarmEntry)
+	s.order.Remove(el)
+	delete(s.entries, entry.url)
+	s.size -= int64(len(entry.body))
+}
+
+// prewarmTransport answers GETs of whole resources and prewarmed sub-ranges
+// from the cache, so every handler benefits without knowing about it
+type prewarmTransport struct {
+	next http.RoundTripper
+}
+
+func (t *prewarmTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || req.Context().Value(prewarmBypassKey{}) != nil {
+		return t.next.RoundTrip(req)
+	}
+	rangeHeader := req.Header.Get("Range")
+	key := requestSegmentKey(req.URL.String(), rangeHeader)
+	if rangeHeader != "" && key == req.URL.String() {
+		return t.next.RoundTrip(req)
+	}
+	key += requestCredentialKey(req)
+	entry, ok := prewarmed.get(key)
+	if !ok && rangeHeader == "" {
+		entry, ok = loadCacheEntry(req.URL.Hostname(), key)
+	}
+	if !ok || (rangeHeader != "") != (entry.contentRange != "") {
+		return t.next.RoundTrip(req)
+	}
+
+	header := make(http.Header)
+	if entry.contentType != "" {
+		header.Set("Content-Type", entry.contentType)
+	}
+	header.Set("Content-Length", strconv.Itoa(len(entry.body)))
+	if entry.cacheControl != "" {
+		header.Set("Cache-Control", entry.cacheControl)
+	}
+	status := http.StatusOK
+	if entry.contentRange != "" {
+		header.Set("Content-Range", entry.contentRange)
+		status = http.StatusPartialContent
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(entry.body)),
+		ContentLength: int64(len(entry.body)),
+		Request:       req,
+	}, nil
+}
+
+// prewarmRequest is the body accepted by /prewarm
+type prewarmRequest struct {
+	URLs     []string          `json:"urls"`
+	Headers  map[string]string `json:"headers"`
+	Segments *int              `json:"segments"`
+}
+
+// prewarmResult reports what was fetched for one requested URL
+type prewarmResult struct {
+	URL       string           `json:"url"`
+	Playlists int              `json:"playlists"`
+	Segments  int              `json:"segments"`
+	Bytes     int64            `json:"bytes"`
+	Error     string           `json:"error,omitempty"`
+	Variants  []prewarmVariant `json:"variants,omitempty"`
+}
+
+// prewarmVariant is the fetch of one variant or rendition playlist
+type prewarmVariant struct {
+	URL       string `json:"url"`
+	LatencyMs int64  `json:"latencyMs"`
+	Error     string `json:"error,omitempty"`
+}
+
+// prewarmJob fetches one playlist tree into the cache
+type prewarmJob struct {
+	headers  map[string]string
+	segments int
+	sem      chan struct{}
+
+	mu     sync.Mutex
+	result prewarmResult
+}
+
+// fetch stores one upstream resource, or the sub-range given as a Range
+// header value, and returns its body
+func (j *prewarmJob) fetch(targetURL, byteRange string, isPlaylist bool) ([]byte, error) {
+	body, _, err := j.fetchTimed(targetURL, byteRange, isPlaylist)
+	return body, err
+}
+
+// fetchTimed is fetch, also returning how long the upstream took to answer
+// with the whole body, not counting the wait for a fetch slot
+func (j *prewarmJob) fetchTimed(targetURL, byteRange string, isPlaylist bool) ([]byte, time.Duration, error) {
+	j.sem <- struct{}{}
+	defer func() { <-j.sem }()
+	start := time.Now()
+
+	headers := generateRequestHeaders(targetURL, j.headers)
+	if byteRange != "" {
+		headers["Range"] = byteRange
+	}
+	ctx := context.WithValue(context.Background(), prewarmBypassKey{}, true)
+	resp, err := fetch(ctx, fetchOptions{url: targetURL, headers: headers, overrides: j.headers})
+	if err != nil {
+		return nil, time.Since(start), err
+	}
+	defer resp.Body.Close()
+	if byteRange != "" && resp.StatusCode != http.StatusPartialContent {
+		// An origin ignoring Range would have this cached as the sub-range
+		return nil, time.Since(start), &prewarmStatusError{url: targetURL, status: resp.Status}
+	}
+	if byteRange == "" && resp.StatusCode != http.StatusOK {
+		return nil, time.Since(start), &prewarmStatusError{url: targetURL, status: resp.Status}
+	}
+	prepareUpstreamBody(resp)
+	body, err := io.ReadAll(io.LimitReader(resp.Body, prewarmMaxEntryBytes+1))
+	latency := time.Since(start)
+	if err != nil {
+		return nil, latency, err
+	}
+	if len(body) > prewarmMaxEntryBytes {
+		return nil, latency, &prewarmStatusError{url: targetURL, status: "too large to prewarm"}
+	}
+
+	ttl := prewarmTTL
+	if isPlaylist {
+		// Live playlists change every target duration; don't freeze them
+		if playlist := parseMediaPlaylist(string(body), targetURL); len(playlist.segments) > 0 && !playlist.endList {
+			ttl = time.Duration(playlist.targetDuration) * time.Second
+		}
+	}
+	if ttl > 0 {
+		entry := &prewarmEntry{url: targetURL, body: body, contentType: resp.Header.Get("Content-Type"), expires: time.Now().Add(ttl)}
+		if byteRange != "" {
+			entry.url, entry.contentRange = requestSegmentKey(targetURL, byteRange), resp.Header.Get("Content-Range")
+		}
+		// Keyed like the lookup, so viewers with other headers don't get it
+		entry.url += credentialSuffix(headers, j.headers)
+		prewarmed.put(entry)
+	}
+
+	j.mu.Lock()
+	if isPlaylist {
+		j.result.Playlists++
+	} else {
+		j.result.Segments++
+	}
+	j.result.Bytes += int64(len(body))
+	j.mu.Unlock()
+	return body, latency, nil
+}
+
+// prewarmStatusError is a non-200 or oversized upstream answer
+type prewarmStatusError struct {
+	url, status string
+}
+
+func (e *prewarmStatusError) Error() string {
+	return e.url + ": " + e.status
+}
+
+// run fetches a playlist, its variants and the first segments of each
+func (j *prewarmJob) run(playlistURL string) {
+	body, err := j.fetch(playlistURL, "", true)
+	if err != nil {
+		j.result.Error = err.Error()
+		return
+	}
+
+	mediaPlaylists := []string{playlistURL}
+	mediaBodies := map[string][]byte{playlistURL: body}
+	if master := parseMasterPlaylist(string(body), playlistURL); len(master.variants) > 0 {
+		mediaPlaylists = mediaPlaylists[:0]
+		for _, v := range master.variants {
+			mediaPlaylists = append(mediaPlaylists, v.uri)
+		}
+		for _, rendition := range master.renditions {
+			if rendition.uri != "" {
+				mediaPlaylists = append(mediaPlaylists, rendition.uri)
+			}
+		}
+
+		// Variants are fetched concurrently, within the prewarm's fetch limit
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		timings := make([]prewarmVariant, len(mediaPlaylists))
+		for i, variant := range mediaPlaylists {
+			wg.Add(1)
+			go func(i int, variant string) {
+				defer wg.Done()
+				body, latency, err := j.fetchTimed(variant, "", true)
+				timings[i] = prewarmVariant{URL: variant, LatencyMs: latency.Milliseconds()}
+				if err != nil {
+					timings[i].Error = err.Error()
+					return
+				}
+				mu.Lock()
+				mediaBodies[variant] = body
+				mu.Unlock()
+			}(i, variant)
+		}
+		wg.Wait()
+		j.mu.Lock()
+		j.result.Variants = timings
+		j.mu.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	for _, variant := range mediaPlaylists {
+		body, ok := mediaBodies[variant]
+		if !ok {
+			continue
+		}
+		playlist := parseMediaPlaylist(string(body), variant)
+		segments := playlist.segments
+		if len(segments) > j.segments {
+			segments = segments[:j.segments]
+		}
+		if playlist.mapURI != "" {
+			segments = append([]mediaSegment{{uri: playlist.mapURI, rangeStart: playlist.mapRangeStart, rangeLength: playlist.mapRangeLength}}, segments...)
+		}
+		for _, segment := range segments {
+			byteRange := ""
+			if segment.rangeLength > 0 {
+				// Players fetch byte-range segments with this exact Range
+				byteRange = byteRangeHeader(segment.rangeStart, segment.rangeLength)
+			}
+			wg.Add(1)
+			go func(uri, byteRange string) {
+				defer wg.Done()
+				j.fetch(uri, byteRange, false)
+			}(segment.uri, byteRange)
+		}
+	}
+	wg.Wait()
+}
+
+// prewarmHandler fetches the posted playlists, their variants and first
+// segments into the cache ahead of an event
+func prewarmHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Use POST with a JSON body"})
+		return
+	}
+	if prewarmTTL <= 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Prewarming is disabled; set PREWARM_TTL"})
+		return
+	}
+
+	var body prewarmRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.URLs) == 0 || len(body.URLs) > prewarmMaxURLs {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Body must be {\"urls\": [...]} with 1 to " + strconv.Itoa(prewarmMaxURLs) + " playlist URLs"})
+		return
+	}
+	segments := prewarmDefaultSegments
+	if body.Segments != nil && *body.Segments >= 0 {
+		segments = *body.Segments
+	}
+
+	sem := make(chan struct{}, prewarmConcurrency)
+	jobs := make([]*prewarmJob, len(body.URLs))
+	var wg sync.WaitGroup
+	for i, playlistURL := range body.URLs {
+		jobs[i] = &prewarmJob{headers: body.Headers, segments: segments, sem: sem, result: prewarmResult{URL: playlistURL}}
+		wg.Add(1)
+		go func(job *prewarmJob, playlistURL string) {
+			defer wg.Done()
+			job.run(playlistURL)
+		}(jobs[i], playlistURL)
+	}
+	wg.Wait()
+
+	results := make([]prewarmResult, len(jobs))
+	for i, job := range jobs {
+		results[i] = job.result
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"results": results,
+		"ttl":     prewarmTTL.String(),
+	})
+}
@@ -0,0 +1,266 @@
+package hlsproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// probeConcurrency bounds how many ffprobe processes run at once
+	probeConcurrency = 4
+	// probeMaxCached bounds the probe result cache
+	probeMaxCached = 1024
+)
+
+var (
+	ffprobePath   string
+	probeTimeout  time.Duration
+	probeCacheTTL time.Duration
+)
+
+// probeStream is the part of an ffprobe stream the endpoint reports
+type probeStream struct {
+	Index         int     `json:"index"`
+	Type          string  `json:"type"`
+	Codec         string  `json:"codec"`
+	Profile       string  `json:"profile,omitempty"`
+	Width         int     `json:"width,omitempty"`
+	Height        int     `json:"height,omitempty"`
+	FrameRate     float64 `json:"frameRate,omitempty"`
+	Channels      int     `json:"channels,omitempty"`
+	ChannelLayout string  `json:"channelLayout,omitempty"`
+	SampleRate    int     `json:"sampleRate,omitempty"`
+	Language      string  `json:"language,omitempty"`
+}
+
+// probeReport is the JSON document returned by /probe
+type probeReport struct {
+	URL      string        `json:"url"`
+	Format   string        `json:"format"`
+	Duration float64       `json:"duration,omitempty"`
+	BitRate  int           `json:"bitRate,omitempty"`
+	Streams  []probeStream `json:"streams"`
+	Cached   bool          `json:"cached"`
+}
+
+// ffprobeOutput is what ffprobe -print_format json prints
+type ffprobeOutput struct {
+	Streams []struct {
+		Index         int               `json:"index"`
+		CodecType     string            `json:"codec_type"`
+		CodecName     string            `json:"codec_name"`
+		Profile       string            `json:"profile"`
+		Width         int               `json:"width"`
+		Height        int               `json:"height"`
+		AvgFrameRate  string            `json:"avg_frame_rate"`
+		Channels      int               `json:"channels"`
+		ChannelLayout string            `json:"channel_layout"`
+		SampleRate    string            `json:"sample_rate"`
+		Tags          map[string]string `json:"tags"`
+	} `json:"streams"`
+	Format struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+		BitRate    string `json:"bit_rate"`
+	} `json:"format"`
+}
+
+// cachedProbe is one cached probe result
+type cachedProbe struct {
+	report  probeReport
+	expires time.Time
+}
+
+// probeCache keeps probe results, keyed by the proxied URL ffprobe read
+type probeCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedProbe
+}
+
+var (
+	probes     = &probeCache{entries: make(map[string]cachedProbe)}
+	probeSlots = make(chan struct{}, probeConcurrency)
+)
+
+func (c *probeCache) get(key string) (probeReport, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return probeReport{}, false
+	}
+	return entry.report, true
+}
+
+func (c *probeCache) put(key string, report probeReport) {
+	if probeCacheTTL <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= probeMaxCached {
+		now := time.Now()
+		for k, entry := range c.entries {
+			if now.After(entry.expires) || len(c.entries) >= probeMaxCached {
+				delete(c.entries, k)
+			}
+		}
+	}
+	c.entries[key] = cachedProbe{report: report, expires: time.Now().Add(probeCacheTTL)}
+}
+
+// localBaseURL returns the base URL of the listener r arrived on. ffprobe
+// reads the stream through it rather than the public URL, which with
+// PUBLIC_URL unset comes from the client's Host header and would let the
+// client point ffprobe at any server.
+func localBaseURL(r *http.Request) (string, bool) {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok || addr.Network() != "tcp" {
+		return "", false
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + addr.String(), true
+}
+
+// probeHandler runs ffprobe against the proxied form of a URL, so it sees
+// the stream with exactly the headers a player would, and reports codecs,
+// resolution, frame rate, audio channels and duration
+// URL format: /probe?url={media_url}&headers={optional_headers}
+func probeHandler(w http.ResponseWriter, r *http.Request) {
+	targetURL, _, err := validateRequest(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	base, ok := localBaseURL(r)
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotImplemented)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Probing needs a TCP listener; ffprobe can't reach a Unix socket"})
+		return
+	}
+	endpoint := "/ts-proxy"
+	if isM3U8URL(targetURL) {
+		endpoint = "/proxy"
+	}
+	proxiedURL := base + endpoint + "?url=" + url.QueryEscape(targetURL)
+	if headers := r.URL.Query().Get("headers"); headers != "" {
+		proxiedURL += "&headers=" + url.QueryEscape(headers)
+	}
+	proxiedURL += tokenParam(r)
+
+	if report, ok := probes.get(proxiedURL); ok {
+		report.Cached = true
+		sendProbeReport(w, report)
+		return
+	}
+
+	path, err := exec.LookPath(ffprobePath)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotImplemented)
+		json.NewEncoder(w).Encode(map[string]string{"error": "ffprobe is not available; install it or set FFPROBE_PATH"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), probeTimeout)
+	defer cancel()
+	select {
+	case probeSlots <- struct{}{}:
+		defer func() { <-probeSlots }()
+	case <-ctx.Done():
+		w.Header().Set("Retry-After", "5")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Too many probes in progress"})
+		return
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, "-v", "error", "-print_format", "json", "-show_format", "-show_streams", proxiedURL)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			status = http.StatusGatewayTimeout
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error":   "ffprobe failed",
+			"details": strings.TrimSpace(stderr.String() + " " + err.Error()),
+		})
+		return
+	}
+
+	var out ffprobeOutput
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		sendError(w, "Failed to parse ffprobe output", err.Error())
+		return
+	}
+	report := newProbeReport(targetURL, out)
+	probes.put(proxiedURL, report)
+	sendProbeReport(w, report)
+}
+
+// newProbeReport converts ffprobe's output
+func newProbeReport(targetURL string, out ffprobeOutput) probeReport {
+	report := probeReport{URL: targetURL, Format: out.Format.FormatName, Streams: []probeStream{}}
+	report.Duration, _ = strconv.ParseFloat(out.Format.Duration, 64)
+	report.BitRate, _ = strconv.Atoi(out.Format.BitRate)
+	for _, s := range out.Streams {
+		stream := probeStream{
+			Index:         s.Index,
+			Type:          s.CodecType,
+			Codec:         s.CodecName,
+			Profile:       s.Profile,
+			Width:         s.Width,
+			Height:        s.Height,
+			FrameRate:     parseFrameRate(s.AvgFrameRate),
+			Channels:      s.Channels,
+			ChannelLayout: s.ChannelLayout,
+			Language:      s.Tags["language"],
+		}
+		stream.SampleRate, _ = strconv.Atoi(s.SampleRate)
+		report.Streams = append(report.Streams, stream)
+	}
+	return report
+}
+
+// parseFrameRate turns ffprobe's "30000/1001" into 29.97
+func parseFrameRate(rate string) float64 {
+	num, den, ok := strings.Cut(rate, "/")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	if !ok {
+		return n
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return float64(int(n/d*1000+0.5)) / 1000
+}
+
+func sendProbeReport(w http.ResponseWriter, report probeReport) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,137 @@
+package hlsproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// h3RetryAfter is how long a host that failed over HTTP/3 is fetched over TCP
+const h3RetryAfter = 5 * time.Minute
+
+// upstreamProtocols maps hostname patterns (* wildcards) to the HTTP version
+// used for them: "h1", "h2" or the experimental "h3". Unlisted hosts let
+// net/http negotiate.
+var upstreamProtocols map[string]string
+
+// validateUpstreamProtocols rejects unknown protocol names
+func validateUpstreamProtocols(protocols map[string]string) error {
+	for pattern, proto := range protocols {
+		switch proto {
+		case "h1", "h2", "h3":
+		default:
+			return fmt.Errorf("unknown upstream protocol %q for %q (want h1, h2 or h3)", proto, pattern)
+		}
+	}
+	return nil
+}
+
+// matchHostPattern returns the value of the longest pattern matching host
+func matchHostPattern[V any](patterns map[string]V, host string) V {
+	host = strings.ToLower(host)
+	best := -1
+	var value V
+	for pattern, v := range patterns {
+		if len(pattern) > best && wildcardMatch(strings.ToLower(pattern), host) {
+			best, value = len(pattern), v
+		}
+	}
+	return value
+}
+
+// protocolTransport picks the HTTP version for each upstream host. HTTP/3
+// falls back to TCP when QUIC can't connect, e.g. because UDP is blocked.
+type protocolTransport struct {
+	auto, h1, h2 http.RoundTripper
+	h3           *http3.Transport
+	proxied      bool
+
+	mu       sync.Mutex
+	h3Broken map[string]time.Time
+}
+
+// newProtocolTransport builds the per-protocol variants of t
+func newProtocolTransport(t *http.Transport) *protocolTransport {
+	h1 := t.Clone()
+	h1.ForceAttemptHTTP2 = false
+	// A non-nil empty map is how net/http is told not to offer HTTP/2
+	h1.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+
+	h2 := t.Clone()
+	h2.ForceAttemptHTTP2 = true
+
+	return &protocolTransport{
+		auto: &fingerprintTransport{std: t},
+		h1:   &fingerprintTransport{std: h1},
+		h2:   &fingerprintTransport{std: h2, h2: true},
+		h3: &http3.Transport{
+			TLSClientConfig: t.TLSClientConfig,
+			QUICConfig:      &quic.Config{HandshakeIdleTimeout: 3 * time.Second},
+		},
+		proxied:  t.Proxy != nil,
+		h3Broken: make(map[string]time.Time),
+	}
+}
+
+func (t *protocolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch matchHostPattern(upstreamProtocols, req.URL.Hostname()) {
+	case "h1":
+		return t.h1.RoundTrip(req)
+	case "h2":
+		return t.h2.RoundTrip(req)
+	case "h3":
+		// QUIC can't go through the HTTP forward proxy and needs TLS
+		if req.URL.Scheme == "https" && !t.proxied {
+			return t.roundTripH3(req)
+		}
+	}
+	return t.auto.RoundTrip(req)
+}
+
+// roundTripH3 tries HTTP/3 unless the host failed recently, falling back to
+// the negotiated TCP transport
+func (t *protocolTransport) roundTripH3(req *http.Request) (*http.Response, error) {
+	host := strings.ToLower(req.URL.Host)
+
+	t.mu.Lock()
+	failedAt, broken := t.h3Broken[host]
+	if broken && time.Since(failedAt) > h3RetryAfter {
+		delete(t.h3Broken, host)
+		broken = false
+	}
+	t.mu.Unlock()
+	if broken {
+		return t.auto.RoundTrip(req)
+	}
+
+	resp, err := t.h3.RoundTrip(req)
+	if err == nil || req.Context().Err() != nil {
+		return resp, err
+	}
+
+	// Only retry when the request body can be replayed
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, err
+		}
+		body, bodyErr := req.GetBody()
+		if bodyErr != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+
+	log.Printf("HTTP/3 to %s failed, using TCP for %s: %v", host, h3RetryAfter, err)
+	t.mu.Lock()
+	t.h3Broken[host] = time.Now()
+	t.mu.Unlock()
+	return t.auto.RoundTrip(req)
+}
@@ -0,0 +1,412 @@
+package hlsproxy
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	webServerURL        string
+	allowedOrigins      []string
+	ghostProxyURL       string
+	maxRedirects        = 5
+	redirectMatchDomain bool
+	variantFailover     bool
+	adminToken          string
+
+	mp4ParallelConnections int
+	mp4ParallelChunkSize   int64
+	mp4QueueWait           time.Duration
+
+	keyCacheTTL time.Duration
+	prewarmTTL  time.Duration
+
+	shortURLTTL time.Duration
+
+	maxBodyBytes int64
+
+	circuitBreakerFailures int
+	circuitBreakerWindow   time.Duration
+	circuitBreakerCooldown time.Duration
+
+	upstreamMaxConcurrency int
+	upstreamQueueSize      int
+	upstreamQueueWait      time.Duration
+)
+
+// Proxy is a configured proxy, as returned by New
+type Proxy struct {
+	cfg Config
+}
+
+// configured is set once a proxy has been set up in this process
+var configured atomic.Bool
+
+// errConfigured is returned by New once a proxy is set up in the process
+var errConfigured = errors.New("hlsproxy: a proxy is already configured in this process")
+
+// New configures the proxy from cfg and returns it, for embedding in another
+// server. Settings, stores and background workers are process-wide, so only
+// one proxy can be configured per process; later calls return an error
+// instead of reopening them underneath the first. To mount it under a
+// prefix, strip the prefix and include it in PublicURL:
+//
+//	cfg := hlsproxy.DefaultConfig()
+//	cfg.PublicURL = "https://api.example.com/stream"
+//	proxy, err := hlsproxy.New(cfg)
+//	mux.Handle("/stream/", http.StripPrefix("/stream", proxy))
+func New(cfg Config) (*Proxy, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if err := setup(cfg); err != nil {
+		return nil, err
+	}
+	return &Proxy{cfg: cfg}, nil
+}
+
+// ServeHTTP serves the proxy's routes
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	routeHandler(w, r)
+}
+
+// Config returns the configuration the proxy was set up with
+func (p *Proxy) Config() Config {
+	return p.cfg
+}
+
+// Main runs the standalone proxy server configured from the command line,
+// the environment, an optional .env file and an optional YAML file
+func Main() {
+	// Load .env file
+	godotenv.Load()
+
+	// Get configuration from flags, environment and optional config file
+	cfg, mode, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if mode == runPrintConfig {
+		out, _ := yaml.Marshal(cfg.redacted())
+		os.Stdout.Write(out)
+		return
+	}
+	if err := setup(cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	if mode == runSelfTest {
+		if err := runSelftest(); err != nil {
+			log.Printf("Self-test failed: %v", err)
+			os.Exit(1)
+		}
+		log.Printf("Self-test passed")
+		return
+	}
+
+	// Create server with timeouts
+	server := &http.Server{
+		Handler:           http.HandlerFunc(routeHandler),
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+
+	if err := serve(server, cfg); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// setup applies a validated configuration and opens the stores, scripts and
+// directories it names. It runs once per process.
+func setup(cfg Config) error {
+	if !configured.CompareAndSwap(false, true) {
+		return errConfigured
+	}
+	applyConfig(cfg)
+
+	var err error
+	if shortURLs, err = newStore(cfg, cfg.ShortenerBackend, "shorturl:"); err != nil {
+		return err
+	}
+	if headerSessions, err = newStore(cfg, cfg.ShortenerBackend, "hsession:"); err != nil {
+		return err
+	}
+	if watermarks, err = newStore(cfg, cfg.ShortenerBackend, "wm:"); err != nil {
+		return err
+	}
+	cacheStore = nil
+	if cfg.CacheBackend != "" {
+		if cacheStore, err = newStore(cfg, cfg.CacheBackend, "cache:"); err != nil {
+			return err
+		}
+	}
+
+	if cfg.ScriptFile != "" {
+		if scripts, err = loadScript(cfg.ScriptFile); err != nil {
+			return err
+		}
+		log.Printf("Loaded script hooks from %s", cfg.ScriptFile)
+	}
+
+	if cfg.UsageDB != "" {
+		if usage, err = openUsageStore(cfg.UsageDB); err != nil {
+			return err
+		}
+	}
+
+	if cfg.LocalMediaDir != "" {
+		if localMedia, err = os.OpenRoot(cfg.LocalMediaDir); err != nil {
+			return err
+		}
+		log.Printf("Serving %s under /local/", cfg.LocalMediaDir)
+	}
+
+	if cfg.MP4CacheDir != "" {
+		if mp4Cache, err = newMP4DiskCache(cfg.MP4CacheDir, cfg.MP4CacheMaxBytes, cfg.MP4CacheChunkSize); err != nil {
+			return err
+		}
+		log.Printf("Caching MP4s in %s", cfg.MP4CacheDir)
+	}
+
+	if cfg.JWTAlgorithm == "RS256" {
+		if jwtPublicKey, err = loadJWTPublicKey(cfg.JWTPublicKeyFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyConfig publishes the configuration to the package-level settings
+func applyConfig(cfg Config) {
+	publicURLs = nil
+	for _, u := range splitList(cfg.PublicURL) {
+		publicURLs = append(publicURLs, strings.TrimSuffix(u, "/"))
+	}
+	detectPublicURL = len(publicURLs) == 0
+	if detectPublicURL {
+		// Only for URLs made outside of a request
+		publicURLs = []string{fmt.Sprintf("http://%s:%s", cfg.Host, cfg.Port)}
+	}
+	webServerURL = publicURLs[0]
+	publicURLMode = cfg.PublicURLMode
+	allowedOrigins = cfg.AllowedOrigins
+	corsPolicies = cfg.CORSPolicies
+	responseHeaders = cfg.ResponseHeaders
+	paramAliases = cfg.ParamAliases
+	allowedClientCIDRs, _ = parseCIDRs(cfg.AllowedClientCIDRs)
+	blockedClientCIDRs, _ = parseCIDRs(cfg.BlockedClientCIDRs)
+	blockedReferers = cfg.BlockedReferers
+	blockedUserAgents = cfg.BlockedUserAgents
+	trustedProxyCIDRs, _ = parseCIDRs(cfg.TrustedProxyCIDRs)
+	ghostProxyURL = cfg.GhostProxyURL
+	maxRedirects = cfg.MaxRedirects
+	maxPlaylistDepth = cfg.MaxPlaylistDepth
+	upstreamFirstByteTimeout = cfg.UpstreamFirstByteTimeout
+	upstreamIdleTimeout = cfg.UpstreamIdleTimeout
+	serverWriteTimeout = cfg.WriteTimeout
+	streamFlushBytes = cfg.StreamFlushBytes
+	playlistDepthSecret = []byte(cfg.PlaylistDepthSecret)
+	redirectMatchDomain = cfg.RedirectMatchDomain
+	schemeMemoryTTL = cfg.SchemeMemoryTTL
+	variantFailover = cfg.SegmentVariantFailover
+	verifySegments = cfg.VerifySegments
+	segmentTiming = cfg.SegmentTiming
+	adminToken = cfg.AdminToken
+	jwtAlgorithm = cfg.JWTAlgorithm
+	jwtSecret = cfg.JWTSecret
+	watermarkSecret = cfg.WatermarkSecret
+	mp4ParallelConnections = cfg.MP4ParallelConnections
+	mp4ParallelChunkSize = cfg.MP4ParallelChunkSize
+	mp4QueueWait = cfg.MP4QueueWait
+	mp4Transfers = nil
+	if cfg.MP4MaxTransfers > 0 {
+		mp4Transfers = make(chan struct{}, cfg.MP4MaxTransfers)
+	}
+	keyCacheTTL = cfg.KeyCacheTTL
+	prewarmTTL = cfg.PrewarmTTL
+	shortURLTTL = cfg.ShortURLTTL
+	headerSessionTTL = cfg.HeaderSessionTTL
+	sessionRefreshWebhook = cfg.SessionRefreshWebhook
+	sessionRefreshInterval = cfg.SessionRefreshInterval
+	shortURLBinding = cfg.ShortURLBinding
+	shortURLBindingSecret = []byte(cfg.ShortURLBindingSecret)
+	ffprobePath = cfg.FFprobePath
+	probeTimeout = cfg.ProbeTimeout
+	probeCacheTTL = cfg.ProbeCacheTTL
+	epgCacheTTL = cfg.EPGCacheTTL
+	maxBodyBytes = cfg.MaxBodyBytes
+	fetchEnabled = cfg.FetchEnabled
+	pushEnabled = cfg.PushEnabled
+	testStreamEnabled = cfg.TestStreamEnabled
+	ffmpegPath = cfg.FFmpegPath
+	unwrapProxies = cfg.UnwrapProxies
+	fetchMaxBytes = cfg.FetchMaxBytes
+	fetchContentTypes = cfg.FetchContentTypes
+	egress = nil
+	if cfg.MaxEgressMbps > 0 {
+		egress = newEgressBucket(cfg.MaxEgressMbps)
+	}
+	circuitBreakerFailures = cfg.CircuitBreakerFailures
+	circuitBreakerWindow = cfg.CircuitBreakerWindow
+	circuitBreakerCooldown = cfg.CircuitBreakerCooldown
+	quarantineErrorRate = cfg.QuarantineErrorRate
+	quarantineMinRequests = cfg.QuarantineMinRequests
+	quarantineWindow = cfg.QuarantineWindow
+	quarantineCooldown = cfg.QuarantineCooldown
+	upstreamMaxConcurrency = cfg.UpstreamMaxConcurrency
+	upstreamQueueSize = cfg.UpstreamQueueSize
+	upstreamQueueWait = cfg.UpstreamQueueWait
+	rateLimitMaxWait = cfg.RateLimitMaxWait
+	licenseHeaders = cfg.LicenseHeaders
+	pathProxyHeaders = cfg.PathProxyHeaders
+	tlsFingerprints = cfg.TLSFingerprints
+	upstreamProtocols = cfg.UpstreamProtocols
+	upstreamAuths = cfg.UpstreamAuth
+	domainPolicies = cfg.DomainPolicies
+	preserveHeaderCase = cfg.PreserveHeaderCase
+	minimalHeaderDomains = cfg.MinimalHeaderDomains
+	outboundAddrs, _ = parseOutboundAddrs(cfg.OutboundAddrs)
+	outboundAddrMode = cfg.OutboundAddrMode
+	sampleAESMode = cfg.SampleAESMode
+	injectedVariants = cfg.InjectVariants
+}
+
+func routeHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	setResponseHeaders(w)
+	applyParamAliases(r)
+	r = withHeaderSession(r)
+
+	if !clientAllowed(r) {
+		sendForbidden(w)
+		return
+	}
+	if source := blockedSource(r); source != "" {
+		sendBlockedSource(w, source)
+		return
+	}
+
+	// Bound request bodies; the proxy endpoints never need large uploads
+	if maxBodyBytes > 0 && r.Body != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	}
+
+	tw := newTransferWriter(w)
+	w = tw
+	defer tw.finish()
+	r = r.WithContext(context.WithValue(r.Context(), transferWriterKey{}, tw))
+	trackTransfer(r, tw)
+
+	// Share the egress bandwidth cap across every response
+	if egress != nil {
+		w = &egressWriter{ResponseWriter: w, ctx: r.Context()}
+	}
+
+	if !trackStream(w, r, tw) {
+		return
+	}
+
+	// Compress playlists and JSON for clients that accept it
+	cw := &compressWriter{ResponseWriter: w}
+	if r.Method != http.MethodHead {
+		cw.encoding = negotiateEncoding(r.Header.Get("Accept-Encoding"))
+	}
+	defer cw.Close()
+	w = cw
+
+	rt, vars := matchRoute(path)
+	rt.dispatch(w, r, vars)
+}
+
+// trackTransfer accounts the bytes r's client actually receives, and the
+// transfers it aborts, per upstream domain and API key
+func trackTransfer(r *http.Request, tw *transferWriter) {
+	domain := usageDomain(r)
+	if domain == "" {
+		return
+	}
+	tw.onDone(func() {
+		aborted := tw.aborted(r)
+		clientTransfers.record(domain, tw.bytes, aborted)
+		if usage != nil {
+			usage.record(requestAPIKey(r), domain, tw.bytes, aborted)
+		}
+	})
+}
+
+// trackStream tracks who is playing what for /admin/streams. It returns
+// false, having answered, when r's viewer was terminated.
+func trackStream(w http.ResponseWriter, r *http.Request, tw *transferWriter) bool {
+	if r.URL.Path != "/proxy" && r.URL.Path != "/ts-proxy" {
+		return true
+	}
+	id, playlistURL := requestStream(r)
+	if id == "" {
+		return true
+	}
+	viewer := viewerKey(r)
+	if streams.isTerminated(id, viewer) {
+		sendStreamTerminated(w)
+		return false
+	}
+	tw.onDone(func() { streams.record(r, id, playlistURL, viewer, tw.bytes) })
+	return true
+}
+
+func homeHandler(w http.ResponseWriter, r *http.Request) {
+	corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		allowedOriginsDisplay := "All (*)"
+		if len(allowedOrigins) > 0 {
+			allowedOriginsDisplay = strings.Join(allowedOrigins, ", ")
+		}
+
+		response := fmt.Sprintf(`{
+  "message": "M3U8 Cross-Origin Proxy Server",
+  "endpoints": {
+    "m3u8": "/proxy?url={m3u8_url}&headers={optional_headers}&repair={optional_1}&start={optional_offset_seconds}&from_seq={optional_media_sequence}&count={optional_segments}&audio_lang={optional_auto_or_langs}&hdr_mode={optional_minimal}&header_session={optional_session_id}&fwd_headers={optional_client_header_names}&rewrite={optional_relative}&sample_aes={optional_pass_or_reject}&group={optional_iptv_groups}&inject={optional_variants_json}",
+    "ts": "/ts-proxy?url={ts_segment_url}&headers={optional_headers}&hdr_mode={optional_minimal}&fwd_headers={optional_client_header_names}",
+    "fetch": "/fetch?url={any_url}&ref={optional_referer}",
+    "mp4": "/mp4-proxy?url={mp4_url}&headers={optional_headers}&faststart={optional_1}&dl={optional_1}&filename={optional_name}",
+    "ghost": "/ghost-proxy?url={target_url}&proxy={proxy_url}&headers={optional_headers}&rewrite={optional_relative}",
+    "audio": "/audio-proxy?url={stream_url}&headers={optional_headers}&strip_icy={optional_1}",
+    "dash": "/convert/dash?url={m3u8_url}&headers={optional_headers}",
+    "stitch": "/stitch?urls={m3u8_url},{m3u8_url},...&headers={optional_headers}",
+    "clip": "/clip?url={vod_m3u8_url}&start={seconds}&end={seconds}&headers={optional_headers}",
+    "export": "/export?url={m3u8_url}&headers={optional_headers}&filename={optional_name}",
+    "inspect": "/inspect?url={m3u8_url}&headers={optional_headers}",
+    "validate": "/validate?url={m3u8_url}&headers={optional_headers}&deep={optional_1}",
+    "probe": "/probe?url={media_url}&headers={optional_headers}",
+    "epg": "/epg?url={xmltv_url}&playlist={optional_m3u_url}&headers={optional_headers}",
+    "local": "/local/{path_under_LOCAL_MEDIA_DIR}",
+    "push": "/push?url={live_m3u8_url}&headers={optional_headers} (server-sent events, PUSH_ENABLED)",
+    "shorten": "/shorten?url={proxied_url}&ttl={optional_seconds}",
+    "license": "/license-proxy?url={license_server_url}&headers={optional_headers_json}",
+    "path": "/{domain}/{path}?headers={optional_headers}",
+    "test": "/test-stream.m3u8 (synthetic live stream, TEST_STREAM_ENABLED)",
+    "openapi": "/openapi.json"
+  },
+  "allowedOrigins": "%s"
+}`, allowedOriginsDisplay)
+
+		w.Write([]byte(response))
+	})(w, r)
+}
@@ -0,0 +1,273 @@
+package hlsproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// pushMinInterval and pushDefaultInterval bound how often a playlist is
+	// polled; live playlists are polled every half target duration
+	pushMinInterval     = time.Second
+	pushDefaultInterval = 2 * time.Second
+	// pushHeartbeat keeps idle event streams open through proxies
+	pushHeartbeat = 15 * time.Second
+)
+
+// pushEnabled turns on the experimental /push endpoint
+var pushEnabled bool
+
+// pushEvent is one server-sent event
+type pushEvent struct {
+	id   int64
+	name string // playlist or error
+	data string
+}
+
+// pushPoller polls one playlist for every client subscribed to it and
+// broadcasts each change, so a thousand viewers cost one upstream request
+// per refresh
+type pushPoller struct {
+	key      string
+	template *http.Request // the /proxy request each poll replays
+
+	mu          sync.Mutex
+	subscribers map[chan pushEvent]bool
+	last        *pushEvent
+	done        chan struct{}
+}
+
+// pushPollers holds the running pollers by request key
+var pushPollers = struct {
+	sync.Mutex
+	m map[string]*pushPoller
+}{m: make(map[string]*pushPoller)}
+
+// pushKey identifies the pollers a request can share: the same query and
+// the same forwarded client headers rewrite to the same playlist
+func pushKey(r *http.Request) string {
+	forwarded := forwardedHeaders(r)
+	names := make([]string, 0, len(forwarded))
+	for name := range forwarded {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	key := r.URL.RawQuery
+	for _, name := range names {
+		key += "\x00" + name + ":" + forwarded[name]
+	}
+	return key
+}
+
+// subscribePush attaches a client to the poller of its playlist, starting
+// one if needed. The latest playlist is delivered right away.
+func subscribePush(r *http.Request) (*pushPoller, chan pushEvent) {
+	key := pushKey(r)
+	ch := make(chan pushEvent, 1)
+
+	pushPollers.Lock()
+	defer pushPollers.Unlock()
+	p, ok := pushPollers.m[key]
+	if !ok {
+		template, _ := http.NewRequest(http.MethodGet, "/proxy?"+r.URL.RawQuery, nil)
+		template.Header = r.Header.Clone()
+		template.Host, template.RemoteAddr = r.Host, r.RemoteAddr
+		p = &pushPoller{key: key, template: template, subscribers: make(map[chan pushEvent]bool), done: make(chan struct{})}
+		pushPollers.m[key] = p
+		go p.run()
+	}
+
+	p.mu.Lock()
+	p.subscribers[ch] = true
+	if p.last != nil {
+		ch <- *p.last
+	}
+	p.mu.Unlock()
+	return p, ch
+}
+
+// unsubscribe detaches a client, stopping the poller after the last one
+func (p *pushPoller) unsubscribe(ch chan pushEvent) {
+	pushPollers.Lock()
+	defer pushPollers.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.subscribers[ch] {
+		return
+	}
+	delete(p.subscribers, ch)
+	if len(p.subscribers) == 0 && pushPollers.m[p.key] == p {
+		delete(pushPollers.m, p.key)
+		close(p.done)
+	}
+}
+
+// run polls until nobody listens or the playlist ends
+func (p *pushPoller) run() {
+	var id int64
+	var lastData string
+	for {
+		event, interval, ended := p.poll()
+		if event.name != "playlist" || event.data != lastData || ended {
+			id++
+			event.id = id
+			p.broadcast(event)
+			if event.name == "playlist" {
+				lastData = event.data
+			}
+		}
+		if ended {
+			p.finish()
+			return
+		}
+		select {
+		case <-time.After(interval):
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// poll fetches and rewrites the playlist exactly as /proxy would. It also
+// returns when to poll next and whether the playlist can't change anymore.
+func (p *pushPoller) poll() (pushEvent, time.Duration, bool) {
+	capture := &pushCapture{header: make(http.Header)}
+	m3u8ProxyHandler(capture, p.template.Clone(context.Background()))
+	if capture.status != http.StatusOK {
+		return pushEvent{name: "error", data: strings.TrimSpace(capture.body.String())}, pushDefaultInterval, false
+	}
+
+	content := capture.body.String()
+	if strings.Contains(content, "#EXT-X-STREAM-INF") {
+		// Master playlists don't change; players poll their variants
+		return pushEvent{name: "playlist", data: content}, 0, true
+	}
+	playlist := parseMediaPlaylist(content, "")
+	interval := pushDefaultInterval
+	if playlist.targetDuration > 0 {
+		interval = max(pushMinInterval, time.Duration(playlist.targetDuration)*time.Second/2)
+	}
+	return pushEvent{name: "playlist", data: content}, interval, playlist.endList
+}
+
+// broadcast hands an event to every subscriber. Slow clients only miss
+// intermediate playlists, never the latest one.
+func (p *pushPoller) broadcast(event pushEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if event.name == "playlist" {
+		p.last = &event
+	}
+	for ch := range p.subscribers {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- event
+	}
+}
+
+// finish ends every subscriber's stream after the final playlist
+func (p *pushPoller) finish() {
+	pushPollers.Lock()
+	defer pushPollers.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pushPollers.m[p.key] == p {
+		delete(pushPollers.m, p.key)
+	}
+	for ch := range p.subscribers {
+		close(ch)
+		delete(p.subscribers, ch)
+	}
+}
+
+// pushCapture is the ResponseWriter a poll renders the playlist into
+type pushCapture struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (c *pushCapture) Header() http.Header { return c.header }
+
+func (c *pushCapture) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+}
+
+func (c *pushCapture) Write(p []byte) (int, error) {
+	c.WriteHeader(http.StatusOK)
+	return c.body.Write(p)
+}
+
+// pushHandler streams a playlist as server-sent events: a "playlist" event
+// with the rewritten playlist whenever it changes, and "error" events with
+// the JSON error /proxy would answer. One poller serves every client of the
+// same playlist and parameters.
+// URL format: /push?url={m3u8_url}&headers={optional_headers} (plus any /proxy param)
+func pushHandler(w http.ResponseWriter, r *http.Request) {
+	if !pushEnabled {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Playlist push is disabled"})
+		return
+	}
+	if r.URL.Query().Get("url") == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "URL parameter is required"})
+		return
+	}
+
+	// Event streams outlive WRITE_TIMEOUT
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flush := func() {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	flush()
+
+	poller, events := subscribePush(r)
+	defer poller.unsubscribe(events)
+	heartbeat := time.NewTicker(pushHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			var b strings.Builder
+			fmt.Fprintf(&b, "id: %d\nevent: %s\n", event.id, event.name)
+			for _, line := range strings.Split(event.data, "\n") {
+				b.WriteString("data: " + line + "\n")
+			}
+			b.WriteString("\n")
+			if _, err := w.Write([]byte(b.String())); err != nil {
+				return
+			}
+			flush()
+		case <-heartbeat.C:
+			if _, err := w.Write([]byte(": keepalive\n\n")); err != nil {
+				return
+			}
+			flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
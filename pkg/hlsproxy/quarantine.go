@@ -0,0 +1,331 @@
+package hlsproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// quarantineStaleMaxBytes bounds the playlists kept to serve while quarantined
+	quarantineStaleMaxBytes = 1 << 20
+	quarantineStaleEntries  = 1024
+	// quarantineMaxOutcomes bounds the outcomes scored per domain
+	quarantineMaxOutcomes = 1000
+)
+
+var (
+	// quarantineErrorRate is the failure ratio over quarantineWindow that
+	// quarantines a domain; 0 disables quarantine
+	quarantineErrorRate   float64
+	quarantineMinRequests int
+	quarantineWindow      time.Duration
+	quarantineCooldown    time.Duration
+)
+
+// quarantinedError is returned for requests to a quarantined domain
+type quarantinedError struct {
+	domain     string
+	retryAfter time.Duration
+}
+
+func (e *quarantinedError) Error() string {
+	return fmt.Sprintf("%s is quarantined for a high error rate, retry in %s", e.domain, e.retryAfter.Round(time.Second))
+}
+
+func (e *quarantinedError) RetryAfter() time.Duration { return e.retryAfter }
+
+// requestOutcome is one finished upstream request
+type requestOutcome struct {
+	at     time.Time
+	failed bool
+}
+
+// domainHealth is the rolling record of one upstream domain
+type domainHealth struct {
+	outcomes []requestOutcome // inside quarantineWindow, oldest first
+	until    time.Time        // quarantined until, zero when healthy
+	reason   string
+	count    int64 // times quarantined
+}
+
+// prune drops outcomes older than the window
+func (h *domainHealth) prune(now time.Time) {
+	i := 0
+	for i < len(h.outcomes) && now.Sub(h.outcomes[i].at) > quarantineWindow {
+		i++
+	}
+	h.outcomes = h.outcomes[i:]
+}
+
+// errorRate returns the failure ratio and request count inside the window
+func (h *domainHealth) errorRate() (float64, int) {
+	if len(h.outcomes) == 0 {
+		return 0, 0
+	}
+	failed := 0
+	for _, o := range h.outcomes {
+		if o.failed {
+			failed++
+		}
+	}
+	return float64(failed) / float64(len(h.outcomes)), len(h.outcomes)
+}
+
+// staleResponse is the last good copy of a playlist
+type staleResponse struct {
+	body        []byte
+	contentType string
+}
+
+// domainHealthTracker scores upstream domains and quarantines bad ones
+type domainHealthTracker struct {
+	mu      sync.Mutex
+	domains map[string]*domainHealth
+	stale   map[string]staleResponse
+}
+
+var domainHealths = &domainHealthTracker{domains: make(map[string]*domainHealth), stale: make(map[string]staleResponse)}
+
+// quarantined returns how long domain stays quarantined, lifting expired quarantines
+func (t *domainHealthTracker) quarantined(domain string, now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := t.domains[domain]
+	if !ok || h.until.IsZero() {
+		return 0
+	}
+	if wait := h.until.Sub(now); wait > 0 {
+		return wait
+	}
+	log.Printf("Quarantine of %s lifted after cool-down", domain)
+	h.until, h.outcomes = time.Time{}, nil
+	return 0
+}
+
+// record scores one request and quarantines the domain when its error rate
+// crosses the threshold
+func (t *domainHealthTracker) record(domain string, failed bool, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := t.domains[domain]
+	if !ok {
+		h = &domainHealth{}
+		t.domains[domain] = h
+	}
+	h.prune(now)
+	if len(h.outcomes) >= quarantineMaxOutcomes {
+		h.outcomes = h.outcomes[1:]
+	}
+	h.outcomes = append(h.outcomes, requestOutcome{at: now, failed: failed})
+	if !h.until.IsZero() {
+		return
+	}
+	if rate, n := h.errorRate(); n >= quarantineMinRequests && rate >= quarantineErrorRate {
+		h.until = now.Add(quarantineCooldown)
+		h.reason = fmt.Sprintf("%.0f%% of %d requests failed within %s", rate*100, n, quarantineWindow)
+		h.count++
+		log.Printf("Quarantining %s for %s: %s", domain, quarantineCooldown, h.reason)
+	}
+}
+
+// lift ends a quarantine early
+func (t *domainHealthTracker) lift(domain string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := t.domains[domain]
+	if !ok || h.until.IsZero() {
+		return false
+	}
+	h.until, h.outcomes = time.Time{}, nil
+	log.Printf("Quarantine of %s lifted by an admin", domain)
+	return true
+}
+
+// keepStale stores the last good copy of a playlist for quarantine periods
+func (t *domainHealthTracker) keepStale(url string, resp staleResponse) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.stale[url]; !ok && len(t.stale) >= quarantineStaleEntries {
+		for k := range t.stale {
+			delete(t.stale, k)
+			break
+		}
+	}
+	t.stale[url] = resp
+}
+
+func (t *domainHealthTracker) staleCopy(url string) (staleResponse, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	resp, ok := t.stale[url]
+	return resp, ok
+}
+
+// domainHealthStats is one domain in the /admin/quarantine listing
+type domainHealthStats struct {
+	Domain           string     `json:"domain"`
+	HealthScore      float64    `json:"healthScore"` // success ratio inside the window
+	Requests         int        `json:"requests"`
+	ErrorRate        float64    `json:"errorRate"`
+	Quarantined      bool       `json:"quarantined"`
+	QuarantinedUntil *time.Time `json:"quarantinedUntil,omitempty"`
+	Reason           string     `json:"reason,omitempty"`
+	TimesQuarantined int64      `json:"timesQuarantined"`
+}
+
+// snapshot lists every tracked domain, quarantined and least healthy first
+func (t *domainHealthTracker) snapshot() []domainHealthStats {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := make([]domainHealthStats, 0, len(t.domains))
+	for domain, h := range t.domains {
+		h.prune(now)
+		rate, n := h.errorRate()
+		stats := domainHealthStats{
+			Domain:           domain,
+			HealthScore:      1 - rate,
+			Requests:         n,
+			ErrorRate:        rate,
+			TimesQuarantined: h.count,
+		}
+		if now.Before(h.until) {
+			until := h.until
+			stats.Quarantined, stats.QuarantinedUntil, stats.Reason = true, &until, h.reason
+		}
+		if n == 0 && !stats.Quarantined && h.count == 0 {
+			delete(t.domains, domain)
+			continue
+		}
+		list = append(list, stats)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Quarantined != list[j].Quarantined {
+			return list[i].Quarantined
+		}
+		if list[i].HealthScore != list[j].HealthScore {
+			return list[i].HealthScore < list[j].HealthScore
+		}
+		return list[i].Domain < list[j].Domain
+	})
+	return list
+}
+
+// playlistHealthKey marks upstream requests whose every answer but 200
+// counts against the domain's health, not only server errors: a playlist
+// that is missing or refused can't be played either
+type playlistHealthKey struct{}
+
+// withPlaylistHealth marks ctx for playlistHealthKey scoring
+func withPlaylistHealth(ctx context.Context) context.Context {
+	return context.WithValue(ctx, playlistHealthKey{}, true)
+}
+
+// quarantineTransport refuses requests to quarantined domains, answering
+// playlists from their last good copy when there is one
+type quarantineTransport struct {
+	next http.RoundTripper
+}
+
+func (t *quarantineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if quarantineErrorRate <= 0 {
+		return t.next.RoundTrip(req)
+	}
+
+	domain := strings.ToLower(req.URL.Hostname())
+	if wait := domainHealths.quarantined(domain, time.Now()); wait > 0 {
+		if stale, ok := domainHealths.staleCopy(req.URL.String()); ok && req.Method == http.MethodGet && req.Header.Get("Range") == "" {
+			return staleHTTPResponse(req, stale), nil
+		}
+		return nil, &quarantinedError{domain: domain, retryAfter: wait}
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	var unavailable unavailableError
+	if req.Context().Err() != nil || errors.As(err, &unavailable) {
+		// Cancellations and our own short-circuits say nothing about the origin
+		return resp, err
+	}
+	failed := err != nil || resp.StatusCode >= 500
+	if strict, _ := req.Context().Value(playlistHealthKey{}).(bool); strict && err == nil {
+		failed = resp.StatusCode != http.StatusOK
+	}
+	domainHealths.record(domain, failed, time.Now())
+
+	if err == nil && resp.StatusCode == http.StatusOK && req.Method == http.MethodGet && isM3U8URL(req.URL.String()) &&
+		resp.ContentLength >= 0 && resp.ContentLength <= quarantineStaleMaxBytes && resp.Header.Get("Content-Encoding") == "" {
+		resp.Body = &staleRecorder{ReadCloser: resp.Body, url: req.URL.String(), contentType: resp.Header.Get("Content-Type")}
+	}
+	return resp, err
+}
+
+// staleRecorder keeps a copy of a playlist body once it was read completely
+type staleRecorder struct {
+	io.ReadCloser
+	url         string
+	contentType string
+	buf         bytes.Buffer
+}
+
+func (b *staleRecorder) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	if err == io.EOF {
+		domainHealths.keepStale(b.url, staleResponse{body: b.buf.Bytes(), contentType: b.contentType})
+	}
+	return n, err
+}
+
+// staleHTTPResponse builds a response from a stale copy, marked with a Warning
+func staleHTTPResponse(req *http.Request, stale staleResponse) *http.Response {
+	header := make(http.Header)
+	if stale.contentType != "" {
+		header.Set("Content-Type", stale.contentType)
+	}
+	header.Set("Content-Length", strconv.Itoa(len(stale.body)))
+	header.Set("Warning", `110 - "Response is stale: upstream quarantined"`)
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(stale.body)),
+		ContentLength: int64(len(stale.body)),
+		Request:       req,
+	}
+}
+
+// adminQuarantineHandler lists domain health on GET and lifts a quarantine
+// on DELETE ?domain={domain}
+func adminQuarantineHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(map[string]interface{}{"domains": domainHealths.snapshot()})
+	case http.MethodDelete:
+		domain := strings.ToLower(r.URL.Query().Get("domain"))
+		if domain == "" || !domainHealths.lift(domain) {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Domain is not quarantined"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"lifted": domain})
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Use GET to list or DELETE to lift a quarantine"})
+	}
+}
@@ -0,0 +1,208 @@
+package hlsproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// queueFullError is returned when a host's queue is full or the wait expired
+type queueFullError struct {
+	host    string
+	timeout bool
+}
+
+func (e *queueFullError) Error() string {
+	if e.timeout {
+		return fmt.Sprintf("timed out after %s waiting for a connection slot to %s", upstreamQueueWait, e.host)
+	}
+	return fmt.Sprintf("request queue for %s is full", e.host)
+}
+
+func (e *queueFullError) RetryAfter() time.Duration { return time.Second }
+
+// hostQueue limits in-flight requests to one host and queues the excess
+type hostQueue struct {
+	slots   chan struct{}
+	mu      sync.Mutex
+	waiting int
+	users   int // requests holding or waiting for a slot; guarded by upstreamQueues.mu
+}
+
+// upstreamQueues holds the queue of every upstream host
+type upstreamQueues struct {
+	mu    sync.Mutex
+	hosts map[string]*hostQueue
+}
+
+var queues = &upstreamQueues{hosts: make(map[string]*hostQueue)}
+
+// get returns the queue for host, creating it with the configured limit.
+// Every get is paired with a put once the request is done with the queue.
+func (q *upstreamQueues) get(host string) *hostQueue {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	hq, ok := q.hosts[host]
+	if !ok {
+		hq = &hostQueue{slots: make(chan struct{}, upstreamMaxConcurrency)}
+		q.hosts[host] = hq
+	}
+	hq.users++
+	return hq
+}
+
+// put hands back a queue from get, dropping it when no request holds or
+// waits for one of its slots
+func (q *upstreamQueues) put(host string, hq *hostQueue) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if hq.users--; hq.users == 0 {
+		delete(q.hosts, host)
+	}
+}
+
+// acquire takes a slot, waiting in line for up to upstreamQueueWait
+func (hq *hostQueue) acquire(req *http.Request, host string) error {
+	select {
+	case hq.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	hq.mu.Lock()
+	if hq.waiting >= upstreamQueueSize {
+		hq.mu.Unlock()
+		return &queueFullError{host: host}
+	}
+	hq.waiting++
+	hq.mu.Unlock()
+	defer func() {
+		hq.mu.Lock()
+		hq.waiting--
+		hq.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(upstreamQueueWait)
+	defer timer.Stop()
+	select {
+	case hq.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return &queueFullError{host: host, timeout: true}
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+// release frees a slot
+func (hq *hostQueue) release() {
+	<-hq.slots
+}
+
+// queueTransport applies the per-host concurrency limit. A slot is held
+// until the response body is closed, since segment and MP4 bodies stream
+// for much longer than the headers take to arrive.
+type queueTransport struct {
+	next http.RoundTripper
+}
+
+func (t *queueTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if upstreamMaxConcurrency <= 0 {
+		return t.next.RoundTrip(req)
+	}
+
+	host := strings.ToLower(req.URL.Host)
+	hq := queues.get(host)
+	if err := hq.acquire(req, host); err != nil {
+		queues.put(host, hq)
+		return nil, err
+	}
+	release := func() {
+		hq.release()
+		queues.put(host, hq)
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// releasingBody gives the queue slot back when the body is closed
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// mp4Transfers caps simultaneous /mp4-proxy transfers; nil when unlimited.
+// HLS endpoints never take a slot, so bulk downloads can't starve them.
+var mp4Transfers chan struct{}
+
+// transferLimitError is returned when every MP4 transfer slot stayed busy
+type transferLimitError struct{}
+
+func (e *transferLimitError) Error() string {
+	return fmt.Sprintf("all %d MP4 transfer slots are busy", cap(mp4Transfers))
+}
+
+func (e *transferLimitError) RetryAfter() time.Duration { return 5 * time.Second }
+
+// acquireMP4Transfer takes an MP4 transfer slot, waiting up to mp4QueueWait
+// for one to free up. The returned func gives it back.
+func acquireMP4Transfer(r *http.Request) (func(), error) {
+	if mp4Transfers == nil {
+		return func() {}, nil
+	}
+	release := func() { <-mp4Transfers }
+	select {
+	case mp4Transfers <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if mp4QueueWait <= 0 {
+		return nil, &transferLimitError{}
+	}
+
+	timer := time.NewTimer(mp4QueueWait)
+	defer timer.Stop()
+	select {
+	case mp4Transfers <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, &transferLimitError{}
+	case <-r.Context().Done():
+		return nil, r.Context().Err()
+	}
+}
+
+// sendTransferLimit answers 503 when no MP4 transfer slot is free
+func sendTransferLimit(w http.ResponseWriter, err error) {
+	var limit *transferLimitError
+	retryAfter := 1
+	if errors.As(err, &limit) {
+		retryAfter = int(limit.RetryAfter().Seconds())
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":   "Too many MP4 transfers in progress",
+		"details": err.Error(),
+	})
+}
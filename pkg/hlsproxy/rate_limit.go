@@ -0,0 +1,68 @@
+package hlsproxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// rateLimitRetries bounds the in-proxy retries of one request
+	rateLimitRetries = 3
+	// rateLimitDefaultWait is used when a 429 carries no usable Retry-After
+	rateLimitDefaultWait = time.Second
+)
+
+// rateLimitMaxWait is the total time a segment request may wait out upstream
+// 429s before the 429 is passed on; 0 passes it on at once
+var rateLimitMaxWait time.Duration
+
+// parseRetryAfter reads a Retry-After header in seconds or as an HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(0, at.Sub(now)), true
+	}
+	return 0, false
+}
+
+// retryRateLimited waits out an upstream 429 as long as Retry-After fits in
+// rateLimitMaxWait, and retries req. It returns the last response, which is
+// still a 429 when the budget ran out.
+func retryRateLimited(client *http.Client, req *http.Request, resp *http.Response) (*http.Response, error) {
+	budget := rateLimitMaxWait
+	for attempt := 0; attempt < rateLimitRetries && resp.StatusCode == http.StatusTooManyRequests; attempt++ {
+		wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		if !ok {
+			wait = rateLimitDefaultWait
+		}
+		if wait > budget {
+			return resp, nil
+		}
+		budget -= wait
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		metrics.addRateLimitRetry(strings.ToLower(req.URL.Host))
+		next, err := client.Do(req.Clone(req.Context()))
+		if err != nil {
+			return nil, err
+		}
+		resp = next
+	}
+	return resp, nil
+}
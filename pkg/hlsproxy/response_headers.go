@@ -0,0 +1,28 @@
+package hlsproxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// responseHeaders are added to every response, e.g. security headers
+var responseHeaders map[string]string
+
+// setResponseHeaders adds the configured RESPONSE_HEADERS; handlers may
+// still override them
+func setResponseHeaders(w http.ResponseWriter) {
+	for name, value := range responseHeaders {
+		w.Header().Set(name, value)
+	}
+}
+
+// validateResponseHeaders rejects names and values that can't be sent as headers
+func validateResponseHeaders(headers map[string]string) error {
+	for name, value := range headers {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") || strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("invalid response header %q: %q", name, value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package hlsproxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxResumeAttempts bounds how often one transfer is resumed after upstream drops it
+const maxResumeAttempts = 3
+
+// clientWriter remembers whether writing to the client failed, so a broken
+// client connection isn't mistaken for a broken upstream one. It flushes
+// every streamFlushBytes, so players get data as it arrives.
+type clientWriter struct {
+	w         http.ResponseWriter
+	err       error
+	unflushed int
+}
+
+func (c *clientWriter) Write(p []byte) (int, error) {
+	extendWriteDeadline(c.w)
+	n, err := c.w.Write(p)
+	if err != nil {
+		c.err = err
+		return n, err
+	}
+	if c.unflushed += n; streamFlushBytes > 0 && c.unflushed >= streamFlushBytes {
+		http.NewResponseController(c.w).Flush()
+		c.unflushed = 0
+	}
+	return n, nil
+}
+
+// copyUpstreamBody streams resp to the client. When upstream stops before
+// Content-Length bytes and supports ranges, the rest is fetched with a Range
+// request validated by If-Range; otherwise the client connection is aborted,
+// so the player sees a failed request and retries instead of decoding a
+// truncated segment that looks complete.
+func copyUpstreamBody(w http.ResponseWriter, resp *http.Response) {
+	cw := &clientWriter{w: w}
+	expected := resp.ContentLength
+	written, err := io.Copy(cw, resp.Body)
+	if cw.err != nil || (expected < 0 && err == nil) || (expected >= 0 && written >= expected) {
+		return
+	}
+
+	first, last, ok := resumableRange(resp)
+	for attempt := 1; ok && attempt <= maxResumeAttempts && written < expected; attempt++ {
+		next, err := fetchRemainder(resp, first+written, last)
+		if err != nil {
+			log.Printf("Resuming %s at byte %d failed: %v", resp.Request.URL, first+written, err)
+			break
+		}
+		n, _ := io.Copy(cw, next.Body)
+		next.Body.Close()
+		written += n
+		if cw.err != nil {
+			return
+		}
+	}
+	if expected >= 0 && written >= expected {
+		return
+	}
+	log.Printf("Aborting truncated transfer of %s after %d of %d bytes", resp.Request.URL, written, expected)
+	panic(http.ErrAbortHandler)
+}
+
+// resumableRange returns the absolute byte range resp covers, when upstream
+// advertised range support and the representation can be validated
+func resumableRange(resp *http.Response) (first, last int64, ok bool) {
+	if resp.Request == nil || resp.ContentLength <= 0 || resp.Uncompressed {
+		return 0, 0, false
+	}
+	if resp.Header.Get("ETag") == "" && resp.Header.Get("Last-Modified") == "" {
+		// Without a validator a resumed range could come from a different file
+		return 0, 0, false
+	}
+	if resp.StatusCode == http.StatusPartialContent {
+		var total string
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%s", &first, &last, &total); err != nil {
+			return 0, 0, false
+		}
+		return first, last, true
+	}
+	if !strings.EqualFold(resp.Header.Get("Accept-Ranges"), "bytes") {
+		return 0, 0, false
+	}
+	return 0, resp.ContentLength - 1, true
+}
+
+// fetchRemainder requests bytes from..to of the resource behind resp, with
+// the headers and through the client of the request that got resp
+func fetchRemainder(resp *http.Response, from, to int64) (*http.Response, error) {
+	headers := make(map[string]string, len(resp.Request.Header)+2)
+	for name := range resp.Request.Header {
+		headers[name] = resp.Request.Header.Get(name)
+	}
+	headers["Range"] = "bytes=" + strconv.FormatInt(from, 10) + "-" + strconv.FormatInt(to, 10)
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		headers["If-Range"] = etag
+	} else if lastModified := resp.Header.Get("Last-Modified"); lastModified != "" {
+		headers["If-Range"] = lastModified
+	} else {
+		return nil, fmt.Errorf("no strong validator for If-Range")
+	}
+
+	next, err := fetch(resp.Request.Context(), fetchOptions{url: resp.Request.URL.String(), headers: headers, client: fetchClient(resp)})
+	if err != nil {
+		return nil, err
+	}
+	var start int64
+	if next.StatusCode != http.StatusPartialContent {
+		next.Body.Close()
+		return nil, fmt.Errorf("upstream answered %s, resource changed or ranges unsupported", next.Status)
+	}
+	if _, err := fmt.Sscanf(next.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != from {
+		next.Body.Close()
+		return nil, fmt.Errorf("upstream sent range %q", next.Header.Get("Content-Range"))
+	}
+	return next, nil
+}
@@ -0,0 +1,292 @@
+package hlsproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// routeParam documents one query parameter of a route
+type routeParam struct {
+	name        string
+	description string
+	required    bool
+}
+
+// middleware wraps the handlers of the routes that list it
+type middleware struct {
+	name string
+	wrap func(http.HandlerFunc) http.HandlerFunc
+}
+
+var (
+	withCORS  = middleware{"cors", corsMiddleware}
+	withAdmin = middleware{"admin", adminMiddleware} // documented as requiring the admin token
+	withToken = middleware{"token", tokenMiddleware} // documented as requiring a playback token
+)
+
+// route is one entry of the routing table. The table drives both request
+// dispatch and /openapi.json, so documented parameters can't drift from the
+// endpoints that exist.
+type route struct {
+	// pattern is matched segment by segment: literal segments, {name} for
+	// one segment and a final {name...} for the rest of the path. Handlers
+	// read the variables with r.PathValue.
+	pattern    string
+	methods    []string // GET and HEAD when empty; OPTIONS always passes to the middleware
+	summary    string
+	produces   string       // response content type, comma-separated when there are several
+	params     []routeParam // required params are checked before the handler runs
+	middleware []middleware // outermost first
+	handler    http.HandlerFunc
+
+	segments []string
+}
+
+// Parameters shared by several routes
+var (
+	urlParam       = routeParam{"url", "Upstream URL", true}
+	headersParam   = routeParam{"headers", "Upstream request headers as a JSON object, or per-domain header rules", false}
+	apiKeyParam    = routeParam{"api_key", "API key usage is accounted to", false}
+	upstreamParams = []routeParam{
+		{"hdr_mode", "minimal sends only the given headers upstream", false},
+		{"header_session", "Header session id whose headers are sent upstream", false},
+		{"fwd_headers", "Comma-separated client header names to forward upstream", false},
+	}
+)
+
+// routes is the routing table, in match order; the last route matches
+// every path. It is filled in init since the OpenAPI handler reads it.
+var routes []route
+
+func init() {
+	withUpstream := func(params ...routeParam) []routeParam {
+		return append(params, upstreamParams...)
+	}
+	routes = []route{
+		{pattern: "/", summary: "Server info and endpoint list", produces: "application/json",
+			handler: homeHandler},
+		{pattern: "/openapi.json", summary: "OpenAPI description of this server", produces: "application/json", middleware: []middleware{withCORS},
+			handler: openAPIHandler},
+		{pattern: "/proxy", summary: "Proxy and rewrite an HLS playlist", produces: "application/vnd.apple.mpegurl", middleware: []middleware{withCORS, withToken},
+			params: withUpstream(urlParam, headersParam, apiKeyParam,
+				routeParam{"repair", "1 repairs malformed playlists", false},
+				routeParam{"start", "Start offset in seconds, negative from the live edge", false},
+				routeParam{"from_seq", "Serve segments from this media sequence on", false},
+				routeParam{"count", "Serve at most this many segments", false},
+				routeParam{"audio_lang", "auto or comma-separated languages to order audio renditions by", false},
+				routeParam{"rewrite", "relative rewrites URIs relative to the request", false},
+				routeParam{"sample_aes", "pass or reject SAMPLE-AES encrypted playlists", false},
+				routeParam{"stream", "Stream id for /admin/streams", false},
+				routeParam{"group", "Comma-separated groups to keep from an IPTV channel list", false},
+				routeParam{"inject", `JSON list of {"uri", "bandwidth", "resolution", "codecs"} variants to add to a master`, false},
+				routeParam{"depth", "Nesting depth of a rewritten playlist URL, signed by depth_sig", false}),
+			handler: m3u8ProxyHandler},
+		{pattern: "/ts-proxy", summary: "Proxy a segment, key or init section", produces: "video/mp2t", middleware: []middleware{withCORS, withToken},
+			params:  withUpstream(urlParam, headersParam, apiKeyParam, routeParam{"stream", "Stream id for /admin/streams", false}),
+			handler: tsProxyHandler},
+		{pattern: "/mp4-proxy", summary: "Proxy an MP4 file", produces: "video/mp4", middleware: []middleware{withCORS, withToken},
+			params: withUpstream(urlParam, headersParam,
+				routeParam{"faststart", "1 moves the moov box to the front", false},
+				routeParam{"dl", "1 serves the file as a download", false},
+				routeParam{"filename", "Download file name", false}),
+			handler: mp4ProxyHandler},
+		{pattern: "/fetch", summary: "Fetch any URL", produces: "application/octet-stream", middleware: []middleware{withCORS, withToken},
+			params:  []routeParam{urlParam, {"ref", "Referer to send upstream", false}},
+			handler: fetchHandler},
+		{pattern: "/ghost-proxy", summary: "Proxy a playlist through another proxy", produces: "application/vnd.apple.mpegurl", middleware: []middleware{withCORS, withToken},
+			params:  []routeParam{urlParam, {"proxy", "Proxy URL to fetch through", false}, headersParam, {"rewrite", "relative rewrites URIs relative to the request", false}},
+			handler: ghostProxyHandler},
+		{pattern: "/audio-proxy", summary: "Proxy an audio stream", produces: "audio/mpeg", middleware: []middleware{withCORS, withToken},
+			params:  withUpstream(urlParam, headersParam, routeParam{"strip_icy", "1 removes ICY metadata", false}),
+			handler: audioProxyHandler},
+		{pattern: "/push", summary: "Stream playlist updates as server-sent events", produces: "text/event-stream", middleware: []middleware{withCORS, withToken},
+			params:  withUpstream(urlParam, headersParam),
+			handler: pushHandler},
+		{pattern: "/inspect", summary: "Describe a playlist", produces: "application/json", middleware: []middleware{withCORS, withToken},
+			params:  withUpstream(urlParam, headersParam),
+			handler: inspectHandler},
+		{pattern: "/validate", summary: "Check that a playlist's variants and segments are reachable", produces: "application/json", middleware: []middleware{withCORS, withToken},
+			params:  withUpstream(urlParam, headersParam, routeParam{"deep", "1 also checks the first and last segments of each variant", false}),
+			handler: validateHandler},
+		{pattern: "/probe", summary: "Probe a media file", produces: "application/json", middleware: []middleware{withCORS, withToken},
+			params:  withUpstream(urlParam, headersParam),
+			handler: probeHandler},
+		{pattern: "/epg", summary: "Serve a cached XMLTV guide", produces: "application/xml", middleware: []middleware{withCORS, withToken},
+			params:  withUpstream(urlParam, routeParam{"playlist", "Channel list whose tvg-ids the guide is filtered to", false}, headersParam),
+			handler: epgHandler},
+		{pattern: "/stitch", summary: "Join VOD playlists into one", produces: "application/vnd.apple.mpegurl", middleware: []middleware{withCORS, withToken},
+			params:  withUpstream(routeParam{"urls", "Comma-separated playlist URLs", true}, headersParam, apiKeyParam),
+			handler: stitchHandler},
+		{pattern: "/clip", summary: "Serve the segments of a VOD between two times", produces: "application/vnd.apple.mpegurl", middleware: []middleware{withCORS, withToken},
+			params: withUpstream(urlParam,
+				routeParam{"start", "Clip start in seconds", true},
+				routeParam{"end", "Clip end in seconds", true},
+				headersParam, apiKeyParam),
+			handler: clipHandler},
+		{pattern: "/export", summary: "Download a VOD playlist with its segments as a zip", produces: "application/zip", middleware: []middleware{withCORS, withToken},
+			params:  withUpstream(urlParam, headersParam, routeParam{"filename", "Download file name", false}),
+			handler: exportHandler},
+		{pattern: "/convert/dash", summary: "Convert an HLS playlist to a DASH manifest", produces: "application/dash+xml", middleware: []middleware{withCORS, withToken},
+			params:  withUpstream(urlParam, headersParam),
+			handler: dashConvertHandler},
+		{pattern: "/license-proxy", methods: []string{http.MethodGet, http.MethodPost}, summary: "Proxy a DRM license request",
+			produces: "application/octet-stream", middleware: []middleware{withCORS, withToken},
+			params:  withUpstream(urlParam, routeParam{"headers", "License server headers as a JSON object", false}),
+			handler: licenseProxyHandler},
+		{pattern: "/shorten", summary: "Create a short alias for a proxied URL", produces: "application/json", middleware: []middleware{withCORS},
+			params:  []routeParam{{"url", "Proxied URL", true}, {"ttl", "Lifetime in seconds", false}},
+			handler: shortenHandler},
+		{pattern: "/test-stream.m3u8", summary: "Serve a synthetic live playlist", produces: "application/vnd.apple.mpegurl", middleware: []middleware{withCORS},
+			handler: testStreamHandler},
+		{pattern: "/test-stream/{segment}", summary: "Serve a synthetic test segment", produces: "video/mp2t", middleware: []middleware{withCORS},
+			handler: testSegmentHandler},
+		{pattern: "/local/{path...}", summary: "Serve the playlists and segments of LOCAL_MEDIA_DIR",
+			produces:   "application/vnd.apple.mpegurl, audio/x-mpegurl, application/dash+xml, video/mp2t, video/iso.segment, video/mp4, audio/mp4, audio/aac, text/vtt",
+			middleware: []middleware{withCORS, withToken},
+			handler:    localMediaHandler},
+		{pattern: "/u/{id}", summary: "Serve a short URL", produces: "application/vnd.apple.mpegurl",
+			handler: shortURLHandler},
+		{pattern: "/metrics", summary: "Prometheus metrics", produces: "text/plain", middleware: []middleware{withAdmin},
+			handler: prometheusHandler},
+		{pattern: "/admin/streams", methods: []string{http.MethodGet, http.MethodDelete}, summary: "List or terminate streams",
+			produces: "application/json", middleware: []middleware{withCORS, withAdmin},
+			params:  []routeParam{{"id", "Stream id to terminate", false}, {"viewer", "Viewer to terminate", false}},
+			handler: adminStreamsHandler},
+		{pattern: "/admin/header-sessions", methods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
+			summary: "Manage header sessions", produces: "application/json", middleware: []middleware{withCORS, withAdmin},
+			params:  []routeParam{{"id", "Header session id", false}},
+			handler: adminHeaderSessionsHandler},
+		{pattern: "/admin/quarantine", methods: []string{http.MethodGet, http.MethodDelete}, summary: "List or release quarantined domains",
+			produces: "application/json", middleware: []middleware{withCORS, withAdmin},
+			params:  []routeParam{{"domain", "Domain to release", false}},
+			handler: adminQuarantineHandler},
+		{pattern: "/admin/watermark", methods: []string{http.MethodPost}, summary: "Trace a leaked playlist to its API key or user",
+			produces: "application/json", middleware: []middleware{withCORS, withAdmin},
+			params:  []routeParam{{"ids", "Comma-separated suspected ids (api_key:..., sub:...) to check the attribute order against", false}},
+			handler: adminWatermarkHandler},
+		{pattern: "/admin/metrics", summary: "Per-host upstream metrics", produces: "application/json", middleware: []middleware{withCORS, withAdmin},
+			handler: adminMetricsHandler},
+		{pattern: "/prewarm", methods: []string{http.MethodPost}, summary: "Prefetch playlists into the cache", produces: "application/json",
+			middleware: []middleware{withCORS, withAdmin},
+			handler:    prewarmHandler},
+		{pattern: "/usage", summary: "Recorded usage", produces: "application/json", middleware: []middleware{withCORS, withAdmin},
+			params: []routeParam{{"from", "First day, YYYY-MM-DD", false}, {"to", "Last day, YYYY-MM-DD", false},
+				apiKeyParam, {"domain", "Upstream domain", false}},
+			handler: usageHandler},
+		{pattern: "/debug/fetch", summary: "Report an upstream exchange", produces: "application/json", middleware: []middleware{withCORS, withAdmin},
+			params:  withUpstream(urlParam, headersParam, routeParam{"bytes", "Body bytes to include", false}),
+			handler: debugFetchHandler},
+		{pattern: "/{domain}/{path...}", summary: "Path-based proxy of https://{domain}/{path}",
+			produces: "application/octet-stream", middleware: []middleware{withCORS, withToken},
+			params:  []routeParam{headersParam},
+			handler: pathProxyHandler},
+	}
+	for i := range routes {
+		routes[i].segments = strings.Split(strings.TrimPrefix(routes[i].pattern, "/"), "/")
+	}
+}
+
+// matchRoute returns the route serving path and its path variables
+func matchRoute(path string) (route, map[string]string) {
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for _, rt := range routes {
+		if vars, ok := rt.match(segments); ok {
+			return rt, vars
+		}
+	}
+	return routes[len(routes)-1], nil
+}
+
+// match matches the segments of a request path against the route pattern
+func (rt route) match(segments []string) (map[string]string, bool) {
+	var vars map[string]string
+	for i, part := range rt.segments {
+		name, isVar := strings.CutPrefix(part, "{")
+		name = strings.TrimSuffix(name, "}")
+		if rest, ok := strings.CutSuffix(name, "..."); isVar && ok {
+			if vars == nil {
+				vars = make(map[string]string)
+			}
+			vars[rest] = strings.Join(segments[min(i, len(segments)):], "/")
+			return vars, true
+		}
+		switch {
+		case i >= len(segments):
+			return nil, false
+		case !isVar:
+			if part != segments[i] {
+				return nil, false
+			}
+		case segments[i] == "":
+			return nil, false
+		default:
+			if vars == nil {
+				vars = make(map[string]string)
+			}
+			vars[name] = segments[i]
+		}
+	}
+	return vars, len(segments) == len(rt.segments)
+}
+
+// allows reports whether the route serves method
+func (rt route) allows(method string) bool {
+	if method == http.MethodOptions {
+		return true
+	}
+	if len(rt.methods) == 0 {
+		return method == http.MethodGet || method == http.MethodHead
+	}
+	return slices.Contains(rt.methods, method)
+}
+
+// requires reports whether a middleware of the given name guards the route
+func (rt route) requires(name string) bool {
+	return slices.ContainsFunc(rt.middleware, func(m middleware) bool { return m.name == name })
+}
+
+// dispatch runs the route's handler behind its middleware, after checking
+// the method and required params
+func (rt route) dispatch(w http.ResponseWriter, r *http.Request, vars map[string]string) {
+	for name, value := range vars {
+		r.SetPathValue(name, value)
+	}
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			rt.handler(w, r)
+			return
+		}
+		if !rt.allows(r.Method) {
+			methods := rt.methods
+			if len(methods) == 0 {
+				methods = []string{http.MethodGet, http.MethodHead}
+			}
+			w.Header().Set("Allow", strings.Join(methods, ", "))
+			sendRouteError(w, http.StatusMethodNotAllowed, "Use "+strings.Join(methods, " or "))
+			return
+		}
+		for _, p := range rt.params {
+			if p.required && r.URL.Query().Get(p.name) == "" {
+				name := p.name
+				if name == "url" {
+					name = "URL"
+				}
+				sendRouteError(w, http.StatusBadRequest, name+" parameter is required")
+				return
+			}
+		}
+		rt.handler(w, r)
+	}
+	for i := len(rt.middleware) - 1; i >= 0; i-- {
+		handler = rt.middleware[i].wrap(handler)
+	}
+	handler(w, r)
+}
+
+func sendRouteError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -0,0 +1,72 @@
+package hlsproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// sampleAESMode is what /proxy does with playlists encrypted with
+// SAMPLE-AES outside a DRM key system, which hls.js can't play but native
+// players can: "pass" rewrites them like any other playlist, "reject"
+// answers with an error so an hls.js frontend can fall back to a native
+// player
+var sampleAESMode = "pass"
+
+// validateSampleAESMode checks a SAMPLE_AES_MODE value
+func validateSampleAESMode(mode string) error {
+	switch mode {
+	case "reject", "pass":
+		return nil
+	}
+	return fmt.Errorf("unknown SAMPLE-AES mode %q (want reject or pass)", mode)
+}
+
+// sampleAESModeFor returns the mode for a request; sample_aes=pass or
+// sample_aes=reject overrides the configured one
+func sampleAESModeFor(r *http.Request) string {
+	if mode := r.URL.Query().Get("sample_aes"); validateSampleAESMode(mode) == nil {
+		return mode
+	}
+	return sampleAESMode
+}
+
+// isSampleAES reports whether an encryption method is SAMPLE-AES or SAMPLE-AES-CTR
+func isSampleAES(method string) bool {
+	return strings.HasPrefix(method, "SAMPLE-AES")
+}
+
+// sampleAESMethod returns the method of the first EXT-X-KEY or
+// EXT-X-SESSION-KEY using SAMPLE-AES with a plain key, or "" when there is
+// none. Keys naming a DRM KEYFORMAT go through /license-proxy and are left
+// to the player's key system
+func sampleAESMethod(content string) string {
+	for _, line := range strings.Split(normalizeLineEndings(content), "\n") {
+		line = strings.TrimSpace(line)
+		switch playlistTagName(line) {
+		case "EXT-X-KEY", "EXT-X-SESSION-KEY":
+		default:
+			continue
+		}
+		if isLicenseKey(line) {
+			continue
+		}
+		_, attrList, _ := strings.Cut(line, ":")
+		if method := parseAttributeList(attrList)["METHOD"]; isSampleAES(method) {
+			return method
+		}
+	}
+	return ""
+}
+
+// sendSampleAESError explains why a SAMPLE-AES playlist isn't proxied
+func sendSampleAESError(w http.ResponseWriter, method string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":   "Stream is encrypted with " + method + ", which hls.js can't play",
+		"method":  method,
+		"details": "Play it with a native HLS player (e.g. Safari or ExoPlayer), or add &sample_aes=pass to proxy it anyway",
+	})
+}
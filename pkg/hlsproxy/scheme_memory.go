@@ -0,0 +1,123 @@
+package hlsproxy
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// schemeMemoryMaxHosts bounds the remembered scheme switches
+const schemeMemoryMaxHosts = 4096
+
+// schemeMemoryTTL is how long a redirect that only upgraded the scheme from
+// http to https is remembered for its host; 0 disables
+var schemeMemoryTTL time.Duration
+
+type schemeSwitch struct {
+	scheme  string
+	expires time.Time
+}
+
+// schemeMemory maps hosts to the scheme their origin redirects to, which is
+// always https
+type schemeMemory struct {
+	mu    sync.Mutex
+	hosts map[string]schemeSwitch
+}
+
+var schemeSwitches = &schemeMemory{hosts: make(map[string]schemeSwitch)}
+
+// lookup returns the remembered scheme for host
+func (m *schemeMemory) lookup(host string, now time.Time) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.hosts[host]
+	if !ok {
+		return "", false
+	}
+	if now.After(s.expires) {
+		delete(m.hosts, host)
+		return "", false
+	}
+	return s.scheme, true
+}
+
+func (m *schemeMemory) remember(host, scheme string, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.hosts[host]; !ok || s.scheme != scheme {
+		log.Printf("Remembering %s for %s after a scheme redirect", scheme, host)
+	}
+	if _, ok := m.hosts[host]; !ok && len(m.hosts) >= schemeMemoryMaxHosts {
+		for k := range m.hosts {
+			delete(m.hosts, k)
+			break
+		}
+	}
+	m.hosts[host] = schemeSwitch{scheme: scheme, expires: now.Add(schemeMemoryTTL)}
+}
+
+func (m *schemeMemory) forget(host string) {
+	m.mu.Lock()
+	delete(m.hosts, host)
+	m.mu.Unlock()
+}
+
+// observeSchemeRedirect remembers a redirect hop that kept the host, path and
+// query and only upgraded http to https. Downgrades aren't remembered: the
+// scheme transport runs before credentials are added, so they would go out
+// in plaintext on every later request to the host.
+func observeSchemeRedirect(req *http.Request, via []*http.Request) {
+	if schemeMemoryTTL <= 0 || len(via) == 0 {
+		return
+	}
+	prev := via[len(via)-1]
+	if prev.URL.Scheme != "http" || req.URL.Scheme != "https" {
+		return
+	}
+	if !strings.EqualFold(prev.URL.Host, req.URL.Host) || prev.URL.Path != req.URL.Path || prev.URL.RawQuery != req.URL.RawQuery {
+		return
+	}
+	schemeSwitches.remember(strings.ToLower(req.URL.Host), req.URL.Scheme, time.Now())
+}
+
+func isHTTPScheme(scheme string) bool {
+	return scheme == "http" || scheme == "https"
+}
+
+// schemeTransport sends requests straight to the scheme their host is known
+// to redirect to, sparing a redirect per segment. If the remembered scheme
+// stops working it is forgotten and the original URL is tried.
+type schemeTransport struct {
+	next http.RoundTripper
+}
+
+func (t *schemeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if schemeMemoryTTL <= 0 || !isHTTPScheme(req.URL.Scheme) {
+		return t.next.RoundTrip(req)
+	}
+	host := strings.ToLower(req.URL.Host)
+	scheme, ok := schemeSwitches.lookup(host, time.Now())
+	if !ok || scheme == req.URL.Scheme {
+		return t.next.RoundTrip(req)
+	}
+
+	switched := req.Clone(req.Context())
+	switched.URL.Scheme = scheme
+	resp, err := t.next.RoundTrip(switched)
+	if err == nil || req.Context().Err() != nil || req.Body != nil && req.GetBody == nil {
+		return resp, err
+	}
+	schemeSwitches.forget(host)
+	if req.GetBody != nil {
+		body, bodyErr := req.GetBody()
+		if bodyErr != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,197 @@
+package hlsproxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// scriptTimeout bounds a single hook invocation
+const scriptTimeout = 250 * time.Millisecond
+
+// scriptHooks runs a user Lua script that may define
+//
+//	on_request(req)        -- req.url, req.host, req.headers; mutate in place
+//	on_playlist(text, url) -- return the new playlist text, or nil to keep it
+//
+// Lua states are not safe for concurrent use, so each call borrows one from
+// a pool; every state runs the compiled script once when created.
+type scriptHooks struct {
+	proto *lua.FunctionProto
+	pool  sync.Pool
+}
+
+var scripts *scriptHooks
+
+// loadScript compiles the script at path and checks that it runs
+func loadScript(path string) (*scriptHooks, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	chunk, err := parse.Parse(f, path)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	proto, err := lua.Compile(chunk, path)
+	if err != nil {
+		return nil, fmt.Errorf("compiling %s: %w", path, err)
+	}
+
+	s := &scriptHooks{proto: proto}
+	L, err := s.newState()
+	if err != nil {
+		return nil, fmt.Errorf("running %s: %w", path, err)
+	}
+	s.pool.Put(L)
+	return s, nil
+}
+
+// newState creates a sandboxed Lua state with the script loaded
+func (s *scriptHooks) newState() (*lua.LState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	// Scripts only transform data; keep them off the filesystem
+	for _, name := range []string{"dofile", "loadfile", "require"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	L.Push(L.NewFunctionFromProto(s.proto))
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		L.Close()
+		return nil, err
+	}
+	return L, nil
+}
+
+// call runs the named global function if the script defines it, passing the
+// values from build and handing its first result to read. Missing hooks and
+// script errors leave the caller's data untouched.
+func (s *scriptHooks) call(name string, build func(L *lua.LState) []lua.LValue, read func(L *lua.LState, ret lua.LValue)) {
+	L, _ := s.pool.Get().(*lua.LState)
+	if L == nil {
+		var err error
+		if L, err = s.newState(); err != nil {
+			log.Printf("Script error: %v", err)
+			return
+		}
+	}
+
+	fn := L.GetGlobal(name)
+	if fn.Type() != lua.LTFunction {
+		s.pool.Put(L)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), scriptTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+	err := L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, build(L)...)
+	L.RemoveContext()
+	if err != nil {
+		// A timed-out or failed state may be left mid-call; don't reuse it
+		log.Printf("Script %s error: %v", name, err)
+		L.Close()
+		return
+	}
+
+	ret := L.Get(-1)
+	L.Pop(1)
+	read(L, ret)
+	s.pool.Put(L)
+}
+
+// onRequest lets the script rewrite an outgoing upstream request. It
+// returns req unchanged when there's no hook, otherwise a modified clone.
+func (s *scriptHooks) onRequest(req *http.Request) *http.Request {
+	var table *lua.LTable
+	out := req
+
+	s.call("on_request", func(L *lua.LState) []lua.LValue {
+		headers := L.NewTable()
+		for name, values := range req.Header {
+			if len(values) > 0 {
+				headers.RawSetString(name, lua.LString(values[0]))
+			}
+		}
+		table = L.NewTable()
+		table.RawSetString("url", lua.LString(req.URL.String()))
+		table.RawSetString("host", lua.LString(req.URL.Hostname()))
+		table.RawSetString("headers", headers)
+		return []lua.LValue{table}
+	}, func(L *lua.LState, ret lua.LValue) {
+		if t, ok := ret.(*lua.LTable); ok {
+			table = t
+		}
+
+		out = req.Clone(req.Context())
+		if rawURL := lua.LVAsString(table.RawGetString("url")); rawURL != req.URL.String() {
+			newURL, err := url.Parse(rawURL)
+			if err != nil || newURL.Host == "" {
+				log.Printf("Script on_request returned invalid url %q", rawURL)
+			} else {
+				out.URL = newURL
+				out.Host = ""
+			}
+		}
+
+		if headers, ok := table.RawGetString("headers").(*lua.LTable); ok {
+			out.Header = make(http.Header)
+			headers.ForEach(func(k, v lua.LValue) {
+				if v != lua.LNil && v != lua.LFalse {
+					out.Header.Set(lua.LVAsString(k), lua.LVAsString(v))
+				}
+			})
+		}
+	})
+
+	return out
+}
+
+// onPlaylist lets the script post-process upstream playlist text before it
+// is rewritten
+func (s *scriptHooks) onPlaylist(content, playlistURL string) string {
+	s.call("on_playlist", func(L *lua.LState) []lua.LValue {
+		return []lua.LValue{lua.LString(content), lua.LString(playlistURL)}
+	}, func(L *lua.LState, ret lua.LValue) {
+		if text, ok := ret.(lua.LString); ok {
+			content = string(text)
+		}
+	})
+	return content
+}
+
+// scriptTransport runs the request hook on every upstream request,
+// including redirect hops
+type scriptTransport struct {
+	next http.RoundTripper
+}
+
+func (t *scriptTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if scripts != nil {
+		req = scripts.onRequest(req)
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,245 @@
+package hlsproxy
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// segmentTimingWindow is how many recent segments of a stream are judged
+	segmentTimingWindow = 5
+	// stallWarnInterval limits stall risk warnings to one per stream
+	stallWarnInterval = time.Minute
+	// segmentDurationTTL is how long segment durations stay known after
+	// their playlist was last seen
+	segmentDurationTTL = 10 * time.Minute
+)
+
+// segmentTiming enables per-segment upstream timings and stall risk warnings
+var segmentTiming bool
+
+// knownDuration is the EXTINF duration of one segment
+type knownDuration struct {
+	seconds float64
+	seen    time.Time
+}
+
+// segmentDurationTracker remembers the EXTINF durations of proxied
+// playlists, so a segment's transfer can be compared with its playback time
+type segmentDurationTracker struct {
+	mu        sync.Mutex
+	durations map[string]knownDuration
+	lastPrune time.Time
+}
+
+var segmentDurations = &segmentDurationTracker{durations: make(map[string]knownDuration)}
+
+// observe records the segment durations of a fetched media playlist
+func (t *segmentDurationTracker) observe(m3u8Content, playlistURL string) {
+	playlist := parseMediaPlaylist(m3u8Content, playlistURL)
+	if len(playlist.segments) == 0 {
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, segment := range playlist.segments {
+		t.durations[segmentKey(segment.uri, segment.rangeStart, segment.rangeLength)] = knownDuration{seconds: segment.duration, seen: now}
+	}
+	if now.Sub(t.lastPrune) > segmentDurationTTL {
+		t.lastPrune = now
+		for key, d := range t.durations {
+			if now.Sub(d.seen) > segmentDurationTTL {
+				delete(t.durations, key)
+			}
+		}
+	}
+}
+
+// lookup returns the duration of a segment, or 0 when it is unknown
+func (t *segmentDurationTracker) lookup(key string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Duration(t.durations[key].seconds * float64(time.Second))
+}
+
+// segmentSample is the upstream timing of one proxied segment
+type segmentSample struct {
+	ttfb     time.Duration // until the first body byte
+	transfer time.Duration // until the last body byte
+	bytes    int64
+	duration time.Duration // EXTINF, 0 when unknown
+}
+
+// slow reports whether the segment took longer to fetch than to play
+func (s segmentSample) slow() bool {
+	return s.duration > 0 && s.transfer > s.duration
+}
+
+// segmentTimings is the recent timing of a stream's segments
+type segmentTimings struct {
+	recent    []segmentSample // last segmentTimingWindow segments
+	segments  int64
+	slow      int64
+	host      string
+	lastWarn  time.Time
+	stallRisk bool
+}
+
+// add records a sample and reports whether every segment of a full window
+// was slow, i.e. the player is draining its buffer
+func (t *segmentTimings) add(sample segmentSample) bool {
+	t.recent = append(t.recent, sample)
+	if len(t.recent) > segmentTimingWindow {
+		t.recent = t.recent[len(t.recent)-segmentTimingWindow:]
+	}
+	t.segments++
+	if sample.slow() {
+		t.slow++
+	}
+	t.stallRisk = len(t.recent) == segmentTimingWindow
+	for _, s := range t.recent {
+		if !s.slow() {
+			t.stallRisk = false
+		}
+	}
+	return t.stallRisk
+}
+
+// averages returns the mean of the recent samples
+func (t *segmentTimings) averages() (ttfb, transfer, duration time.Duration, bytes int64) {
+	if len(t.recent) == 0 {
+		return 0, 0, 0, 0
+	}
+	for _, s := range t.recent {
+		ttfb += s.ttfb
+		transfer += s.transfer
+		duration += s.duration
+		bytes += s.bytes
+	}
+	n := int64(len(t.recent))
+	return ttfb / time.Duration(n), transfer / time.Duration(n), duration / time.Duration(n), bytes / n
+}
+
+// segmentTimingStats is the segmentTiming of a stream in /admin/streams
+type segmentTimingStats struct {
+	Segments       int64   `json:"segments"`
+	SlowSegments   int64   `json:"slowSegments"` // fetched slower than their duration
+	AvgTTFBMs      int64   `json:"avgTtfbMs"`
+	AvgTransferMs  int64   `json:"avgTransferMs"`
+	AvgDurationMs  int64   `json:"avgDurationMs"`
+	AvgBytes       int64   `json:"avgBytes"`
+	TransferRatio  float64 `json:"transferRatio"` // avg transfer / avg duration
+	StallRisk      bool    `json:"stallRisk"`
+	UpstreamHost   string  `json:"upstreamHost,omitempty"`
+	RecentSegments int     `json:"recentSegments"`
+}
+
+// stats summarizes t for the admin listing
+func (t *segmentTimings) stats() *segmentTimingStats {
+	ttfb, transfer, duration, bytes := t.averages()
+	stats := &segmentTimingStats{
+		Segments:       t.segments,
+		SlowSegments:   t.slow,
+		AvgTTFBMs:      ttfb.Milliseconds(),
+		AvgTransferMs:  transfer.Milliseconds(),
+		AvgDurationMs:  duration.Milliseconds(),
+		AvgBytes:       bytes,
+		StallRisk:      t.stallRisk,
+		UpstreamHost:   t.host,
+		RecentSegments: len(t.recent),
+	}
+	if duration > 0 {
+		stats.TransferRatio = float64(transfer.Milliseconds()) / float64(duration.Milliseconds())
+	}
+	return stats
+}
+
+// recordSegmentTiming adds a segment's timing to its stream and warns once
+// per stallWarnInterval while the stream is at risk of stalling
+func (s *streamRegistry) recordSegmentTiming(r *http.Request, id, host string, sample segmentSample) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stream := s.stream(r, id, "", now)
+	if stream.timing == nil {
+		stream.timing = &segmentTimings{}
+	}
+	timing := stream.timing
+	timing.host = host
+	if !timing.add(sample) || now.Sub(timing.lastWarn) < stallWarnInterval {
+		return
+	}
+	timing.lastWarn = now
+	ttfb, transfer, duration, bytes := timing.averages()
+	log.Printf("Stall risk on stream %s from %s: last %d segments took %s on average (ttfb %s, %d bytes) for %s of playback",
+		id, host, len(timing.recent), transfer.Round(time.Millisecond), ttfb.Round(time.Millisecond), bytes, duration.Round(time.Millisecond))
+}
+
+// segmentTimer measures one segment transfer from the upstream request
+type segmentTimer struct {
+	r     *http.Request
+	key   string
+	host  string
+	start time.Time
+	first time.Time
+	bytes int64
+}
+
+// startSegmentTimer starts timing a segment request, or returns nil when
+// timing is off
+func startSegmentTimer(r *http.Request, targetURL, rangeHeader string) *segmentTimer {
+	if !segmentTiming {
+		return nil
+	}
+	host := targetURL
+	if u, err := url.Parse(targetURL); err == nil {
+		host = u.Host
+	}
+	return &segmentTimer{r: r, key: requestSegmentKey(targetURL, rangeHeader), host: host, start: time.Now()}
+}
+
+// watch times the reads of resp's body
+func (t *segmentTimer) watch(resp *http.Response) {
+	if t == nil {
+		return
+	}
+	resp.Body = &timedBody{ReadCloser: resp.Body, timer: t}
+}
+
+// finish records a transfer that got its first byte against the request's stream
+func (t *segmentTimer) finish() {
+	if t == nil || t.first.IsZero() {
+		return
+	}
+	id, _ := requestStream(t.r)
+	if id == "" {
+		return
+	}
+	sample := segmentSample{
+		ttfb:     t.first.Sub(t.start),
+		transfer: time.Since(t.start),
+		bytes:    t.bytes,
+		duration: segmentDurations.lookup(t.key),
+	}
+	streams.recordSegmentTiming(t.r, id, t.host, sample)
+}
+
+// timedBody notes when the first byte arrives and how many follow
+type timedBody struct {
+	io.ReadCloser
+	timer *segmentTimer
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && b.timer.first.IsZero() {
+		b.timer.first = time.Now()
+	}
+	b.timer.bytes += int64(n)
+	return n, err
+}
@@ -0,0 +1,154 @@
+package hlsproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// selftestTimeout bounds the whole self-test run
+const selftestTimeout = 15 * time.Second
+
+// selftestKey and selftestSegment are the bytes the sample origin serves
+var (
+	selftestKey     = []byte("0123456789abcdef")
+	selftestSegment = bytes.Repeat([]byte{0x47, 0x00, 0x11, 0x10}, 47)
+)
+
+// selftestOrigin serves a small AES-128 stream: a master playlist, one
+// variant, its key and two segments
+func selftestOrigin() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		io.WriteString(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360\nvideo/index.m3u8\n")
+	})
+	mux.HandleFunc("/video/index.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		io.WriteString(w, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:0\n"+
+			"#EXT-X-KEY:METHOD=AES-128,URI=\"../keys/key.bin\",IV=0x00000000000000000000000000000001\n"+
+			"#EXTINF:4.0,\nseg0.ts\n#EXTINF:4.0,\nseg1.ts\n#EXT-X-ENDLIST\n")
+	})
+	mux.HandleFunc("/keys/key.bin", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(selftestKey)
+	})
+	segment := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp2t")
+		w.Write(selftestSegment)
+	}
+	mux.HandleFunc("/video/seg0.ts", segment)
+	mux.HandleFunc("/video/seg1.ts", segment)
+	return mux
+}
+
+// runSelftest starts the sample origin and the proxy on random loopback
+// ports and walks master → variant → key → segment through the proxy
+func runSelftest() error {
+	origin, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer origin.Close()
+	go http.Serve(origin, selftestOrigin())
+
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer proxy.Close()
+	go http.Serve(proxy, http.HandlerFunc(routeHandler))
+
+	// The rewritten playlists must point back at this instance, and the
+	// client address lists are about real viewers, not the self-test
+	webServerURL = "http://" + proxy.Addr().String()
+	publicURLs = []string{webServerURL}
+	detectPublicURL = false
+	allowedClientCIDRs, blockedClientCIDRs = nil, nil
+
+	ctx, cancel := context.WithTimeout(context.Background(), selftestTimeout)
+	defer cancel()
+	originURL := "http://" + origin.Addr().String()
+
+	master, err := selftestGet(ctx, webServerURL+"/proxy?url="+url.QueryEscape(originURL+"/master.m3u8"))
+	if err != nil {
+		return fmt.Errorf("master playlist: %w", err)
+	}
+	variantURL := selftestURILine(string(master))
+	if !strings.HasPrefix(variantURL, webServerURL+"/proxy?") {
+		return fmt.Errorf("master playlist: variant not rewritten through the proxy: %q", variantURL)
+	}
+
+	variant, err := selftestGet(ctx, variantURL)
+	if err != nil {
+		return fmt.Errorf("variant playlist: %w", err)
+	}
+	keyURL := selftestKeyURI(string(variant))
+	if !strings.HasPrefix(keyURL, webServerURL+"/ts-proxy?") {
+		return fmt.Errorf("variant playlist: key not rewritten through the proxy: %q", keyURL)
+	}
+	segmentURL := selftestURILine(string(variant))
+	if !strings.HasPrefix(segmentURL, webServerURL+"/ts-proxy?") {
+		return fmt.Errorf("variant playlist: segment not rewritten through the proxy: %q", segmentURL)
+	}
+
+	if key, err := selftestGet(ctx, keyURL); err != nil {
+		return fmt.Errorf("key: %w", err)
+	} else if !bytes.Equal(key, selftestKey) {
+		return fmt.Errorf("key: got %d bytes that don't match the origin", len(key))
+	}
+	if segment, err := selftestGet(ctx, segmentURL); err != nil {
+		return fmt.Errorf("segment: %w", err)
+	} else if !bytes.Equal(segment, selftestSegment) {
+		return fmt.Errorf("segment: got %d bytes that don't match the origin", len(segment))
+	}
+	return nil
+}
+
+// selftestGet fetches a proxy URL and requires a 200
+func selftestGet(ctx context.Context, target string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// selftestURILine returns the first URI line of a playlist
+func selftestURILine(m3u8Content string) string {
+	for _, line := range strings.Split(m3u8Content, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			return line
+		}
+	}
+	return ""
+}
+
+// selftestKeyURI returns the URI of the first EXT-X-KEY tag
+func selftestKeyURI(m3u8Content string) string {
+	for _, line := range strings.Split(m3u8Content, "\n") {
+		if playlistTagName(line) == "EXT-X-KEY" {
+			_, attrList, _ := strings.Cut(strings.TrimSpace(line), ":")
+			return parseAttributeList(attrList)["URI"]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,181 @@
+package hlsproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var (
+	// sessionRefreshWebhook is called for fresh headers when a header
+	// session's upstream requests start failing with 401 or 403
+	sessionRefreshWebhook string
+	// sessionRefreshInterval is the least time between webhook calls for one session
+	sessionRefreshInterval time.Duration
+)
+
+// headerSessionKey is the context key of a request's header session id
+type headerSessionKey struct{}
+
+// withHeaderSession binds the request's header_session to its context, so
+// its upstream requests can refresh the session when they're refused
+func withHeaderSession(r *http.Request) *http.Request {
+	id := r.URL.Query().Get("header_session")
+	if sessionRefreshWebhook == "" || id == "" {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), headerSessionKey{}, id))
+}
+
+// sessionRefresh is the webhook's answer: the session's new headers, flat
+// or per URL pattern, and optionally a new URL for the refused request
+type sessionRefresh struct {
+	Headers json.RawMessage `json:"headers"`
+	URL     string          `json:"url"`
+}
+
+// sessionRefresher calls the refresh webhook at most once per session and
+// interval, however many viewers hit the expiry at once
+type sessionRefresher struct {
+	mu       sync.Mutex
+	sessions map[string]*sessionRefreshState
+}
+
+// sessionRefreshState serializes the refreshes of one session
+type sessionRefreshState struct {
+	mu         sync.Mutex
+	created    time.Time
+	at         time.Time // of the last successful refresh
+	refusedURL string    // the request that triggered the last webhook call
+	url        string    // the new URL the webhook returned for it
+}
+
+var sessionRefreshes = &sessionRefresher{sessions: make(map[string]*sessionRefreshState)}
+
+// refresh asks the webhook for fresh headers for session id after
+// refusedURL was answered with status, and stores them in the session.
+// Right after another refresh it only returns the session as it is. The
+// returned URL replaces refusedURL when not empty.
+func (s *sessionRefresher) refresh(ctx context.Context, id, refusedURL string, status int) (headerSession, string, error) {
+	s.mu.Lock()
+	state, ok := s.sessions[id]
+	if !ok {
+		// Forget sessions that haven't been refreshed in a while, counting
+		// those whose refreshes all failed from when they were first seen
+		for other, st := range s.sessions {
+			last := st.at
+			if last.IsZero() {
+				last = st.created
+			}
+			if time.Since(last) > max(sessionRefreshInterval, time.Hour) {
+				delete(s.sessions, other)
+			}
+		}
+		state = &sessionRefreshState{created: time.Now()}
+		s.sessions[id] = state
+	}
+	s.mu.Unlock()
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	session, ok, err := loadHeaderSession(id)
+	if err != nil || !ok {
+		return headerSession{}, "", fmt.Errorf("header session not found or expired")
+	}
+	if time.Since(state.at) < sessionRefreshInterval {
+		newURL := ""
+		if state.refusedURL == refusedURL {
+			newURL = state.url
+		}
+		return session, newURL, nil
+	}
+
+	payload, _ := json.Marshal(map[string]any{"session": id, "url": refusedURL, "status": status})
+	ctx, cancel := webhookContext(ctx)
+	defer cancel()
+	resp, err := fetch(ctx, fetchOptions{
+		method:  http.MethodPost,
+		url:     sessionRefreshWebhook,
+		body:    payload,
+		headers: map[string]string{"Content-Type": "application/json"},
+	})
+	if err != nil {
+		return headerSession{}, "", fmt.Errorf("refreshing header session: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return headerSession{}, "", fmt.Errorf("refreshing header session: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return headerSession{}, "", fmt.Errorf("refreshing header session: webhook returned %s", resp.Status)
+	}
+	var refreshed sessionRefresh
+	if err := json.Unmarshal(body, &refreshed); err != nil {
+		return headerSession{}, "", fmt.Errorf("refreshing header session: webhook returned invalid JSON")
+	}
+	if refreshed.URL != "" {
+		if u, err := url.Parse(refreshed.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return headerSession{}, "", fmt.Errorf("refreshing header session: webhook returned an invalid url")
+		}
+	}
+
+	// The session keeps the hosts it was created for
+	if len(parseHeadersParam(string(refreshed.Headers))) > 0 {
+		session.Headers = refreshed.Headers
+		if err := session.save(id); err != nil {
+			return headerSession{}, "", err
+		}
+	}
+	state.at, state.refusedURL, state.url = time.Now(), refusedURL, refreshed.URL
+	return session, refreshed.URL, nil
+}
+
+// sessionRefreshTransport retries an upstream request of a header session
+// once with refreshed headers when it is answered with 401 or 403, e.g.
+// after the origin's segment tokens expired mid-stream
+type sessionRefreshTransport struct {
+	next http.RoundTripper
+}
+
+func (t *sessionRefreshTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	id, _ := req.Context().Value(headerSessionKey{}).(string)
+	if err != nil || id == "" || isWebhookCall(req) || (resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden) ||
+		(req.Body != nil && req.GetBody == nil) {
+		return resp, err
+	}
+
+	session, newURL, refreshErr := sessionRefreshes.refresh(req.Context(), id, req.URL.String(), resp.StatusCode)
+	if refreshErr != nil {
+		// Viewers still get the origin's answer
+		log.Printf("Header session %s: %v", id, refreshErr)
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	retry := req.Clone(req.Context())
+	if newURL != "" {
+		if retry.URL, err = url.Parse(newURL); err != nil {
+			return nil, err
+		}
+		retry.Host = ""
+	}
+	if session.appliesTo(retry.URL.String()) {
+		for k, v := range session.rules().forURL(retry.URL.String()) {
+			retry.Header.Set(k, v)
+		}
+	}
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return t.next.RoundTrip(retry)
+}
@@ -0,0 +1,154 @@
+package hlsproxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+)
+
+var (
+	// publicURLs are all configured public base URLs; webServerURL is the first
+	publicURLs []string
+	// publicURLMode spreads rewritten URLs over publicURLs: "shard" hashes
+	// each segment URL, "session" pins every URL of a viewer to one base
+	publicURLMode string
+	// detectPublicURL is set when PUBLIC_URL is unset: rewritten URLs then
+	// use the scheme and host each request arrived with
+	detectPublicURL bool
+)
+
+// requestBaseURL returns the base URL a client made a request to: its Host,
+// over https when it came over TLS. Behind a trusted proxy, X-Forwarded-Proto
+// and X-Forwarded-Host, or Forwarded, say what the client used instead.
+func requestBaseURL(r *http.Request) string {
+	scheme, host := "http", r.Host
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if trustedPeer(r) {
+		proto, fwdHost := forwardedParams(r.Header.Get("Forwarded"))
+		if proto == "" {
+			proto, _, _ = strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+		}
+		if fwdHost == "" {
+			fwdHost, _, _ = strings.Cut(r.Header.Get("X-Forwarded-Host"), ",")
+		}
+		if proto = strings.ToLower(strings.TrimSpace(proto)); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if fwdHost = strings.TrimSpace(fwdHost); fwdHost != "" {
+			host = fwdHost
+		}
+	}
+	if host == "" || strings.ContainsAny(host, "/\\@?# ") {
+		return webServerURL
+	}
+	return scheme + "://" + host
+}
+
+// forwardedParams returns the proto and host of the first element of an
+// RFC 7239 Forwarded header
+func forwardedParams(header string) (proto, host string) {
+	first, _, _ := strings.Cut(header, ",")
+	for _, pair := range strings.Split(first, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		value = strings.Trim(value, `"`)
+		switch strings.ToLower(name) {
+		case "proto":
+			proto = value
+		case "host":
+			host = value
+		}
+	}
+	return proto, host
+}
+
+// validatePublicURLMode rejects unknown spreading modes
+func validatePublicURLMode(mode string) error {
+	switch mode {
+	case "shard", "session":
+		return nil
+	}
+	return fmt.Errorf("unknown public URL mode %q (want shard or session)", mode)
+}
+
+// pickPublicURL returns the base URL of publicURLs that key hashes to
+func pickPublicURL(key string) string {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return publicURLs[h.Sum32()%uint32(len(publicURLs))]
+}
+
+// viewerKey identifies a viewer for session mode: the session ID the
+// player sends, or else the client address
+func viewerKey(r *http.Request) string {
+	if session := r.Header.Get("X-Session-ID"); session != "" {
+		return session
+	}
+	if session := r.URL.Query().Get("session"); session != "" {
+		return session
+	}
+	if addr, ok := clientIP(r); ok {
+		return addr.String()
+	}
+	return r.RemoteAddr
+}
+
+// playlistBaseURL returns the base URL for rewritten playlist URLs
+func playlistBaseURL(r *http.Request) string {
+	if detectPublicURL {
+		return requestBaseURL(r)
+	}
+	if len(publicURLs) < 2 || publicURLMode != "session" {
+		return webServerURL
+	}
+	return pickPublicURL(viewerKey(r))
+}
+
+// segmentBaseURL returns the base URL for the rewritten URL of a segment.
+// Sharding hashes the upstream URL, so a segment keeps its hostname across
+// live refreshes and browser and CDN caches stay warm.
+func segmentBaseURL(r *http.Request, resolvedURL string) string {
+	if detectPublicURL {
+		return requestBaseURL(r)
+	}
+	if len(publicURLs) < 2 {
+		return webServerURL
+	}
+	if publicURLMode == "session" {
+		return pickPublicURL(viewerKey(r))
+	}
+	return pickPublicURL(resolvedURL)
+}
+
+// rewriteBaseURL returns base, or with &rewrite=relative the relative path
+// from the playlist request to the proxy root, so rewritten URLs work behind
+// any reverse-proxy path prefix
+func rewriteBaseURL(r *http.Request, base string) string {
+	if r.URL.Query().Get("rewrite") != "relative" {
+		return base
+	}
+	path := r.URL.Path
+	if original, ok := r.Context().Value(clientPathKey{}).(string); ok {
+		path = original
+	}
+	if depth := strings.Count(path, "/") - 1; depth > 0 {
+		return strings.TrimSuffix(strings.Repeat("../", depth), "/")
+	}
+	return "."
+}
+
+// isPublicURL reports whether target points at one of this proxy's public
+// base URLs, or with PUBLIC_URL unset at the one r was addressed to
+func isPublicURL(r *http.Request, target string) bool {
+	if detectPublicURL && strings.HasPrefix(target, requestBaseURL(r)+"/") {
+		return true
+	}
+	for _, base := range publicURLs {
+		if strings.HasPrefix(target, base+"/") {
+			return true
+		}
+	}
+	return strings.HasPrefix(target, webServerURL+"/")
+}
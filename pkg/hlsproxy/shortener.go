@@ -0,0 +1,145 @@
+package hlsproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const shortIDAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// clientPathKey records the path a client requested before /u/{id} dispatched
+// it internally, for URLs relative to it
+type clientPathKey struct{}
+
+// shortURLs backs /shorten and /u/{id}; set up in main from the config
+var shortURLs Store = newMemoryStore()
+
+// newShortID returns a random 8-character base62 identifier
+func newShortID() string {
+	return randomID(8)
+}
+
+// randomID returns a random n-character base62 identifier. Random bytes
+// past the last whole multiple of the alphabet are rejected, so every
+// character is equally likely.
+func randomID(n int) string {
+	const limit = 256 - 256%len(shortIDAlphabet)
+	id := make([]byte, 0, n)
+	buf := make([]byte, n)
+	for len(id) < n {
+		rand.Read(buf)
+		for _, b := range buf {
+			if int(b) < limit && len(id) < n {
+				id = append(id, shortIDAlphabet[b%byte(len(shortIDAlphabet))])
+			}
+		}
+	}
+	return string(id)
+}
+
+// shortenHandler stores a proxied URL and returns a short alias for it
+// URL format: /shorten?url={proxied_url}&ttl={optional_seconds}
+func shortenHandler(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("url")
+	if target == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "URL parameter is required"})
+		return
+	}
+
+	// Only URLs served by this proxy can be shortened, so /u/ can't be used as an open redirector
+	parsed, err := url.Parse(target)
+	if err != nil || !isPublicURL(r, target) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "URL must point at this proxy"})
+		return
+	}
+
+	ttl := shortURLTTL
+	if seconds, err := strconv.Atoi(r.URL.Query().Get("ttl")); err == nil && seconds > 0 {
+		if requested := time.Duration(seconds) * time.Second; ttl == 0 || requested < ttl {
+			ttl = requested
+		}
+	}
+
+	// Store only the path and query; the host is always this proxy
+	id := newShortID()
+	if err := shortURLs.Set(id, []byte(parsed.RequestURI()), ttl); err != nil {
+		sendError(w, "Failed to store short URL", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":        id,
+		"shortUrl":  playlistBaseURL(r) + "/u/" + id,
+		"expiresIn": int(ttl.Seconds()),
+	})
+}
+
+// shortURLHandler serves /u/{id} by dispatching the stored proxy URL
+// internally, so players keep the short URL and skip a redirect
+func shortURLHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	// IDs are base62; anything else could address a binding entry
+	if strings.Trim(id, shortIDAlphabet) != "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Short URL not found or expired"})
+		return
+	}
+
+	stored, ok, err := shortURLs.Get(id)
+	if err != nil {
+		sendError(w, "Failed to look up short URL", err.Error())
+		return
+	}
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Short URL not found or expired"})
+		return
+	}
+
+	if !checkBinding(w, r, id) {
+		return
+	}
+
+	target, err := url.ParseRequestURI(string(stored))
+	if err != nil || strings.HasPrefix(target.Path, "/u/") {
+		sendError(w, "Invalid stored URL", string(stored))
+		return
+	}
+
+	r2 := r.Clone(context.WithValue(r.Context(), clientPathKey{}, r.URL.Path))
+	r2.URL.Path = target.Path
+	r2.URL.RawPath = target.RawPath
+	r2.URL.RawQuery = target.RawQuery
+	if shortURLBinding != "" {
+		// The URLs the playlist is rewritten to stay bound to this client
+		r2.URL.RawQuery = strings.TrimPrefix(target.RawQuery+"&bind="+url.QueryEscape(bindingValue(r, id)), "&")
+	}
+	r2.RequestURI = r2.URL.RequestURI()
+
+	// routeHandler already wrapped w; only what depends on the stored URL
+	// is left to do for it
+	applyParamAliases(r2)
+	r2 = withHeaderSession(r2)
+	if tw, ok := r2.Context().Value(transferWriterKey{}).(*transferWriter); ok {
+		trackTransfer(r2, tw)
+		if !trackStream(w, r2, tw) {
+			return
+		}
+	}
+	rt, vars := matchRoute(r2.URL.Path)
+	rt.dispatch(w, r2, vars)
+}
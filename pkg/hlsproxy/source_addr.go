@@ -0,0 +1,124 @@
+package hlsproxy
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+var (
+	// outboundAddrs are the local addresses upstream connections are bound to
+	outboundAddrs []netip.Addr
+	// outboundAddrMode is how a connection picks one of several outboundAddrs:
+	// "rotate" takes the next address for that upstream host on every new
+	// connection, "sticky" keeps each upstream host on one address
+	outboundAddrMode string
+)
+
+// parseOutboundAddrs parses local IP addresses
+func parseOutboundAddrs(values []string) ([]netip.Addr, error) {
+	addrs := make([]netip.Addr, 0, len(values))
+	for _, v := range values {
+		addr, err := netip.ParseAddr(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid outbound address %q", v)
+		}
+		addrs = append(addrs, addr.Unmap())
+	}
+	return addrs, nil
+}
+
+// validateOutboundAddrMode rejects unknown OUTBOUND_ADDR_MODE values
+func validateOutboundAddrMode(mode string) error {
+	switch mode {
+	case "rotate", "sticky":
+		return nil
+	}
+	return fmt.Errorf("unknown outbound address mode %q (want rotate or sticky)", mode)
+}
+
+// outboundRotation counts connections per upstream host for "rotate"
+var outboundRotation = struct {
+	sync.Mutex
+	next map[string]uint64
+}{next: make(map[string]uint64)}
+
+// outboundIndex returns the position in the address pool for a new
+// connection to host
+func outboundIndex(host string) uint64 {
+	if outboundAddrMode == "sticky" {
+		h := fnv.New64a()
+		h.Write([]byte(host))
+		return h.Sum64()
+	}
+	outboundRotation.Lock()
+	defer outboundRotation.Unlock()
+	if len(outboundRotation.next) > 10000 {
+		outboundRotation.next = make(map[string]uint64)
+	}
+	n := outboundRotation.next[host]
+	outboundRotation.next[host] = n + 1
+	return n
+}
+
+// outboundAddrFor picks the n-th pool address of remote's family, so IPv4
+// and IPv6 destinations each use their own part of a dual-stack pool
+func outboundAddrFor(remote netip.Addr, n uint64) (netip.Addr, bool) {
+	var candidates []netip.Addr
+	for _, addr := range outboundAddrs {
+		if addr.Is4() == remote.Unmap().Is4() {
+			candidates = append(candidates, addr)
+		}
+	}
+	if len(candidates) == 0 {
+		return netip.Addr{}, false
+	}
+	return candidates[n%uint64(len(candidates))], true
+}
+
+// dialUpstream opens upstream TCP connections, bound to one of
+// OUTBOUND_ADDRS when configured
+func dialUpstream(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if len(outboundAddrs) == 0 {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	remotes := []netip.Addr{}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		remotes = append(remotes, ip)
+	} else if remotes, err = net.DefaultResolver.LookupNetIP(ctx, "ip", host); err != nil {
+		return nil, err
+	}
+
+	n := outboundIndex(host)
+	var lastErr error
+	for _, remote := range remotes {
+		local, ok := outboundAddrFor(remote, n)
+		if !ok {
+			continue
+		}
+		d := *dialer
+		d.LocalAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(local, 0))
+		conn, err := d.DialContext(ctx, network, net.JoinHostPort(remote.Unmap().String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no outbound address matches the address family of %s", host)
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,145 @@
+package hlsproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// maxStitchSources bounds how many playlists one /stitch request joins
+const maxStitchSources = 16
+
+// stitchSegmentTags are the media playlist tags that describe segments and
+// travel with them into the stitched playlist; header tags are regenerated
+var stitchSegmentTags = map[string]bool{
+	"EXTINF":                  true,
+	"EXT-X-BYTERANGE":         true,
+	"EXT-X-DISCONTINUITY":     true,
+	"EXT-X-KEY":               true,
+	"EXT-X-MAP":               true,
+	"EXT-X-PROGRAM-DATE-TIME": true,
+	"EXT-X-GAP":               true,
+	"EXT-X-BITRATE":           true,
+}
+
+// stitchHandler joins several VOD playlists into one, with a discontinuity
+// between sources, e.g. to play intro + episode + outro as one stream. A
+// master playlist contributes its highest-bandwidth variant.
+// URL format: /stitch?urls={m3u8_url},{m3u8_url},...&headers={optional_headers}
+func stitchHandler(w http.ResponseWriter, r *http.Request) {
+	sources := splitList(r.URL.Query().Get("urls"))
+	if len(sources) == 0 || len(sources) > maxStitchSources {
+		sendStitchError(w, http.StatusBadRequest, fmt.Sprintf("urls must list 1 to %d playlist URLs", maxStitchSources))
+		return
+	}
+
+	// Segment URLs carry the headers param; header session headers are
+	// looked up again on every request
+	rules := parseHeadersParam(r.URL.Query().Get("headers"))
+	sessionRules, err := requestHeaderRules(r)
+	if err != nil {
+		sendStitchError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	keyParam := streamParam(r, strings.Join(sources, ",")) + headerParams(r)
+	if apiKey := r.URL.Query().Get("api_key"); apiKey != "" {
+		keyParam += "&api_key=" + url.QueryEscape(apiKey)
+	}
+
+	version, targetDuration := 3, 1
+	var body []string
+	encrypted := false
+	for i, source := range sources {
+		playlistURL, content, err := fetchMediaPlaylist(r.Context(), source, sessionRules)
+		if err != nil {
+			sendUpstreamError(w, "Failed to fetch "+source, err)
+			return
+		}
+		playlist := parseMediaPlaylist(content, playlistURL)
+		if !playlist.endList && playlist.playlistType != "VOD" {
+			sendStitchError(w, http.StatusUnprocessableEntity, "Only VOD playlists can be stitched; "+source+" is live")
+			return
+		}
+		targetDuration = max(targetDuration, playlist.targetDuration)
+
+		encodedHeaders := url.QueryEscape(rules.encode(generateRequestHeaders(playlistURL, rules["*"])))
+		rewrite := func(resolvedURL string, kind uriKind) string {
+			return fmt.Sprintf("%s/%s?url=%s&headers=%s",
+				rewriteBaseURL(r, segmentBaseURL(r, resolvedURL)),
+				segmentEndpoint(kind),
+				url.QueryEscape(resolvedURL),
+				encodedHeaders) + keyParam
+		}
+
+		if i > 0 {
+			body = append(body, "#EXT-X-DISCONTINUITY")
+			if encrypted {
+				// Keys don't carry over from the previous source
+				body = append(body, "#EXT-X-KEY:METHOD=NONE")
+			}
+		}
+		encrypted = false
+		for _, line := range strings.Split(preparePlaylist(content, playlistURL), "\n") {
+			trimmed := strings.TrimSpace(line)
+			switch tag := playlistTagName(trimmed); {
+			case trimmed == "":
+				continue
+			case tag == "EXT-X-VERSION":
+				if v, err := strconv.Atoi(strings.TrimPrefix(trimmed, "#EXT-X-VERSION:")); err == nil {
+					version = max(version, v)
+				}
+				continue
+			case strings.HasPrefix(trimmed, "#") && !stitchSegmentTags[tag]:
+				continue
+			case tag == "EXT-X-KEY":
+				encrypted = !strings.Contains(trimmed, "METHOD=NONE")
+			}
+			body = append(body, rewritePlaylistLine(trimmed, playlistURL, false, rewrite))
+		}
+	}
+
+	out := []string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:" + strconv.Itoa(version),
+		"#EXT-X-TARGETDURATION:" + strconv.Itoa(targetDuration),
+		"#EXT-X-MEDIA-SEQUENCE:0",
+		"#EXT-X-PLAYLIST-TYPE:VOD",
+	}
+	out = append(out, body...)
+	out = append(out, "#EXT-X-ENDLIST", "")
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Write([]byte(strings.Join(out, "\n")))
+}
+
+// fetchMediaPlaylist fetches a media playlist, following a master playlist
+// to its highest-bandwidth variant
+func fetchMediaPlaylist(ctx context.Context, source string, rules requestRules) (playlistURL, content string, err error) {
+	content, err = fetchPlaylistText(ctx, source, generateRequestHeaders(source, rules.forURL(source)))
+	if err != nil {
+		return "", "", err
+	}
+	master := parseMasterPlaylist(content, source)
+	if len(master.variants) == 0 {
+		return source, content, nil
+	}
+
+	best, bestBandwidth := master.variants[0].uri, -1
+	for _, v := range master.variants {
+		if bandwidth, _ := strconv.Atoi(v.attrs["BANDWIDTH"]); bandwidth > bestBandwidth {
+			best, bestBandwidth = v.uri, bandwidth
+		}
+	}
+	content, err = fetchPlaylistText(ctx, best, generateRequestHeaders(best, rules.forURL(best)))
+	return best, content, err
+}
+
+func sendStitchError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
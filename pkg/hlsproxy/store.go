@@ -0,0 +1,268 @@
+package hlsproxy
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store is a key/value store with per-entry expiry used by server-side state
+// such as short URLs. A zero ttl means the entry never expires.
+type Store interface {
+	Get(key string) ([]byte, bool, error)
+	Set(key string, value []byte, ttl time.Duration) error
+	// SetIfAbsent stores value only when key has no live entry, and
+	// reports whether it did. Concurrent callers see one of them win.
+	SetIfAbsent(key string, value []byte, ttl time.Duration) (bool, error)
+	Delete(key string) error
+}
+
+// newStore creates a store for the given backend name ("memory", "redis",
+// "sqlite", "bolt" or "s3") with the connection settings of cfg. Entries
+// of all but memory survive restarts; redis and s3 are shared between
+// instances, sqlite and bolt need no server.
+func newStore(cfg Config, backend, prefix string) (Store, error) {
+	switch strings.ToLower(backend) {
+	case "", "memory":
+		return newMemoryStore(), nil
+	case "redis":
+		if cfg.RedisURL == "" {
+			return nil, fmt.Errorf("redis backend requires REDIS_URL")
+		}
+		if _, err := url.Parse(cfg.RedisURL); err != nil {
+			return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+		}
+		return &redisStore{client: newRedisClient(cfg.RedisURL), prefix: prefix}, nil
+	case "sqlite":
+		if cfg.StoreDB == "" {
+			return nil, fmt.Errorf("sqlite backend requires STORE_DB")
+		}
+		return openSQLiteStore(cfg.StoreDB, prefix)
+	case "bolt":
+		if cfg.BoltDB == "" {
+			return nil, fmt.Errorf("bolt backend requires BOLT_DB")
+		}
+		return openBoltStore(cfg.BoltDB, prefix)
+	case "s3":
+		return newS3Store(cfg, prefix)
+	default:
+		return nil, fmt.Errorf("unknown store backend %q", backend)
+	}
+}
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+// memoryStore keeps entries in process memory
+type memoryStore struct {
+	mu        sync.Mutex
+	entries   map[string]memoryEntry
+	lastSweep time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{entries: make(map[string]memoryEntry)}
+}
+
+func (s *memoryStore) Get(key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		delete(s.entries, key)
+		return nil, false, nil
+	}
+	return entry.value, true, nil
+}
+
+func (s *memoryStore) Set(key string, value []byte, ttl time.Duration) error {
+	now := time.Now()
+	entry := memoryEntry{value: value}
+	if ttl > 0 {
+		entry.expires = now.Add(ttl)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = entry
+
+	// Drop expired entries at most once a minute
+	if now.Sub(s.lastSweep) > time.Minute {
+		s.lastSweep = now
+		for k, e := range s.entries {
+			if !e.expires.IsZero() && now.After(e.expires) {
+				delete(s.entries, k)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) SetIfAbsent(key string, value []byte, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	entry := memoryEntry{value: value}
+	if ttl > 0 {
+		entry.expires = now.Add(ttl)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.entries[key]; ok && (existing.expires.IsZero() || now.Before(existing.expires)) {
+		return false, nil
+	}
+	s.entries[key] = entry
+	return true, nil
+}
+
+func (s *memoryStore) Delete(key string) error {
+	s.mu.Lock()
+	delete(s.entries, key)
+	s.mu.Unlock()
+	return nil
+}
+
+// redisStore keeps entries in Redis under a key prefix
+type redisStore struct {
+	client *redisClient
+	prefix string
+}
+
+func (s *redisStore) Get(key string) ([]byte, bool, error) {
+	reply, err := s.client.do("GET", s.prefix+key)
+	if err != nil {
+		return nil, false, err
+	}
+	if reply == nil {
+		return nil, false, nil
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("unexpected redis reply %T", reply)
+	}
+	return value, true, nil
+}
+
+func (s *redisStore) Set(key string, value []byte, ttl time.Duration) error {
+	args := []string{"SET", s.prefix + key, string(value)}
+	if ttl > 0 {
+		args = append(args, "PX", fmt.Sprint(ttl.Milliseconds()))
+	}
+	_, err := s.client.do(args...)
+	return err
+}
+
+func (s *redisStore) SetIfAbsent(key string, value []byte, ttl time.Duration) (bool, error) {
+	args := []string{"SET", s.prefix + key, string(value), "NX"}
+	if ttl > 0 {
+		args = append(args, "PX", fmt.Sprint(ttl.Milliseconds()))
+	}
+	// NX answers OK when set and a nil reply when the key exists
+	reply, err := s.client.do(args...)
+	return reply != nil, err
+}
+
+func (s *redisStore) Delete(key string) error {
+	_, err := s.client.do("DEL", s.prefix+key)
+	return err
+}
+
+// sqliteStore keeps entries in a SQLite database under a key prefix, so
+// several stores can share one file
+type sqliteStore struct {
+	db     *sql.DB
+	prefix string
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+// openSQLiteStore opens or creates the store table in the database at path
+func openSQLiteStore(path, prefix string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer; one connection avoids "database is locked"
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS store (
+		key     TEXT    PRIMARY KEY,
+		value   BLOB    NOT NULL,
+		expires INTEGER NOT NULL DEFAULT 0
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteStore{db: db, prefix: prefix}, nil
+}
+
+func (s *sqliteStore) Get(key string) ([]byte, bool, error) {
+	var value []byte
+	err := s.db.QueryRow(`SELECT value FROM store WHERE key = ? AND (expires = 0 OR expires > ?)`,
+		s.prefix+key, time.Now().UnixMilli()).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (s *sqliteStore) Set(key string, value []byte, ttl time.Duration) error {
+	now := time.Now()
+	var expires int64
+	if ttl > 0 {
+		expires = now.Add(ttl).UnixMilli()
+	}
+	_, err := s.db.Exec(`INSERT INTO store (key, value, expires) VALUES (?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires = excluded.expires`,
+		s.prefix+key, value, expires)
+	if err != nil {
+		return err
+	}
+
+	// Drop expired entries at most once a minute
+	s.mu.Lock()
+	sweep := now.Sub(s.lastSweep) > time.Minute
+	if sweep {
+		s.lastSweep = now
+	}
+	s.mu.Unlock()
+	if sweep {
+		_, err = s.db.Exec(`DELETE FROM store WHERE expires != 0 AND expires <= ?`, now.UnixMilli())
+	}
+	return err
+}
+
+func (s *sqliteStore) SetIfAbsent(key string, value []byte, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	var expires int64
+	if ttl > 0 {
+		expires = now.Add(ttl).UnixMilli()
+	}
+	// An expired row is replaced; a live one is left alone
+	result, err := s.db.Exec(`INSERT INTO store (key, value, expires) VALUES (?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires = excluded.expires
+		WHERE store.expires != 0 AND store.expires <= ?`,
+		s.prefix+key, value, expires, now.UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqliteStore) Delete(key string) error {
+	_, err := s.db.Exec(`DELETE FROM store WHERE key = ?`, s.prefix+key)
+	return err
+}
@@ -0,0 +1,153 @@
+package hlsproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltBucket holds the entries of every bolt store
+var boltBucket = []byte("store")
+
+// boltDBs are the open bolt files by path. A file can only be opened once
+// per process, so the stores sharing one get the same handle.
+var (
+	boltMu  sync.Mutex
+	boltDBs = make(map[string]*bolt.DB)
+)
+
+// boltStore keeps entries in a local BoltDB file under a key prefix: no
+// server to run, and entries survive restarts
+type boltStore struct {
+	db     *bolt.DB
+	prefix string
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+// openBoltStore opens or creates the bolt file at path
+func openBoltStore(path, prefix string) (*boltStore, error) {
+	boltMu.Lock()
+	defer boltMu.Unlock()
+	db, ok := boltDBs[path]
+	if !ok {
+		var err error
+		if db, err = bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second}); err != nil {
+			return nil, fmt.Errorf("opening %s: %w", path, err)
+		}
+		err = db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(boltBucket)
+			return err
+		})
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		boltDBs[path] = db
+	}
+	return &boltStore{db: db, prefix: prefix}, nil
+}
+
+// encodeExpiring prefixes value with its expiry in Unix milliseconds, 0 for never
+func encodeExpiring(value []byte, ttl time.Duration) []byte {
+	var expires int64
+	if ttl > 0 {
+		expires = time.Now().Add(ttl).UnixMilli()
+	}
+	out := make([]byte, 8+len(value))
+	binary.BigEndian.PutUint64(out, uint64(expires))
+	copy(out[8:], value)
+	return out
+}
+
+// decodeExpiring returns the value of an encodeExpiring record and whether
+// it is still live
+func decodeExpiring(record []byte, now time.Time) ([]byte, bool) {
+	if len(record) < 8 {
+		return nil, false
+	}
+	expires := int64(binary.BigEndian.Uint64(record))
+	if expires != 0 && now.UnixMilli() >= expires {
+		return nil, false
+	}
+	return record[8:], true
+}
+
+func (s *boltStore) Get(key string) ([]byte, bool, error) {
+	var value []byte
+	var ok bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		record := tx.Bucket(boltBucket).Get([]byte(s.prefix + key))
+		if record == nil {
+			return nil
+		}
+		// Bolt's bytes are only valid inside the transaction
+		var live []byte
+		if live, ok = decodeExpiring(record, time.Now()); ok {
+			value = append([]byte(nil), live...)
+		}
+		return nil
+	})
+	return value, ok, err
+}
+
+func (s *boltStore) Set(key string, value []byte, ttl time.Duration) error {
+	now := time.Now()
+	s.mu.Lock()
+	sweep := now.Sub(s.lastSweep) > time.Minute
+	if sweep {
+		s.lastSweep = now
+	}
+	s.mu.Unlock()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		if err := bucket.Put([]byte(s.prefix+key), encodeExpiring(value, ttl)); err != nil {
+			return err
+		}
+		if !sweep {
+			return nil
+		}
+		// Drop this store's expired entries at most once a minute
+		prefix := []byte(s.prefix)
+		var expired [][]byte
+		c := bucket.Cursor()
+		for k, record := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, record = c.Next() {
+			if _, live := decodeExpiring(record, now); !live {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+		}
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) SetIfAbsent(key string, value []byte, ttl time.Duration) (bool, error) {
+	var set bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		if record := bucket.Get([]byte(s.prefix + key)); record != nil {
+			if _, live := decodeExpiring(record, time.Now()); live {
+				return nil
+			}
+		}
+		set = true
+		return bucket.Put([]byte(s.prefix+key), encodeExpiring(value, ttl))
+	})
+	return set && err == nil, err
+}
+
+func (s *boltStore) Delete(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(s.prefix + key))
+	})
+}
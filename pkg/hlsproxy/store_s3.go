@@ -0,0 +1,160 @@
+package hlsproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// s3Client talks to the store bucket directly, not through the upstream
+// transport with its policies and credentials
+var s3Client = &http.Client{Timeout: 30 * time.Second}
+
+// s3Store keeps entries as objects in an S3 bucket under a key prefix,
+// durable and shared by every instance. Objects carry their expiry in the
+// body; expired ones are skipped and deleted on read, so give the bucket a
+// lifecycle rule to clear out those that are never read again.
+type s3Store struct {
+	endpoint string // scheme and host; the bucket is the first path element
+	bucket   string
+	prefix   string
+	auth     upstreamAuth
+}
+
+// newS3Store validates the bucket settings of cfg
+func newS3Store(cfg Config, prefix string) (*s3Store, error) {
+	if cfg.S3Bucket == "" || cfg.S3Region == "" {
+		return nil, fmt.Errorf("s3 backend requires S3_BUCKET and S3_REGION")
+	}
+	if cfg.S3AccessKey == "" || cfg.S3SecretKey == "" {
+		return nil, fmt.Errorf("s3 backend requires S3_ACCESS_KEY and S3_SECRET_KEY")
+	}
+	endpoint := cfg.S3Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + cfg.S3Region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3_ENDPOINT %q", endpoint)
+	}
+	return &s3Store{
+		endpoint: u.Scheme + "://" + u.Host,
+		bucket:   cfg.S3Bucket,
+		prefix:   cfg.S3Prefix + prefix,
+		auth: upstreamAuth{
+			Type:      "sigv4",
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey,
+			Region:    cfg.S3Region,
+			Service:   "s3",
+		},
+	}, nil
+}
+
+// do sends a signed request for the object of key, with the extra headers given
+func (s *s3Store) do(method, key string, body []byte, header http.Header) (*http.Response, error) {
+	path := "/" + s.bucket + "/" + s.prefix + key
+	var segments []string
+	for _, segment := range strings.Split(path, "/") {
+		segments = append(segments, awsEscape(segment))
+	}
+	u, err := url.Parse(s.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	// Send the path exactly as it was signed
+	u.Path, u.RawPath = path, strings.Join(segments, "/")
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		req.Body, req.GetBody, req.ContentLength = nil, nil, 0
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if err := signSigV4(req, s.auth, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	return s3Client.Do(req)
+}
+
+// s3Error describes a failed S3 answer
+func s3Error(method string, resp *http.Response) error {
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("s3 %s: %s %s", method, resp.Status, strings.TrimSpace(string(detail)))
+}
+
+func (s *s3Store) Get(key string) ([]byte, bool, error) {
+	resp, err := s.do(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, s3Error("GET", resp)
+	}
+	record, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	value, live := decodeExpiring(record, time.Now())
+	if !live {
+		s.Delete(key)
+		return nil, false, nil
+	}
+	return value, true, nil
+}
+
+func (s *s3Store) Set(key string, value []byte, ttl time.Duration) error {
+	resp, err := s.do(http.MethodPut, key, encodeExpiring(value, ttl), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("PUT", resp)
+	}
+	return nil
+}
+
+func (s *s3Store) SetIfAbsent(key string, value []byte, ttl time.Duration) (bool, error) {
+	// Get removes an expired object, which a conditional PUT would count as
+	// present
+	if _, found, err := s.Get(key); err != nil || found {
+		return false, err
+	}
+	resp, err := s.do(http.MethodPut, key, encodeExpiring(value, ttl), http.Header{"If-None-Match": {"*"}})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		return false, nil
+	}
+	return false, s3Error("PUT", resp)
+}
+
+func (s *s3Store) Delete(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return s3Error("DELETE", resp)
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+package hlsproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// streamActiveWindow is how recent a viewer's last request must be to count as watching
+	streamActiveWindow = 30 * time.Second
+	// streamIdleTimeout drops viewers, and then streams, idle for this long
+	streamIdleTimeout = 2 * time.Minute
+	// streamTerminatedTTL is how long a terminated session keeps being refused
+	streamTerminatedTTL = 10 * time.Minute
+)
+
+// streamID derives the id of a stream from its top-level playlist URL
+func streamID(playlistURL string) string {
+	sum := sha256.Sum256([]byte(playlistURL))
+	return hex.EncodeToString(sum[:6])
+}
+
+// transferSample is the bytes sent to a viewer by one request
+type transferSample struct {
+	at    time.Time
+	bytes int64
+}
+
+// viewerSession is one viewer playing one stream
+type viewerSession struct {
+	first, last time.Time
+	playlist    string // media playlist most recently fetched
+	requests    int64
+	bytes       int64
+	samples     []transferSample // within streamActiveWindow, for the bitrate
+}
+
+// activeStream is a playlist being played through the proxy. Its id is
+// carried as &stream= on every rewritten URL, so variant playlist and
+// segment requests are attributed to it.
+type activeStream struct {
+	url     string
+	first   time.Time
+	viewers map[string]*viewerSession
+
+	corrupt          int64 // segments that failed VERIFY_SEGMENTS checks
+	lastCorruption   string
+	lastCorruptionAt time.Time
+
+	timing *segmentTimings // with SEGMENT_TIMING
+}
+
+// streamRegistry tracks what is currently being played
+type streamRegistry struct {
+	mu         sync.Mutex
+	streams    map[string]*activeStream
+	terminated map[string]time.Time // stream id, or id + "\x00" + viewer, until when refused
+	lastSweep  time.Time
+}
+
+var streams = &streamRegistry{
+	streams:    make(map[string]*activeStream),
+	terminated: make(map[string]time.Time),
+}
+
+// requestStream returns the stream id of a playlist, segment or key
+// request, and the top-level playlist URL when the request starts a stream
+func requestStream(r *http.Request) (id, playlistURL string) {
+	q := r.URL.Query()
+	if id = q.Get("stream"); id != "" {
+		return id, ""
+	}
+	if r.URL.Path == "/proxy" && q.Get("url") != "" {
+		return streamID(q.Get("url")), q.Get("url")
+	}
+	return "", ""
+}
+
+// isTerminated reports whether the stream, or this viewer's session of it, was terminated
+func (s *streamRegistry) isTerminated(id, viewer string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for _, key := range []string{id, id + "\x00" + viewer} {
+		if until, ok := s.terminated[key]; ok {
+			if now.Before(until) {
+				return true
+			}
+			delete(s.terminated, key)
+		}
+	}
+	return false
+}
+
+// record attributes a finished request to a viewer session
+func (s *streamRegistry) record(r *http.Request, id, playlistURL, viewer string, bytes int64) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stream := s.stream(r, id, playlistURL, now)
+	session, ok := stream.viewers[viewer]
+	if !ok {
+		session = &viewerSession{first: now}
+		stream.viewers[viewer] = session
+	}
+	session.last = now
+	session.requests++
+	session.bytes += bytes
+	session.samples = append(pruneSamples(session.samples, now), transferSample{at: now, bytes: bytes})
+	if r.URL.Path == "/proxy" {
+		session.playlist = r.URL.Query().Get("url")
+	}
+	if now.Sub(s.lastSweep) > streamActiveWindow {
+		s.sweep(now)
+	}
+}
+
+// stream returns the tracked stream id, creating it; callers must hold s.mu
+func (s *streamRegistry) stream(r *http.Request, id, playlistURL string, now time.Time) *activeStream {
+	stream, ok := s.streams[id]
+	if !ok {
+		if playlistURL == "" {
+			// Segment of a stream that expired or was never started here
+			playlistURL = r.URL.Query().Get("url")
+		}
+		stream = &activeStream{url: playlistURL, first: now, viewers: make(map[string]*viewerSession)}
+		s.streams[id] = stream
+	}
+	return stream
+}
+
+// recordCorruption counts a corrupted segment against its stream
+func (s *streamRegistry) recordCorruption(r *http.Request, id, reason string) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stream := s.stream(r, id, "", now)
+	stream.corrupt++
+	stream.lastCorruption, stream.lastCorruptionAt = reason, now
+}
+
+// sweep drops idle viewers and empty streams; callers must hold s.mu
+func (s *streamRegistry) sweep(now time.Time) {
+	s.lastSweep = now
+	for id, stream := range s.streams {
+		for viewer, session := range stream.viewers {
+			if now.Sub(session.last) > streamIdleTimeout {
+				delete(stream.viewers, viewer)
+			}
+		}
+		if len(stream.viewers) == 0 {
+			delete(s.streams, id)
+		}
+	}
+	for key, until := range s.terminated {
+		if now.After(until) {
+			delete(s.terminated, key)
+		}
+	}
+}
+
+// pruneSamples drops samples older than streamActiveWindow
+func pruneSamples(samples []transferSample, now time.Time) []transferSample {
+	i := 0
+	for i < len(samples) && now.Sub(samples[i].at) > streamActiveWindow {
+		i++
+	}
+	return samples[i:]
+}
+
+// terminate refuses further requests of a stream, or of one viewer of it
+func (s *streamRegistry) terminate(id, viewer string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stream, ok := s.streams[id]
+	if !ok {
+		return false
+	}
+	until := time.Now().Add(streamTerminatedTTL)
+	if viewer == "" {
+		s.terminated[id] = until
+		delete(s.streams, id)
+		return true
+	}
+	if _, ok := stream.viewers[viewer]; !ok {
+		return false
+	}
+	s.terminated[id+"\x00"+viewer] = until
+	delete(stream.viewers, viewer)
+	return true
+}
+
+// streamViewerStats is one viewer in the /admin/streams listing
+type streamViewerStats struct {
+	Viewer       string    `json:"viewer"`
+	Playlist     string    `json:"playlist,omitempty"`
+	Requests     int64     `json:"requests"`
+	Bytes        int64     `json:"bytes"`
+	BitrateBps   int64     `json:"bitrateBps"`
+	Started      time.Time `json:"started"`
+	LastActivity time.Time `json:"lastActivity"`
+	Active       bool      `json:"active"`
+}
+
+// streamStats is one stream in the /admin/streams listing
+type streamStats struct {
+	ID           string              `json:"id"`
+	URL          string              `json:"url"`
+	Viewers      int                 `json:"viewers"`
+	BitrateBps   int64               `json:"bitrateBps"`
+	Started      time.Time           `json:"started"`
+	LastActivity time.Time           `json:"lastActivity"`
+	Sessions     []streamViewerStats `json:"sessions"`
+
+	CorruptSegments  int64      `json:"corruptSegments"`
+	LastCorruption   string     `json:"lastCorruption,omitempty"`
+	LastCorruptionAt *time.Time `json:"lastCorruptionAt,omitempty"`
+
+	SegmentTiming *segmentTimingStats `json:"segmentTiming,omitempty"`
+}
+
+// snapshot lists the tracked streams, most watched first
+func (s *streamRegistry) snapshot() []streamStats {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+
+	list := make([]streamStats, 0, len(s.streams))
+	for id, stream := range s.streams {
+		stats := streamStats{ID: id, URL: stream.url, Started: stream.first, Sessions: []streamViewerStats{}}
+		stats.CorruptSegments, stats.LastCorruption = stream.corrupt, stream.lastCorruption
+		if !stream.lastCorruptionAt.IsZero() {
+			at := stream.lastCorruptionAt
+			stats.LastCorruptionAt = &at
+		}
+		if stream.timing != nil {
+			stats.SegmentTiming = stream.timing.stats()
+		}
+		for viewer, session := range stream.viewers {
+			session.samples = pruneSamples(session.samples, now)
+			var recent int64
+			for _, sample := range session.samples {
+				recent += sample.bytes
+			}
+			v := streamViewerStats{
+				Viewer:       viewer,
+				Playlist:     session.playlist,
+				Requests:     session.requests,
+				Bytes:        session.bytes,
+				BitrateBps:   recent * 8 / int64(streamActiveWindow/time.Second),
+				Started:      session.first,
+				LastActivity: session.last,
+				Active:       now.Sub(session.last) <= streamActiveWindow,
+			}
+			if v.Active {
+				stats.Viewers++
+			}
+			stats.BitrateBps += v.BitrateBps
+			if session.last.After(stats.LastActivity) {
+				stats.LastActivity = session.last
+			}
+			stats.Sessions = append(stats.Sessions, v)
+		}
+		sort.Slice(stats.Sessions, func(i, j int) bool { return stats.Sessions[i].LastActivity.After(stats.Sessions[j].LastActivity) })
+		list = append(list, stats)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Viewers != list[j].Viewers {
+			return list[i].Viewers > list[j].Viewers
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// streamParam returns the &stream= suffix carried by rewritten URLs
+func streamParam(r *http.Request, targetURL string) string {
+	id := r.URL.Query().Get("stream")
+	if id == "" {
+		id = streamID(targetURL)
+	}
+	return "&stream=" + url.QueryEscape(id)
+}
+
+// sendStreamTerminated refuses a request of a terminated session
+func sendStreamTerminated(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusGone)
+	json.NewEncoder(w).Encode(map[string]string{"error": "This stream session was terminated"})
+}
+
+// adminStreamsHandler lists active streams on GET and terminates a stream,
+// or one viewer's session of it, on DELETE ?id={stream_id}&viewer={optional_viewer}
+func adminStreamsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"streams": streams.snapshot()})
+	case http.MethodDelete:
+		id, viewer := r.URL.Query().Get("id"), r.URL.Query().Get("viewer")
+		w.Header().Set("Content-Type", "application/json")
+		if id == "" || !streams.terminate(id, viewer) {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "No such stream session"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"terminated": id, "viewer": viewer})
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Use GET to list or DELETE to terminate"})
+	}
+}
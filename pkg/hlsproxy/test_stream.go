@@ -0,0 +1,152 @@
+package hlsproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// testStreamSegmentSeconds is the duration of each synthetic segment
+	testStreamSegmentSeconds = 2
+	// testStreamWindow is how many segments the live playlist lists
+	testStreamWindow = 6
+	// testStreamRetained is how far behind the live edge segments are still served
+	testStreamRetained = 30
+	// testStreamTimeout bounds generating one segment
+	testStreamTimeout = 20 * time.Second
+)
+
+var (
+	// testStreamEnabled turns on /test-stream.m3u8
+	testStreamEnabled bool
+	// ffmpegPath is the ffmpeg binary that renders test segments
+	ffmpegPath string
+)
+
+// testSegmentCache keeps rendered segments by media sequence number, so
+// every viewer of the test stream shares one ffmpeg run per segment
+type testSegmentCache struct {
+	mu       sync.Mutex
+	segments map[int64][]byte
+}
+
+var testSegments = &testSegmentCache{segments: make(map[int64][]byte)}
+
+// get returns the segment for sequence, rendering it on first use
+func (c *testSegmentCache) get(ctx context.Context, sequence int64) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if segment, ok := c.segments[sequence]; ok {
+		return segment, nil
+	}
+	segment, err := renderTestSegment(ctx, sequence)
+	if err != nil {
+		return nil, err
+	}
+	for s := range c.segments {
+		if s < sequence-testStreamRetained {
+			delete(c.segments, s)
+		}
+	}
+	c.segments[sequence] = segment
+	return segment, nil
+}
+
+// renderTestSegment has ffmpeg draw SMPTE color bars with a 1 kHz tone
+// into an MPEG-TS segment, with timestamps continuing from the one before
+func renderTestSegment(ctx context.Context, sequence int64) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, testStreamTimeout)
+	defer cancel()
+	seconds := strconv.Itoa(testStreamSegmentSeconds)
+	fps := 30
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpegPath, "-hide_banner", "-loglevel", "error",
+		"-f", "lavfi", "-i", fmt.Sprintf("smptebars=size=640x360:rate=%d", fps),
+		"-f", "lavfi", "-i", "sine=frequency=1000:sample_rate=48000",
+		"-t", seconds,
+		"-c:v", "libx264", "-preset", "ultrafast", "-tune", "zerolatency", "-pix_fmt", "yuv420p",
+		"-g", strconv.Itoa(fps*testStreamSegmentSeconds), "-sc_threshold", "0",
+		"-c:a", "aac", "-b:a", "64k",
+		"-output_ts_offset", strconv.FormatInt(sequence*testStreamSegmentSeconds, 10),
+		"-f", "mpegts", "pipe:1")
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s %v", strings.TrimSpace(stderr.String()), err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// liveTestSequence returns the media sequence number of the newest segment
+func liveTestSequence(now time.Time) int64 {
+	return now.Unix()/testStreamSegmentSeconds - 1
+}
+
+// testStreamHandler serves a synthetic live playlist whose segments are
+// rendered on demand, for testing players, CORS and latency against the
+// proxy alone. Segments carry EXT-X-PROGRAM-DATE-TIME, so players can show
+// their distance from the live edge. It can also be fetched through
+// /proxy?url= like any origin.
+// URL format: /test-stream.m3u8
+func testStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if !testStreamEnabled {
+		sendTestStreamError(w, http.StatusNotFound, "The test stream is disabled")
+		return
+	}
+	newest := liveTestSequence(time.Now())
+	first := newest - testStreamWindow + 1
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:%d\n", testStreamSegmentSeconds, first)
+	for sequence := first; sequence <= newest; sequence++ {
+		start := time.Unix(sequence*testStreamSegmentSeconds, 0).UTC()
+		fmt.Fprintf(&b, "#EXT-X-PROGRAM-DATE-TIME:%s\n#EXTINF:%d.000,\ntest-stream/%d.ts\n",
+			start.Format("2006-01-02T15:04:05.000Z"), testStreamSegmentSeconds, sequence)
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(b.String()))
+}
+
+// testSegmentHandler serves one rendered segment of the test stream
+// URL format: /test-stream/{sequence}.ts
+func testSegmentHandler(w http.ResponseWriter, r *http.Request) {
+	if !testStreamEnabled {
+		sendTestStreamError(w, http.StatusNotFound, "The test stream is disabled")
+		return
+	}
+	sequence, err := strconv.ParseInt(strings.TrimSuffix(r.PathValue("segment"), ".ts"), 10, 64)
+	newest := liveTestSequence(time.Now())
+	if err != nil || sequence > newest || sequence < newest-testStreamRetained {
+		sendTestStreamError(w, http.StatusNotFound, "No such segment in the test stream window")
+		return
+	}
+	if _, err := exec.LookPath(ffmpegPath); err != nil {
+		sendTestStreamError(w, http.StatusNotImplemented, "ffmpeg is not available; install it or set FFMPEG_PATH")
+		return
+	}
+
+	segment, err := testSegments.get(r.Context(), sequence)
+	if err != nil {
+		sendError(w, "Failed to render test segment", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	w.Header().Set("Content-Length", strconv.Itoa(len(segment)))
+	w.Write(segment)
+}
+
+func sendTestStreamError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -0,0 +1,191 @@
+package hlsproxy
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// transferWriter sits next to the client connection and counts the body
+// bytes the client was actually sent, after compression and throttling.
+// It also notices responses the client didn't receive in full.
+type transferWriter struct {
+	http.ResponseWriter
+	status int
+	length int64 // declared Content-Length, -1 when unknown
+	bytes  int64
+	failed bool     // a write to the client failed
+	done   []func() // run by finish, once every byte is counted
+}
+
+// transferWriterKey carries the request's transferWriter, so /u/{id} can
+// account the request it resolves to
+type transferWriterKey struct{}
+
+func newTransferWriter(w http.ResponseWriter) *transferWriter {
+	return &transferWriter{ResponseWriter: w, length: -1}
+}
+
+func (w *transferWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+		if length, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64); err == nil {
+			w.length = length
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *transferWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	if err != nil {
+		w.failed = true
+	}
+	return n, err
+}
+
+// onDone has f run once the response is complete
+func (w *transferWriter) onDone(f func()) {
+	w.done = append(w.done, f)
+}
+
+// finish runs the onDone funcs
+func (w *transferWriter) finish() {
+	for _, f := range w.done {
+		f()
+	}
+}
+
+// Flush keeps streaming handlers working through the wrapper
+func (w *transferWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *transferWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// aborted reports whether the client went away before the response was
+// complete: a write failed, the connection closed while the handler ran, or
+// fewer bytes than the declared Content-Length were sent
+func (w *transferWriter) aborted(r *http.Request) bool {
+	if w.failed || r.Context().Err() != nil {
+		return true
+	}
+	if r.Method == http.MethodHead || w.status == http.StatusNoContent || w.status == http.StatusNotModified {
+		return false
+	}
+	return w.length >= 0 && w.bytes < w.length
+}
+
+// clientTransferCounts are the responses sent for one upstream domain
+type clientTransferCounts struct {
+	transfers int64
+	bytes     int64
+	aborted   int64
+	lastSeen  time.Time
+}
+
+// otherTransferDomain counts the domains past metricsMaxHosts
+const otherTransferDomain = "other"
+
+// clientTransferStats counts what clients were actually sent per upstream
+// domain, to set against the upstream bytes of the same domain
+type clientTransferStats struct {
+	mu      sync.Mutex
+	domains map[string]*clientTransferCounts
+}
+
+var clientTransfers = &clientTransferStats{domains: make(map[string]*clientTransferCounts)}
+
+// record counts one response for domain. Like upstream metrics, at most
+// metricsMaxHosts domains are tracked: domains idle for metricsHostIdle
+// make room, and the rest count as otherTransferDomain.
+func (s *clientTransferStats) record(domain string, bytes int64, aborted bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	c, ok := s.domains[domain]
+	if !ok {
+		if s.tracked() >= metricsMaxHosts {
+			s.evict(now)
+		}
+		if s.tracked() >= metricsMaxHosts {
+			domain = otherTransferDomain
+		}
+		if c, ok = s.domains[domain]; !ok {
+			c = &clientTransferCounts{}
+			s.domains[domain] = c
+		}
+	}
+	c.lastSeen = now
+	c.transfers++
+	c.bytes += bytes
+	if aborted {
+		c.aborted++
+	}
+}
+
+// tracked is the number of domains counted on their own; callers must
+// hold s.mu
+func (s *clientTransferStats) tracked() int {
+	if _, ok := s.domains[otherTransferDomain]; ok {
+		return len(s.domains) - 1
+	}
+	return len(s.domains)
+}
+
+// evict folds the domains idle for metricsHostIdle into
+// otherTransferDomain; callers must hold s.mu
+func (s *clientTransferStats) evict(now time.Time) {
+	var idle []*clientTransferCounts
+	for domain, c := range s.domains {
+		if domain != otherTransferDomain && now.Sub(c.lastSeen) > metricsHostIdle {
+			idle = append(idle, c)
+			delete(s.domains, domain)
+		}
+	}
+	if len(idle) == 0 {
+		return
+	}
+	other, ok := s.domains[otherTransferDomain]
+	if !ok {
+		other = &clientTransferCounts{}
+		s.domains[otherTransferDomain] = other
+	}
+	for _, c := range idle {
+		other.transfers += c.transfers
+		other.bytes += c.bytes
+		other.aborted += c.aborted
+	}
+	other.lastSeen = now
+}
+
+// clientTransferSnapshot is the reported view of one domain's client transfers
+type clientTransferSnapshot struct {
+	Domain    string `json:"domain"`
+	Transfers int64  `json:"transfers"`
+	Bytes     int64  `json:"bytes"`
+	Aborted   int64  `json:"aborted"`
+}
+
+// snapshot returns the counts of every domain, sorted by domain
+func (s *clientTransferStats) snapshot() []clientTransferSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshots := make([]clientTransferSnapshot, 0, len(s.domains))
+	for domain, c := range s.domains {
+		snapshots = append(snapshots, clientTransferSnapshot{Domain: domain, Transfers: c.transfers, Bytes: c.bytes, Aborted: c.aborted})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Domain < snapshots[j].Domain })
+	return snapshots
+}
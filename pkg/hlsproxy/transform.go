@@ -0,0 +1,123 @@
+package hlsproxy
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// transformMaxBytes caps a non-playlist body buffered for transformers
+const transformMaxBytes = 16 << 20
+
+// playlistContentType is the content type playlist transformers register for
+const playlistContentType = "application/vnd.apple.mpegurl"
+
+// TransformContext describes the response a Transformer is rewriting
+type TransformContext struct {
+	// Request is the client request being served
+	Request *http.Request
+	// URL is the upstream URL the body was fetched from
+	URL string
+	// ContentType is the media type of the body, without parameters
+	ContentType string
+}
+
+// Transformer rewrites a response body and returns the new body. An error
+// fails the request instead of serving the body.
+type Transformer func(body []byte, ctx TransformContext) ([]byte, error)
+
+// registeredTransformer is one Transformer and the content type it handles
+type registeredTransformer struct {
+	contentType string
+	transform   Transformer
+}
+
+var (
+	transformersMu sync.RWMutex
+	transformers   []registeredTransformer
+)
+
+// RegisterTransformer adds t to the pipeline for contentType, a media type
+// such as "text/vtt" or a wildcard such as "text/*". Transformers run in the
+// order they were registered, each on the output of the one before.
+// Playlists reach transformers as "application/vnd.apple.mpegurl" before
+// their URLs are rewritten; other bodies are buffered, so register only for
+// types small enough to hold in memory. Register before serving requests:
+//
+//	hlsproxy.RegisterTransformer("text/vtt", func(body []byte, ctx hlsproxy.TransformContext) ([]byte, error) {
+//		return bytes.ReplaceAll(body, []byte("\r\n"), []byte("\n")), nil
+//	})
+func RegisterTransformer(contentType string, t Transformer) {
+	transformersMu.Lock()
+	defer transformersMu.Unlock()
+	transformers = append(transformers, registeredTransformer{contentType: mediaType(contentType), transform: t})
+}
+
+// mediaType returns the lowercased media type of a Content-Type value
+func mediaType(contentType string) string {
+	if parsed, _, err := mime.ParseMediaType(contentType); err == nil {
+		return parsed
+	}
+	parsed, _, _ := strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(parsed))
+}
+
+// transformersFor returns the transformers registered for a content type
+func transformersFor(contentType string) []Transformer {
+	contentType = mediaType(contentType)
+	major, _, _ := strings.Cut(contentType, "/")
+	transformersMu.RLock()
+	defer transformersMu.RUnlock()
+	var matched []Transformer
+	for _, rt := range transformers {
+		if rt.contentType == contentType || rt.contentType == "*/*" || rt.contentType == major+"/*" {
+			matched = append(matched, rt.transform)
+		}
+	}
+	return matched
+}
+
+// transformBody runs the pipeline for contentType over body
+func transformBody(r *http.Request, targetURL, contentType string, body []byte) ([]byte, error) {
+	ctx := TransformContext{Request: r, URL: targetURL, ContentType: mediaType(contentType)}
+	for _, transform := range transformersFor(contentType) {
+		var err error
+		if body, err = transform(body, ctx); err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+// serveTransformed buffers a whole upstream response and writes it through
+// the transformers for its content type. It reports false, leaving the
+// response untouched, when none apply: nothing is registered, the body is
+// a partial range or it is still encoded.
+func serveTransformed(w http.ResponseWriter, r *http.Request, targetURL, contentType string, resp *http.Response) bool {
+	if resp.StatusCode != http.StatusOK || w.Header().Get("Content-Encoding") != "" || len(transformersFor(contentType)) == 0 {
+		return false
+	}
+	// The upstream length no longer applies, nor do its ranges
+	w.Header().Del("Content-Length")
+	w.Header().Del("Accept-Ranges")
+	body, err := io.ReadAll(io.LimitReader(resp.Body, transformMaxBytes+1))
+	if err != nil {
+		sendError(w, "Failed to read upstream response", err.Error())
+		return true
+	}
+	if len(body) > transformMaxBytes {
+		sendError(w, "Failed to transform response", fmt.Sprintf("body exceeds %d MB", transformMaxBytes>>20))
+		return true
+	}
+	if body, err = transformBody(r, targetURL, contentType, body); err != nil {
+		sendError(w, "Failed to transform response", err.Error())
+		return true
+	}
+	w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+	w.WriteHeader(resp.StatusCode)
+	w.Write(body)
+	return true
+}
@@ -0,0 +1,95 @@
+package hlsproxy
+
+import (
+	"encoding/base64"
+	"log"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+)
+
+// maxUnwrapDepth bounds how many nested proxy URLs are unwrapped
+const maxUnwrapDepth = 4
+
+// unwrapProxies rewrites playlist URLs that point at other public proxies
+// to the origin URL they forward to, so requests skip the stranger's server.
+// Headers the other proxy would have sent aren't carried over.
+var unwrapProxies bool
+
+// proxyEndpoints are the endpoint names other m3u8 proxies are known to use
+var proxyEndpoints = map[string]bool{
+	"proxy": true, "m3u8-proxy": true, "ts-proxy": true, "hls-proxy": true, "mp4-proxy": true,
+	"video-proxy": true, "stream-proxy": true, "segment-proxy": true, "cors": true, "fetch": true,
+}
+
+// proxyURLParams are the query params those endpoints take the target in
+var proxyURLParams = []string{"url", "u", "link", "src", "target"}
+
+// reportedProxies remembers the proxy hosts already logged
+var reportedProxies sync.Map
+
+// proxiedTarget returns the URL a known proxy URL forwards to: the target
+// param of an endpoint such as /proxy?url=, plain or base64, or the path of
+// a cors-anywhere style https://proxy.example/https://origin/...
+func proxiedTarget(rawURL string) (string, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return "", false
+	}
+	if rest := strings.TrimPrefix(u.Path, "/"); isHTTPURL(rest) {
+		if u.RawQuery != "" {
+			rest += "?" + u.RawQuery
+		}
+		return rest, true
+	}
+
+	name := path.Base(u.Path)
+	if !proxyEndpoints[strings.TrimSuffix(name, path.Ext(name))] {
+		return "", false
+	}
+	query := u.Query()
+	for _, param := range proxyURLParams {
+		value := query.Get(param)
+		if isHTTPURL(value) {
+			return value, true
+		}
+		for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+			if decoded, err := encoding.DecodeString(value); err == nil && isHTTPURL(string(decoded)) {
+				return string(decoded), true
+			}
+		}
+	}
+	return "", false
+}
+
+// isHTTPURL reports whether s is an absolute http(s) URL
+func isHTTPURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// unwrapProxiedURL returns the origin URL behind a chain of known proxy
+// URLs when UNWRAP_PROXIES is on, logging each proxy host once
+func unwrapProxiedURL(rawURL string) string {
+	target := rawURL
+	for range maxUnwrapDepth {
+		inner, ok := proxiedTarget(target)
+		if !ok {
+			break
+		}
+		if u, err := url.Parse(target); err == nil {
+			if _, seen := reportedProxies.LoadOrStore(u.Host, true); !seen {
+				if unwrapProxies {
+					log.Printf("Playlist URLs route through the proxy at %s; unwrapping them", u.Host)
+				} else {
+					log.Printf("Playlist URLs route through the proxy at %s; set UNWRAP_PROXIES to request the origin directly", u.Host)
+				}
+			}
+		}
+		target = inner
+	}
+	if !unwrapProxies {
+		return rawURL
+	}
+	return target
+}
@@ -0,0 +1,164 @@
+package hlsproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// inheritedListenerEnv tells a process started by an upgrade that its
+// listener is fd 3 and fd 4 is the pipe it reports readiness on
+const inheritedListenerEnv = "M3U8_PROXY_INHERITED_LISTENER"
+
+// upgradeReadyTimeout is how long a new binary may take to start serving
+const upgradeReadyTimeout = 30 * time.Second
+
+// serve runs the server until SIGINT or SIGTERM, then drains it for up to
+// cfg.ShutdownTimeout. SIGHUP starts the current binary on disk with the
+// same listening socket and drains this process once the new one is ready,
+// so upgrades don't refuse or drop connections.
+func serve(server *http.Server, cfg Config) error {
+	listener, addr, ready, err := inheritedListener()
+	if err != nil {
+		return err
+	}
+	if listener == nil {
+		if listener, addr, err = listen(cfg); err != nil {
+			return err
+		}
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(listener) }()
+	log.Printf("M3U8 Proxy Server running at %s", addr)
+
+	if cfg.PIDFile != "" {
+		if err := os.WriteFile(cfg.PIDFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+			return err
+		}
+	}
+	if ready != nil {
+		ready.Write([]byte{1})
+		ready.Close()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for {
+		select {
+		case err := <-served:
+			return err
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				if err := upgrade(listener); err != nil {
+					log.Printf("Upgrade failed, still serving: %v", err)
+					continue
+				}
+				// The socket file now belongs to the new process
+				if unix, ok := listener.(*net.UnixListener); ok {
+					unix.SetUnlinkOnClose(false)
+				}
+				log.Printf("Upgraded; draining connections")
+			} else {
+				log.Printf("Received %s; draining connections", sig)
+			}
+			return shutdown(server, cfg.ShutdownTimeout)
+		}
+	}
+}
+
+// shutdown stops accepting connections and waits for active requests,
+// closing whatever is still open after timeout
+func shutdown(server *http.Server, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Drain incomplete, closing remaining connections: %v", err)
+		return server.Close()
+	}
+	return nil
+}
+
+// inheritedListener returns the listener handed over by an upgrading
+// process, or nil when the process was started normally
+func inheritedListener() (net.Listener, string, *os.File, error) {
+	if os.Getenv(inheritedListenerEnv) == "" {
+		return nil, "", nil, nil
+	}
+	os.Unsetenv(inheritedListenerEnv)
+
+	file := os.NewFile(3, "listener")
+	listener, err := net.FileListener(file)
+	file.Close()
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("inherited listener: %w", err)
+	}
+	addr := "http://" + listener.Addr().String()
+	if listener.Addr().Network() == "unix" {
+		addr = "unix:" + listener.Addr().String()
+	}
+	return listener, addr + " (inherited)", os.NewFile(4, "ready"), nil
+}
+
+// upgrade starts the binary with the listening socket and waits until it
+// reports that it serves
+func upgrade(listener net.Listener) error {
+	filer, ok := listener.(interface{ File() (*os.File, error) })
+	if !ok {
+		return errors.New("listener can't be handed over")
+	}
+	file, err := filer.File()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	readyRead, readyWrite, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyRead.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), inheritedListenerEnv+"=1")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{file, readyWrite}
+	err = cmd.Start()
+	readyWrite.Close()
+	if err != nil {
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	// One byte means ready; EOF means the new process died first
+	result := make(chan error, 1)
+	go func() {
+		_, err := readyRead.Read(make([]byte, 1))
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			cmd.Process.Kill()
+			return fmt.Errorf("new process exited before serving: %v", <-exited)
+		}
+		return nil
+	case <-time.After(upgradeReadyTimeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("new process not serving after %s", upgradeReadyTimeout)
+	}
+}
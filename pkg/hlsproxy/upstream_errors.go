@@ -0,0 +1,70 @@
+package hlsproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+)
+
+// classifyUpstreamError maps a failed upstream request to the status sent to
+// the client and a machine-readable error code
+func classifyUpstreamError(err error) (int, string) {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var certErr *tls.CertificateVerificationError
+	var alertErr tls.AlertError
+	var recordErr tls.RecordHeaderError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+
+	switch {
+	case errors.As(err, &dnsErr):
+		if dnsErr.IsTimeout {
+			return http.StatusGatewayTimeout, "dns_timeout"
+		}
+		return http.StatusBadGateway, "dns_failure"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout, "timeout"
+	case errors.As(err, &certErr), errors.As(err, &alertErr), errors.As(err, &recordErr),
+		errors.As(err, &authorityErr), errors.As(err, &hostnameErr), errors.As(err, &invalidErr),
+		strings.Contains(err.Error(), "tls: "):
+		return http.StatusBadGateway, "tls_failure"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return http.StatusBadGateway, "connection_refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return http.StatusBadGateway, "connection_reset"
+	case errors.Is(err, errRedirectNotAllowed):
+		return http.StatusForbidden, "redirect_not_allowed"
+	}
+	return http.StatusBadGateway, "upstream_error"
+}
+
+// sendUpstreamStatus answers with the JSON error model for an upstream
+// error status. Client errors such as 403 and 404 keep their status; server
+// errors become 502.
+func sendUpstreamStatus(w http.ResponseWriter, resp *http.Response) {
+	status := resp.StatusCode
+	if status >= 500 {
+		status = http.StatusBadGateway
+	}
+	for _, name := range []string{"Retry-After", "Content-Range"} {
+		if v := resp.Header.Get(name); v != "" {
+			w.Header().Set(name, v)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":          fmt.Sprintf("Upstream returned %s", resp.Status),
+		"code":           "upstream_status",
+		"upstreamStatus": resp.StatusCode,
+	})
+}
@@ -0,0 +1,89 @@
+package hlsproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+// fetchOptions describes one upstream request made with fetch
+type fetchOptions struct {
+	method    string            // GET when empty
+	url       string            // the upstream URL
+	body      []byte            // request body, replayable on redirects and retries
+	headers   map[string]string // headers sent; empty values are left out
+	overrides map[string]string // the caller's own headers, kept across redirects in their exact casing
+	client    *http.Client      // sharedClient when nil
+	retry429  bool              // wait out 429s up to RATE_LIMIT_MAX_WAIT before answering
+}
+
+// webhookTimeout bounds one call of a refresh webhook
+const webhookTimeout = 10 * time.Second
+
+// webhookCallKey marks the context of the proxy's own webhook calls
+type webhookCallKey struct{}
+
+// webhookContext returns ctx for a webhook call, limited to webhookTimeout.
+// The calls go through the shared client like any upstream request, but
+// the session refresh and credential layers leave them alone, since those
+// call the webhooks themselves.
+func webhookContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithValue(ctx, webhookCallKey{}, true), webhookTimeout)
+}
+
+// isWebhookCall reports whether req is one of the proxy's webhook calls
+func isWebhookCall(req *http.Request) bool {
+	return req.Context().Value(webhookCallKey{}) != nil
+}
+
+// fetchClientKey is the context key of the client a fetch went through
+type fetchClientKey struct{}
+
+// fetchClient returns the client the request of resp went through
+func fetchClient(resp *http.Response) *http.Client {
+	if client, ok := resp.Request.Context().Value(fetchClientKey{}).(*http.Client); ok {
+		return client
+	}
+	return sharedClient
+}
+
+// fetch sends an upstream request bound to ctx, so it stops once the client
+// that asked for it goes away. Every client shares the transport that adds
+// credentials and applies limits, timeouts, retries and per-try metrics.
+func fetch(ctx context.Context, opts fetchOptions) (*http.Response, error) {
+	method := opts.method
+	if method == "" {
+		method = http.MethodGet
+	}
+	var body io.Reader
+	if opts.body != nil {
+		body = bytes.NewReader(opts.body)
+	}
+	client := opts.client
+	if client == nil {
+		client = sharedClient
+	}
+	// Follow-up requests for the response, such as resumed transfers, use the same client
+	ctx = context.WithValue(ctx, fetchClientKey{}, client)
+	req, err := http.NewRequestWithContext(ctx, method, opts.url, body)
+	if err != nil {
+		return nil, err
+	}
+	if opts.overrides != nil {
+		req = withHeaderOverrides(req, opts.overrides)
+	}
+	for k, v := range opts.headers {
+		if v != "" {
+			req.Header.Set(k, v)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err == nil && opts.retry429 && resp.StatusCode == http.StatusTooManyRequests && rateLimitMaxWait > 0 {
+		// Players give up on 429s; wait out short rate limits here instead
+		resp, err = retryRateLimited(client, req, resp)
+	}
+	return resp, err
+}
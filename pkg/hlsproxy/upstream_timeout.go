@@ -0,0 +1,87 @@
+package hlsproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// upstreamFirstByteTimeout bounds the wait for upstream response
+	// headers, per attempt, unless a domain policy sets its own timeout
+	upstreamFirstByteTimeout time.Duration
+	// upstreamIdleTimeout bounds the wait for the next upstream body bytes,
+	// so a stalled origin is dropped while a slow but steady one can stream
+	// for as long as it takes
+	upstreamIdleTimeout time.Duration
+	// serverWriteTimeout is WRITE_TIMEOUT, extended while a body streams
+	serverWriteTimeout time.Duration
+)
+
+// upstreamTimeoutError is returned when upstream sent nothing for too long;
+// it is a timeout, so clients get a 504
+type upstreamTimeoutError struct {
+	msg string
+}
+
+func (e *upstreamTimeoutError) Error() string   { return e.msg }
+func (e *upstreamTimeoutError) Timeout() bool   { return true }
+func (e *upstreamTimeoutError) Temporary() bool { return true }
+
+// idleTimeoutBody cancels an upstream response once a read waited longer
+// than timeout for data. Time spent between reads, e.g. while a slow client
+// drains what was read, doesn't count.
+type idleTimeoutBody struct {
+	io.ReadCloser
+	host    string
+	timeout time.Duration
+	timer   *time.Timer
+	expired atomic.Bool
+	cancel  context.CancelFunc
+}
+
+func newIdleTimeoutBody(body io.ReadCloser, host string, timeout time.Duration, cancel context.CancelFunc) *idleTimeoutBody {
+	b := &idleTimeoutBody{ReadCloser: body, host: host, timeout: timeout, cancel: cancel}
+	b.timer = time.AfterFunc(timeout, func() {
+		b.expired.Store(true)
+		cancel()
+	})
+	b.timer.Stop()
+	return b
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	if b.expired.Load() {
+		return 0, b.timeoutError()
+	}
+	b.timer.Reset(b.timeout)
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Stop()
+	if err != nil && err != io.EOF && b.expired.Load() {
+		return n, b.timeoutError()
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) timeoutError() error {
+	return &upstreamTimeoutError{msg: fmt.Sprintf("%s: no data for %s", b.host, b.timeout)}
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// extendWriteDeadline pushes the client write deadline WRITE_TIMEOUT past
+// now, so a long segment that keeps streaming isn't cut off by the server's
+// total response timeout; a stalled client still is
+func extendWriteDeadline(w http.ResponseWriter) {
+	if serverWriteTimeout > 0 {
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(serverWriteTimeout))
+	}
+}
@@ -0,0 +1,263 @@
+package hlsproxy
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// usageFlushInterval is how often aggregated counters are written to SQLite
+const usageFlushInterval = 10 * time.Second
+
+// usageKey identifies one row of the usage table
+type usageKey struct {
+	day    string // YYYY-MM-DD, UTC
+	apiKey string
+	domain string
+}
+
+// usageCounts are the counters aggregated for one usageKey
+type usageCounts struct {
+	requests int64
+	bytes    int64 // sent to clients
+	aborted  int64 // requests the client abandoned before the end
+}
+
+// usageStore aggregates per-day, per-API-key, per-domain traffic in memory
+// and periodically adds it to a SQLite database
+type usageStore struct {
+	db *sql.DB
+
+	mu      sync.Mutex
+	pending map[usageKey]*usageCounts
+}
+
+var usage *usageStore
+
+// openUsageStore opens or creates the SQLite usage database at path
+func openUsageStore(path string) (*usageStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer; one connection avoids "database is locked"
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS usage (
+		day      TEXT    NOT NULL,
+		api_key  TEXT    NOT NULL,
+		domain   TEXT    NOT NULL,
+		requests INTEGER NOT NULL DEFAULT 0,
+		bytes    INTEGER NOT NULL DEFAULT 0,
+		aborted  INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (day, api_key, domain)
+	)`)
+	if err == nil {
+		// Databases created before aborted transfers were counted
+		if _, probe := db.Exec(`SELECT aborted FROM usage LIMIT 0`); probe != nil {
+			_, err = db.Exec(`ALTER TABLE usage ADD COLUMN aborted INTEGER NOT NULL DEFAULT 0`)
+		}
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &usageStore{db: db, pending: make(map[usageKey]*usageCounts)}
+	go func() {
+		for range time.Tick(usageFlushInterval) {
+			if err := s.flush(); err != nil {
+				log.Printf("Failed to write usage: %v", err)
+			}
+		}
+	}()
+	return s, nil
+}
+
+// record counts one request, the bytes the client received for it and
+// whether it was aborted
+func (s *usageStore) record(apiKey, domain string, bytes int64, aborted bool) {
+	key := usageKey{day: time.Now().UTC().Format("2006-01-02"), apiKey: apiKey, domain: domain}
+	s.mu.Lock()
+	c, ok := s.pending[key]
+	if !ok {
+		c = &usageCounts{}
+		s.pending[key] = c
+	}
+	c.requests++
+	c.bytes += bytes
+	if aborted {
+		c.aborted++
+	}
+	s.mu.Unlock()
+}
+
+// flush adds the pending counters to the database
+func (s *usageStore) flush() error {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = make(map[usageKey]*usageCounts)
+	s.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	err := s.write(pending)
+	if err != nil {
+		// Keep the counters for the next attempt
+		s.mu.Lock()
+		for key, c := range pending {
+			if cur, ok := s.pending[key]; ok {
+				cur.requests += c.requests
+				cur.bytes += c.bytes
+				cur.aborted += c.aborted
+			} else {
+				s.pending[key] = c
+			}
+		}
+		s.mu.Unlock()
+	}
+	return err
+}
+
+func (s *usageStore) write(pending map[usageKey]*usageCounts) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for key, c := range pending {
+		_, err := tx.Exec(`INSERT INTO usage (day, api_key, domain, requests, bytes, aborted) VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (day, api_key, domain) DO UPDATE SET
+				requests = requests + excluded.requests,
+				bytes = bytes + excluded.bytes,
+				aborted = aborted + excluded.aborted`,
+			key.day, key.apiKey, key.domain, c.requests, c.bytes, c.aborted)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// usageRow is one aggregated row returned by /usage
+type usageRow struct {
+	Day      string `json:"day"`
+	APIKey   string `json:"apiKey"`
+	Domain   string `json:"domain"`
+	Requests int64  `json:"requests"`
+	Bytes    int64  `json:"bytes"`
+	Aborted  int64  `json:"aborted"`
+}
+
+// query returns the rows matching the optional filters, newest day first
+func (s *usageStore) query(from, to, apiKey, domain string) ([]usageRow, error) {
+	if err := s.flush(); err != nil {
+		return nil, err
+	}
+
+	where := []string{"1 = 1"}
+	var args []interface{}
+	for _, f := range []struct{ clause, value string }{
+		{"day >= ?", from},
+		{"day <= ?", to},
+		{"api_key = ?", apiKey},
+		{"domain = ?", domain},
+	} {
+		if f.value != "" {
+			where = append(where, f.clause)
+			args = append(args, f.value)
+		}
+	}
+
+	rows, err := s.db.Query(`SELECT day, api_key, domain, requests, bytes, aborted FROM usage
+		WHERE `+strings.Join(where, " AND ")+`
+		ORDER BY day DESC, bytes DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []usageRow{}
+	for rows.Next() {
+		var row usageRow
+		if err := rows.Scan(&row.Day, &row.APIKey, &row.Domain, &row.Requests, &row.Bytes, &row.Aborted); err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// requestAPIKey identifies who a request is billed to, from the X-API-Key
+// header or the api_key query param
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if key := r.URL.Query().Get("api_key"); key != "" {
+		return key
+	}
+	return "anonymous"
+}
+
+// usageDomain returns the upstream domain a proxy request targets, or ""
+// for requests that aren't proxied traffic
+func usageDomain(r *http.Request) string {
+	switch r.URL.Path {
+	case "/", "/shorten", "/usage", "/metrics", "/debug/fetch":
+		return ""
+	}
+	if target := r.URL.Query().Get("url"); target != "" {
+		if u, err := url.Parse(target); err == nil {
+			return strings.ToLower(u.Hostname())
+		}
+		return ""
+	}
+	// Path-style proxy URLs start with the upstream domain
+	first, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if strings.Contains(first, ".") {
+		return strings.ToLower(first)
+	}
+	return ""
+}
+
+// usageHandler reports recorded usage, filtered by the optional from, to
+// (YYYY-MM-DD), api_key and domain params
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	if usage == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Usage accounting is disabled; set USAGE_DB"})
+		return
+	}
+
+	q := r.URL.Query()
+	rows, err := usage.query(q.Get("from"), q.Get("to"), q.Get("api_key"), q.Get("domain"))
+	if err != nil {
+		sendError(w, "Failed to read usage", err.Error())
+		return
+	}
+
+	var totalRequests, totalBytes, totalAborted int64
+	for _, row := range rows {
+		totalRequests += row.Requests
+		totalBytes += row.Bytes
+		totalAborted += row.Aborted
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"usage":         rows,
+		"totalRequests": totalRequests,
+		"totalBytes":    totalBytes,
+		"totalAborted":  totalAborted,
+	})
+}
@@ -0,0 +1,264 @@
+package hlsproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// validateConcurrency bounds the upstream requests one /validate runs at once
+const validateConcurrency = 8
+
+// validateSegment is the result of checking one segment
+type validateSegment struct {
+	URL      string `json:"url"`
+	Playlist string `json:"playlist"`
+	Status   int    `json:"status,omitempty"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+}
+
+// validatePlaylist is the result of checking one variant or rendition
+type validatePlaylist struct {
+	URL        string            `json:"url"`
+	Kind       string            `json:"kind"` // variant, audio, subtitles or media
+	Bandwidth  int               `json:"bandwidth,omitempty"`
+	Resolution string            `json:"resolution,omitempty"`
+	Reachable  bool              `json:"reachable"`
+	Error      string            `json:"error,omitempty"`
+	Live       bool              `json:"live"`
+	Segments   int               `json:"segments"`
+	Checked    []validateSegment `json:"checked,omitempty"`
+}
+
+// validateReport is the JSON document returned by /validate. RequiredHeaders
+// lists the given headers the origin refuses the playlist without.
+type validateReport struct {
+	URL               string             `json:"url"`
+	Type              string             `json:"type,omitempty"` // master or media
+	Healthy           bool               `json:"healthy"`
+	Error             string             `json:"error,omitempty"`
+	Deep              bool               `json:"deep"`
+	Playlists         []validatePlaylist `json:"playlists,omitempty"`
+	ReachableVariants int                `json:"reachableVariants"`
+	TotalVariants     int                `json:"totalVariants"`
+	BrokenSegments    []validateSegment  `json:"brokenSegments,omitempty"`
+	RequiredHeaders   []string           `json:"requiredHeaders,omitempty"`
+}
+
+// validator runs the checks of one /validate request
+type validator struct {
+	ctx     context.Context
+	r       *http.Request
+	headers map[string]string // the caller's headers for the playlist URL
+	slots   chan struct{}
+}
+
+// headersFor returns the headers sent to targetURL
+func (v *validator) headersFor(targetURL string) map[string]string {
+	return requestHeadersFor(v.r, targetURL, v.headers)
+}
+
+// fetchPlaylist fetches a playlist's text, failing on non-200 answers
+func (v *validator) fetchPlaylist(playlistURL string, headers map[string]string) (string, error) {
+	v.slots <- struct{}{}
+	defer func() { <-v.slots }()
+	resp, err := fetch(v.ctx, fetchOptions{url: playlistURL, headers: headers})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("upstream returned %d for %s", resp.StatusCode, playlistURL)
+	}
+	prepareUpstreamBody(resp)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if !strings.Contains(string(body), "#EXTM3U") {
+		return "", fmt.Errorf("%s is not an M3U8 playlist", playlistURL)
+	}
+	return string(body), nil
+}
+
+// checkSegment asks for a segment without downloading it: a HEAD, or the
+// first byte of its range when the origin doesn't answer HEADs
+func (v *validator) checkSegment(segment mediaSegment, playlistURL string) validateSegment {
+	v.slots <- struct{}{}
+	defer func() { <-v.slots }()
+	result := validateSegment{URL: segment.uri, Playlist: playlistURL}
+	headers := v.headersFor(segment.uri)
+
+	if segment.rangeLength == 0 {
+		resp, err := fetch(v.ctx, fetchOptions{method: http.MethodHead, url: segment.uri, headers: headers})
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 400 {
+				result.Status, result.OK = resp.StatusCode, true
+				return result
+			}
+		}
+	}
+
+	ranged := mergeHeaders(make(map[string]string), headers)
+	ranged["Range"] = byteRangeHeader(segment.rangeStart, 1)
+	resp, err := fetch(v.ctx, fetchOptions{url: segment.uri, headers: ranged})
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	resp.Body.Close()
+	result.Status = resp.StatusCode
+	result.OK = resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent
+	if !result.OK {
+		result.Error = fmt.Sprintf("upstream returned %d", resp.StatusCode)
+	}
+	return result
+}
+
+// checkPlaylist fetches a media playlist and, when deep, checks its first
+// and last segments
+func (v *validator) checkPlaylist(p *validatePlaylist, content string, deep bool) {
+	if content == "" {
+		var err error
+		if content, err = v.fetchPlaylist(p.URL, v.headersFor(p.URL)); err != nil {
+			p.Error = err.Error()
+			return
+		}
+	}
+	p.Reachable = true
+	playlist := parseMediaPlaylist(content, p.URL)
+	p.Live = !playlist.endList && playlist.playlistType != "VOD"
+	p.Segments = len(playlist.segments)
+	if !deep || len(playlist.segments) == 0 {
+		return
+	}
+
+	checks := []mediaSegment{playlist.segments[0]}
+	if len(playlist.segments) > 1 {
+		checks = append(checks, playlist.segments[len(playlist.segments)-1])
+	}
+	p.Checked = make([]validateSegment, len(checks))
+	var wg sync.WaitGroup
+	for i, segment := range checks {
+		wg.Add(1)
+		go func(i int, segment mediaSegment) {
+			defer wg.Done()
+			p.Checked[i] = v.checkSegment(segment, p.URL)
+		}(i, segment)
+	}
+	wg.Wait()
+}
+
+// requiredHeaders returns the names of the given headers the origin refuses
+// the playlist without, or none when it serves it with only the defaults
+func (v *validator) requiredHeaders(playlistURL string) []string {
+	if len(v.headers) == 0 {
+		return nil
+	}
+	if _, err := v.fetchPlaylist(playlistURL, requestHeadersFor(v.r, playlistURL, nil)); err == nil {
+		return nil
+	}
+	var names []string
+	for name := range v.headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validateHandler checks that a playlist and every variant and rendition it
+// lists can be fetched, and with deep=1 that their first and last segments
+// answer too, so link checkers can prune dead streams. The checks run
+// concurrently; the report is returned with 200 whether or not the stream
+// is healthy.
+// URL format: /validate?url={m3u8_url}&headers={optional_headers}&deep={optional_1}
+func validateHandler(w http.ResponseWriter, r *http.Request) {
+	targetURL, parsedHeaders, err := validateRequest(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	v := &validator{ctx: r.Context(), r: r, headers: parsedHeaders, slots: make(chan struct{}, validateConcurrency)}
+	report := validateReport{URL: targetURL, Deep: r.URL.Query().Get("deep") == "1"}
+	content, err := v.fetchPlaylist(targetURL, v.headersFor(targetURL))
+	if err != nil {
+		report.Error = err.Error()
+		sendValidateReport(w, report)
+		return
+	}
+
+	var requiredHeaders []string
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		requiredHeaders = v.requiredHeaders(targetURL)
+	}()
+
+	master := parseMasterPlaylist(content, targetURL)
+	if len(master.variants) == 0 {
+		report.Type = "media"
+		report.Playlists = []validatePlaylist{{URL: targetURL, Kind: "media"}}
+		v.checkPlaylist(&report.Playlists[0], content, report.Deep)
+	} else {
+		report.Type = "master"
+		for _, variant := range master.variants {
+			bandwidth, _ := strconv.Atoi(variant.attrs["BANDWIDTH"])
+			report.Playlists = append(report.Playlists, validatePlaylist{
+				URL: variant.uri, Kind: "variant", Bandwidth: bandwidth, Resolution: variant.attrs["RESOLUTION"],
+			})
+		}
+		for _, m := range master.renditions {
+			if kind := strings.ToLower(m.attrs["TYPE"]); m.uri != "" && (kind == "audio" || kind == "subtitles") {
+				report.Playlists = append(report.Playlists, validatePlaylist{URL: m.uri, Kind: kind})
+			}
+		}
+		for i := range report.Playlists {
+			wg.Add(1)
+			go func(p *validatePlaylist) {
+				defer wg.Done()
+				v.checkPlaylist(p, "", report.Deep)
+			}(&report.Playlists[i])
+		}
+	}
+	wg.Wait()
+	report.RequiredHeaders = requiredHeaders
+
+	report.Healthy = true
+	for _, p := range report.Playlists {
+		if p.Kind == "variant" || p.Kind == "media" {
+			report.TotalVariants++
+			if p.Reachable {
+				report.ReachableVariants++
+			}
+		}
+		if !p.Reachable {
+			report.Healthy = false
+		}
+		for _, segment := range p.Checked {
+			if !segment.OK {
+				report.BrokenSegments = append(report.BrokenSegments, segment)
+				report.Healthy = false
+			}
+		}
+	}
+	sendValidateReport(w, report)
+}
+
+func sendValidateReport(w http.ResponseWriter, report validateReport) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(report)
+}
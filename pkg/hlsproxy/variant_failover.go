@@ -0,0 +1,171 @@
+package hlsproxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// variantSessionTTL is how long playlist and segment observations are kept
+const variantSessionTTL = 5 * time.Minute
+
+// segmentRef locates a segment inside a live media playlist
+type segmentRef struct {
+	playlist string
+	sequence int64
+	seen     time.Time
+}
+
+// variantSession is the variants of one master playlist and when the master
+// or any of them was last fetched or used for a retry
+type variantSession struct {
+	variants []string
+	used     time.Time
+}
+
+// variantTracker remembers which variants belong to the same master playlist
+// and where each live segment sits, so a 404 on one variant can be retried
+// against the same media sequence number of a sibling variant
+type variantTracker struct {
+	mu        sync.Mutex
+	siblings  map[string]*variantSession // variant URL -> the session of its master
+	segments  map[string]segmentRef
+	lastPrune time.Time
+}
+
+var variants = &variantTracker{
+	siblings: make(map[string]*variantSession),
+	segments: make(map[string]segmentRef),
+}
+
+// record inspects a fetched playlist and updates the tracked sessions
+func (t *variantTracker) record(m3u8Content, playlistURL string) {
+	now := time.Now()
+	if list := masterVariants(m3u8Content, playlistURL); len(list) > 1 {
+		session := &variantSession{variants: list, used: now}
+		t.mu.Lock()
+		for _, v := range list {
+			t.siblings[v] = session
+		}
+		t.prune(now)
+		t.mu.Unlock()
+		return
+	}
+
+	playlist := parseMediaPlaylist(m3u8Content, playlistURL)
+	if playlist.endList {
+		// VOD playlists don't suffer from live edge glitches
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	session, ok := t.siblings[playlistURL]
+	if !ok {
+		return
+	}
+	session.used = now
+	for i, segment := range playlist.segments {
+		t.segments[segmentKey(segment.uri, segment.rangeStart, segment.rangeLength)] = segmentRef{
+			playlist: playlistURL,
+			sequence: playlist.mediaSequence + int64(i),
+			seen:     now,
+		}
+	}
+	t.prune(now)
+}
+
+// prune drops the sessions whose master and variants all went unused for
+// variantSessionTTL, and the segments of stale playlists; callers must hold
+// t.mu
+func (t *variantTracker) prune(now time.Time) {
+	if now.Sub(t.lastPrune) < time.Minute {
+		return
+	}
+	t.lastPrune = now
+	for variant, session := range t.siblings {
+		if now.Sub(session.used) > variantSessionTTL {
+			delete(t.siblings, variant)
+		}
+	}
+	for segment, ref := range t.segments {
+		if _, ok := t.siblings[ref.playlist]; !ok || now.Sub(ref.seen) > variantSessionTTL {
+			delete(t.segments, segment)
+		}
+	}
+}
+
+// lookup returns the segment's position and the other variants to try
+func (t *variantTracker) lookup(key string) (segmentRef, []string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ref, ok := t.segments[key]
+	if !ok {
+		return segmentRef{}, nil, false
+	}
+	session, ok := t.siblings[ref.playlist]
+	if !ok {
+		return segmentRef{}, nil, false
+	}
+	session.used = time.Now()
+	var others []string
+	for _, v := range session.variants {
+		if v != ref.playlist {
+			others = append(others, v)
+		}
+	}
+	return ref, others, len(others) > 0
+}
+
+// retry fetches the equivalent segment from a sibling variant. It returns
+// nil when the segment is not tracked or no sibling has it.
+func (t *variantTracker) retry(ctx context.Context, segmentURL string, requestHeaders map[string]string) *http.Response {
+	ref, others, ok := t.lookup(requestSegmentKey(segmentURL, requestHeaders["Range"]))
+	if !ok {
+		return nil
+	}
+
+	for _, variant := range others {
+		resp, err := fetchWithHeaders(ctx, variant, requestHeaders)
+		if err != nil {
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			continue
+		}
+
+		playlist := parseMediaPlaylist(string(body), variant)
+		index := ref.sequence - playlist.mediaSequence
+		if index < 0 || index >= int64(len(playlist.segments)) {
+			continue
+		}
+
+		// The sibling's segment has its own sub-range, if any
+		alternate := playlist.segments[index]
+		headers := make(map[string]string, len(requestHeaders))
+		for k, v := range requestHeaders {
+			if k != "Range" {
+				headers[k] = v
+			}
+		}
+		if alternate.rangeLength > 0 {
+			headers["Range"] = byteRangeHeader(alternate.rangeStart, alternate.rangeLength)
+		}
+		resp, err = fetchWithHeaders(ctx, alternate.uri, headers)
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent && alternate.rangeLength > 0 {
+			log.Printf("Segment 404 on %s, served sequence %d from sibling variant %s", segmentURL, ref.sequence, variant)
+			return resp
+		}
+		resp.Body.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package hlsproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// injectedVariant is an extra #EXT-X-STREAM-INF entry added to masters,
+// such as a low-bitrate mirror or an audio-only rendition
+type injectedVariant struct {
+	URI        string `yaml:"uri" json:"uri"`
+	Bandwidth  int    `yaml:"bandwidth" json:"bandwidth"`
+	Resolution string `yaml:"resolution,omitempty" json:"resolution,omitempty"`
+	Codecs     string `yaml:"codecs,omitempty" json:"codecs,omitempty"`
+}
+
+// injectedVariants maps hostname patterns (* wildcards) of master playlist
+// URLs to the variants added to them
+var injectedVariants map[string][]injectedVariant
+
+// validateInjectedVariants rejects variants without a URI or bandwidth
+func validateInjectedVariants(variants []injectedVariant) error {
+	for _, v := range variants {
+		if v.URI == "" || v.Bandwidth <= 0 {
+			return fmt.Errorf("injected variant %q needs a uri and a positive bandwidth", v.URI)
+		}
+	}
+	return nil
+}
+
+// injectParam parses the inject param, a JSON list of variants
+func injectParam(r *http.Request) ([]injectedVariant, error) {
+	raw := r.URL.Query().Get("inject")
+	if raw == "" {
+		return nil, nil
+	}
+	var variants []injectedVariant
+	if err := json.Unmarshal([]byte(raw), &variants); err != nil {
+		return nil, fmt.Errorf(`inject must be a JSON list of {"uri": ..., "bandwidth": ...} variants`)
+	}
+	return variants, validateInjectedVariants(variants)
+}
+
+// streamInf formats the variant's #EXT-X-STREAM-INF tag
+func (v injectedVariant) streamInf() string {
+	attrs := []string{fmt.Sprintf("BANDWIDTH=%d", v.Bandwidth)}
+	if v.Resolution != "" {
+		attrs = append(attrs, "RESOLUTION="+v.Resolution)
+	}
+	if v.Codecs != "" {
+		attrs = append(attrs, `CODECS="`+v.Codecs+`"`)
+	}
+	return "#EXT-X-STREAM-INF:" + strings.Join(attrs, ",")
+}
+
+// injectVariants appends the configured and requested variants to a master
+// playlist before it is rewritten, so they go through the proxy like the
+// origin's own. Variants the master already lists are skipped.
+func injectVariants(body []byte, ctx TransformContext) ([]byte, error) {
+	content := string(body)
+	if !strings.Contains(content, "#EXT-X-STREAM-INF") {
+		return body, nil
+	}
+	var variants []injectedVariant
+	if u, err := url.Parse(ctx.URL); err == nil && len(injectedVariants) > 0 {
+		variants = append(variants, matchHostPattern(injectedVariants, u.Hostname())...)
+	}
+	requested, err := injectParam(ctx.Request)
+	if err != nil {
+		return nil, err
+	}
+	variants = append(variants, requested...)
+	if len(variants) == 0 {
+		return body, nil
+	}
+
+	listed := make(map[string]bool)
+	for _, line := range strings.Split(normalizeLineEndings(content), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			listed[resolveURL(line, ctx.URL)] = true
+		}
+	}
+	content = strings.TrimRight(content, "\r\n")
+	for _, v := range variants {
+		resolved := resolveURL(v.URI, ctx.URL)
+		if listed[resolved] {
+			continue
+		}
+		listed[resolved] = true
+		content += "\n" + v.streamInf() + "\n" + resolved
+	}
+	return []byte(content + "\n"), nil
+}
+
+// Injection runs as a playlist transformer, after ?repair=1
+func init() {
+	RegisterTransformer(playlistContentType, injectVariants)
+}
@@ -0,0 +1,65 @@
+package hlsproxy
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// limitResolution drops the variants of a master playlist taller than the
+// playback token's max_resolution, keeping the smallest when every one is.
+// Only masters are filtered; a variant playlist doesn't say its resolution.
+func limitResolution(body []byte, ctx TransformContext) ([]byte, error) {
+	claims, _ := ctx.Request.Context().Value(playbackClaimsKey{}).(*playbackClaims)
+	if claims == nil || claims.MaxResolution <= 0 || !strings.Contains(string(body), "#EXT-X-STREAM-INF") {
+		return body, nil
+	}
+
+	lines := strings.Split(normalizeLineEndings(string(body)), "\n")
+	type variant struct{ tag, uri, height int }
+	var variants []variant
+	for i := 0; i < len(lines); i++ {
+		if !strings.HasPrefix(strings.TrimSpace(lines[i]), "#EXT-X-STREAM-INF:") {
+			continue
+		}
+		v := variant{tag: i, uri: -1}
+		_, attrList, _ := strings.Cut(lines[i], ":")
+		if _, height, ok := strings.Cut(parseAttributeList(attrList)["RESOLUTION"], "x"); ok {
+			v.height, _ = strconv.Atoi(height)
+		}
+		for j := i + 1; j < len(lines); j++ {
+			if line := strings.TrimSpace(lines[j]); line != "" && !strings.HasPrefix(line, "#") {
+				v.uri = j
+				break
+			}
+		}
+		variants = append(variants, v)
+	}
+
+	drop := make(map[int]bool)
+	dropped := 0
+	for _, v := range variants {
+		if v.height > claims.MaxResolution {
+			drop[v.tag], drop[v.uri] = true, true
+			dropped++
+		}
+	}
+	if dropped == len(variants) {
+		sort.Slice(variants, func(i, j int) bool { return variants[i].height < variants[j].height })
+		delete(drop, variants[0].tag)
+		delete(drop, variants[0].uri)
+	}
+	kept := lines[:0]
+	for i, line := range lines {
+		if !drop[i] {
+			kept = append(kept, line)
+		}
+	}
+	return []byte(strings.Join(kept, "\n")), nil
+}
+
+// The resolution limit runs after the other playlist transformers, so it
+// also applies to injected variants
+func init() {
+	RegisterTransformer(playlistContentType, limitResolution)
+}
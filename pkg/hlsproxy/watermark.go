@@ -0,0 +1,193 @@
+package hlsproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// watermarkSecret keys playlist watermarks; empty disables them
+var watermarkSecret string
+
+// watermarks maps watermark codes back to the API key or user they were
+// made for; set up in main from the config
+var watermarks Store = newMemoryStore()
+
+// recordedWatermarks are the codes already written to watermarks
+var recordedWatermarks sync.Map
+
+// watermarkTags are the tags whose attributes are reordered
+var watermarkTags = map[string]bool{
+	"EXT-X-STREAM-INF": true, "EXT-X-I-FRAME-STREAM-INF": true, "EXT-X-MEDIA": true,
+	"EXT-X-KEY": true, "EXT-X-MAP": true, "EXT-X-SESSION-KEY": true,
+}
+
+// watermarkCode returns the code identifying id in watermarks: a keyed
+// hash, so playlists don't expose the id itself
+func watermarkCode(id string) string {
+	mac := hmac.New(sha256.New, []byte(watermarkSecret))
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// watermarkID returns who a playlist is proxied for: the api_key param,
+// or the sub claim of the playback token
+func watermarkID(r *http.Request) string {
+	if apiKey := r.URL.Query().Get("api_key"); apiKey != "" {
+		return "api_key:" + apiKey
+	}
+	if claims, _ := r.Context().Value(playbackClaimsKey{}).(*playbackClaims); claims != nil && claims.Subject != "" {
+		return "sub:" + claims.Subject
+	}
+	return ""
+}
+
+// splitAttributes splits an attribute list into its NAME=value entries,
+// keeping quoted values with commas whole
+func splitAttributes(list string) []string {
+	var attrs []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(list); i++ {
+		switch list[i] {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				attrs = append(attrs, list[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(attrs, list[start:])
+}
+
+// watermarkOrder orders the attributes of a tag for code: sorted by name,
+// then shuffled by a generator seeded from the code and tag, so the order
+// is the same for every playlist made for one code
+func watermarkOrder(code, tag string, attrs []string) []string {
+	ordered := append([]string(nil), attrs...)
+	sort.Slice(ordered, func(i, j int) bool {
+		a, _, _ := strings.Cut(ordered[i], "=")
+		b, _, _ := strings.Cut(ordered[j], "=")
+		return a < b
+	})
+	mac := hmac.New(sha256.New, []byte(watermarkSecret))
+	mac.Write([]byte(code + "\x00" + tag))
+	seed := mac.Sum(nil)
+	rng := rand.New(rand.NewPCG(binary.BigEndian.Uint64(seed[:8]), binary.BigEndian.Uint64(seed[8:16])))
+	rng.Shuffle(len(ordered), func(i, j int) { ordered[i], ordered[j] = ordered[j], ordered[i] })
+	return ordered
+}
+
+// watermarkPlaylist adds a "# wm:{code}" comment after #EXTM3U and puts the
+// attributes of the watermarkTags in the code's order, which players don't
+// care about but survives the comment being stripped from a leaked copy
+func watermarkPlaylist(body []byte, ctx TransformContext) ([]byte, error) {
+	if watermarkSecret == "" {
+		return body, nil
+	}
+	id := watermarkID(ctx.Request)
+	if id == "" {
+		return body, nil
+	}
+	code := watermarkCode(id)
+	if _, recorded := recordedWatermarks.Load(code); !recorded {
+		if err := watermarks.Set(code, []byte(id), 0); err != nil {
+			return nil, err
+		}
+		recordedWatermarks.Store(code, true)
+	}
+
+	lines := strings.Split(normalizeLineEndings(string(body)), "\n")
+	out := make([]string, 0, len(lines)+1)
+	for i, line := range lines {
+		if tag := playlistTagName(line); watermarkTags[tag] {
+			if _, list, ok := strings.Cut(strings.TrimSpace(line), ":"); ok && list != "" {
+				line = "#" + tag + ":" + strings.Join(watermarkOrder(code, tag, splitAttributes(list)), ",")
+			}
+		}
+		out = append(out, line)
+		if i == 0 && strings.HasPrefix(line, "#EXTM3U") {
+			out = append(out, "# wm:"+code)
+		}
+	}
+	return []byte(strings.Join(out, "\n")), nil
+}
+
+// watermarkMatches reports whether every reorderable tag of a playlist with
+// more than one attribute is in the order of code, and there is at least one
+func watermarkMatches(content, code string) bool {
+	checked := 0
+	for _, line := range strings.Split(normalizeLineEndings(content), "\n") {
+		tag := playlistTagName(line)
+		if !watermarkTags[tag] {
+			continue
+		}
+		_, list, _ := strings.Cut(strings.TrimSpace(line), ":")
+		attrs := splitAttributes(list)
+		if len(attrs) < 2 {
+			continue
+		}
+		if strings.Join(watermarkOrder(code, tag, attrs), ",") != list {
+			return false
+		}
+		checked++
+	}
+	return checked > 0
+}
+
+// Watermarks run after the other playlist transformers, on the final tags
+func init() {
+	RegisterTransformer(playlistContentType, watermarkPlaylist)
+}
+
+// adminWatermarkHandler traces a leaked playlist, POSTed as the body, to
+// the API key or user it was proxied for: by its wm comment, or when that
+// was stripped, by checking its attribute order against the ids in ?ids=
+func adminWatermarkHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if watermarkSecret == "" {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Watermarking is disabled; set WATERMARK_SECRET"})
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sendError(w, "Failed to read playlist", err.Error())
+		return
+	}
+	content := string(body)
+
+	for _, line := range strings.Split(normalizeLineEndings(content), "\n") {
+		code, ok := strings.CutPrefix(strings.TrimSpace(line), "# wm:")
+		if !ok {
+			continue
+		}
+		id, found, err := watermarks.Get(code)
+		if err != nil {
+			sendError(w, "Failed to look up watermark", err.Error())
+			return
+		}
+		if found {
+			json.NewEncoder(w).Encode(map[string]string{"id": string(id), "code": code, "via": "comment"})
+			return
+		}
+	}
+	for _, id := range splitList(r.URL.Query().Get("ids")) {
+		if code := watermarkCode(id); watermarkMatches(content, code) {
+			json.NewEncoder(w).Encode(map[string]string{"id": id, "code": code, "via": "attributes"})
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(map[string]string{"error": "No known watermark found; pass suspected ids as ?ids=api_key:...,sub:..."})
+}